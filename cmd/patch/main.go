@@ -18,13 +18,13 @@ import (
 
 var SYSTEM_LIST = []string{"db", "redis", "api"}
 
-func loadApi(ctx context.Context, prefix string, mainConfig *util.Config, dbConnection system.UserTable) (*api.Server, error) {
+func loadApi(ctx context.Context, prefix string, mainConfig *util.Config, dbConnection system.UserTable, patchStore system.PatchTable, trafficStore system.TrafficTable, compareStore system.CompareTable, roleStore system.RoleTable, tokenStore system.TokenTable, twoFactorStore system.TwoFactorTable, authTokenStore system.AuthTokenTable) (*api.Server, error) {
 	logger, config, err := setup.PrepareSubsystemInit(prefix, "API", []string{"redis"}, mainConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	server, err := api.NewServer(ctx, logger, config, dbConnection)
+	server, err := api.NewServer(ctx, logger, config, dbConnection, patchStore, trafficStore, compareStore, roleStore, tokenStore, twoFactorStore, authTokenStore)
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +105,7 @@ func main() {
 	}
 
 	// Load API Server
-	server, err := loadApi(mainContext, prefix, mainConfig, database.GetUserDB())
+	server, err := loadApi(mainContext, prefix, mainConfig, database.GetUserDB(), database.GetPatchDB(), database.GetTrafficDB(), database.GetCompareDB(), database.GetRoleDB(), database.GetTokenDB(), database.GetTwoFactorDB(), database.GetAuthTokenDB())
 	if err != nil {
 		logger.Fatalln("error while loading api server: ", err)
 	}
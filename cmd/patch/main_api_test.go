@@ -32,7 +32,7 @@ func TestMain(m *testing.M) {
 	mainContext := context.TODO()
 	mainConfig := util.NewConfig(DEFAULT_CONFIG, nil)
 	gin.SetMode(gin.ReleaseMode)
-	server, err := loadApi(mainContext, PREFIX, mainConfig, system.NewUserIMDB())
+	server, err := loadApi(mainContext, PREFIX, mainConfig, system.NewUserIMDB(), system.NewPatchIMDB(), system.NewTrafficIMDB(), system.NewCompareIMDB(), system.NewRoleIMDB(), system.NewTokenIMDB(), system.NewTwoFactorIMDB(), system.NewAuthTokenIMDB())
 	if err != nil {
 		panic(err)
 	}
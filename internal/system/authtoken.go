@@ -0,0 +1,48 @@
+package system
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+const (
+	AUTH_TOKEN_VERIFY_EMAIL   = "verify_email"
+	AUTH_TOKEN_RESET_PASSWORD = "reset_password"
+	VERIFY_EMAIL_TTL          = 24 * time.Hour
+	RESET_PASSWORD_TTL        = time.Hour
+)
+
+// AuthToken is a single use token mailed to a user, only its hash is stored.
+// Verification tokens are bound to the address they were sent to
+type AuthToken struct {
+	Hash      string    `json:"hash"`
+	User      string    `json:"user"`
+	Purpose   string    `json:"purpose"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewAuthToken creates a token for the user expiring after ttl, the raw token is returned to be mailed
+func NewAuthToken(user string, email string, purpose string, ttl time.Duration) (*AuthToken, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now().UTC()
+	return &AuthToken{
+		Hash:      HashToken(raw),
+		User:      user,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}, raw, nil
+}
+
+// Expired reports if the token expired at now
+func (t *AuthToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,62 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchAuthToken = errors.New("invalid or expired token")
+)
+
+// AuthTokenTable keeps mailed tokens, a user has at most one token per purpose.
+// Saving a token replaces the previous one, consuming a token deletes it
+type AuthTokenTable interface {
+	SaveAuthToken(ctx context.Context, token *AuthToken) error
+	ConsumeAuthToken(ctx context.Context, purpose string, hash string) (*AuthToken, error)
+	DeleteAuthToken(ctx context.Context, user string, purpose string) error
+}
+
+type AuthTokenIMDB struct {
+	// AuthTokenTable
+	sync.Mutex
+	Tokens map[string]*AuthToken
+}
+
+func NewAuthTokenIMDB() *AuthTokenIMDB {
+	return &AuthTokenIMDB{
+		Tokens: make(map[string]*AuthToken),
+	}
+}
+
+func (a *AuthTokenIMDB) SaveAuthToken(ctx context.Context, token *AuthToken) error {
+	a.Lock()
+	defer a.Unlock()
+	stored := *token
+	a.Tokens[token.Purpose+":"+token.User] = &stored
+	return nil
+}
+
+func (a *AuthTokenIMDB) ConsumeAuthToken(ctx context.Context, purpose string, hash string) (*AuthToken, error) {
+	a.Lock()
+	defer a.Unlock()
+	for key, token := range a.Tokens {
+		if token.Purpose == purpose && token.Hash == hash {
+			delete(a.Tokens, key)
+			if token.Expired(time.Now()) {
+				return nil, ErrNoSuchAuthToken
+			}
+			return token, nil
+		}
+	}
+	return nil, ErrNoSuchAuthToken
+}
+
+func (a *AuthTokenIMDB) DeleteAuthToken(ctx context.Context, user string, purpose string) error {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.Tokens, purpose+":"+user)
+	return nil
+}
@@ -0,0 +1,61 @@
+package system
+
+import (
+	"strings"
+	"time"
+)
+
+// CompareRecord is a proxied request whose primary and candidate responses
+// did not match, bodies are truncated while the sizes hold the full length
+type CompareRecord struct {
+	ID                int64               `json:"id"`
+	Patch             string              `json:"patch"`
+	Method            string              `json:"method"`
+	Path              string              `json:"path"`
+	PrimaryURL        string              `json:"primary_url"`
+	CandidateURL      string              `json:"candidate_url"`
+	PrimaryStatus     int                 `json:"primary_status"`
+	CandidateStatus   int                 `json:"candidate_status"`
+	PrimaryBody       []byte              `json:"primary_body"`
+	CandidateBody     []byte              `json:"candidate_body"`
+	PrimaryDuration   time.Duration       `json:"primary_duration"`
+	CandidateDuration time.Duration       `json:"candidate_duration"`
+	Differences       []CompareDifference `json:"differences"`
+	// the candidate request failed, there is no candidate response
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// CompareDifference is a single mismatch, field is "status", "header.<name>"
+// or "body" followed by the json path of the value. Values are json encoded
+// and empty if missing on that side
+type CompareDifference struct {
+	Field     string `json:"field"`
+	Primary   string `json:"primary"`
+	Candidate string `json:"candidate"`
+}
+
+// CompareFilter selects recorded mismatches, zero values match everything
+type CompareFilter struct {
+	Patch string    `form:"patch"`
+	Path  string    `form:"path"`
+	From  time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To    time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit int       `form:"limit"`
+}
+
+func (f *CompareFilter) Match(record *CompareRecord) bool {
+	if f.Patch != "" && record.Patch != f.Patch {
+		return false
+	}
+	if f.Path != "" && !strings.HasPrefix(record.Path, f.Path) {
+		return false
+	}
+	if !f.From.IsZero() && record.StartedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && record.StartedAt.After(f.To) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoSuchComparison = errors.New("no such comparison")
+)
+
+type CompareTable interface {
+	Save(ctx context.Context, record *CompareRecord) error
+	Query(ctx context.Context, filter *CompareFilter) ([]*CompareRecord, error)
+	GetById(ctx context.Context, id int64) (*CompareRecord, error)
+}
+
+type CompareIMDB struct {
+	// CompareTable
+	sync.RWMutex
+	Records   []*CompareRecord
+	idCounter int64
+}
+
+func NewCompareIMDB() *CompareIMDB {
+	return &CompareIMDB{
+		Records: make([]*CompareRecord, 0),
+	}
+}
+
+func (t *CompareIMDB) Save(ctx context.Context, record *CompareRecord) error {
+	t.Lock()
+	defer t.Unlock()
+	t.idCounter++
+	record.ID = t.idCounter
+	t.Records = append(t.Records, record)
+	return nil
+}
+
+// Query returns the matching records, newest first
+func (t *CompareIMDB) Query(ctx context.Context, filter *CompareFilter) ([]*CompareRecord, error) {
+	t.RLock()
+	defer t.RUnlock()
+	records := make([]*CompareRecord, 0)
+	for _, record := range t.Records {
+		if filter == nil || filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+	if filter != nil && filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (t *CompareIMDB) GetById(ctx context.Context, id int64) (*CompareRecord, error) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, record := range t.Records {
+		if record.ID == id {
+			return record, nil
+		}
+	}
+	return nil, ErrNoSuchComparison
+}
@@ -0,0 +1,24 @@
+package system
+
+import (
+	"time"
+)
+
+// PatchRecord is the persisted form of a patch, the spec is kept as raw json
+// so the storage layer does not need to know about the api patch types
+type PatchRecord struct {
+	Path      string    `json:"path"`
+	Spec      string    `json:"spec"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewPatchRecord(path string, spec string) *PatchRecord {
+	now := time.Now().UTC()
+	return &PatchRecord{
+		Path:      path,
+		Spec:      spec,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
@@ -0,0 +1,71 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchPatch = errors.New("no such patch")
+)
+
+type PatchTable interface {
+	GetAll(ctx context.Context) ([]*PatchRecord, error)
+	GetByPath(ctx context.Context, path string) (*PatchRecord, error)
+	Save(ctx context.Context, record *PatchRecord) error
+	DeleteByPath(ctx context.Context, path string) error
+}
+
+type PatchIMDB struct {
+	// PatchTable
+	sync.RWMutex
+	Patches map[string]*PatchRecord
+}
+
+func NewPatchIMDB() *PatchIMDB {
+	return &PatchIMDB{
+		Patches: make(map[string]*PatchRecord),
+	}
+}
+
+func (p *PatchIMDB) GetAll(ctx context.Context) ([]*PatchRecord, error) {
+	p.RLock()
+	defer p.RUnlock()
+	allPatches := make([]*PatchRecord, 0, len(p.Patches))
+	for _, patch := range p.Patches {
+		allPatches = append(allPatches, patch)
+	}
+	return allPatches, nil
+}
+
+func (p *PatchIMDB) GetByPath(ctx context.Context, path string) (*PatchRecord, error) {
+	p.RLock()
+	defer p.RUnlock()
+	if patch, ok := p.Patches[path]; ok {
+		return patch, nil
+	}
+	return nil, ErrNoSuchPatch
+}
+
+func (p *PatchIMDB) Save(ctx context.Context, record *PatchRecord) error {
+	p.Lock()
+	defer p.Unlock()
+	if existing, ok := p.Patches[record.Path]; ok {
+		record.CreatedAt = existing.CreatedAt
+		record.UpdatedAt = time.Now().UTC()
+	}
+	p.Patches[record.Path] = record
+	return nil
+}
+
+func (p *PatchIMDB) DeleteByPath(ctx context.Context, path string) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.Patches[path]; !ok {
+		return ErrNoSuchPatch
+	}
+	delete(p.Patches, path)
+	return nil
+}
@@ -0,0 +1,73 @@
+package system
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// manage every patch and the cache and replays of patches
+	PERMISSION_PATCH_ADMIN = "patch:admin"
+	// manage roles and the roles of users
+	PERMISSION_USER_ADMIN = "user:admin"
+	// read recorded traffic and comparisons
+	PERMISSION_TRAFFIC_READ = "traffic:read"
+)
+
+// BuiltinPermissions are the permissions checked by the api, they always exist
+var BuiltinPermissions = []string{PERMISSION_PATCH_ADMIN, PERMISSION_USER_ADMIN, PERMISSION_TRAFFIC_READ}
+
+type Role struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	// members have to use two factor authentication to connect
+	RequireTwoFactor bool      `json:"require_two_factor"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type Permission struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ValidRoleName reports if name can be used for a role or permission
+func ValidRoleName(name string) bool {
+	return name != "" && len(name) <= 255 && !strings.ContainsAny(name, " \t\r\n/")
+}
+
+// RolePermissions collects the distinct permissions of roles, in the order they are granted
+func RolePermissions(roles []*Role) []string {
+	seen := make(map[string]bool)
+	permissions := make([]string, 0)
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+// RequireTwoFactor reports if any of the roles requires two factor authentication
+func RequireTwoFactor(roles []*Role) bool {
+	for _, role := range roles {
+		if role.RequireTwoFactor {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleNames lists the names of roles
+func RoleNames(roles []*Role) []string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+	return names
+}
@@ -0,0 +1,230 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchRole       = errors.New("no such role")
+	ErrRoleExists       = errors.New("role already exists")
+	ErrNoSuchPermission = errors.New("no such permission")
+	ErrPermissionExists = errors.New("permission already exists")
+)
+
+// RoleTable keeps roles, the permissions they grant and the roles of users.
+// Users are referenced by name, deleting a role or permission removes it
+// from every user and role
+type RoleTable interface {
+	CreatePermission(ctx context.Context, name string) (*Permission, error)
+	GetPermissions(ctx context.Context) ([]*Permission, error)
+	DeletePermission(ctx context.Context, name string) error
+	CreateRole(ctx context.Context, name string, permissions []string) (*Role, error)
+	GetRole(ctx context.Context, name string) (*Role, error)
+	GetRoles(ctx context.Context) ([]*Role, error)
+	SetPermissions(ctx context.Context, name string, permissions []string) (*Role, error)
+	SetTwoFactor(ctx context.Context, name string, required bool) (*Role, error)
+	DeleteRole(ctx context.Context, name string) error
+	AssignRole(ctx context.Context, username string, role string) error
+	RevokeRole(ctx context.Context, username string, role string) error
+	GetUserRoles(ctx context.Context, username string) ([]*Role, error)
+}
+
+type RoleIMDB struct {
+	// RoleTable
+	sync.RWMutex
+	Permissions map[string]*Permission
+	Roles       map[string]*Role
+	UserRoles   map[string]map[string]bool
+	idCounter   int64
+}
+
+// NewRoleIMDB creates a role table knowing the builtin permissions
+func NewRoleIMDB() *RoleIMDB {
+	r := &RoleIMDB{
+		Permissions: make(map[string]*Permission),
+		Roles:       make(map[string]*Role),
+		UserRoles:   make(map[string]map[string]bool),
+	}
+	for _, name := range BuiltinPermissions {
+		r.idCounter++
+		r.Permissions[name] = &Permission{ID: r.idCounter, Name: name, CreatedAt: time.Now().UTC()}
+	}
+	return r
+}
+
+func (r *RoleIMDB) CreatePermission(ctx context.Context, name string) (*Permission, error) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.Permissions[name]; ok {
+		return nil, ErrPermissionExists
+	}
+	r.idCounter++
+	permission := &Permission{ID: r.idCounter, Name: name, CreatedAt: time.Now().UTC()}
+	r.Permissions[name] = permission
+	copied := *permission
+	return &copied, nil
+}
+
+func (r *RoleIMDB) GetPermissions(ctx context.Context) ([]*Permission, error) {
+	r.RLock()
+	defer r.RUnlock()
+	permissions := make([]*Permission, 0, len(r.Permissions))
+	for _, permission := range r.Permissions {
+		copied := *permission
+		permissions = append(permissions, &copied)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	return permissions, nil
+}
+
+func (r *RoleIMDB) DeletePermission(ctx context.Context, name string) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.Permissions[name]; !ok {
+		return ErrNoSuchPermission
+	}
+	delete(r.Permissions, name)
+	for _, role := range r.Roles {
+		kept := make([]string, 0, len(role.Permissions))
+		for _, permission := range role.Permissions {
+			if permission != name {
+				kept = append(kept, permission)
+			}
+		}
+		role.Permissions = kept
+	}
+	return nil
+}
+
+// knownPermissions fails if any of the permissions does not exist, the lock has to be held
+func (r *RoleIMDB) knownPermissions(permissions []string) error {
+	for _, permission := range permissions {
+		if _, ok := r.Permissions[permission]; !ok {
+			return ErrNoSuchPermission
+		}
+	}
+	return nil
+}
+
+func (r *RoleIMDB) CreateRole(ctx context.Context, name string, permissions []string) (*Role, error) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.Roles[name]; ok {
+		return nil, ErrRoleExists
+	}
+	if err := r.knownPermissions(permissions); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	r.idCounter++
+	role := &Role{ID: r.idCounter, Name: name, Permissions: append([]string{}, permissions...), CreatedAt: now, UpdatedAt: now}
+	r.Roles[name] = role
+	return copyRole(role), nil
+}
+
+func (r *RoleIMDB) GetRole(ctx context.Context, name string) (*Role, error) {
+	r.RLock()
+	defer r.RUnlock()
+	role, ok := r.Roles[name]
+	if !ok {
+		return nil, ErrNoSuchRole
+	}
+	return copyRole(role), nil
+}
+
+func (r *RoleIMDB) GetRoles(ctx context.Context) ([]*Role, error) {
+	r.RLock()
+	defer r.RUnlock()
+	roles := make([]*Role, 0, len(r.Roles))
+	for _, role := range r.Roles {
+		roles = append(roles, copyRole(role))
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func (r *RoleIMDB) SetPermissions(ctx context.Context, name string, permissions []string) (*Role, error) {
+	r.Lock()
+	defer r.Unlock()
+	role, ok := r.Roles[name]
+	if !ok {
+		return nil, ErrNoSuchRole
+	}
+	if err := r.knownPermissions(permissions); err != nil {
+		return nil, err
+	}
+	role.Permissions = append([]string{}, permissions...)
+	role.UpdatedAt = time.Now().UTC()
+	return copyRole(role), nil
+}
+
+func (r *RoleIMDB) SetTwoFactor(ctx context.Context, name string, required bool) (*Role, error) {
+	r.Lock()
+	defer r.Unlock()
+	role, ok := r.Roles[name]
+	if !ok {
+		return nil, ErrNoSuchRole
+	}
+	role.RequireTwoFactor = required
+	role.UpdatedAt = time.Now().UTC()
+	return copyRole(role), nil
+}
+
+func (r *RoleIMDB) DeleteRole(ctx context.Context, name string) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.Roles[name]; !ok {
+		return ErrNoSuchRole
+	}
+	delete(r.Roles, name)
+	for _, roles := range r.UserRoles {
+		delete(roles, name)
+	}
+	return nil
+}
+
+func (r *RoleIMDB) AssignRole(ctx context.Context, username string, role string) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.Roles[role]; !ok {
+		return ErrNoSuchRole
+	}
+	if r.UserRoles[username] == nil {
+		r.UserRoles[username] = make(map[string]bool)
+	}
+	r.UserRoles[username][role] = true
+	return nil
+}
+
+func (r *RoleIMDB) RevokeRole(ctx context.Context, username string, role string) error {
+	r.Lock()
+	defer r.Unlock()
+	if !r.UserRoles[username][role] {
+		return ErrNoSuchRole
+	}
+	delete(r.UserRoles[username], role)
+	return nil
+}
+
+func (r *RoleIMDB) GetUserRoles(ctx context.Context, username string) ([]*Role, error) {
+	r.RLock()
+	defer r.RUnlock()
+	roles := make([]*Role, 0, len(r.UserRoles[username]))
+	for name := range r.UserRoles[username] {
+		if role, ok := r.Roles[name]; ok {
+			roles = append(roles, copyRole(role))
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func copyRole(role *Role) *Role {
+	copied := *role
+	copied.Permissions = append([]string{}, role.Permissions...)
+	return &copied
+}
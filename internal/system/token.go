@@ -0,0 +1,73 @@
+package system
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	// raw tokens start with the prefix so they are recognized in configs and logs
+	TOKEN_PREFIX = "pat_"
+	// length of the shown part of a token, it helps users tell their tokens apart
+	TOKEN_HINT_LENGTH = len(TOKEN_PREFIX) + 6
+)
+
+// APIToken authenticates a machine client as its user, the raw token is only
+// known on creation and stored as its hash. Scopes limit the permissions of
+// the user while authenticated by the token
+type APIToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	User       string     `json:"user"`
+	Hash       string     `json:"-"`
+	Hint       string     `json:"hint"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// GenerateToken creates a random raw token and the hash it is stored as
+func GenerateToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	raw := TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(buf)
+	return raw, HashToken(raw), nil
+}
+
+// HashToken hashes a raw token, tokens are random so a plain hash suffices
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(raw)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Expired reports if the token expired at now
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// ScopedPermissions limits permissions to the scopes of the token
+func (t *APIToken) ScopedPermissions(permissions []string) []string {
+	scoped := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		if t.HasScope(permission) {
+			scoped = append(scoped, permission)
+		}
+	}
+	return scoped
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
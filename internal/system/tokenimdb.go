@@ -0,0 +1,99 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchToken = errors.New("no such token")
+	ErrTokenExists = errors.New("token name already in use")
+)
+
+// TokenTable keeps the api tokens of users, token names are unique per user
+type TokenTable interface {
+	CreateToken(ctx context.Context, token *APIToken) error
+	GetTokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	GetUserTokens(ctx context.Context, user string) ([]*APIToken, error)
+	DeleteToken(ctx context.Context, user string, id int64) error
+	TouchToken(ctx context.Context, id int64, usedAt time.Time) error
+}
+
+type TokenIMDB struct {
+	// TokenTable
+	sync.RWMutex
+	Tokens    map[int64]*APIToken
+	idCounter int64
+}
+
+func NewTokenIMDB() *TokenIMDB {
+	return &TokenIMDB{
+		Tokens: make(map[int64]*APIToken),
+	}
+}
+
+func (t *TokenIMDB) CreateToken(ctx context.Context, token *APIToken) error {
+	t.Lock()
+	defer t.Unlock()
+	for _, existing := range t.Tokens {
+		if existing.User == token.User && existing.Name == token.Name {
+			return ErrTokenExists
+		}
+	}
+	t.idCounter++
+	token.ID = t.idCounter
+	stored := *token
+	t.Tokens[token.ID] = &stored
+	return nil
+}
+
+func (t *TokenIMDB) GetTokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, token := range t.Tokens {
+		if token.Hash == hash {
+			copied := *token
+			return &copied, nil
+		}
+	}
+	return nil, ErrNoSuchToken
+}
+
+func (t *TokenIMDB) GetUserTokens(ctx context.Context, user string) ([]*APIToken, error) {
+	t.RLock()
+	defer t.RUnlock()
+	tokens := make([]*APIToken, 0)
+	for _, token := range t.Tokens {
+		if token.User == user {
+			copied := *token
+			tokens = append(tokens, &copied)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+func (t *TokenIMDB) DeleteToken(ctx context.Context, user string, id int64) error {
+	t.Lock()
+	defer t.Unlock()
+	token, ok := t.Tokens[id]
+	if !ok || token.User != user {
+		return ErrNoSuchToken
+	}
+	delete(t.Tokens, id)
+	return nil
+}
+
+func (t *TokenIMDB) TouchToken(ctx context.Context, id int64, usedAt time.Time) error {
+	t.Lock()
+	defer t.Unlock()
+	token, ok := t.Tokens[id]
+	if !ok {
+		return ErrNoSuchToken
+	}
+	token.LastUsedAt = &usedAt
+	return nil
+}
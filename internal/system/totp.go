@@ -0,0 +1,134 @@
+package system
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// codes follow the defaults of RFC 6238 understood by every authenticator app
+	TOTP_DIGITS = 6
+	TOTP_PERIOD = 30 * time.Second
+	// codes of the neighbouring periods are accepted to allow for clock skew
+	TOTP_SKEW           = 1
+	TOTP_SECRET_BYTES   = 20
+	RECOVERY_CODE_COUNT = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is the totp enrolment of a user, it is enabled once the first
+// code was confirmed. Recovery codes are stored hashed and used up one by one
+type TwoFactor struct {
+	User          string     `json:"user"`
+	Secret        string     `json:"-"`
+	Enabled       bool       `json:"enabled"`
+	RecoveryCodes []string   `json:"-"`
+	LastStep      int64      `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// GenerateTOTPSecret creates a random base32 secret
+func GenerateTOTPSecret() (string, error) {
+	buf := make([]byte, TOTP_SECRET_BYTES)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// TOTPURI is the otpauth uri authenticator apps import, usually as qr code
+func TOTPURI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	query.Set("period", fmt.Sprint(int(TOTP_PERIOD.Seconds())))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TOTPCode computes the code of the secret for the period step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000), nil
+}
+
+// TOTPStep is the period step of t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD.Seconds())
+}
+
+// ValidateTOTP checks the code against the steps around now, codes of steps
+// up to lastStep were used before and are rejected. The matched step is returned
+func ValidateTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := TOTPStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateRecoveryCodes creates the raw recovery codes shown to the user and the hashes stored
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		buf := make([]byte, 6)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = HashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+// UseRecoveryCode removes the matching recovery code, it reports if one matched
+func (t *TwoFactor) UseRecoveryCode(code string) bool {
+	hash := HashToken(normalizeRecoveryCode(code))
+	for i, stored := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,34 @@
+package system
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// secret and times of the RFC 6238 sha1 test vectors, cut to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for unix, want := range vectors {
+		if code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0))); err != nil || code != want {
+			t.Errorf("Expected %s at %d, got %s %v", want, unix, code, err)
+		}
+	}
+	now := time.Unix(1234567890, 0)
+	step, ok := ValidateTOTP(secret, "005924", now, 0)
+	if !ok || step != TOTPStep(now) {
+		t.Errorf("Expected the current code to be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, "005924", now, step); ok {
+		t.Errorf("Expected a used code to be rejected")
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil || len(codes) != RECOVERY_CODE_COUNT {
+		t.Fatalf("Expected %d recovery codes, got %d %v", RECOVERY_CODE_COUNT, len(codes), err)
+	}
+	tf := &TwoFactor{RecoveryCodes: hashes}
+	if !tf.UseRecoveryCode(codes[3]) || tf.UseRecoveryCode(codes[3]) || len(tf.RecoveryCodes) != RECOVERY_CODE_COUNT-1 {
+		t.Errorf("Expected a recovery code to be used once")
+	}
+}
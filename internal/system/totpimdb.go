@@ -0,0 +1,62 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrNoTwoFactor = errors.New("two factor authentication not set up")
+)
+
+// TwoFactorTable keeps the totp enrolment of users by name
+type TwoFactorTable interface {
+	GetTwoFactor(ctx context.Context, user string) (*TwoFactor, error)
+	SaveTwoFactor(ctx context.Context, twoFactor *TwoFactor) error
+	DeleteTwoFactor(ctx context.Context, user string) error
+}
+
+type TwoFactorIMDB struct {
+	// TwoFactorTable
+	sync.RWMutex
+	Enrolments map[string]*TwoFactor
+}
+
+func NewTwoFactorIMDB() *TwoFactorIMDB {
+	return &TwoFactorIMDB{
+		Enrolments: make(map[string]*TwoFactor),
+	}
+}
+
+func (t *TwoFactorIMDB) GetTwoFactor(ctx context.Context, user string) (*TwoFactor, error) {
+	t.RLock()
+	defer t.RUnlock()
+	twoFactor, ok := t.Enrolments[user]
+	if !ok {
+		return nil, ErrNoTwoFactor
+	}
+	copied := *twoFactor
+	copied.RecoveryCodes = append([]string{}, twoFactor.RecoveryCodes...)
+	return &copied, nil
+}
+
+// SaveTwoFactor creates or replaces the enrolment of the user
+func (t *TwoFactorIMDB) SaveTwoFactor(ctx context.Context, twoFactor *TwoFactor) error {
+	t.Lock()
+	defer t.Unlock()
+	stored := *twoFactor
+	stored.RecoveryCodes = append([]string{}, twoFactor.RecoveryCodes...)
+	t.Enrolments[twoFactor.User] = &stored
+	return nil
+}
+
+func (t *TwoFactorIMDB) DeleteTwoFactor(ctx context.Context, user string) error {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.Enrolments[user]; !ok {
+		return ErrNoTwoFactor
+	}
+	delete(t.Enrolments, user)
+	return nil
+}
@@ -0,0 +1,69 @@
+package system
+
+import (
+	"strings"
+	"time"
+)
+
+// TrafficRecord is a captured exchange of a proxied request and its response,
+// bodies are truncated while the sizes hold the full length
+type TrafficRecord struct {
+	ID              int64               `json:"id"`
+	Patch           string              `json:"patch"`
+	Method          string              `json:"method"`
+	Path            string              `json:"path"`
+	URL             string              `json:"url"`
+	RequestHeaders  map[string][]string `json:"request_headers"`
+	RequestBody     []byte              `json:"request_body"`
+	RequestSize     int64               `json:"request_size"`
+	Status          int                 `json:"status"`
+	ResponseHeaders map[string][]string `json:"response_headers"`
+	ResponseBody    []byte              `json:"response_body"`
+	ResponseSize    int64               `json:"response_size"`
+	ClientIP        string              `json:"client_ip"`
+	StartedAt       time.Time           `json:"started_at"`
+	Duration        time.Duration       `json:"duration"`
+	// id of the replay job that sent the request, 0 for proxied traffic
+	Replay int64 `json:"replay,omitempty"`
+	// attempts it took to get the response, 0 if the patch does not retry
+	Attempts int `json:"attempts,omitempty"`
+	// the exchange was sent to the mirror of the patch
+	Mirror bool `json:"mirror,omitempty"`
+}
+
+// TrafficFilter selects captured traffic, zero values match everything
+type TrafficFilter struct {
+	Patch  string    `form:"patch"`
+	Status int       `form:"status"`
+	Path   string    `form:"path"`
+	From   time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To     time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit  int       `form:"limit"`
+	Replay int64     `form:"replay"`
+	Mirror *bool     `form:"mirror"`
+}
+
+func (f *TrafficFilter) Match(record *TrafficRecord) bool {
+	if f.Patch != "" && record.Patch != f.Patch {
+		return false
+	}
+	if f.Status != 0 && record.Status != f.Status {
+		return false
+	}
+	if f.Path != "" && !strings.HasPrefix(record.Path, f.Path) {
+		return false
+	}
+	if f.Replay != 0 && record.Replay != f.Replay {
+		return false
+	}
+	if f.Mirror != nil && record.Mirror != *f.Mirror {
+		return false
+	}
+	if !f.From.IsZero() && record.StartedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && record.StartedAt.After(f.To) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoSuchTraffic = errors.New("no such traffic record")
+)
+
+type TrafficTable interface {
+	Save(ctx context.Context, record *TrafficRecord) error
+	Query(ctx context.Context, filter *TrafficFilter) ([]*TrafficRecord, error)
+	GetById(ctx context.Context, id int64) (*TrafficRecord, error)
+}
+
+type TrafficIMDB struct {
+	// TrafficTable
+	sync.RWMutex
+	Records   []*TrafficRecord
+	idCounter int64
+}
+
+func NewTrafficIMDB() *TrafficIMDB {
+	return &TrafficIMDB{
+		Records: make([]*TrafficRecord, 0),
+	}
+}
+
+func (t *TrafficIMDB) Save(ctx context.Context, record *TrafficRecord) error {
+	t.Lock()
+	defer t.Unlock()
+	t.idCounter++
+	record.ID = t.idCounter
+	t.Records = append(t.Records, record)
+	return nil
+}
+
+// Query returns the matching records, newest first
+func (t *TrafficIMDB) Query(ctx context.Context, filter *TrafficFilter) ([]*TrafficRecord, error) {
+	t.RLock()
+	defer t.RUnlock()
+	records := make([]*TrafficRecord, 0)
+	for _, record := range t.Records {
+		if filter == nil || filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+	if filter != nil && filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (t *TrafficIMDB) GetById(ctx context.Context, id int64) (*TrafficRecord, error) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, record := range t.Records {
+		if record.ID == id {
+			return record, nil
+		}
+	}
+	return nil, ErrNoSuchTraffic
+}
@@ -23,17 +23,21 @@ func CheckPasswords(hashedPassword string, password string) bool {
 }
 
 type User struct {
-	id        int64     `json:"-"`
-	Name      string    `json:"name" binding:"required"`
-	Email     string    `json:"email" binding:"optional"`
-	CreatedAt time.Time `json:"created_at" binding:"optional"`
-	UpdatedAt time.Time `json:"updated_at" binding:"optional"`
+	id    int64  `json:"-"`
+	Name  string `json:"name" binding:"required"`
+	Email string `json:"email" binding:"optional"`
+	// set once the user confirmed the email by a mailed token
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at" binding:"optional"`
+	UpdatedAt     time.Time `json:"updated_at" binding:"optional"`
 }
 
 type RawUser struct {
 	Username string `json:"username"`
-	// Email    string `json:"email"`
+	Email    string `json:"email,omitempty"`
 	Password string `json:"password"`
+	// totp or recovery code for users with two factor authentication
+	Code string `json:"code,omitempty"`
 }
 
 func NewUser(name string, email string) *User {
@@ -3,11 +3,13 @@ package system
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 var (
 	ErrAuthFailed = errors.New("auth failed")
 	ErrNoSuchUser = errors.New("no such user")
+	ErrUserExists = errors.New("username or email already exists")
 )
 
 type UserTable interface {
@@ -16,6 +18,7 @@ type UserTable interface {
 	GetByName(ctx context.Context, name string) (*User, error)
 	GetByEmail(ctx context.Context, email string) (*User, error)
 	Update(ctx context.Context, user *User) (*User, error)
+	UpdateUserPassword(ctx context.Context, user *User, new_password string) (*User, error)
 	DeleteByName(ctx context.Context, user string) error
 }
 
@@ -60,8 +63,12 @@ func (u *UserIMDB) GetByName(ctx context.Context, name string) (*User, error) {
 }
 
 func (u *UserIMDB) GetByEmail(ctx context.Context, email string) (*User, error) {
-	// panic("not implemented")
-	return nil, nil
+	for _, user := range u.Users {
+		if email != "" && user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, ErrNoSuchUser
 }
 
 func (u *UserIMDB) GetById(ctx context.Context, id int64) (*User, error) {
@@ -80,6 +87,9 @@ func (u *UserIMDB) GetUsers(ctx context.Context) ([]*User, error) {
 }
 
 func (u *UserIMDB) Create(ctx context.Context, name string, email string, password string) (*User, error) {
+	if _, err := u.GetByEmail(ctx, email); err == nil {
+		return nil, ErrUserExists
+	}
 	user := NewUser(name, email)
 	id := u.nextId()
 	user.SetID(id)
@@ -100,6 +110,19 @@ func (u *UserIMDB) Update(ctx context.Context, user *User) (*User, error) {
 	return user, nil
 }
 
+func (u *UserIMDB) UpdateUserPassword(ctx context.Context, user *User, new_password string) (*User, error) {
+	if _, ok := u.Users[user.ID()]; !ok {
+		return nil, ErrNoSuchUser
+	}
+	password, err := EncryptPassword(new_password)
+	if err != nil {
+		return nil, err
+	}
+	u.IDPasswords[user.ID()] = password
+	user.UpdatedAt = time.Now().UTC()
+	return user, nil
+}
+
 func (u *UserIMDB) DeleteById(ctx context.Context, id int64) error {
 	if _, ok := u.Users[id]; !ok {
 		return ErrNoSuchUser
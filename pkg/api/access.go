@@ -0,0 +1,172 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+const (
+	// only the owner and admins see the patch
+	VISIBILITY_PRIVATE = "private"
+	// the users the patch is shared with see it as well
+	VISIBILITY_SHARED = "shared"
+	// every user sees the patch
+	VISIBILITY_PUBLIC = "public"
+)
+
+var (
+	ErrForbidden         = errors.New("not allowed to modify patch")
+	ErrInvalidVisibility = errors.New("invalid visibility")
+	ErrAdminPassword     = errors.New("admin password required")
+)
+
+// AdminList names the users allowed to see and modify every patch
+type AdminList []string
+
+// loadAdmins reads the comma separated admins of the api config
+func loadAdmins(config *util.Config) AdminList {
+	raw, ok := config.GetString("admins")
+	if !ok {
+		return AdminList{}
+	}
+	admins := make(AdminList, 0)
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins = append(admins, name)
+		}
+	}
+	return admins
+}
+
+// loadBootstrapAdmin reads the admin created on startup from the admin keys of
+// the api config, it is nil if no admin name is set and a name requires a password
+func loadBootstrapAdmin(config *util.Config) (*internal.AdminBootstrap, error) {
+	name, ok := config.GetString("admin.name")
+	if !ok || strings.TrimSpace(name) == "" {
+		return nil, nil
+	}
+	admin := &internal.AdminBootstrap{Name: strings.TrimSpace(name)}
+	admin.Email, _ = config.GetString("admin.email")
+	admin.Password, _ = config.GetString("admin.password")
+	if admin.Password == "" {
+		return nil, fmt.Errorf("%w: %s", ErrAdminPassword, admin.Name)
+	}
+	return admin, nil
+}
+
+func (a AdminList) contains(user string) bool {
+	for _, admin := range a {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func validateVisibility(patch *ForwardPatch) error {
+	switch patch.Visibility {
+	case "", VISIBILITY_PRIVATE, VISIBILITY_PUBLIC:
+		if len(patch.SharedWith) > 0 {
+			return fmt.Errorf("%w: shared with needs shared visibility", ErrInvalidVisibility)
+		}
+	case VISIBILITY_SHARED:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidVisibility, patch.Visibility)
+	}
+	return nil
+}
+
+// visibility of the patch, patches without owner predate ownership and stay public
+func (p *ForwardPatch) visibility() string {
+	if p.Visibility != "" {
+		return p.Visibility
+	}
+	if p.Owner == "" {
+		return VISIBILITY_PUBLIC
+	}
+	return VISIBILITY_PRIVATE
+}
+
+// requestUser is the user set by the session control of the request
+func requestUser(c *gin.Context) string {
+	if val, ok := c.Get("username"); ok {
+		if user, ok := val.(string); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+// isAdmin reports if the user of the request is a configured admin or holds
+// the patch admin permission through one of their roles, configured admins
+// using an api token need the patch admin scope
+func (pc *PatchControl) isAdmin(c *gin.Context) bool {
+	user := requestUser(c)
+	if user == "" {
+		return false
+	}
+	if pc.admins.contains(user) && internal.ScopeAllows(c, system.PERMISSION_PATCH_ADMIN) {
+		return true
+	}
+	return internal.HasPermission(c, system.PERMISSION_PATCH_ADMIN)
+}
+
+// canModify reports if the user of the request owns the patch or is an admin
+func (pc *PatchControl) canModify(c *gin.Context, patch *ForwardPatch) bool {
+	user := requestUser(c)
+	if user == "" {
+		return false
+	}
+	return pc.isAdmin(c) || (patch.Owner != "" && patch.Owner == user)
+}
+
+func (pc *PatchControl) canView(c *gin.Context, patch *ForwardPatch) bool {
+	user := requestUser(c)
+	if user == "" {
+		return false
+	}
+	switch patch.visibility() {
+	case VISIBILITY_PUBLIC:
+		return true
+	case VISIBILITY_SHARED:
+		for _, shared := range patch.SharedWith {
+			if shared == user {
+				return true
+			}
+		}
+	}
+	return pc.canModify(c, patch)
+}
+
+// canViewPath reports if the user of the request may see the traffic of the
+// patch at path, the traffic of removed patches is left to admins
+func (pc *PatchControl) canViewPath(c *gin.Context, path string) bool {
+	pc.RLock()
+	route, ok := pc.routes[sanitizePath(path)]
+	pc.RUnlock()
+	if !ok {
+		return pc.isAdmin(c)
+	}
+	return pc.canView(c, &route.patch)
+}
+
+// authorizePatch checks the user of the request may see the patch, or modify
+// it if modify is set. Patches the user may not see are reported as not found
+func (pc *PatchControl) authorizePatch(c *gin.Context, path string, modify bool) error {
+	pc.RLock()
+	route, ok := pc.routes[sanitizePath(path)]
+	pc.RUnlock()
+	if !ok || !pc.canView(c, &route.patch) {
+		return ErrPathNotFound
+	}
+	if modify && !pc.canModify(c, &route.patch) {
+		return ErrForbidden
+	}
+	return nil
+}
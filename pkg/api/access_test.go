@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+// withUser stands in for the session control of the router
+func withUser(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("username", name)
+	}
+}
+
+func TestPatchAccess(t *testing.T) {
+	upstream := newTestUpstream()
+	defer upstream.Close()
+	patches := NewPatchControl(nil, AdminList{"admin"})
+	defer patches.Close()
+	router := gin.New()
+	patches.addPatchRoutes(router.Group("/patch", func(c *gin.Context) {
+		c.Set("username", c.GetHeader("X-User"))
+	}))
+	do := func(user, method, target string, patch *ForwardPatch) *httptest.ResponseRecorder {
+		var body []byte
+		if patch != nil {
+			body, _ = json.Marshal(patch)
+		}
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("X-User", user)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+	visible := func(user string) map[string]PatchStatus {
+		var list map[string]PatchStatus
+		json.Unmarshal(do(user, http.MethodGet, "/patch", nil).Body.Bytes(), &list)
+		return list
+	}
+
+	// the owner is taken from the session, not from the patch
+	if resp := do("alice", http.MethodPatch, "/patch", &ForwardPatch{Path: "mine", Dest: upstream.URL, Owner: "bob"}); resp.Code != http.StatusOK {
+		t.Errorf("Expected the patch to be applied, got %d %s", resp.Code, resp.Body.String())
+		t.FailNow()
+	}
+	if owner := patches.routes["mine"].patch.Owner; owner != "alice" {
+		t.Errorf("Expected alice to own the patch, got %q", owner)
+	}
+	do("bob", http.MethodPatch, "/patch", &ForwardPatch{Path: "open", Dest: upstream.URL, Visibility: VISIBILITY_PUBLIC})
+
+	for _, tc := range []struct {
+		name   string
+		user   string
+		method string
+		target string
+		patch  *ForwardPatch
+		status int
+	}{
+		{"private hidden", "bob", http.MethodGet, "/patch/mine", nil, http.StatusNotFound},
+		{"private delete", "bob", http.MethodDelete, "/patch/mine", nil, http.StatusNotFound},
+		{"private replace", "bob", http.MethodPatch, "/patch", &ForwardPatch{Path: "mine", Dest: upstream.URL}, http.StatusNotFound},
+		{"anonymous", "", http.MethodGet, "/patch/open", nil, http.StatusNotFound},
+		{"share", "alice", http.MethodPatch, "/patch",
+			&ForwardPatch{Path: "mine", Dest: upstream.URL, Visibility: VISIBILITY_SHARED, SharedWith: []string{"carol"}}, http.StatusOK},
+		{"shared view", "carol", http.MethodGet, "/patch/mine", nil, http.StatusOK},
+		{"shared delete", "carol", http.MethodDelete, "/patch/mine", nil, http.StatusForbidden},
+		{"shared replace", "carol", http.MethodPatch, "/patch", &ForwardPatch{Path: "mine", Dest: upstream.URL}, http.StatusForbidden},
+		{"public view", "alice", http.MethodGet, "/patch/open", nil, http.StatusOK},
+		{"public delete", "alice", http.MethodDelete, "/patch/open", nil, http.StatusForbidden},
+		{"invalid visibility", "alice", http.MethodPatch, "/patch", &ForwardPatch{Path: "other", Dest: upstream.URL, Visibility: "secret"}, http.StatusBadRequest},
+		{"shared without visibility", "alice", http.MethodPatch, "/patch", &ForwardPatch{Path: "other", Dest: upstream.URL, SharedWith: []string{"bob"}}, http.StatusBadRequest},
+	} {
+		if resp := do(tc.user, tc.method, tc.target, tc.patch); resp.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, tc.status, resp.Code, resp.Body.String())
+		}
+	}
+
+	if list := visible("bob"); len(list) != 1 || list["open"].Owner != "bob" {
+		t.Errorf("Expected bob to only see his patch, got %v", list)
+	}
+	if list := visible("carol"); len(list) != 2 {
+		t.Errorf("Expected carol to see the shared and the public patch, got %d", len(list))
+	}
+	if list := visible("admin"); len(list) != 2 {
+		t.Errorf("Expected the admin to see every patch, got %d", len(list))
+	}
+	if resp := do("admin", http.MethodPatch, "/patch", &ForwardPatch{Path: "mine", Dest: upstream.URL}); resp.Code != http.StatusOK ||
+		patches.routes["mine"].patch.Owner != "alice" {
+		t.Errorf("Expected the admin to replace the patch keeping its owner, got %d", resp.Code)
+	}
+	if resp := do("admin", http.MethodDelete, "/patch/mine", nil); resp.Code != http.StatusOK {
+		t.Errorf("Expected the admin to delete the patch, got %d", resp.Code)
+	}
+}
+
+func TestLoadBootstrapAdmin(t *testing.T) {
+	if admin, err := loadBootstrapAdmin(util.NewConfig(map[string]interface{}{"admin.name": ""}, nil)); admin != nil || err != nil {
+		t.Errorf("Expected no admin without a name, got %v %v", admin, err)
+	}
+	if _, err := loadBootstrapAdmin(util.NewConfig(map[string]interface{}{"admin.name": "root", "admin.password": ""}, nil)); !errors.Is(err, ErrAdminPassword) {
+		t.Errorf("Expected an admin without password to be rejected, got %v", err)
+	}
+	admin, err := loadBootstrapAdmin(util.NewConfig(map[string]interface{}{"admin.name": " root ", "admin.password": "rootpass"}, nil))
+	if err != nil || admin == nil || admin.Name != "root" || admin.Password != "rootpass" {
+		t.Errorf("Expected the root admin, got %v %v", admin, err)
+	}
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STRATEGY_ROUND_ROBIN       = "round_robin"
+	STRATEGY_WEIGHTED_RANDOM   = "weighted_random"
+	STRATEGY_LEAST_OUTSTANDING = "least_outstanding"
+	STRATEGY_HASH              = "hash"
+
+	// virtual nodes per weight unit on the consistent hash ring
+	hashRingReplicas = 64
+)
+
+var (
+	ErrNoUpstream      = errors.New("patch has no upstream")
+	ErrUnknownStrategy = errors.New("unknown load balancing strategy")
+	ErrInvalidWeight   = errors.New("upstream weight cannot be negative")
+)
+
+type Upstream struct {
+	Dest   string `json:"dest"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+type UpstreamStatus struct {
+	Dest        string         `json:"dest"`
+	Weight      int            `json:"weight"`
+	Requests    uint64         `json:"requests"`
+	Outstanding int64          `json:"outstanding"`
+	Share       float64        `json:"share"`
+	Healthy     bool           `json:"healthy"`
+	LastCheck   *time.Time     `json:"last_check,omitempty"`
+	LastError   string         `json:"last_error,omitempty"`
+	Circuit     *CircuitStatus `json:"circuit,omitempty"`
+}
+
+type upstream struct {
+	dest        *url.URL
+	weight      int
+	current     int
+	requests    atomic.Uint64
+	outstanding atomic.Int64
+	healthy     atomic.Bool
+	health      healthState
+	breaker     *breaker
+}
+
+func (u *upstream) acquire() {
+	u.requests.Add(1)
+	u.outstanding.Add(1)
+}
+
+func (u *upstream) release() {
+	u.outstanding.Add(-1)
+}
+
+// inRotation reports if the upstream is healthy and its circuit lets requests through
+func (u *upstream) inRotation(now time.Time) bool {
+	return u.healthy.Load() && u.breaker.available(now)
+}
+
+type hashRingEntry struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// balancer picks the upstream for each request of a patch
+type balancer struct {
+	sync.Mutex
+	strategy   string
+	hashHeader string
+	upstreams  []*upstream
+	ring       []hashRingEntry
+}
+
+// upstreamList returns the upstreams of the patch, a plain dest counts as a single upstream
+func (p *ForwardPatch) upstreamList() []Upstream {
+	if len(p.Upstreams) > 0 {
+		return p.Upstreams
+	}
+	if p.Dest == "" {
+		return nil
+	}
+	return []Upstream{{Dest: p.Dest}}
+}
+
+// newBalancer parses the upstreams of the patch, destinations are only probed if probe is set
+func newBalancer(patch *ForwardPatch, probe bool) (*balancer, error) {
+	strategy := strings.ToLower(patch.Strategy)
+	switch strategy {
+	case "":
+		strategy = STRATEGY_ROUND_ROBIN
+	case STRATEGY_ROUND_ROBIN, STRATEGY_WEIGHTED_RANDOM, STRATEGY_LEAST_OUTSTANDING, STRATEGY_HASH:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, patch.Strategy)
+	}
+	list := patch.upstreamList()
+	if len(list) == 0 {
+		return nil, ErrNoUpstream
+	}
+	b := &balancer{
+		strategy:   strategy,
+		hashHeader: patch.HashHeader,
+		upstreams:  make([]*upstream, len(list)),
+	}
+	for i, raw := range list {
+		if raw.Weight < 0 {
+			return nil, ErrInvalidWeight
+		}
+		var dest *url.URL
+		var err error
+		if probe {
+			dest, err = validatePath(raw.Dest)
+		} else {
+			dest, err = parseDest(raw.Dest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		weight := raw.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		b.upstreams[i] = &upstream{dest: dest, weight: weight}
+		b.upstreams[i].healthy.Store(true)
+	}
+	if strategy == STRATEGY_HASH {
+		b.buildRing()
+	}
+	return b, nil
+}
+
+func (b *balancer) buildRing() {
+	b.ring = make([]hashRingEntry, 0)
+	for _, up := range b.upstreams {
+		for i := 0; i < up.weight*hashRingReplicas; i++ {
+			b.ring = append(b.ring, hashRingEntry{
+				hash:     hashKey(fmt.Sprintf("%s#%d", up.dest.String(), i)),
+				upstream: up,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// next picks a healthy upstream for the request according to the patch strategy,
+// nil is returned if no upstream is in rotation
+func (b *balancer) next(req *http.Request, clientIP string) *upstream {
+	candidates := b.available()
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	switch b.strategy {
+	case STRATEGY_WEIGHTED_RANDOM:
+		return nextWeightedRandom(candidates)
+	case STRATEGY_LEAST_OUTSTANDING:
+		return nextLeastOutstanding(candidates)
+	case STRATEGY_HASH:
+		key := clientIP
+		if b.hashHeader != "" {
+			if val := req.Header.Get(b.hashHeader); val != "" {
+				key = val
+			}
+		}
+		return b.nextHash(key)
+	default:
+		return b.nextRoundRobin(candidates)
+	}
+}
+
+// available returns the upstreams currently in rotation
+func (b *balancer) available() []*upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	for _, up := range b.upstreams {
+		if up.inRotation(now) {
+			candidates = append(candidates, up)
+		}
+	}
+	return candidates
+}
+
+// nextRoundRobin is a smooth weighted round robin, spreading heavier upstreams evenly
+func (b *balancer) nextRoundRobin(candidates []*upstream) *upstream {
+	b.Lock()
+	defer b.Unlock()
+	total := 0
+	var best *upstream
+	for _, up := range candidates {
+		up.current += up.weight
+		total += up.weight
+		if best == nil || up.current > best.current {
+			best = up
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func nextWeightedRandom(candidates []*upstream) *upstream {
+	total := 0
+	for _, up := range candidates {
+		total += up.weight
+	}
+	pick := rand.Intn(total)
+	for _, up := range candidates {
+		if pick < up.weight {
+			return up
+		}
+		pick -= up.weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+func nextLeastOutstanding(candidates []*upstream) *upstream {
+	best := candidates[0]
+	bestLoad := best.outstanding.Load()
+	for _, up := range candidates[1:] {
+		load := up.outstanding.Load()
+		// compare load relative to the weight without dividing
+		if load*int64(best.weight) < bestLoad*int64(up.weight) {
+			best, bestLoad = up, load
+		}
+	}
+	return best
+}
+
+func (b *balancer) nextHash(key string) *upstream {
+	hash := hashKey(key)
+	i := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	// walk the ring until an upstream in rotation is found
+	now := time.Now()
+	for n := 0; n < len(b.ring); n++ {
+		entry := b.ring[(i+n)%len(b.ring)]
+		if entry.upstream.inRotation(now) {
+			return entry.upstream
+		}
+	}
+	return nil
+}
+
+func (b *balancer) status() []UpstreamStatus {
+	var total uint64
+	for _, up := range b.upstreams {
+		total += up.requests.Load()
+	}
+	status := make([]UpstreamStatus, len(b.upstreams))
+	for i, up := range b.upstreams {
+		requests := up.requests.Load()
+		status[i] = UpstreamStatus{
+			Dest:        up.dest.String(),
+			Weight:      up.weight,
+			Requests:    requests,
+			Outstanding: up.outstanding.Load(),
+			Healthy:     up.healthy.Load(),
+		}
+		up.health.fillStatus(&status[i])
+		if up.breaker != nil {
+			status[i].Circuit = up.breaker.status(time.Now())
+		}
+		if total > 0 {
+			status[i].Share = float64(requests) / float64(total)
+		}
+	}
+	return status
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func testBalancer(t *testing.T, strategy string, weights ...int) *balancer {
+	patch := &ForwardPatch{Path: "lb", Strategy: strategy, HashHeader: "X-User"}
+	for i, weight := range weights {
+		patch.Upstreams = append(patch.Upstreams, Upstream{
+			Dest:   "http://upstream" + string(rune('a'+i)) + ":8080",
+			Weight: weight,
+		})
+	}
+	b, err := newBalancer(patch, false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return b
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := testBalancer(t, STRATEGY_ROUND_ROBIN, 3, 1)
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	counts := make(map[*upstream]int)
+	for i := 0; i < 8; i++ {
+		up := b.next(req, "127.0.0.1")
+		up.acquire()
+		up.release()
+		counts[up]++
+	}
+	if counts[b.upstreams[0]] != 6 || counts[b.upstreams[1]] != 2 {
+		t.Errorf("Expected 6/2 split, got %d/%d", counts[b.upstreams[0]], counts[b.upstreams[1]])
+	}
+	status := b.status()
+	if status[0].Share != 0.75 {
+		t.Errorf("Expected share 0.75, got %f", status[0].Share)
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b := testBalancer(t, STRATEGY_LEAST_OUTSTANDING, 1, 1)
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	first := b.next(req, "127.0.0.1")
+	first.acquire()
+	second := b.next(req, "127.0.0.1")
+	if first == second {
+		t.Error("Expected the idle upstream to be picked")
+	}
+	first.release()
+}
+
+func TestBalancerHash(t *testing.T) {
+	b := testBalancer(t, STRATEGY_HASH, 1, 1, 1)
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", "alice")
+	picked := b.next(req, "127.0.0.1")
+	for i := 0; i < 10; i++ {
+		if b.next(req, "10.0.0.1") != picked {
+			t.Error("Expected the same upstream for the same hash key")
+		}
+	}
+	req.Header.Del("X-User")
+	byIP := b.next(req, "10.0.0.1")
+	if b.next(req, "10.0.0.1") != byIP {
+		t.Error("Expected the same upstream for the same client ip")
+	}
+}
+
+func TestBalancerWeightedRandom(t *testing.T) {
+	b := testBalancer(t, STRATEGY_WEIGHTED_RANDOM, 1, 0)
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 10; i++ {
+		if up := b.next(req, "127.0.0.1"); up == nil {
+			t.Error("Expected an upstream")
+		}
+	}
+}
+
+func TestBalancerInvalid(t *testing.T) {
+	if _, err := newBalancer(&ForwardPatch{Path: "lb", Dest: "http://a:80", Strategy: "fastest"}, false); !errors.Is(err, ErrUnknownStrategy) {
+		t.Errorf("Expected %v, got %v", ErrUnknownStrategy, err)
+	}
+	if _, err := newBalancer(&ForwardPatch{Path: "lb"}, false); !errors.Is(err, ErrNoUpstream) {
+		t.Errorf("Expected %v, got %v", ErrNoUpstream, err)
+	}
+}
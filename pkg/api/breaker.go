@@ -0,0 +1,372 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half_open"
+
+	DEFAULT_BREAKER_ERROR_RATE   = 0.5
+	DEFAULT_BREAKER_MIN_REQUESTS = 10
+	DEFAULT_BREAKER_WINDOW       = 30 * time.Second
+	DEFAULT_BREAKER_OPEN_TIMEOUT = 30 * time.Second
+	DEFAULT_BREAKER_PROBES       = 1
+
+	// the window is split into buckets so old outcomes drop out gradually
+	breakerBuckets = 10
+)
+
+var (
+	ErrInvalidBreaker = errors.New("invalid circuit breaker")
+	ErrCircuitOpen    = errors.New("circuit open")
+)
+
+// BreakerConfig opens the circuit of an upstream once the share of failed
+// requests in the window reaches the error rate, 5xx responses, errors and
+// responses slower than the latency threshold count as failed. After the open
+// timeout the circuit is half open and lets a few probe requests through,
+// it closes again if all of them succeed
+type BreakerConfig struct {
+	ErrorRate        float64  `json:"error_rate,omitempty"`
+	Latency          Duration `json:"latency,omitempty"`
+	MinRequests      int      `json:"min_requests,omitempty"`
+	Window           Duration `json:"window,omitempty"`
+	OpenTimeout      Duration `json:"open_timeout,omitempty"`
+	HalfOpenRequests int      `json:"half_open_requests,omitempty"`
+}
+
+func (b *BreakerConfig) validate() error {
+	if b.ErrorRate < 0 || b.ErrorRate > 1 {
+		return fmt.Errorf("%w: error rate must be between 0 and 1", ErrInvalidBreaker)
+	}
+	if b.Latency < 0 || b.Window < 0 || b.OpenTimeout < 0 {
+		return fmt.Errorf("%w: durations must not be negative", ErrInvalidBreaker)
+	}
+	if b.MinRequests < 0 || b.HalfOpenRequests < 0 {
+		return fmt.Errorf("%w: request counts must not be negative", ErrInvalidBreaker)
+	}
+	return nil
+}
+
+func (b *BreakerConfig) withDefaults() BreakerConfig {
+	config := *b
+	if config.ErrorRate == 0 {
+		config.ErrorRate = DEFAULT_BREAKER_ERROR_RATE
+	}
+	if config.MinRequests == 0 {
+		config.MinRequests = DEFAULT_BREAKER_MIN_REQUESTS
+	}
+	if config.Window == 0 {
+		config.Window = Duration(DEFAULT_BREAKER_WINDOW)
+	}
+	if config.OpenTimeout == 0 {
+		config.OpenTimeout = Duration(DEFAULT_BREAKER_OPEN_TIMEOUT)
+	}
+	if config.HalfOpenRequests == 0 {
+		config.HalfOpenRequests = DEFAULT_BREAKER_PROBES
+	}
+	return config
+}
+
+type CircuitStatus struct {
+	State     string     `json:"state"`
+	Requests  int        `json:"requests"`
+	Failures  int        `json:"failures"`
+	ErrorRate float64    `json:"error_rate"`
+	Opened    uint64     `json:"opened"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+}
+
+type breakerBucket struct {
+	requests int
+	failures int
+}
+
+// breaker is the circuit of a single upstream
+type breaker struct {
+	sync.Mutex
+	name   string
+	config BreakerConfig
+	logger *log.Logger
+
+	state    string
+	openedAt time.Time
+	opened   uint64
+	// rolling window while closed
+	buckets     [breakerBuckets]breakerBucket
+	current     int
+	bucketStart time.Time
+	// probes while half open
+	inFlight  int
+	succeeded int
+}
+
+func newBreaker(name string, config BreakerConfig, logger *log.Logger) *breaker {
+	return &breaker{
+		name:        name,
+		config:      config,
+		logger:      logger,
+		state:       CIRCUIT_CLOSED,
+		bucketStart: time.Now(),
+	}
+}
+
+func (b *breaker) openTimeout() time.Duration {
+	return time.Duration(b.config.OpenTimeout)
+}
+
+// available reports if the breaker would let a request through, nil breakers always do
+func (b *breaker) available(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CIRCUIT_OPEN:
+		return now.Sub(b.openedAt) >= b.openTimeout()
+	case CIRCUIT_HALF_OPEN:
+		return b.inFlight < b.config.HalfOpenRequests
+	}
+	return true
+}
+
+// retryIn returns the time until an open circuit lets probes through
+func (b *breaker) retryIn(now time.Time) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.state != CIRCUIT_OPEN {
+		return 0, false
+	}
+	return b.openTimeout() - now.Sub(b.openedAt), true
+}
+
+// allow admits a request, probe is set if it was admitted as a half open probe
+func (b *breaker) allow(now time.Time) (probe bool, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case CIRCUIT_OPEN:
+		if now.Sub(b.openedAt) < b.openTimeout() {
+			return false, false
+		}
+		b.state = CIRCUIT_HALF_OPEN
+		b.inFlight = 0
+		b.succeeded = 0
+		b.logger.Printf("circuit of %s is half open\n", b.name)
+		fallthrough
+	case CIRCUIT_HALF_OPEN:
+		if b.inFlight >= b.config.HalfOpenRequests {
+			return false, false
+		}
+		b.inFlight++
+		return true, true
+	}
+	return false, true
+}
+
+// record counts the outcome of an admitted request
+func (b *breaker) record(now time.Time, probe, failed bool) {
+	b.Lock()
+	defer b.Unlock()
+	if probe {
+		if b.state != CIRCUIT_HALF_OPEN {
+			return
+		}
+		b.inFlight--
+		if failed {
+			b.open(now)
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.config.HalfOpenRequests {
+			b.close(now)
+		}
+		return
+	}
+	// requests admitted before the circuit opened do not count
+	if b.state != CIRCUIT_CLOSED {
+		return
+	}
+	b.rotate(now)
+	b.buckets[b.current].requests++
+	if failed {
+		b.buckets[b.current].failures++
+	}
+	requests, failures := b.totals()
+	if requests >= b.config.MinRequests && float64(failures)/float64(requests) >= b.config.ErrorRate {
+		b.open(now)
+	}
+}
+
+// release gives back a probe slot without counting an outcome
+func (b *breaker) release(probe bool) {
+	if !probe {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CIRCUIT_HALF_OPEN {
+		b.inFlight--
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	requests, failures := b.totals()
+	b.state = CIRCUIT_OPEN
+	b.openedAt = now
+	b.opened++
+	b.logger.Printf("circuit of %s is open after %d of %d requests failed\n", b.name, failures, requests)
+}
+
+func (b *breaker) close(now time.Time) {
+	b.state = CIRCUIT_CLOSED
+	b.buckets = [breakerBuckets]breakerBucket{}
+	b.current = 0
+	b.bucketStart = now
+	b.logger.Printf("circuit of %s is closed again\n", b.name)
+}
+
+// rotate moves the window forward, clearing the buckets that fell out of it
+func (b *breaker) rotate(now time.Time) {
+	width := time.Duration(b.config.Window) / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	steps := int(now.Sub(b.bucketStart) / width)
+	if steps <= 0 {
+		return
+	}
+	if steps > breakerBuckets {
+		steps = breakerBuckets
+	}
+	for i := 0; i < steps; i++ {
+		b.current = (b.current + 1) % breakerBuckets
+		b.buckets[b.current] = breakerBucket{}
+	}
+	b.bucketStart = now.Add(-(now.Sub(b.bucketStart) % width))
+}
+
+func (b *breaker) totals() (int, int) {
+	requests, failures := 0, 0
+	for _, bucket := range b.buckets {
+		requests += bucket.requests
+		failures += bucket.failures
+	}
+	return requests, failures
+}
+
+func (b *breaker) status(now time.Time) *CircuitStatus {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == CIRCUIT_CLOSED {
+		b.rotate(now)
+	}
+	requests, failures := b.totals()
+	status := &CircuitStatus{
+		State:    b.state,
+		Requests: requests,
+		Failures: failures,
+		Opened:   b.opened,
+	}
+	if b.state == CIRCUIT_OPEN && now.Sub(b.openedAt) >= b.openTimeout() {
+		status.State = CIRCUIT_HALF_OPEN
+	}
+	if requests > 0 {
+		status.ErrorRate = float64(failures) / float64(requests)
+	}
+	if b.opened > 0 {
+		openedAt := b.openedAt.UTC()
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// breakerCallKey stores the breakerCall of a forwarded request for the proxy hooks
+type breakerCallKey struct{}
+
+// breakerCall reports the outcome of one forwarded request to the breaker of its upstream
+type breakerCall struct {
+	sync.Mutex
+	breaker *breaker
+	probe   bool
+	start   time.Time
+	done    bool
+}
+
+// respond counts the response once its headers arrived, streamed bodies do not add to the latency
+func (call *breakerCall) respond(statusCode int) {
+	now := time.Now()
+	latency := time.Duration(call.breaker.config.Latency)
+	failed := statusCode >= http.StatusInternalServerError || (latency > 0 && now.Sub(call.start) > latency)
+	call.finish(func() { call.breaker.record(now, call.probe, failed) })
+}
+
+// fail counts a proxy error, requests cancelled by the client are not the fault of the upstream
+func (call *breakerCall) fail(cancelled bool) {
+	call.finish(func() {
+		if cancelled {
+			call.breaker.release(call.probe)
+			return
+		}
+		call.breaker.record(time.Now(), call.probe, true)
+	})
+}
+
+// abandon releases the probe slot if the request ended without an outcome
+func (call *breakerCall) abandon() {
+	call.finish(func() { call.breaker.release(call.probe) })
+}
+
+func (call *breakerCall) finish(report func()) {
+	call.Lock()
+	defer call.Unlock()
+	if call.done {
+		return
+	}
+	call.done = true
+	report()
+}
+
+// circuitRetry is the time until the first open circuit of a healthy upstream
+// lets requests through again, false if no circuit holds a healthy upstream back
+func (b *balancer) circuitRetry(now time.Time) (time.Duration, bool) {
+	retry, open := time.Duration(math.MaxInt64), false
+	for _, up := range b.upstreams {
+		if up.breaker == nil || !up.healthy.Load() {
+			continue
+		}
+		if wait, ok := up.breaker.retryIn(now); ok {
+			open = true
+			if wait < retry {
+				retry = wait
+			}
+		}
+	}
+	return retry, open
+}
+
+// respondUnavailable answers a request without an upstream in rotation, if
+// healthy upstreams are only held back by their open circuits the client is
+// told when to retry
+func respondUnavailable(c *gin.Context, b *balancer) {
+	retry, open := b.circuitRetry(time.Now())
+	if !open {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": ErrNoHealthy.Error()})
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Max(1, float64(ceilSeconds(retry))))))
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": ErrCircuitOpen.Error()})
+}
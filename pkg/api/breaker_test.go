@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	var failing atomic.Bool
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path: "fragile",
+		Dest: upstream.URL,
+		Breaker: &BreakerConfig{
+			MinRequests: 2,
+			OpenTimeout: Duration(200 * time.Millisecond),
+		},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	get := func() *http.Response {
+		resp, err := http.Get(server.URL + "/api/v1/forward/fragile")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp
+	}
+	circuit := func() *CircuitStatus {
+		return patches.routes["fragile"].status().Status[0].Circuit
+	}
+
+	failing.Store(true)
+	for i := 0; i < 2; i++ {
+		if resp := get(); resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected the upstream error, got %d", resp.StatusCode)
+		}
+	}
+	before := hits.Load()
+	resp := get()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected a fast 503 with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if hits.Load() != before {
+		t.Error("Expected the open circuit to keep requests from the upstream")
+	}
+	if status := circuit(); status == nil || status.State != CIRCUIT_OPEN || status.Opened != 1 || status.OpenedAt == nil {
+		t.Errorf("Expected an open circuit, got %+v", status)
+	}
+
+	// a failed probe opens the circuit again
+	time.Sleep(250 * time.Millisecond)
+	if status := circuit(); status.State != CIRCUIT_HALF_OPEN {
+		t.Errorf("Expected a half open circuit, got %s", status.State)
+	}
+	if resp := get(); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected the probe to reach the upstream, got %d", resp.StatusCode)
+	}
+	if status := circuit(); status.State != CIRCUIT_OPEN || status.Opened != 2 {
+		t.Errorf("Expected the circuit to open again, got %+v", status)
+	}
+
+	failing.Store(false)
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if resp := get(); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the upstream to be back, got %d", resp.StatusCode)
+		}
+	}
+	if status := circuit(); status.State != CIRCUIT_CLOSED || status.Requests != 1 || status.Failures != 0 {
+		t.Errorf("Expected a closed circuit with a fresh window, got %+v", status)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	config := (&BreakerConfig{
+		ErrorRate:   0.5,
+		Latency:     Duration(100 * time.Millisecond),
+		MinRequests: 4,
+		Window:      Duration(time.Second),
+	}).withDefaults()
+	b := newBreaker("test", config, log.New(io.Discard, "", 0))
+	now := time.Now()
+	b.bucketStart = now
+
+	for _, failed := range []bool{true, false, false} {
+		b.record(now, false, failed)
+	}
+	// the failure leaves the window before the next ones are counted
+	now = now.Add(1100 * time.Millisecond)
+	for _, failed := range []bool{true, false, false} {
+		b.record(now, false, failed)
+	}
+	if status := b.status(now); status.State != CIRCUIT_CLOSED || status.Requests != 3 || status.Failures != 1 {
+		t.Errorf("Expected old outcomes to leave the window, got %+v", status)
+	}
+	// slow responses count as failures
+	call := &breakerCall{breaker: b, start: time.Now().Add(-time.Second)}
+	call.respond(http.StatusOK)
+	if status := b.status(time.Now()); status.State != CIRCUIT_OPEN {
+		t.Errorf("Expected the slow response to open the circuit, got %+v", status)
+	}
+	if _, ok := b.allow(time.Now()); ok {
+		t.Error("Expected the open circuit to reject requests")
+	}
+}
+
+func TestCircuitBreakerInvalid(t *testing.T) {
+	for _, config := range []BreakerConfig{
+		{ErrorRate: 1.5},
+		{MinRequests: -1},
+		{OpenTimeout: Duration(-time.Second)},
+	} {
+		config := config
+		patch := ForwardPatch{Path: "breaker", Dest: "http://localhost:1", Breaker: &config}
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	patch := ForwardPatch{Path: "tcp", Type: PATCH_TCP, Dest: "tcp://localhost:1", Breaker: &BreakerConfig{}}
+	if _, err := newPatchRoute(patch, false, nil); err == nil {
+		t.Error("Expected the breaker to be rejected for tcp patches")
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	DEFAULT_CAPTURE_MAX_BODY = 64 * 1024
+	// captured exchanges waiting to be written before new ones get dropped
+	captureQueueSize = 256
+	// value stored in place of credentials
+	REDACTED = "[redacted]"
+)
+
+// redactedHeaders carry credentials, their values are never stored
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactHeaders clones headers with the values of credential headers replaced
+func redactHeaders(headers http.Header) http.Header {
+	clone := headers.Clone()
+	for _, name := range redactedHeaders {
+		for i := range clone[name] {
+			clone[name][i] = REDACTED
+		}
+	}
+	return clone
+}
+
+// CaptureConfig enables saving the traffic of a patch to the traffic store
+type CaptureConfig struct {
+	MaxBody int `json:"max_body,omitempty"`
+}
+
+func (c *CaptureConfig) maxBody() int {
+	if c.MaxBody <= 0 {
+		return DEFAULT_CAPTURE_MAX_BODY
+	}
+	return c.MaxBody
+}
+
+// captureBuffer keeps the first max bytes written to it and counts the rest
+type captureBuffer struct {
+	buf  bytes.Buffer
+	max  int
+	size int64
+}
+
+func (b *captureBuffer) capture(p []byte) {
+	b.size += int64(len(p))
+	if remaining := b.max - b.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			p = p[:remaining]
+		}
+		b.buf.Write(p)
+	}
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.capture(p)
+	return len(p), nil
+}
+
+func (b *captureBuffer) Bytes() []byte {
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// captureReader tees the request body into a capture buffer while it is streamed upstream
+type captureReader struct {
+	io.ReadCloser
+	captureBuffer
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.capture(p[:n])
+	return n, err
+}
+
+// captureWriter tees the response body into a capture buffer while it is written to the client
+type captureWriter struct {
+	gin.ResponseWriter
+	captureBuffer
+	started   time.Time
+	firstByte time.Time
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	w.markFirstByte()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.markFirstByte()
+	n, err := w.ResponseWriter.Write(p)
+	w.capture(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.markFirstByte()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.capture([]byte(s[:n]))
+	return n, err
+}
+
+func (w *captureWriter) markFirstByte() {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+// wait is the time until the upstream started to respond
+func (w *captureWriter) wait() time.Duration {
+	if w.firstByte.IsZero() {
+		return 0
+	}
+	return w.firstByte.Sub(w.started)
+}
+
+// exchange is an in flight capture of a proxied request
+type exchange struct {
+	record   *system.TrafficRecord
+	request  *captureReader
+	response *captureWriter
+}
+
+// startCapture wraps the request body and the response writer, it has to run before the request is rewritten
+func startCapture(c *gin.Context, patch string, maxBody int) *exchange {
+	ex := &exchange{
+		record: &system.TrafficRecord{
+			Patch:          patch,
+			Method:         c.Request.Method,
+			Path:           c.Param("path"),
+			RequestHeaders: redactHeaders(c.Request.Header),
+			ClientIP:       c.ClientIP(),
+			StartedAt:      time.Now().UTC(),
+		},
+		response: &captureWriter{
+			ResponseWriter: c.Writer,
+			captureBuffer:  captureBuffer{max: maxBody},
+			started:        time.Now(),
+		},
+	}
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		ex.request = &captureReader{
+			ReadCloser:    c.Request.Body,
+			captureBuffer: captureBuffer{max: maxBody},
+		}
+		c.Request.Body = ex.request
+	}
+	c.Writer = ex.response
+	return ex
+}
+
+// finish completes the record once the response has been written
+func (ex *exchange) finish(upstreamURL string) *system.TrafficRecord {
+	record := ex.record
+	record.URL = upstreamURL
+	record.Duration = time.Since(record.StartedAt)
+	if ex.request != nil {
+		record.RequestBody = ex.request.Bytes()
+		record.RequestSize = ex.request.size
+	}
+	record.Status = ex.response.Status()
+	record.ResponseHeaders = redactHeaders(ex.response.Header())
+	record.ResponseBody = ex.response.Bytes()
+	record.ResponseSize = ex.response.size
+	return record
+}
+
+// captureMaxBody is the largest body size any consumer of the exchange needs
+func (r *patchRoute) captureMaxBody() int {
+	maxBody := 0
+	if r.patch.Capture != nil {
+		maxBody = r.patch.Capture.maxBody()
+	}
+	if r.recording != nil && r.recording.maxBody > maxBody {
+		maxBody = r.recording.maxBody
+	}
+	return maxBody
+}
+
+// truncateRecord returns a copy of the record with bodies cut to maxBody
+func truncateRecord(record *system.TrafficRecord, maxBody int) *system.TrafficRecord {
+	truncated := *record
+	if len(truncated.RequestBody) > maxBody {
+		truncated.RequestBody = truncated.RequestBody[:maxBody]
+	}
+	if len(truncated.ResponseBody) > maxBody {
+		truncated.ResponseBody = truncated.ResponseBody[:maxBody]
+	}
+	return &truncated
+}
+
+// trafficRecorder writes captured exchanges to the traffic store in the background
+type trafficRecorder struct {
+	store  system.TrafficTable
+	queue  chan *system.TrafficRecord
+	done   chan struct{}
+	once   sync.Once
+	logger *log.Logger
+}
+
+func newTrafficRecorder(store system.TrafficTable, logger *log.Logger) *trafficRecorder {
+	recorder := &trafficRecorder{
+		store:  store,
+		queue:  make(chan *system.TrafficRecord, captureQueueSize),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go recorder.run()
+	return recorder
+}
+
+func (r *trafficRecorder) run() {
+	defer close(r.done)
+	for record := range r.queue {
+		if err := r.store.Save(context.Background(), record); err != nil {
+			r.logger.Println("error saving captured traffic:", err)
+		}
+	}
+}
+
+func (r *trafficRecorder) record(record *system.TrafficRecord) {
+	select {
+	case r.queue <- record:
+	default:
+		r.logger.Printf("capture queue full, dropping %s %s\n", record.Method, record.URL)
+	}
+}
+
+func (r *trafficRecorder) close() {
+	r.once.Do(func() {
+		close(r.queue)
+		<-r.done
+	})
+}
+
+// /api/v1/auth/traffic routes
+func (pc *PatchControl) addTrafficRoutes(traffic *gin.RouterGroup) {
+	traffic.GET("", pc.getTraffic)
+	traffic.GET("/:id", pc.getTraffic)
+}
+
+func (pc *PatchControl) getTraffic(c *gin.Context) {
+	if rawID := c.Param("id"); rawID != "" {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		record, err := pc.traffic.store.GetById(c, id)
+		if err != nil || !pc.canViewPath(c, record.Patch) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "traffic not found"})
+			return
+		}
+		c.JSON(http.StatusOK, record)
+		return
+	}
+
+	var filter system.TrafficFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filter"})
+		return
+	}
+	filter.Patch = sanitizePath(filter.Patch)
+	filter.Path = "/" + sanitizePath(filter.Path)
+	if filter.Path == "/" {
+		filter.Path = ""
+	}
+	if filter.Patch != "" && !pc.canViewPath(c, filter.Patch) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+		return
+	}
+	records, err := pc.traffic.store.Query(c, &filter)
+	if err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query traffic"})
+		return
+	}
+	// traffic of patches the user may not see is left out
+	visible := make([]*system.TrafficRecord, 0, len(records))
+	for _, record := range records {
+		if pc.canViewPath(c, record.Patch) {
+			visible = append(visible, record)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"traffic": visible})
+}
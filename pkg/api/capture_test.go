@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func TestCapture(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	patches.addTrafficRoutes(router.Group("/traffic", withUser("alice")))
+	patches.addTrafficRoutes(router.Group("/other", withUser("eve")))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{Path: "captured", Dest: upstream.URL, Owner: "alice", Capture: &CaptureConfig{MaxBody: 4}}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/forward/captured/items?x=1", strings.NewReader("hello world"))
+	req.Header.Set("X-Test", "capture")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || string(body) != "hello world" {
+		t.Errorf("Expected 202 with echoed body, got %d %s", resp.StatusCode, body)
+	}
+
+	var records []*system.TrafficRecord
+	if !waitFor(time.Second, func() bool {
+		records, _ = store.Query(ctx, &system.TrafficFilter{Patch: "captured"})
+		return len(records) == 1
+	}) {
+		t.Error("Expected exchange to be captured")
+		t.FailNow()
+	}
+	record := records[0]
+	if record.Method != http.MethodPost || record.Path != "/captured/items" || record.Status != http.StatusAccepted {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if !strings.HasSuffix(record.URL, "/items?x=1") {
+		t.Errorf("Expected upstream url, got %s", record.URL)
+	}
+	if string(record.RequestBody) != "hell" || record.RequestSize != 11 {
+		t.Errorf("Expected truncated request body, got %q of %d", record.RequestBody, record.RequestSize)
+	}
+	if string(record.ResponseBody) != "hell" || record.ResponseSize != 11 {
+		t.Errorf("Expected truncated response body, got %q of %d", record.ResponseBody, record.ResponseSize)
+	}
+	if record.RequestHeaders["X-Test"][0] != "capture" || record.ResponseHeaders["X-Echo"][0] != "yes" {
+		t.Error("Expected headers to be captured")
+	}
+
+	for query, want := range map[string]int{
+		"?patch=captured":               1,
+		"?status=202&path=/captured/it": 1,
+		"?status=500":                   0,
+		"?from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339): 0,
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/traffic"+query, nil))
+		var result struct {
+			Traffic []*system.TrafficRecord `json:"traffic"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(result.Traffic) != want {
+			t.Errorf("%s: expected %d records, got %d", query, want, len(result.Traffic))
+		}
+	}
+
+	// the traffic of a private patch is hidden from other users
+	for target, want := range map[string]int{
+		"/other/" + strconv.FormatInt(record.ID, 10):   http.StatusNotFound,
+		"/other?patch=captured":                        http.StatusNotFound,
+		"/traffic/" + strconv.FormatInt(record.ID, 10): http.StatusOK,
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if resp.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, resp.Code)
+		}
+	}
+	hidden := httptest.NewRecorder()
+	router.ServeHTTP(hidden, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if strings.Contains(hidden.Body.String(), "captured") {
+		t.Errorf("Expected no traffic of the private patch, got %s", hidden.Body.String())
+	}
+}
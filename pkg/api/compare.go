@@ -0,0 +1,600 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	DEFAULT_COMPARE_PERCENT  = 100
+	DEFAULT_COMPARE_TIMEOUT  = 5 * time.Second
+	DEFAULT_COMPARE_MAX_BODY = 64 * 1024
+	// compared requests in flight per patch before new ones are dropped
+	compareMaxInFlight = 64
+	// differences kept per mismatching exchange
+	compareMaxDifferences = 20
+)
+
+var (
+	ErrInvalidCompare       = errors.New("invalid compare")
+	DEFAULT_COMPARE_HEADERS = []string{"Content-Type"}
+)
+
+// CompareConfig sends percent of the requests of a patch, all by default, to
+// a candidate destination as well and compares its response to the one of the
+// primary. Only the primary response is returned, mismatches are saved to the
+// compare store. Status, the listed headers and the bodies are compared, json
+// bodies value by value skipping the ignored fields. Ignored fields are dotted
+// paths like "meta.timestamp" where * matches any key or index. Requests with
+// bodies larger than max body are not compared, response bodies larger than
+// max body are compared by size and their first max body bytes
+type CompareConfig struct {
+	Dest         string   `json:"dest"`
+	Percent      float64  `json:"percent,omitempty"`
+	Headers      []string `json:"headers,omitempty"`
+	IgnoreFields []string `json:"ignore_fields,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+	MaxBody      int      `json:"max_body,omitempty"`
+}
+
+func (c *CompareConfig) withDefaults() CompareConfig {
+	config := *c
+	if config.Percent == 0 {
+		config.Percent = DEFAULT_COMPARE_PERCENT
+	}
+	if config.Headers == nil {
+		config.Headers = DEFAULT_COMPARE_HEADERS
+	}
+	if config.Timeout == 0 {
+		config.Timeout = Duration(DEFAULT_COMPARE_TIMEOUT)
+	}
+	if config.MaxBody == 0 {
+		config.MaxBody = DEFAULT_COMPARE_MAX_BODY
+	}
+	return config
+}
+
+func (c *CompareConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidCompare)
+	}
+	if c.Timeout < 0 || c.MaxBody < 0 {
+		return fmt.Errorf("%w: timeout and max body must not be negative", ErrInvalidCompare)
+	}
+	for _, header := range c.Headers {
+		if strings.TrimSpace(header) == "" {
+			return fmt.Errorf("%w: header names must not be empty", ErrInvalidCompare)
+		}
+	}
+	for _, field := range c.IgnoreFields {
+		for _, segment := range strings.Split(field, ".") {
+			if segment == "" {
+				return fmt.Errorf("%w: invalid ignored field %q", ErrInvalidCompare, field)
+			}
+		}
+	}
+	if _, err := parseDest(c.Dest); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCompare, err)
+	}
+	return nil
+}
+
+type CompareStatus struct {
+	Dest         string  `json:"dest"`
+	Compared     uint64  `json:"compared"`
+	Mismatched   uint64  `json:"mismatched"`
+	MismatchRate float64 `json:"mismatch_rate"`
+	Errors       uint64  `json:"errors"`
+	Dropped      uint64  `json:"dropped"`
+}
+
+// comparer sends copies of requests to the candidate destination of a route
+// and compares the responses
+type comparer struct {
+	sync.Mutex
+	closed   bool
+	config   CompareConfig
+	dest     *url.URL
+	ignore   [][]string
+	rules    *ruleSet
+	client   *http.Client
+	inFlight chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *log.Logger
+
+	compared   atomic.Uint64
+	mismatched atomic.Uint64
+	errors     atomic.Uint64
+	dropped    atomic.Uint64
+}
+
+func newComparer(config CompareConfig, rules *ruleSet, logger *log.Logger) (*comparer, error) {
+	config = config.withDefaults()
+	dest, err := parseDest(config.Dest)
+	if err != nil {
+		return nil, err
+	}
+	ignore := make([][]string, 0, len(config.IgnoreFields))
+	for _, field := range config.IgnoreFields {
+		ignore = append(ignore, strings.Split(field, "."))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &comparer{
+		config: config,
+		dest:   dest,
+		ignore: ignore,
+		rules:  rules,
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   time.Duration(config.Timeout),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, compareMaxInFlight),
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+	}, nil
+}
+
+// comparison is an in flight comparison of a proxied request
+type comparison struct {
+	patch     string
+	path      string
+	request   *http.Request
+	rc        *ruleContext
+	response  *captureWriter
+	primary   chan primaryResponse
+	started   time.Time
+	save      func(*system.CompareRecord)
+	candidate responseSnapshot
+}
+
+// primaryResponse is the primary response as written to the client
+type primaryResponse struct {
+	responseSnapshot
+	url      string
+	duration time.Duration
+}
+
+// responseSnapshot is a response with its body truncated to max body
+type responseSnapshot struct {
+	status int
+	header http.Header
+	body   []byte
+	size   int64
+}
+
+// start sends the candidate request in the background and captures the
+// primary response, it has to run before the request is rewritten. Nil is
+// returned if the request is not compared
+func (m *comparer) start(c *gin.Context, subPath, patch string, save func(*system.CompareRecord)) *comparison {
+	req := c.Request
+	if !m.sample() || req.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	body, ok, err := bufferBody(req, int64(m.config.MaxBody))
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil || !ok {
+		m.dropped.Add(1)
+		return nil
+	}
+	candidate, err := copyRequest(m.ctx, m.dest, req, subPath, body)
+	if err != nil {
+		m.dropped.Add(1)
+		return nil
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return nil
+	}
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		<-m.inFlight
+		return nil
+	}
+	m.wg.Add(1)
+	m.Unlock()
+	cmp := &comparison{
+		patch:   patch,
+		path:    c.Param("path"),
+		request: candidate,
+		primary: make(chan primaryResponse, 1),
+		started: time.Now(),
+		save:    save,
+		response: &captureWriter{
+			ResponseWriter: c.Writer,
+			captureBuffer:  captureBuffer{max: m.config.MaxBody},
+			started:        time.Now(),
+		},
+	}
+	cmp.rc, _ = req.Context().Value(ruleContextKey{}).(*ruleContext)
+	if cmp.rc == nil {
+		cmp.rc = &ruleContext{}
+	}
+	c.Writer = cmp.response
+	go m.run(cmp)
+	return cmp
+}
+
+// finish hands the primary response to the comparison once it has been
+// written, the writer is reused by gin after the handler returns
+func (cmp *comparison) finish(primaryURL string) {
+	cmp.primary <- primaryResponse{
+		responseSnapshot: responseSnapshot{
+			status: cmp.response.Status(),
+			header: cmp.response.Header().Clone(),
+			body:   cmp.response.Bytes(),
+			size:   cmp.response.size,
+		},
+		url:      primaryURL,
+		duration: time.Since(cmp.started),
+	}
+}
+
+// sample decides if a request is compared
+func (m *comparer) sample() bool {
+	return m.config.Percent >= 100 || rand.Float64()*100 < m.config.Percent
+}
+
+func (m *comparer) run(cmp *comparison) {
+	defer m.wg.Done()
+	defer func() { <-m.inFlight }()
+	started := time.Now()
+	resp, err := m.client.Do(cmp.request)
+	var candidateDuration time.Duration
+	if err == nil {
+		m.rules.applyResponse(resp, cmp.rc)
+		body := captureBuffer{max: m.config.MaxBody}
+		_, err = io.Copy(&body, resp.Body)
+		resp.Body.Close()
+		candidateDuration = time.Since(started)
+		cmp.candidate = responseSnapshot{resp.StatusCode, resp.Header, body.Bytes(), body.size}
+	}
+	var primary primaryResponse
+	select {
+	case primary = <-cmp.primary:
+	case <-m.ctx.Done():
+		return
+	}
+	if err != nil && m.ctx.Err() != nil {
+		return
+	}
+	record := &system.CompareRecord{
+		Patch:             cmp.patch,
+		Method:            cmp.request.Method,
+		Path:              cmp.path,
+		PrimaryURL:        primary.url,
+		CandidateURL:      cmp.request.URL.String(),
+		PrimaryStatus:     primary.status,
+		PrimaryBody:       primary.body,
+		PrimaryDuration:   primary.duration,
+		CandidateDuration: candidateDuration,
+		StartedAt:         cmp.started.UTC(),
+	}
+	m.compared.Add(1)
+	if err != nil {
+		m.errors.Add(1)
+		m.mismatched.Add(1)
+		m.logger.Printf("compare of %s to %s failed: %s\n", cmp.patch, cmp.request.URL, err)
+		record.Error = err.Error()
+		cmp.save(record)
+		return
+	}
+	record.CandidateStatus = cmp.candidate.status
+	record.CandidateBody = cmp.candidate.body
+	record.Differences = m.diff(primary.responseSnapshot, cmp.candidate)
+	if len(record.Differences) > 0 {
+		m.mismatched.Add(1)
+		cmp.save(record)
+	}
+}
+
+// diff lists the differences of the candidate to the primary response
+func (m *comparer) diff(primary, candidate responseSnapshot) []system.CompareDifference {
+	diffs := make([]system.CompareDifference, 0)
+	if primary.status != candidate.status {
+		diffs = append(diffs, system.CompareDifference{
+			Field:     "status",
+			Primary:   strconv.Itoa(primary.status),
+			Candidate: strconv.Itoa(candidate.status),
+		})
+	}
+	for _, name := range m.config.Headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		primaryValue, candidateValue := headerValue(primary.header, name), headerValue(candidate.header, name)
+		if primaryValue != candidateValue {
+			diffs = append(diffs, system.CompareDifference{Field: "header." + name, Primary: primaryValue, Candidate: candidateValue})
+		}
+	}
+	if primary.size > int64(len(primary.body)) || candidate.size > int64(len(candidate.body)) {
+		if primary.size != candidate.size {
+			diffs = append(diffs, system.CompareDifference{
+				Field:     "body_size",
+				Primary:   strconv.FormatInt(primary.size, 10),
+				Candidate: strconv.FormatInt(candidate.size, 10),
+			})
+		} else if !bytes.Equal(primary.body, candidate.body) {
+			diffs = append(diffs, bodyDifference(primary.body, candidate.body))
+		}
+		return diffs
+	}
+	primaryJSON, primaryOk := decodeJSON(primary.body)
+	candidateJSON, candidateOk := decodeJSON(candidate.body)
+	if primaryOk && candidateOk {
+		m.diffJSON(&diffs, []string{}, primaryJSON, candidateJSON)
+	} else if !bytes.Equal(primary.body, candidate.body) {
+		diffs = append(diffs, bodyDifference(primary.body, candidate.body))
+	}
+	if len(diffs) > compareMaxDifferences {
+		diffs = diffs[:compareMaxDifferences]
+	}
+	return diffs
+}
+
+// diffJSON compares two decoded json values, path is the json path below the body
+func (m *comparer) diffJSON(diffs *[]system.CompareDifference, path []string, primary, candidate any) {
+	if len(*diffs) > compareMaxDifferences || m.ignored(path) {
+		return
+	}
+	switch primaryValue := primary.(type) {
+	case map[string]any:
+		if candidateValue, ok := candidate.(map[string]any); ok {
+			keys := make([]string, 0, len(primaryValue)+len(candidateValue))
+			for key := range primaryValue {
+				keys = append(keys, key)
+			}
+			for key := range candidateValue {
+				if _, ok := primaryValue[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				m.diffMissing(diffs, childPath(path, key), primaryValue, candidateValue, key)
+			}
+			return
+		}
+	case []any:
+		if candidateValue, ok := candidate.([]any); ok {
+			for i := 0; i < len(primaryValue) || i < len(candidateValue); i++ {
+				elemPath := childPath(path, strconv.Itoa(i))
+				switch {
+				case i >= len(candidateValue):
+					m.addDifference(diffs, elemPath, encodeJSON(primaryValue[i]), "")
+				case i >= len(primaryValue):
+					m.addDifference(diffs, elemPath, "", encodeJSON(candidateValue[i]))
+				default:
+					m.diffJSON(diffs, elemPath, primaryValue[i], candidateValue[i])
+				}
+			}
+			return
+		}
+	case json.Number:
+		if candidateValue, ok := candidate.(json.Number); ok && equalNumbers(primaryValue, candidateValue) {
+			return
+		}
+	default:
+		if primary == candidate {
+			return
+		}
+	}
+	m.addDifference(diffs, path, encodeJSON(primary), encodeJSON(candidate))
+}
+
+func (m *comparer) diffMissing(diffs *[]system.CompareDifference, path []string, primary, candidate map[string]any, key string) {
+	primaryValue, inPrimary := primary[key]
+	candidateValue, inCandidate := candidate[key]
+	switch {
+	case !inCandidate:
+		m.addDifference(diffs, path, encodeJSON(primaryValue), "")
+	case !inPrimary:
+		m.addDifference(diffs, path, "", encodeJSON(candidateValue))
+	default:
+		m.diffJSON(diffs, path, primaryValue, candidateValue)
+	}
+}
+
+// childPath copies path so siblings don't share the backing array
+func childPath(path []string, segment string) []string {
+	child := make([]string, len(path), len(path)+1)
+	copy(child, path)
+	return append(child, segment)
+}
+
+func (m *comparer) addDifference(diffs *[]system.CompareDifference, path []string, primary, candidate string) {
+	if m.ignored(path) {
+		return
+	}
+	*diffs = append(*diffs, system.CompareDifference{
+		Field:     strings.Join(append([]string{"body"}, path...), "."),
+		Primary:   primary,
+		Candidate: candidate,
+	})
+}
+
+// ignored reports if path matches one of the ignored fields
+func (m *comparer) ignored(path []string) bool {
+	for _, pattern := range m.ignore {
+		if len(pattern) != len(path) {
+			continue
+		}
+		matched := true
+		for i, segment := range pattern {
+			if segment != "*" && segment != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *comparer) status() *CompareStatus {
+	status := &CompareStatus{
+		Dest:       m.dest.String(),
+		Compared:   m.compared.Load(),
+		Mismatched: m.mismatched.Load(),
+		Errors:     m.errors.Load(),
+		Dropped:    m.dropped.Load(),
+	}
+	if status.Compared > 0 {
+		status.MismatchRate = float64(status.Mismatched) / float64(status.Compared)
+	}
+	return status
+}
+
+// close cancels the comparisons in flight and waits for them
+func (m *comparer) close() {
+	m.Lock()
+	m.closed = true
+	m.Unlock()
+	m.cancel()
+	m.wg.Wait()
+	m.client.CloseIdleConnections()
+}
+
+func headerValue(header http.Header, name string) string {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return encodeJSON(strings.Join(values, ", "))
+}
+
+func bodyDifference(primary, candidate []byte) system.CompareDifference {
+	return system.CompareDifference{Field: "body", Primary: encodeJSON(string(primary)), Candidate: encodeJSON(string(candidate))}
+}
+
+// decodeJSON decodes body keeping numbers as written, empty bodies are not json
+func decodeJSON(body []byte) (any, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+	return value, true
+}
+
+func encodeJSON(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// equalNumbers compares json numbers by value so 1 and 1.0 are equal
+func equalNumbers(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	x, errA := a.Float64()
+	y, errB := b.Float64()
+	return errA == nil && errB == nil && x == y
+}
+
+// saveComparison writes a mismatching exchange to the compare store
+func (pc *PatchControl) saveComparison(record *system.CompareRecord) {
+	if err := pc.comparisons.Save(context.Background(), record); err != nil {
+		pc.logger.Println("error saving comparison:", err)
+	}
+}
+
+// /api/v1/auth/compare routes
+func (pc *PatchControl) addCompareRoutes(compare *gin.RouterGroup) {
+	compare.GET("", pc.getComparisons)
+	compare.GET("/:id", pc.getComparisons)
+}
+
+// getComparisons lists the mismatching exchanges, the compare status is
+// included if the patch is filtered on
+func (pc *PatchControl) getComparisons(c *gin.Context) {
+	if rawID := c.Param("id"); rawID != "" {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		record, err := pc.comparisons.GetById(c, id)
+		if err != nil || !pc.canViewPath(c, record.Patch) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "comparison not found"})
+			return
+		}
+		c.JSON(http.StatusOK, record)
+		return
+	}
+
+	var filter system.CompareFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filter"})
+		return
+	}
+	filter.Patch = sanitizePath(filter.Patch)
+	filter.Path = "/" + sanitizePath(filter.Path)
+	if filter.Path == "/" {
+		filter.Path = ""
+	}
+	if filter.Patch != "" && !pc.canViewPath(c, filter.Patch) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+		return
+	}
+	records, err := pc.comparisons.Query(c, &filter)
+	if err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query comparisons"})
+		return
+	}
+	// mismatches of patches the user may not see are left out
+	visible := make([]*system.CompareRecord, 0, len(records))
+	for _, record := range records {
+		if pc.canViewPath(c, record.Patch) {
+			visible = append(visible, record)
+		}
+	}
+	response := gin.H{"mismatches": visible}
+	if filter.Patch != "" {
+		pc.RLock()
+		if route, ok := pc.routes[filter.Patch]; ok && route.compare != nil {
+			response["status"] = route.compare.status()
+		}
+		pc.RUnlock()
+	}
+	c.JSON(http.StatusOK, response)
+}
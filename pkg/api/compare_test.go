@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	respond := func(version string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/same":
+				w.Write([]byte(`{"id": 1, "generated": "` + version + `"}`))
+			case "/changed":
+				if version == "v2" {
+					w.WriteHeader(http.StatusCreated)
+				}
+				w.Write([]byte(`{"id": 1, "name": "` + version + `", "echo": "` + string(body) + `"}`))
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+		}
+	}
+	primary := httptest.NewServer(respond("v1"))
+	defer primary.Close()
+	candidate := httptest.NewServer(respond("v2"))
+	defer candidate.Close()
+
+	store := system.NewCompareIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	patches.addCompareRoutes(router.Group("/compare", withUser("alice")))
+	patches.addCompareRoutes(router.Group("/other", withUser("eve")))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path:    "compared",
+		Dest:    primary.URL,
+		Owner:   "alice",
+		Compare: &CompareConfig{Dest: candidate.URL, IgnoreFields: []string{"generated"}},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	for _, path := range []string{"/same", "/changed"} {
+		resp, err := http.Post(server.URL+"/api/v1/forward/compared"+path, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "v2") {
+			t.Errorf("%s: expected the primary response, got %d %s", path, resp.StatusCode, body)
+		}
+	}
+
+	if !waitFor(time.Second, func() bool {
+		return patches.routes["compared"].status().CompareStatus.Compared == 2
+	}) {
+		t.Error("Expected both requests to be compared")
+		t.FailNow()
+	}
+	status := patches.routes["compared"].status().CompareStatus
+	if status.Mismatched != 1 || status.MismatchRate != 0.5 {
+		t.Errorf("Expected a mismatch rate of 0.5, got %+v", status)
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/compare?patch=compared", nil))
+	var result struct {
+		Mismatches []*system.CompareRecord `json:"mismatches"`
+		Status     *CompareStatus          `json:"status"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil || len(result.Mismatches) != 1 || result.Status == nil {
+		t.Errorf("Expected one mismatch with the compare status, got %d %s", resp.Code, resp.Body.String())
+		t.FailNow()
+	}
+	mismatch := result.Mismatches[0]
+	want := []system.CompareDifference{
+		{Field: "status", Primary: "200", Candidate: "201"},
+		{Field: "body.name", Primary: `"v1"`, Candidate: `"v2"`},
+	}
+	if mismatch.Path != "/compared/changed" || mismatch.PrimaryStatus != http.StatusOK || mismatch.CandidateStatus != http.StatusCreated {
+		t.Errorf("Unexpected mismatch %+v", mismatch)
+	}
+	if len(mismatch.Differences) != len(want) {
+		t.Errorf("Expected differences %+v, got %+v", want, mismatch.Differences)
+	} else {
+		for i := range want {
+			if mismatch.Differences[i] != want[i] {
+				t.Errorf("Expected difference %+v, got %+v", want[i], mismatch.Differences[i])
+			}
+		}
+	}
+
+	byID := httptest.NewRecorder()
+	router.ServeHTTP(byID, httptest.NewRequest(http.MethodGet, "/compare/1", nil))
+	if byID.Code != http.StatusOK {
+		t.Errorf("Expected the mismatch by id, got %d", byID.Code)
+	}
+
+	// mismatches of a private patch are hidden from other users
+	for target, want := range map[string]int{"/other/1": http.StatusNotFound, "/other?patch=compared": http.StatusNotFound} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if resp.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, resp.Code)
+		}
+	}
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil || len(result.Mismatches) != 0 {
+		t.Errorf("Expected no mismatches of the private patch, got %s", resp.Body.String())
+	}
+}
+
+func TestCompareDiff(t *testing.T) {
+	m, err := newComparer(CompareConfig{
+		Dest:         "http://localhost:1",
+		Headers:      []string{"content-type", "X-Version"},
+		IgnoreFields: []string{"meta.timestamp", "items.*.updated"},
+	}, &ruleSet{}, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	snapshot := func(header map[string]string, body string) responseSnapshot {
+		h := http.Header{}
+		for name, value := range header {
+			h.Set(name, value)
+		}
+		return responseSnapshot{status: http.StatusOK, header: h, body: []byte(body), size: int64(len(body))}
+	}
+	for _, tc := range []struct {
+		name      string
+		primary   responseSnapshot
+		candidate responseSnapshot
+		fields    []string
+	}{
+		{"ignored", snapshot(nil, `{"meta": {"timestamp": 1}, "items": [{"updated": "a", "n": 1.0}]}`),
+			snapshot(nil, `{"meta": {"timestamp": 2}, "items": [{"updated": "b", "n": 1}]}`), nil},
+		{"order", snapshot(nil, `{"a": 1, "b": 2}`), snapshot(nil, `{"b": 2, "a": 1}`), nil},
+		{"missing", snapshot(nil, `{"a": [1, 2], "b": true}`), snapshot(nil, `{"a": [1], "c": null}`),
+			[]string{"body.a.1", "body.b", "body.c"}},
+		{"headers", snapshot(map[string]string{"Content-Type": "text/plain"}, "same"),
+			snapshot(map[string]string{"X-Version": "2"}, "same"), []string{"header.Content-Type", "header.X-Version"}},
+		{"text", snapshot(nil, "one"), snapshot(nil, "two"), []string{"body"}},
+		{"truncated", responseSnapshot{status: 200, body: []byte("x"), size: 10}, responseSnapshot{status: 200, body: []byte("x"), size: 20},
+			[]string{"body_size"}},
+	} {
+		diffs := m.diff(tc.primary, tc.candidate)
+		fields := make([]string, 0, len(diffs))
+		for _, diff := range diffs {
+			fields = append(fields, diff.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+			t.Errorf("%s: expected differences in %v, got %+v", tc.name, tc.fields, diffs)
+		}
+	}
+
+	for _, config := range []CompareConfig{
+		{Dest: "http://localhost:1", Percent: -1},
+		{Dest: "http://localhost:1", IgnoreFields: []string{"meta..timestamp"}},
+		{Dest: "http://localhost:1", Headers: []string{" "}},
+		{Dest: "localhost"},
+	} {
+		config := config
+		patch := ForwardPatch{Path: "compare", Dest: "http://localhost:1", Compare: &config}
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
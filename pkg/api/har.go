@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	HAR_VERSION     = "1.2"
+	HAR_CREATOR     = "PaT-CH"
+	HAR_HTTPVERSION = "HTTP/1.1"
+)
+
+// HAR 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func buildHAR(exchanges []recordedExchange) *HAR {
+	entries := make([]HAREntry, 0, len(exchanges))
+	for _, ex := range exchanges {
+		entries = append(entries, buildHAREntry(ex))
+	}
+	return &HAR{
+		Log: HARLog{
+			Version: HAR_VERSION,
+			Creator: HARCreator{Name: HAR_CREATOR, Version: HAR_VERSION},
+			Entries: entries,
+		},
+	}
+}
+
+func buildHAREntry(ex recordedExchange) HAREntry {
+	record := ex.record
+	total := milliseconds(record.Duration)
+	wait := milliseconds(ex.wait)
+	entry := HAREntry{
+		StartedDateTime: record.StartedAt.Format(time.RFC3339Nano),
+		Time:            total,
+		Request: HARRequest{
+			Method:      record.Method,
+			URL:         record.URL,
+			HTTPVersion: HAR_HTTPVERSION,
+			Cookies:     harCookies(record.RequestHeaders, "Cookie"),
+			Headers:     harHeaders(record.RequestHeaders),
+			QueryString: harQuery(record.URL),
+			HeadersSize: -1,
+			BodySize:    record.RequestSize,
+		},
+		Response: HARResponse{
+			Status:      record.Status,
+			StatusText:  http.StatusText(record.Status),
+			HTTPVersion: HAR_HTTPVERSION,
+			Cookies:     harCookies(record.ResponseHeaders, "Set-Cookie"),
+			Headers:     harHeaders(record.ResponseHeaders),
+			Content: HARContent{
+				Size:     record.ResponseSize,
+				MimeType: http.Header(record.ResponseHeaders).Get("Content-Type"),
+			},
+			RedirectURL: http.Header(record.ResponseHeaders).Get("Location"),
+			HeadersSize: -1,
+			BodySize:    record.ResponseSize,
+		},
+		Timings: HARTimings{
+			Send:    0,
+			Wait:    wait,
+			Receive: total - wait,
+		},
+	}
+	if record.RequestSize > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: http.Header(record.RequestHeaders).Get("Content-Type"),
+			Text:     string(record.RequestBody),
+		}
+		if int64(len(record.RequestBody)) < record.RequestSize {
+			entry.Request.PostData.Comment = truncatedComment(len(record.RequestBody), record.RequestSize)
+		}
+	}
+	if len(record.ResponseBody) > 0 {
+		if utf8.Valid(record.ResponseBody) {
+			entry.Response.Content.Text = string(record.ResponseBody)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(record.ResponseBody)
+			entry.Response.Content.Encoding = "base64"
+		}
+		if int64(len(record.ResponseBody)) < record.ResponseSize {
+			entry.Response.Content.Comment = truncatedComment(len(record.ResponseBody), record.ResponseSize)
+		}
+	}
+	return entry
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func truncatedComment(kept int, size int64) string {
+	return fmt.Sprintf("truncated to %d of %d bytes", kept, size)
+}
+
+// harHeaders flattens the headers into a list sorted by name
+func harHeaders(headers map[string][]string) []HARNameValue {
+	list := make([]HARNameValue, 0, len(headers))
+	for name, values := range headers {
+		for _, value := range values {
+			list = append(list, HARNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func harCookies(headers map[string][]string, header string) []HARNameValue {
+	list := make([]HARNameValue, 0)
+	fake := http.Header{header: http.Header(headers).Values(header)}
+	var cookies []*http.Cookie
+	if header == "Set-Cookie" {
+		cookies = (&http.Response{Header: fake}).Cookies()
+	} else {
+		cookies = (&http.Request{Header: fake}).Cookies()
+	}
+	for _, cookie := range cookies {
+		list = append(list, HARNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return list
+}
+
+func harQuery(rawURL string) []HARNameValue {
+	list := make([]HARNameValue, 0)
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return list
+	}
+	for name, values := range parsed.Query() {
+		for _, value := range values {
+			list = append(list, HARNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// skipped when building curl commands, curl sets them itself
+var curlSkipHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+}
+
+// buildCurlScript writes a shell script reproducing every recorded request
+func buildCurlScript(exchanges []recordedExchange) string {
+	sb := strings.Builder{}
+	sb.WriteString("#!/bin/sh\n")
+	sb.WriteString(fmt.Sprintf("# %d request(s) recorded by %s\n", len(exchanges), HAR_CREATOR))
+	for _, ex := range exchanges {
+		record := ex.record
+		sb.WriteString(fmt.Sprintf("\n# %s %s -> %d\n", record.StartedAt.Format(time.RFC3339), record.Path, record.Status))
+		if int64(len(record.RequestBody)) < record.RequestSize {
+			sb.WriteString("# warning: " + truncatedComment(len(record.RequestBody), record.RequestSize) + "\n")
+		}
+		binary := len(record.RequestBody) > 0 && !utf8.Valid(record.RequestBody)
+		if binary {
+			sb.WriteString(fmt.Sprintf("echo %s | base64 -d | ", shellQuote(base64.StdEncoding.EncodeToString(record.RequestBody))))
+		}
+		sb.WriteString(fmt.Sprintf("curl -sS -X %s %s", record.Method, shellQuote(record.URL)))
+		for _, header := range harHeaders(record.RequestHeaders) {
+			if curlSkipHeaders[http.CanonicalHeaderKey(header.Name)] {
+				continue
+			}
+			sb.WriteString(" \\\n  -H " + shellQuote(header.Name+": "+header.Value))
+		}
+		if binary {
+			sb.WriteString(" \\\n  --data-binary @-")
+		} else if len(record.RequestBody) > 0 {
+			sb.WriteString(" \\\n  --data-binary " + shellQuote(string(record.RequestBody)))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecordingExport(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=upstream-secret")
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	patches := NewPatchControl(nil, AdminList{"admin"})
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	patches.addRecordingRoutes(router.Group("/recording", withUser("admin")))
+	patches.addRecordingRoutes(router.Group("/other", withUser("eve")))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "recorded", Dest: upstream.URL, Owner: "admin"}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	call := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Test", "record")
+		req.Header.Set("Authorization", "Bearer client-secret")
+		req.Header.Set("Cookie", "session=client-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		return resp
+	}
+
+	if resp := call(http.MethodGet, "/recording/har?patch=recorded", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict without recording, got %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodPut, "/recording?patch=recorded", `{"size": 2}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected recording to start, got %d", resp.StatusCode)
+	}
+	for _, body := range []string{"one", "it's two", "three"} {
+		resp := call(http.MethodPost, "/api/v1/forward/recorded/items?q=1", body)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	resp := call(http.MethodGet, "/recording/har?patch=recorded", "")
+	var har HAR
+	if err := json.NewDecoder(resp.Body).Decode(&har); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if har.Log.Version != HAR_VERSION || len(har.Log.Entries) != 2 {
+		t.Errorf("Expected 2 entries of the ring, got %+v", har.Log)
+		t.FailNow()
+	}
+	entry := har.Log.Entries[1]
+	if entry.Request.Method != http.MethodPost || entry.Request.PostData == nil || entry.Request.PostData.Text != "three" {
+		t.Errorf("Unexpected request %+v", entry.Request)
+	}
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "1" {
+		t.Errorf("Expected query string, got %+v", entry.Request.QueryString)
+	}
+	if entry.Response.Status != http.StatusCreated || entry.Response.Content.Text != "three" {
+		t.Errorf("Unexpected response %+v", entry.Response)
+	}
+	if entry.Timings.Wait < 0 || entry.Timings.Wait > entry.Time {
+		t.Errorf("Unexpected timings %+v of %f", entry.Timings, entry.Time)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime); err != nil {
+		t.Error(err)
+	}
+	for _, header := range append(entry.Request.Headers, entry.Response.Headers...) {
+		switch header.Name {
+		case "Authorization", "Cookie", "Set-Cookie":
+			if header.Value != REDACTED {
+				t.Errorf("Expected %s to be redacted, got %s", header.Name, header.Value)
+			}
+		}
+	}
+	if len(entry.Request.Cookies) != 0 || len(entry.Response.Cookies) != 0 {
+		t.Errorf("Expected no cookies in the export, got %+v %+v", entry.Request.Cookies, entry.Response.Cookies)
+	}
+	if resp := call(http.MethodGet, "/other/har?patch=recorded", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the private recording to be hidden from other users, got %d", resp.StatusCode)
+	}
+
+	resp = call(http.MethodGet, "/recording/curl?patch=recorded&limit=1", "")
+	script, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Count(string(script), "curl ") != 1 || !strings.Contains(string(script), "--data-binary 'three'") {
+		t.Errorf("Unexpected curl script:\n%s", script)
+	}
+	if strings.Contains(string(script), "client-secret") {
+		t.Errorf("Expected credentials to be redacted:\n%s", script)
+	}
+
+	resp = call(http.MethodGet, "/recording/curl?patch=recorded&status=500", "")
+	script, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(script), "curl ") {
+		t.Errorf("Expected filtered curl script to be empty:\n%s", script)
+	}
+
+	if resp := call(http.MethodDelete, "/recording?patch=recorded", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected recording to stop, got %d", resp.StatusCode)
+	}
+	if resp := call(http.MethodGet, "/recording/har?patch=recorded", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict after stopping, got %d", resp.StatusCode)
+	}
+}
+
+func TestCurlScriptQuoting(t *testing.T) {
+	if quoted := shellQuote("it's"); quoted != `'it'\''s'` {
+		t.Errorf("Unexpected quoting %s", quoted)
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	ErrHealthCheck = errors.New("invalid health check")
+)
+
+var defaultHealthCheck = HealthCheck{
+	Path:               "/",
+	Interval:           Duration(10 * time.Second),
+	Timeout:            Duration(2 * time.Second),
+	StatusMin:          200,
+	StatusMax:          399,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 3,
+}
+
+// HealthCheck configures the active probing of the upstreams of a patch,
+// unset fields fall back to defaultHealthCheck
+type HealthCheck struct {
+	Path               string   `json:"path,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	StatusMin          int      `json:"status_min,omitempty"`
+	StatusMax          int      `json:"status_max,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+}
+
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Path == "" {
+		h.Path = defaultHealthCheck.Path
+	}
+	if h.Interval == 0 {
+		h.Interval = defaultHealthCheck.Interval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHealthCheck.Timeout
+	}
+	if h.StatusMin == 0 {
+		h.StatusMin = defaultHealthCheck.StatusMin
+	}
+	if h.StatusMax == 0 {
+		h.StatusMax = defaultHealthCheck.StatusMax
+	}
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = defaultHealthCheck.HealthyThreshold
+	}
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = defaultHealthCheck.UnhealthyThreshold
+	}
+	return h
+}
+
+func (h HealthCheck) validate() error {
+	if h.Interval < 0 || h.Timeout < 0 {
+		return fmt.Errorf("%w: durations cannot be negative", ErrHealthCheck)
+	}
+	// an unset bound is replaced by its default, the range has to hold with it
+	status := h.withDefaults()
+	if h.StatusMin < 0 || h.StatusMax < 0 || status.StatusMin > status.StatusMax {
+		return fmt.Errorf("%w: bad status range %d-%d", ErrHealthCheck, status.StatusMin, status.StatusMax)
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		return fmt.Errorf("%w: thresholds cannot be negative", ErrHealthCheck)
+	}
+	return nil
+}
+
+// healthState tracks the consecutive probe results of an upstream
+type healthState struct {
+	sync.Mutex
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+func (s *healthState) fillStatus(status *UpstreamStatus) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.lastCheck.IsZero() {
+		lastCheck := s.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	status.LastError = s.lastError
+}
+
+// healthChecker probes every upstream of a balancer in the background
+type healthChecker struct {
+	config HealthCheck
+	client *http.Client
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	logger *log.Logger
+}
+
+func startHealthChecks(b *balancer, config HealthCheck, logger *log.Logger) *healthChecker {
+	config = config.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	checker := &healthChecker{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout)},
+		cancel: cancel,
+		logger: logger,
+	}
+	for _, up := range b.upstreams {
+		checker.wg.Add(1)
+		go checker.run(ctx, up)
+	}
+	return checker
+}
+
+func (h *healthChecker) stop() {
+	h.cancel()
+	h.wg.Wait()
+}
+
+func (h *healthChecker) run(ctx context.Context, up *upstream) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(time.Duration(h.config.Interval))
+	defer ticker.Stop()
+	for {
+		h.probe(ctx, up)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) probe(ctx context.Context, up *upstream) {
+	target := url.URL{Scheme: up.dest.Scheme, Host: up.dest.Host, Path: h.config.Path}
+	err := h.check(ctx, target.String())
+	if ctx.Err() != nil {
+		return
+	}
+
+	up.health.Lock()
+	defer up.health.Unlock()
+	up.health.lastCheck = time.Now().UTC()
+	if err == nil {
+		up.health.lastError = ""
+		up.health.failures = 0
+		up.health.successes++
+		if !up.healthy.Load() && up.health.successes >= h.config.HealthyThreshold {
+			h.logger.Printf("upstream %s is healthy again\n", up.dest)
+			up.healthy.Store(true)
+		}
+		return
+	}
+	up.health.lastError = err.Error()
+	up.health.successes = 0
+	up.health.failures++
+	if up.healthy.Load() && up.health.failures >= h.config.UnhealthyThreshold {
+		h.logger.Printf("upstream %s is unhealthy, taking it out of rotation: %s\n", up.dest, err)
+		up.healthy.Store(false)
+	}
+}
+
+func (h *healthChecker) check(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < h.config.StatusMin || resp.StatusCode > h.config.StatusMax {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(timeout time.Duration, check func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if check() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return check()
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	var failing atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer flaky.Close()
+	stable := newTestUpstream()
+	defer stable.Close()
+
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	patch := ForwardPatch{
+		Path: "health",
+		Upstreams: []Upstream{
+			{Dest: flaky.URL},
+			{Dest: stable.URL},
+		},
+		Health: &HealthCheck{
+			Path:               "/healthz",
+			Interval:           Duration(10 * time.Millisecond),
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+		},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	route := patches.routes["health"]
+	flakyUpstream := route.balancer.upstreams[0]
+
+	failing.Store(true)
+	if !waitFor(time.Second, func() bool { return !flakyUpstream.healthy.Load() }) {
+		t.Error("Expected failing upstream to be taken out of rotation")
+		t.FailNow()
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 4; i++ {
+		if up := route.balancer.next(req, "127.0.0.1"); up == flakyUpstream {
+			t.Error("Unhealthy upstream was picked")
+		}
+	}
+	status := route.status().Status
+	if status[0].Healthy || status[0].LastError == "" || status[0].LastCheck == nil {
+		t.Errorf("Expected unhealthy status with error, got %+v", status[0])
+	}
+
+	failing.Store(false)
+	if !waitFor(time.Second, func() bool { return flakyUpstream.healthy.Load() }) {
+		t.Error("Expected recovered upstream to be back in rotation")
+	}
+}
+
+func TestHealthCheckInvalid(t *testing.T) {
+	for _, health := range []HealthCheck{
+		{StatusMin: 500, StatusMax: 200},
+		// the default upper bound is below the lower one
+		{StatusMin: 500},
+	} {
+		health := health
+		patch := ForwardPatch{
+			Path:   "health",
+			Dest:   "http://localhost:1",
+			Health: &health,
+		}
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected status range %d-%d to be rejected", health.StatusMin, health.StatusMax)
+		}
+	}
+	if err := (HealthCheck{StatusMax: 204}).validate(); err != nil {
+		t.Errorf("Expected the default lower bound to fit, got %v", err)
+	}
+}
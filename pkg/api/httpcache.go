@@ -0,0 +1,414 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
+)
+
+const (
+	DEFAULT_CACHE_TTL      = time.Minute
+	DEFAULT_CACHE_MAX_SIZE = 1024 * 1024
+
+	CACHE_HIT         = "HIT"
+	CACHE_MISS        = "MISS"
+	CACHE_REVALIDATED = "REVALIDATED"
+
+	cachePrefix = "httpcache"
+)
+
+var (
+	ErrInvalidCache = errors.New("cache ttl and max size must not be negative")
+)
+
+// CacheConfig caches GET responses of a patch, responses without freshness
+// information are kept for the ttl and bodies larger than max size are not cached
+type CacheConfig struct {
+	TTL     Duration `json:"ttl,omitempty"`
+	MaxSize int      `json:"max_size,omitempty"`
+}
+
+func (c *CacheConfig) validate() error {
+	if c.TTL < 0 || c.MaxSize < 0 {
+		return ErrInvalidCache
+	}
+	return nil
+}
+
+func (c *CacheConfig) withDefaults() CacheConfig {
+	config := *c
+	if config.TTL == 0 {
+		config.TTL = Duration(DEFAULT_CACHE_TTL)
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = DEFAULT_CACHE_MAX_SIZE
+	}
+	return config
+}
+
+// cacheEntry is a stored response, vary holds the request headers it was stored for
+type cacheEntry struct {
+	Status  int               `json:"status"`
+	Header  http.Header       `json:"header"`
+	Body    []byte            `json:"body"`
+	Vary    map[string]string `json:"vary,omitempty"`
+	Stored  time.Time         `json:"stored"`
+	Expires time.Time         `json:"expires"`
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+func (e *cacheEntry) matchesVary(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// notModified evaluates the conditional headers of the request against the entry
+func (e *cacheEntry) notModified(req *http.Request) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, e.Header.Get("ETag"))
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// etagMatches is the weak comparison of If-None-Match
+func etagMatches(match, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl parses the directives of a Cache-Control header, names are lower case
+func cacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheKey is the key of a response, it is made of the patch and the sub path
+// with the query so entries can be purged by patch and path prefix
+func cacheKey(patch, subPath, rawQuery string) string {
+	key := fmt.Sprintf("%s:%s:%s", cachePrefix, patch, joinPath("", subPath))
+	if rawQuery != "" {
+		key += "?" + rawQuery
+	}
+	return key
+}
+
+// cacheCallKey stores the cacheCall of a forwarded request for the proxy hooks
+type cacheCallKey struct{}
+
+// cacheCall stores the response of a forwarded GET request that missed the cache
+type cacheCall struct {
+	key    string
+	config CacheConfig
+	store  cache.ObjectCache
+	logger *log.Logger
+	// headers of the request before the cache added its conditionals
+	request http.Header
+	// stale entry sent for revalidation
+	stale *cacheEntry
+	// conditionals were added by the cache, a 304 is answered from the stale entry
+	revalidating bool
+}
+
+// lookupCache serves the request from the cache of the route, true is
+// returned if the response was written. A returned call has to be passed
+// to the proxy to store the response. Requests sent to the alternate
+// upstreams of a split have their own entries
+func (pc *PatchControl) lookupCache(c *gin.Context, route *patchRoute, subPath string, alternate bool) (*cacheCall, bool) {
+	req := c.Request
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, false
+	}
+	directives := cacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil, false
+	}
+	call := &cacheCall{
+		key:     cacheKey(route.patch.Path, subPath, req.URL.RawQuery),
+		config:  route.patch.Cache.withDefaults(),
+		store:   pc.objects,
+		logger:  pc.logger,
+		request: req.Header.Clone(),
+	}
+	if alternate {
+		call.key += splitCacheSuffix
+	}
+	raw, err := pc.objects.Load(c, call.key)
+	if err != nil {
+		if !errors.Is(err, cache.ErrCacheMiss) {
+			pc.logger.Println("error loading cached response:", err)
+		}
+		return call, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		pc.logger.Println("error loading cached response:", err)
+		return call, false
+	}
+	if !entry.matchesVary(req) {
+		return call, false
+	}
+	now := time.Now()
+	_, noCache := directives["no-cache"]
+	maxAge, limited := directiveSeconds(directives, "max-age")
+	if entry.fresh(now) && !noCache && (!limited || now.Sub(entry.Stored) <= maxAge) {
+		serveCached(c, &entry, now)
+		return nil, true
+	}
+	if entry.hasValidators() {
+		call.stale = &entry
+		if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+			call.revalidating = true
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified := entry.Header.Get("Last-Modified"); modified != "" {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+		}
+	}
+	return call, false
+}
+
+func serveCached(c *gin.Context, entry *cacheEntry, now time.Time) {
+	header := c.Writer.Header()
+	for name, values := range entry.Header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(entry.Stored).Seconds())))
+	header.Set("X-Cache", CACHE_HIT)
+	if entry.notModified(c.Request) {
+		header.Del("Content-Length")
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	c.Status(entry.Status)
+	if c.Request.Method == http.MethodHead {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(entry.Body)
+}
+
+// respond runs on the upstream response, a 304 to a revalidation refreshes the
+// stale entry, cacheable responses are stored once their body was read
+func (call *cacheCall) respond(resp *http.Response) {
+	now := time.Now()
+	if resp.StatusCode == http.StatusNotModified && call.stale != nil {
+		entry := call.stale
+		for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+			if value := resp.Header.Get(name); value != "" {
+				entry.Header.Set(name, value)
+			}
+		}
+		if ttl, keep, ok := call.lifetime(resp.Request, entry.Header, now); ok {
+			entry.Stored, entry.Expires = now, now.Add(ttl)
+			call.save(resp.Request.Context(), entry, keep)
+		}
+		if !call.revalidating {
+			return
+		}
+		resp.StatusCode = entry.Status
+		resp.Status = fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status))
+		resp.Header = entry.Header.Clone()
+		resp.Header.Set("X-Cache", CACHE_REVALIDATED)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+		resp.ContentLength = int64(len(entry.Body))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+		return
+	}
+	resp.Header.Set("X-Cache", CACHE_MISS)
+	if resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		resp.ContentLength > int64(call.config.MaxSize) {
+		return
+	}
+	ttl, keep, ok := call.lifetime(resp.Request, resp.Header, now)
+	if !ok {
+		return
+	}
+	entry := &cacheEntry{
+		Status:  resp.StatusCode,
+		Header:  resp.Header.Clone(),
+		Vary:    make(map[string]string),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	}
+	entry.Header.Del("X-Cache")
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				entry.Vary[name] = call.request.Get(name)
+			}
+		}
+	}
+	resp.Body = &cacheBody{ReadCloser: resp.Body, call: call, entry: entry, keep: keep, ctx: resp.Request.Context()}
+}
+
+// lifetime returns how long a response stays fresh and how long it is kept
+// for revalidation, false is returned if the response must not be stored
+func (call *cacheCall) lifetime(req *http.Request, header http.Header, now time.Time) (time.Duration, time.Duration, bool) {
+	directives := cacheControl(header.Get("Cache-Control"))
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0, 0, false
+		}
+	}
+	if header.Get("Set-Cookie") != "" {
+		return 0, 0, false
+	}
+	_, public := directives["public"]
+	sharedMaxAge, shared := directiveSeconds(directives, "s-maxage")
+	if req.Header.Get("Authorization") != "" && !public && !shared {
+		return 0, 0, false
+	}
+	ttl := time.Duration(call.config.TTL)
+	if maxAge, ok := directiveSeconds(directives, "max-age"); shared {
+		ttl = sharedMaxAge
+	} else if ok {
+		ttl = maxAge
+	} else if expires := header.Get("Expires"); expires != "" {
+		ttl = 0
+		if at, err := http.ParseTime(expires); err == nil && at.After(now) {
+			ttl = at.Sub(now)
+		}
+	}
+	if _, ok := directives["no-cache"]; ok {
+		ttl = 0
+	}
+	keep := ttl
+	if header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+		keep += time.Duration(call.config.TTL)
+	}
+	return ttl, keep, keep > 0
+}
+
+// cacheBody collects the body passed to the client and stores the entry once it was read completely
+type cacheBody struct {
+	io.ReadCloser
+	call  *cacheCall
+	entry *cacheEntry
+	keep  time.Duration
+	ctx   context.Context
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+	if b.buf.Len()+n > b.call.config.MaxSize {
+		b.done = true
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		b.done = true
+		b.entry.Body = b.buf.Bytes()
+		b.call.save(b.ctx, b.entry, b.keep)
+	}
+	return n, err
+}
+
+func (call *cacheCall) save(ctx context.Context, entry *cacheEntry, keep time.Duration) {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		call.logger.Println("error storing response:", err)
+		return
+	}
+	if err := call.store.Store(ctx, call.key, raw, keep); err != nil {
+		call.logger.Println("error storing response:", err)
+	}
+}
+
+// /api/v1/auth/cache routes
+func (pc *PatchControl) addCacheRoutes(cacheGroup *gin.RouterGroup) {
+	cacheGroup.DELETE("", pc.purgeCache)
+}
+
+// purgeCache deletes the cached responses of a patch, limited to the sub paths
+// starting with prefix if set, all cached responses are deleted without a patch
+func (pc *PatchControl) purgeCache(c *gin.Context) {
+	patch := sanitizePath(c.Query("patch"))
+	prefix := c.Query("prefix")
+	key := cachePrefix + ":"
+	if patch != "" {
+		key = fmt.Sprintf("%s%s:", key, patch)
+		if prefix != "" {
+			key += "/" + strings.TrimPrefix(prefix, "/")
+		}
+	} else if prefix != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix needs a patch"})
+		return
+	}
+	purged, err := pc.objects.Purge(c, key)
+	if err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to purge cache"})
+		return
+	}
+	pc.logger.Printf("Purged %d cached responses of %s\n", purged, key)
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResponseCache(t *testing.T) {
+	ctx := context.Background()
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/data":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("data"))
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("private"))
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 64)))
+		}
+	}))
+	defer upstream.Close()
+
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	patches.addCacheRoutes(router.Group("/cache"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path:  "cached",
+		Dest:  upstream.URL,
+		Cache: &CacheConfig{TTL: Duration(200 * time.Millisecond), MaxSize: 32},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	get := func(path string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/forward/cached"+path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	expect := func(name, path string, header map[string]string, status int, cached string, wantHits int64) {
+		t.Helper()
+		hits.Store(0)
+		resp, _ := get(path, header)
+		if resp.StatusCode != status || resp.Header.Get("X-Cache") != cached || hits.Load() != wantHits {
+			t.Errorf("%s: expected %d %s with %d upstream hits, got %d %s with %d",
+				name, status, cached, wantHits, resp.StatusCode, resp.Header.Get("X-Cache"), hits.Load())
+		}
+	}
+
+	expect("miss", "/data", nil, http.StatusOK, CACHE_MISS, 1)
+	resp, body := get("/data", nil)
+	if resp.Header.Get("X-Cache") != CACHE_HIT || body != "data" || resp.Header.Get("Age") == "" {
+		t.Errorf("Expected a cache hit with age, got %s %q", resp.Header.Get("X-Cache"), body)
+	}
+	expect("conditional", "/data", map[string]string{"If-None-Match": `W/"v1"`}, http.StatusNotModified, CACHE_HIT, 0)
+	expect("request no-cache", "/data", map[string]string{"Cache-Control": "no-cache"}, http.StatusOK, CACHE_REVALIDATED, 1)
+	time.Sleep(250 * time.Millisecond)
+	hits.Store(0)
+	resp, body = get("/data", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != CACHE_REVALIDATED || body != "data" || hits.Load() != 1 {
+		t.Errorf("Expected the stale entry to be revalidated, got %d %s %q", resp.StatusCode, resp.Header.Get("X-Cache"), body)
+	}
+	expect("refreshed", "/data", nil, http.StatusOK, CACHE_HIT, 0)
+
+	expect("no-store", "/private", nil, http.StatusOK, CACHE_MISS, 1)
+	expect("no-store again", "/private", nil, http.StatusOK, CACHE_MISS, 1)
+	expect("too large", "/large", nil, http.StatusOK, CACHE_MISS, 1)
+	expect("too large again", "/large", nil, http.StatusOK, CACHE_MISS, 1)
+
+	english := map[string]string{"Accept-Language": "en"}
+	expect("vary", "/vary", english, http.StatusOK, CACHE_MISS, 1)
+	expect("vary hit", "/vary", english, http.StatusOK, CACHE_HIT, 0)
+	if _, body := get("/vary", map[string]string{"Accept-Language": "de"}); body != "de" {
+		t.Errorf("Expected the variant to be fetched, got %q", body)
+	}
+
+	for _, purge := range []struct {
+		query string
+		want  int
+	}{
+		{"?patch=cached&prefix=/data", 1},
+		{"?patch=cached&prefix=/data", 0},
+		{"?patch=cached", 1},
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/cache"+purge.query, nil))
+		var result struct {
+			Purged int `json:"purged"`
+		}
+		json.Unmarshal(resp.Body.Bytes(), &result)
+		if resp.Code != http.StatusOK || result.Purged != purge.want {
+			t.Errorf("%s: expected %d purged, got %d %s", purge.query, purge.want, resp.Code, resp.Body.String())
+		}
+	}
+	expect("purged", "/data", nil, http.StatusOK, CACHE_MISS, 1)
+
+	rejected := httptest.NewRecorder()
+	router.ServeHTTP(rejected, httptest.NewRequest(http.MethodDelete, "/cache?prefix=/data", nil))
+	if rejected.Code != http.StatusBadRequest {
+		t.Errorf("Expected a prefix without patch to be rejected, got %d", rejected.Code)
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	call := &cacheCall{config: (&CacheConfig{}).withDefaults()}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	now := time.Now()
+	for name, tc := range map[string]struct {
+		header map[string]string
+		ttl    time.Duration
+		ok     bool
+	}{
+		"default":    {nil, DEFAULT_CACHE_TTL, true},
+		"max-age":    {map[string]string{"Cache-Control": "public, max-age=30"}, 30 * time.Second, true},
+		"s-maxage":   {map[string]string{"Cache-Control": "max-age=30, s-maxage=60"}, time.Minute, true},
+		"expires":    {map[string]string{"Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat)}, time.Hour, true},
+		"private":    {map[string]string{"Cache-Control": "private"}, 0, false},
+		"cookie":     {map[string]string{"Set-Cookie": "a=b"}, 0, false},
+		"no-cache":   {map[string]string{"Cache-Control": "no-cache"}, 0, false},
+		"revalidate": {map[string]string{"Cache-Control": "no-cache", "ETag": `"x"`}, 0, true},
+	} {
+		header := http.Header{}
+		for key, value := range tc.header {
+			header.Set(key, value)
+		}
+		ttl, _, ok := call.lifetime(req, header, now)
+		if ok != tc.ok || (ok && (ttl < tc.ttl-time.Second || ttl > tc.ttl)) {
+			t.Errorf("%s: expected %s %v, got %s %v", name, tc.ttl, tc.ok, ttl, ok)
+		}
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	if _, _, ok := call.lifetime(req, http.Header{}, now); ok {
+		t.Error("Expected authorized responses not to be shared")
+	}
+}
@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JWT_HS256 = "HS256"
+	JWT_EDDSA = "EdDSA"
+
+	DEFAULT_JWT_ISSUER      = "patch"
+	DEFAULT_JWT_AUDIENCE    = "patch-api"
+	DEFAULT_JWT_ACCESS_TTL  = 15 * time.Minute
+	DEFAULT_JWT_REFRESH_TTL = 7 * 24 * time.Hour
+
+	jwt_access  = "access"
+	jwt_refresh = "refresh"
+	// tolerated clock skew between issuer and validator
+	jwt_leeway = 30 * time.Second
+	// hmac secrets shorter than the hash are rejected
+	jwt_min_secret = 32
+)
+
+var (
+	ErrJWTConfig  = errors.New("invalid jwt config")
+	ErrInvalidJWT = errors.New("invalid jwt")
+)
+
+// JWTKey signs and validates tokens, the id is sent as kid in the token
+// header so keys can be rotated while tokens signed by older keys stay valid
+type JWTKey struct {
+	ID        string
+	Algorithm string
+	Secret    []byte
+	Private   ed25519.PrivateKey
+}
+
+// ParseJWTKey reads a key in the form kid:alg:base64, the value is the
+// hmac secret for HS256 and the seed or private key for EdDSA
+func ParseJWTKey(raw string) (*JWTKey, error) {
+	parts := strings.SplitN(strings.TrimSpace(raw), ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: key must be kid:alg:base64", ErrJWTConfig)
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s is not base64", ErrJWTConfig, parts[0])
+	}
+	key := &JWTKey{ID: parts[0], Algorithm: parts[1]}
+	switch parts[1] {
+	case JWT_HS256:
+		if len(value) < jwt_min_secret {
+			return nil, fmt.Errorf("%w: secret of key %s needs at least %d bytes", ErrJWTConfig, key.ID, jwt_min_secret)
+		}
+		key.Secret = value
+	case JWT_EDDSA:
+		switch len(value) {
+		case ed25519.SeedSize:
+			key.Private = ed25519.NewKeyFromSeed(value)
+		case ed25519.PrivateKeySize:
+			key.Private = ed25519.PrivateKey(value)
+		default:
+			return nil, fmt.Errorf("%w: key %s is no ed25519 seed or private key", ErrJWTConfig, key.ID)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrJWTConfig, parts[1])
+	}
+	return key, nil
+}
+
+func (k *JWTKey) sign(data []byte) []byte {
+	if k.Algorithm == JWT_EDDSA {
+		return ed25519.Sign(k.Private, data)
+	}
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k *JWTKey) verify(data []byte, signature []byte) bool {
+	if k.Algorithm == JWT_EDDSA {
+		return ed25519.Verify(k.Private.Public().(ed25519.PublicKey), data, signature)
+	}
+	return hmac.Equal(k.sign(data), signature)
+}
+
+// JWTConfig enables signed access tokens, tokens are signed with the signing
+// key and validated with any of the keys
+type JWTConfig struct {
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	SigningKey string
+	Keys       []*JWTKey
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtAudience is a single audience or a list of them
+type jwtAudience []string
+
+func (a jwtAudience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+type jwtClaims struct {
+	Issuer      string      `json:"iss,omitempty"`
+	Subject     string      `json:"sub"`
+	Audience    jwtAudience `json:"aud,omitempty"`
+	IssuedAt    int64       `json:"iat"`
+	NotBefore   int64       `json:"nbf"`
+	ExpiresAt   int64       `json:"exp"`
+	ID          string      `json:"jti"`
+	Use         string      `json:"use"`
+	Roles       []string    `json:"roles,omitempty"`
+	Permissions []string    `json:"permissions,omitempty"`
+}
+
+// jwtControl issues and validates tokens, used refresh tokens are remembered
+// until they expire so each can be exchanged once. Tokens of a user issued
+// before its revocation, as unix seconds, are rejected
+type jwtControl struct {
+	sync.Mutex
+	config    JWTConfig
+	keys      map[string]*JWTKey
+	signing   *JWTKey
+	refreshed map[string]time.Time
+	revoked   map[string]int64
+}
+
+func newJWTControl(config JWTConfig) (*jwtControl, error) {
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrJWTConfig)
+	}
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = DEFAULT_JWT_ACCESS_TTL
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = DEFAULT_JWT_REFRESH_TTL
+	}
+	j := &jwtControl{config: config, keys: make(map[string]*JWTKey), refreshed: make(map[string]time.Time), revoked: make(map[string]int64)}
+	for _, key := range config.Keys {
+		if _, ok := j.keys[key.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicate key id %s", ErrJWTConfig, key.ID)
+		}
+		j.keys[key.ID] = key
+	}
+	if config.SigningKey == "" {
+		j.signing = config.Keys[0]
+	} else if j.signing = j.keys[config.SigningKey]; j.signing == nil {
+		return nil, fmt.Errorf("%w: unknown signing key %s", ErrJWTConfig, config.SigningKey)
+	}
+	return j, nil
+}
+
+// issue signs a token of the use for the user, valid for ttl from now
+func (j *jwtControl) issue(use string, user string, roles []string, permissions []string, now time.Time) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	ttl := j.config.AccessTTL
+	if use == jwt_refresh {
+		ttl = j.config.RefreshTTL
+	}
+	// tokens issued in the second of a revocation are dated after it
+	issuedAt := now.Unix()
+	j.Lock()
+	if cutoff := j.revoked[user]; issuedAt < cutoff {
+		issuedAt = cutoff
+	}
+	j.Unlock()
+	claims := jwtClaims{
+		Issuer:    j.config.Issuer,
+		Subject:   user,
+		IssuedAt:  issuedAt,
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        hex.EncodeToString(id),
+		Use:       use,
+	}
+	if j.config.Audience != "" {
+		claims.Audience = jwtAudience{j.config.Audience}
+	}
+	if use == jwt_access {
+		claims.Roles, claims.Permissions = roles, permissions
+	}
+	header, err := json.Marshal(jwtHeader{Algorithm: j.signing.Algorithm, Type: "JWT", KeyID: j.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(j.signing.sign([]byte(unsigned))), nil
+}
+
+// parse validates signature, expiry, issuer, audience and use of the token.
+// The algorithm of the header has to match the key it names
+func (j *jwtControl) parse(raw string, use string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidJWT)
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, ok := j.keys[header.KeyID]
+	if !ok || key.Algorithm != header.Algorithm {
+		return nil, fmt.Errorf("%w: unknown key %s", ErrInvalidJWT, header.KeyID)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidJWT)
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Use != use:
+		return nil, fmt.Errorf("%w: not a %s token", ErrInvalidJWT, use)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidJWT)
+	case !now.Before(time.Unix(claims.ExpiresAt, 0).Add(jwt_leeway)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidJWT)
+	case now.Add(jwt_leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidJWT)
+	case j.config.Issuer != "" && claims.Issuer != j.config.Issuer:
+		return nil, fmt.Errorf("%w: issuer %s", ErrInvalidJWT, claims.Issuer)
+	case j.config.Audience != "" && !claims.Audience.contains(j.config.Audience):
+		return nil, fmt.Errorf("%w: audience %v", ErrInvalidJWT, claims.Audience)
+	}
+	j.Lock()
+	defer j.Unlock()
+	if claims.IssuedAt < j.revoked[claims.Subject] {
+		return nil, fmt.Errorf("%w: revoked", ErrInvalidJWT)
+	}
+	return &claims, nil
+}
+
+// revoke rejects every token of the user issued until now, revocations are
+// dropped once the tokens they cover have expired
+func (j *jwtControl) revoke(user string, now time.Time) {
+	j.Lock()
+	defer j.Unlock()
+	ttl := j.config.RefreshTTL
+	if j.config.AccessTTL > ttl {
+		ttl = j.config.AccessTTL
+	}
+	for name, cutoff := range j.revoked {
+		if now.After(time.Unix(cutoff, 0).Add(ttl + jwt_leeway)) {
+			delete(j.revoked, name)
+		}
+	}
+	j.revoked[user] = now.Unix() + 1
+}
+
+// redeem marks the refresh token as used, it fails if it was used before
+func (j *jwtControl) redeem(claims *jwtClaims, now time.Time) error {
+	j.Lock()
+	defer j.Unlock()
+	for id, expires := range j.refreshed {
+		if now.After(expires) {
+			delete(j.refreshed, id)
+		}
+	}
+	if _, ok := j.refreshed[claims.ID]; ok {
+		return fmt.Errorf("%w: refresh token already used", ErrInvalidJWT)
+	}
+	j.refreshed[claims.ID] = time.Unix(claims.ExpiresAt, 0).Add(jwt_leeway)
+	return nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidJWT)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidJWT)
+	}
+	return nil
+}
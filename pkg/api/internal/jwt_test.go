@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWT(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", 32)))
+	seed := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+	hmacKey, err := ParseJWTKey("old:HS256:" + secret)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	edKey, err := ParseJWTKey("new:EdDSA:" + seed)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, raw := range []string{"k:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), "k:RS256:" + secret, "k:EdDSA:c2hvcnQ=", "nokey", ":HS256:" + secret} {
+		if _, err := ParseJWTKey(raw); !errors.Is(err, ErrJWTConfig) {
+			t.Errorf("Expected %s to be rejected, got %v", raw, err)
+		}
+	}
+
+	now := time.Now()
+	config := JWTConfig{Issuer: "patch", Audience: "patch-api", Keys: []*JWTKey{hmacKey, edKey}}
+	before, _ := newJWTControl(config)
+	config.SigningKey = "new"
+	rotated, err := newJWTControl(config)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, err := newJWTControl(JWTConfig{Keys: []*JWTKey{hmacKey}, SigningKey: "missing"}); err == nil {
+		t.Error("Expected an unknown signing key to be rejected")
+	}
+
+	old, _ := before.issue(jwt_access, "alice", []string{"admin"}, []string{"patch:admin"}, now)
+	current, _ := rotated.issue(jwt_access, "alice", nil, nil, now)
+	for name, token := range map[string]string{"old key": old, "new key": current} {
+		claims, err := rotated.parse(token, jwt_access, now)
+		if err != nil || claims.Subject != "alice" {
+			t.Errorf("%s: expected the token to be valid, got %v", name, err)
+		}
+	}
+	if claims, _ := rotated.parse(old, jwt_access, now); len(claims.Permissions) != 1 {
+		t.Errorf("Expected the permissions in the token, got %+v", claims)
+	}
+
+	parts := strings.Split(current, ".")
+	// an EdDSA token relabeled as HS256 must not validate with the hmac key of the same kid
+	confused := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"new"}`)) + "." + parts[1] + "." + parts[2]
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"root","use":"access"}`)) + "." + parts[2]
+	refresh, _ := rotated.issue(jwt_refresh, "alice", nil, nil, now)
+	other, _ := newJWTControl(JWTConfig{Issuer: "other", Audience: "patch-api", Keys: []*JWTKey{edKey}})
+	foreign, _ := other.issue(jwt_access, "alice", nil, nil, now)
+	otherAudience, _ := newJWTControl(JWTConfig{Issuer: "patch", Audience: "elsewhere", Keys: []*JWTKey{edKey}})
+	misdirected, _ := otherAudience.issue(jwt_access, "alice", nil, nil, now)
+	for name, tc := range map[string]struct {
+		token string
+		at    time.Time
+	}{
+		"expired":    {current, now.Add(DEFAULT_JWT_ACCESS_TTL + time.Minute)},
+		"not yet":    {current, now.Add(-time.Minute)},
+		"confused":   {confused, now},
+		"tampered":   {tampered, now},
+		"refresh":    {refresh, now},
+		"issuer":     {foreign, now},
+		"audience":   {misdirected, now},
+		"malformed":  {"a.b", now},
+		"no key":     {strings.Replace(current, parts[0], base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"gone"}`)), 1), now},
+		"empty sign": {parts[0] + "." + parts[1] + ".", now},
+	} {
+		if _, err := rotated.parse(tc.token, jwt_access, tc.at); !errors.Is(err, ErrInvalidJWT) {
+			t.Errorf("%s: expected the token to be rejected, got %v", name, err)
+		}
+	}
+
+	claims, err := rotated.parse(refresh, jwt_refresh, now)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := rotated.redeem(claims, now); err != nil {
+		t.Errorf("Expected the refresh token to be redeemed, got %v", err)
+	}
+	if err := rotated.redeem(claims, now); err == nil {
+		t.Error("Expected the refresh token to be redeemed only once")
+	}
+
+	// tokens issued before a revocation are rejected, the ones issued in the same second after it are not
+	unused, _ := rotated.issue(jwt_refresh, "alice", nil, nil, now)
+	rotated.revoke("alice", now)
+	for name, token := range map[string]string{"access": current, "refresh": unused} {
+		use := jwt_access
+		if name == "refresh" {
+			use = jwt_refresh
+		}
+		if _, err := rotated.parse(token, use, now); !errors.Is(err, ErrInvalidJWT) {
+			t.Errorf("%s: expected the revoked token to be rejected, got %v", name, err)
+		}
+	}
+	renewed, _ := rotated.issue(jwt_access, "alice", nil, nil, now)
+	if _, err := rotated.parse(renewed, jwt_access, now); err != nil {
+		t.Errorf("Expected a token issued after the revocation to be valid, got %v", err)
+	}
+	if _, err := rotated.parse(old, jwt_access, now); !errors.Is(err, ErrInvalidJWT) {
+		t.Errorf("Expected the revocation to cover every key, got %v", err)
+	}
+}
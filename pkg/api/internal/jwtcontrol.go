@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	TOKEN_URL_PATH         = "/api/v1/auth/token"
+	TOKEN_REFRESH_URL_PATH = "/api/v1/auth/token/refresh"
+)
+
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// bearerToken is the token of the bearer authorization header of the request
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// publicPath reports if the auth route is reachable without being authenticated
+func publicPath(path string) bool {
+	switch path {
+	case LOGIN_URL_PATH, TOKEN_URL_PATH, TOKEN_REFRESH_URL_PATH, VERIFY_EMAIL_URL_PATH, FORGOT_PASSWORD_URL_PATH, RESET_PASSWORD_URL_PATH:
+		return true
+	}
+	return false
+}
+
+// jwtRoutePass authenticates the request by the access token of the bearer
+// header, it sets the same context keys as a session
+func (s *SessionControl) jwtRoutePass(c *gin.Context, raw string) {
+	claims, err := s.jwt.parse(raw, jwt_access, time.Now())
+	if err == nil {
+		// tokens of deleted users are not accepted until they expire
+		_, err = s.db.GetByName(c, claims.Subject)
+	}
+	if err != nil {
+		s.logger.Println("Rejected access token for " + c.Request.URL.Path + " from " + c.ClientIP() + ": " + err.Error())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+		return
+	}
+	c.Set("id", claims.ID)
+	c.Set("username", claims.Subject)
+	c.Set(roles_key, claims.Roles)
+	c.Set(permissions_key, claims.Permissions)
+	c.Next()
+}
+
+// issueTokens responds with a new access and refresh token for the user,
+// the roles of the user are loaded into the access token
+func (s *SessionControl) issueTokens(c *gin.Context, user string) {
+	roles, err := s.roles.GetUserRoles(c, user)
+	if err != nil {
+		s.logger.Println(err)
+		roles = []*system.Role{}
+	}
+	now := time.Now()
+	access, err := s.jwt.issue(jwt_access, user, system.RoleNames(roles), system.RolePermissions(roles), now)
+	if err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to issue token"})
+		return
+	}
+	refresh, err := s.jwt.issue(jwt_refresh, user, nil, nil, now)
+	if err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to issue token"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"access_token":       access,
+		"token_type":         "Bearer",
+		"expires_in":         int(s.jwt.config.AccessTTL.Seconds()),
+		"refresh_token":      refresh,
+		"refresh_expires_in": int(s.jwt.config.RefreshTTL.Seconds()),
+	})
+}
+
+func (s *SessionControl) issueToken(c *gin.Context) {
+	var raw system.RawUser
+	if err := c.ShouldBindJSON(&raw); err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": ErrConnect})
+		return
+	}
+	if s.rejectLocked(c, raw.Username) {
+		return
+	}
+	user, err := s.db.Authenticate(c, raw.Username, raw.Password)
+	if err != nil {
+		s.logger.Println(err)
+		s.loginFailed(c, raw.Username)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrConnect})
+		return
+	}
+	// there is no partial session, the code is sent along with the password
+	if ok := s.checkTwoFactorLogin(c, user.Name, raw.Code); !ok {
+		return
+	}
+	s.loginSucceeded(c, user.Name)
+	s.issueTokens(c, user.Name)
+}
+
+// refreshToken exchanges a refresh token for a new pair, each refresh token is accepted once
+func (s *SessionControl) refreshToken(c *gin.Context) {
+	var payload refreshPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.RefreshToken == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "refresh token required"})
+		return
+	}
+	now := time.Now()
+	claims, err := s.jwt.parse(payload.RefreshToken, jwt_refresh, now)
+	if err == nil {
+		_, err = s.db.GetByName(c, claims.Subject)
+	}
+	if err == nil {
+		err = s.jwt.redeem(claims, now)
+	}
+	if err != nil {
+		s.logger.Println("Rejected refresh token from " + c.ClientIP() + ": " + err.Error())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+		return
+	}
+	s.issueTokens(c, claims.Subject)
+}
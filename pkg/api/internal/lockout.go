@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LockoutConfig limits failed logins per user and per client ip. Each failure
+// is answered after a delay doubling with every failure up to MaxDelay, once a
+// threshold is reached within Window the user or ip is locked for Duration
+type LockoutConfig struct {
+	UserAttempts int
+	IPAttempts   int
+	Window       time.Duration
+	Duration     time.Duration
+	Delay        time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultLockoutConfig is used if no lockout config is passed to AddRoutes
+func DefaultLockoutConfig() *LockoutConfig {
+	return &LockoutConfig{
+		UserAttempts: 5,
+		IPAttempts:   20,
+		Window:       15 * time.Minute,
+		Duration:     15 * time.Minute,
+		Delay:        250 * time.Millisecond,
+		MaxDelay:     4 * time.Second,
+	}
+}
+
+func userAttemptsKey(username string) string {
+	return "user:" + username
+}
+
+func ipAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+// delay is the time a failure is answered after, count is the number of failures so far
+func (l *LockoutConfig) delay(count int) time.Duration {
+	delay := l.Delay
+	for i := 1; i < count && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		return l.MaxDelay
+	}
+	return delay
+}
+
+// rejectLocked responds if the user or the client ip is locked out, the
+// password is not checked then. Counter errors do not lock anyone out
+func (s *SessionControl) rejectLocked(c *gin.Context, username string) bool {
+	var locked time.Duration
+	for _, key := range []string{userAttemptsKey(username), ipAttemptsKey(c.ClientIP())} {
+		left, err := s.attempts.LockedFor(c, key)
+		if err != nil {
+			s.logger.Println(err)
+			continue
+		}
+		if left > locked {
+			locked = left
+		}
+	}
+	if locked <= 0 {
+		return false
+	}
+	s.logger.Println("Rejected login of " + username + " from " + c.ClientIP() + " while locked out")
+	c.Header("Retry-After", strconv.Itoa(int(locked.Seconds())+1))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, try again later"})
+	return true
+}
+
+// loginFailed counts a failed password or code of the user, locks the user or
+// ip out from their threshold on and waits the progressive delay before returning.
+// Failures after an expired lock within the window lock again right away
+func (s *SessionControl) loginFailed(c *gin.Context, username string) {
+	ip := c.ClientIP()
+	userCount, err := s.attempts.Fail(c, userAttemptsKey(username), s.lockout.Window)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	ipCount, err := s.attempts.Fail(c, ipAttemptsKey(ip), s.lockout.Window)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	if s.lockout.UserAttempts > 0 && userCount >= s.lockout.UserAttempts {
+		s.lock(c, userAttemptsKey(username), "user "+username+" after "+strconv.Itoa(userCount)+" failed logins, last from "+ip)
+	}
+	if s.lockout.IPAttempts > 0 && ipCount >= s.lockout.IPAttempts {
+		s.lock(c, ipAttemptsKey(ip), "ip "+ip+" after "+strconv.Itoa(ipCount)+" failed logins, last for "+username)
+	}
+	count := userCount
+	if ipCount > count {
+		count = ipCount
+	}
+	timer := time.NewTimer(s.lockout.delay(count))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	}
+}
+
+func (s *SessionControl) lock(ctx context.Context, key string, reason string) {
+	if err := s.attempts.Lock(ctx, key, s.lockout.Duration); err != nil {
+		s.logger.Println(err)
+		return
+	}
+	s.security.Println("Locked out " + reason + " for " + s.lockout.Duration.String())
+}
+
+// loginSucceeded resets the failures of the user, the ones of the ip are kept
+func (s *SessionControl) loginSucceeded(c *gin.Context, username string) {
+	if err := s.attempts.Clear(c, userAttemptsKey(username)); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+func (s *SessionControl) getLockout(c *gin.Context) {
+	key := userAttemptsKey(c.Param("name"))
+	left, err := s.attempts.LockedFor(c, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load lockout"})
+		return
+	}
+	count, err := s.attempts.Attempts(c, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load lockout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"locked":          left > 0,
+		"retry_after":     int(left.Seconds()),
+		"failed_attempts": count,
+	})
+}
+
+// unlockUser lifts the lockout of the user and resets its failures
+func (s *SessionControl) unlockUser(c *gin.Context) {
+	name := c.Param("name")
+	if err := s.attempts.Clear(c, userAttemptsKey(name)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock user"})
+		return
+	}
+	s.security.Println("Unlocked user " + name + " by " + c.GetString("username") + " from " + c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "user unlocked"})
+}
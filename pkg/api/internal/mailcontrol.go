@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/mail"
+)
+
+const (
+	VERIFY_EMAIL_URL_PATH    = "/api/v1/auth/email/verify"
+	FORGOT_PASSWORD_URL_PATH = "/api/v1/auth/password/forgot"
+	RESET_PASSWORD_URL_PATH  = "/api/v1/auth/password/reset"
+)
+
+var (
+	ErrNoMailer = errors.New("mail is not configured")
+)
+
+type mailTokenPayload struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type forgotPasswordPayload struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// sendAuthToken replaces the token the user has for purpose and mails the new one
+func (s *SessionControl) sendAuthToken(ctx context.Context, user *system.User, purpose string) error {
+	if s.mailer == nil {
+		return ErrNoMailer
+	}
+	ttl, subject, text, path := system.VERIFY_EMAIL_TTL, "Verify your email address", "verify your email address", VERIFY_EMAIL_URL_PATH
+	if purpose == system.AUTH_TOKEN_RESET_PASSWORD {
+		ttl, subject, text, path = system.RESET_PASSWORD_TTL, "Reset your password", "set a new password", RESET_PASSWORD_URL_PATH
+	}
+	token, raw, err := system.NewAuthToken(user.Name, user.Email, purpose, ttl)
+	if err != nil {
+		return err
+	}
+	if err := s.authTokens.SaveAuthToken(ctx, token); err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, &mail.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body: fmt.Sprintf("Hello %s,\n\nuse this token with %s to %s:\n\n%s\n\nIt expires in %s. If you did not ask for it, ignore this mail.\n",
+			user.Name, path, text, raw, ttl),
+	})
+}
+
+// resendVerification mails a new verification token to the address of the user
+func (s *SessionControl) resendVerification(c *gin.Context) {
+	user, err := s.db.GetByName(c, c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Error finding User"})
+		return
+	}
+	if user.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no email address set"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "email address already verified"})
+		return
+	}
+	if err := s.sendAuthToken(c, user, system.AUTH_TOKEN_VERIFY_EMAIL); err != nil {
+		s.respondMailError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "verification mail sent"})
+}
+
+// verifyEmail marks the address as verified, the token has to be for the current address
+func (s *SessionControl) verifyEmail(c *gin.Context) {
+	var payload mailTokenPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token required"})
+		return
+	}
+	token, err := s.authTokens.ConsumeAuthToken(c, system.AUTH_TOKEN_VERIFY_EMAIL, system.HashToken(payload.Token))
+	if err != nil {
+		s.respondMailError(c, err)
+		return
+	}
+	user, err := s.db.GetByName(c, token.User)
+	if err != nil || user.Email != token.Email {
+		s.respondMailError(c, system.ErrNoSuchAuthToken)
+		return
+	}
+	user.EmailVerified = true
+	if _, err := s.db.Update(c, user); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email address"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "email address verified"})
+}
+
+// forgotPassword mails a reset token to the verified address of the user. The
+// response is the same whether or not the user exists
+func (s *SessionControl) forgotPassword(c *gin.Context) {
+	var payload forgotPasswordPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || (payload.Username == "" && payload.Email == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or email required"})
+		return
+	}
+	if s.mailer == nil {
+		s.respondMailError(c, ErrNoMailer)
+		return
+	}
+	var user *system.User
+	var err error
+	if payload.Email != "" {
+		user, err = s.db.GetByEmail(c, strings.TrimSpace(payload.Email))
+	} else {
+		user, err = s.db.GetByName(c, payload.Username)
+	}
+	if err == nil && user != nil && user.Email != "" && user.EmailVerified {
+		if err := s.sendAuthToken(c, user, system.AUTH_TOKEN_RESET_PASSWORD); err != nil {
+			s.logger.Println(err)
+		}
+	} else {
+		s.logger.Println("Password reset without verified email requested from " + c.ClientIP())
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "a reset mail was sent if the account has a verified email address"})
+}
+
+// resetPassword sets a new password with a mailed reset token. The api, access and
+// refresh tokens of the user are revoked, cookie sessions expire with their max age
+func (s *SessionControl) resetPassword(c *gin.Context) {
+	var payload mailTokenPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Token == "" || payload.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token and password required"})
+		return
+	}
+	token, err := s.authTokens.ConsumeAuthToken(c, system.AUTH_TOKEN_RESET_PASSWORD, system.HashToken(payload.Token))
+	if err != nil {
+		s.respondMailError(c, err)
+		return
+	}
+	// the token was mailed to the address the user had back then
+	user, err := s.db.GetByName(c, token.User)
+	if err != nil || user.Email != token.Email {
+		s.respondMailError(c, system.ErrNoSuchAuthToken)
+		return
+	}
+	if _, err := s.db.UpdateUserPassword(c, user, payload.Password); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	// credentials issued before the reset may be the compromised ones
+	s.revokeCredentials(c, user.Name)
+	// the reset proves access to the mailbox, earlier failures no longer count
+	s.loginSucceeded(c, user.Name)
+	s.logger.Println("Password of " + user.Name + " reset from " + c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "password reset"})
+}
+
+// respondMailError maps mail and token errors to status codes
+func (s *SessionControl) respondMailError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, system.ErrNoSuchAuthToken):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoMailer):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send mail"})
+	}
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const ADMIN_ROLE = "admin"
+
+var (
+	ErrBootstrap = errors.New("error bootstrapping admin")
+)
+
+// AdminBootstrap names the admin created on startup if the user does not exist,
+// the user is given the admin role granting every builtin permission
+type AdminBootstrap struct {
+	Name     string
+	Email    string
+	Password string
+}
+
+type rolePayload struct {
+	Name             string   `json:"name"`
+	Permissions      []string `json:"permissions"`
+	RequireTwoFactor *bool    `json:"require_two_factor"`
+}
+
+// HasPermission reports if the roles of the session grant the permission
+func HasPermission(c *gin.Context, permission string) bool {
+	permissions, ok := c.Get(permissions_key)
+	if !ok {
+		return false
+	}
+	granted, ok := permissions.([]string)
+	if !ok {
+		return false
+	}
+	for _, p := range granted {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission guards a route group, it has to run after UserRoutePass
+func (s *SessionControl) RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, permission) {
+			s.logger.Println("Missing permission " + permission + " for " + c.Request.URL.Path + " from " + c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing permission " + permission})
+			return
+		}
+		c.Next()
+	}
+}
+
+// bootstrap makes sure the builtin permissions and the admin role exist and
+// creates the configured admin, existing users keep their password
+func (s *SessionControl) bootstrap(ctx context.Context, admin *AdminBootstrap) error {
+	for _, permission := range system.BuiltinPermissions {
+		if _, err := s.roles.CreatePermission(ctx, permission); err != nil && !errors.Is(err, system.ErrPermissionExists) {
+			s.logger.Println(err)
+			return ErrBootstrap
+		}
+	}
+	if role, err := s.roles.GetRole(ctx, ADMIN_ROLE); err == nil {
+		granted := system.RolePermissions([]*system.Role{role, {Permissions: system.BuiltinPermissions}})
+		if len(granted) != len(role.Permissions) {
+			if _, err := s.roles.SetPermissions(ctx, ADMIN_ROLE, granted); err != nil {
+				s.logger.Println(err)
+				return ErrBootstrap
+			}
+		}
+	} else if _, err := s.roles.CreateRole(ctx, ADMIN_ROLE, system.BuiltinPermissions); err != nil {
+		s.logger.Println(err)
+		return ErrBootstrap
+	}
+	if admin == nil || admin.Name == "" {
+		return nil
+	}
+	if _, err := s.db.GetByName(ctx, admin.Name); err != nil {
+		if admin.Password == "" {
+			s.logger.Println("no password set for admin " + admin.Name)
+			return ErrBootstrap
+		}
+		if _, err := s.db.Create(ctx, admin.Name, admin.Email, admin.Password); err != nil {
+			s.logger.Println(err)
+			return ErrBootstrap
+		}
+		s.logger.Println("created admin " + admin.Name)
+	}
+	if err := s.roles.AssignRole(ctx, admin.Name, ADMIN_ROLE); err != nil {
+		s.logger.Println(err)
+		return ErrBootstrap
+	}
+	return nil
+}
+
+// respondRoleError maps role table errors to status codes
+func (s *SessionControl) respondRoleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, system.ErrNoSuchRole), errors.Is(err, system.ErrNoSuchUser):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, system.ErrNoSuchPermission):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, system.ErrRoleExists), errors.Is(err, system.ErrPermissionExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "role operation failed"})
+	}
+}
+
+func (s *SessionControl) getRoles(c *gin.Context) {
+	roles, err := s.roles.GetRoles(c)
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+func (s *SessionControl) getRole(c *gin.Context) {
+	role, err := s.roles.GetRole(c, c.Param("role"))
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+func (s *SessionControl) createRole(c *gin.Context) {
+	var payload rolePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || !system.ValidRoleName(payload.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+		return
+	}
+	role, err := s.roles.CreateRole(c, payload.Name, payload.Permissions)
+	if err == nil && payload.RequireTwoFactor != nil {
+		role, err = s.roles.SetTwoFactor(c, payload.Name, *payload.RequireTwoFactor)
+	}
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, role)
+}
+
+// setRolePermissions replaces the permissions of the role and changes if it
+// requires two factor authentication, fields left out are kept
+func (s *SessionControl) setRolePermissions(c *gin.Context) {
+	var payload rolePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || (payload.Permissions == nil && payload.RequireTwoFactor == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+		return
+	}
+	role, err := s.roles.GetRole(c, c.Param("role"))
+	if err == nil && payload.Permissions != nil {
+		role, err = s.roles.SetPermissions(c, c.Param("role"), payload.Permissions)
+	}
+	if err == nil && payload.RequireTwoFactor != nil {
+		role, err = s.roles.SetTwoFactor(c, c.Param("role"), *payload.RequireTwoFactor)
+	}
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+func (s *SessionControl) deleteRole(c *gin.Context) {
+	if err := s.roles.DeleteRole(c, c.Param("role")); err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted"})
+}
+
+func (s *SessionControl) getPermissions(c *gin.Context) {
+	permissions, err := s.roles.GetPermissions(c)
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, permissions)
+}
+
+func (s *SessionControl) createPermission(c *gin.Context) {
+	var payload rolePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || !system.ValidRoleName(payload.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid permission"})
+		return
+	}
+	permission, err := s.roles.CreatePermission(c, payload.Name)
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, permission)
+}
+
+// deletePermission removes a permission from every role, the builtin ones are kept
+func (s *SessionControl) deletePermission(c *gin.Context) {
+	name := c.Param("permission")
+	for _, builtin := range system.BuiltinPermissions {
+		if name == builtin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "builtin permissions cannot be deleted"})
+			return
+		}
+	}
+	if err := s.roles.DeletePermission(c, name); err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "permission deleted"})
+}
+
+func (s *SessionControl) getUserRoles(c *gin.Context) {
+	if _, err := s.db.GetByName(c, c.Param("name")); err != nil {
+		s.respondRoleError(c, system.ErrNoSuchUser)
+		return
+	}
+	roles, err := s.roles.GetUserRoles(c, c.Param("name"))
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+func (s *SessionControl) assignRole(c *gin.Context) {
+	if _, err := s.db.GetByName(c, c.Param("name")); err != nil {
+		s.respondRoleError(c, system.ErrNoSuchUser)
+		return
+	}
+	if err := s.roles.AssignRole(c, c.Param("name"), c.Param("role")); err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role assigned"})
+}
+
+func (s *SessionControl) revokeRole(c *gin.Context) {
+	if err := s.roles.RevokeRole(c, c.Param("name"), c.Param("role")); err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "role revoked"})
+}
@@ -1,18 +1,25 @@
 package internal
 
 import (
+	"context"
 	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/mail"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
 	"github.com/myLogic207/PaT-CH/pkg/util"
 )
 
 const LOGIN_URL_PATH = "/api/v1/auth/connect"
 
-// / routes
-func AddRoutes(router *gin.RouterGroup, args ...any) {
+// / routes, the session control is returned so other packages can guard their routes.
+// Besides the user table in args[0], args may hold a role, token, two factor and
+// mailed token table, the admin to bootstrap, the config enabling signed access
+// tokens, the mailer used for verification and reset mails, the lockout config
+// and the counter of failed logins
+func AddRoutes(router *gin.RouterGroup, args ...any) *SessionControl {
 	if len(args) == 0 || args[0] == nil {
 		log.Fatalln("no args passed to AddRoutes")
 	}
@@ -23,13 +30,73 @@ func AddRoutes(router *gin.RouterGroup, args ...any) {
 		sessionLogger = log.Default()
 	}
 
+	var roles system.RoleTable
+	var tokens system.TokenTable
+	var admin *AdminBootstrap
+	var jwtConfig *JWTConfig
+	var twoFactor system.TwoFactorTable
+	var authTokens system.AuthTokenTable
+	var mailer mail.Mailer
+	var lockout *LockoutConfig
+	var attempts cache.AttemptCounter
+	for _, arg := range args[1:] {
+		switch val := arg.(type) {
+		case system.RoleTable:
+			roles = val
+		case system.TokenTable:
+			tokens = val
+		case *AdminBootstrap:
+			admin = val
+		case *JWTConfig:
+			jwtConfig = val
+		case system.TwoFactorTable:
+			twoFactor = val
+		case system.AuthTokenTable:
+			authTokens = val
+		case mail.Mailer:
+			mailer = val
+		case *LockoutConfig:
+			lockout = val
+		}
+		// the redis connector is the mailed token table as well, so it is not part of the switch
+		if counter, ok := arg.(cache.AttemptCounter); ok {
+			attempts = counter
+		}
+	}
+
 	var sessionCtl *SessionControl
 	if userDB, ok := args[0].(system.UserTable); ok {
-		sessionCtl = NewSessionControl(userDB, sessionLogger)
+		sessionCtl = NewSessionControl(userDB, roles, tokens, sessionLogger)
 	} else {
 		log.Fatalln("first arg passed to AddRoutes is not a UserTable")
 	}
+	if twoFactor != nil {
+		sessionCtl.twoFactor = twoFactor
+	}
+	if authTokens != nil {
+		sessionCtl.authTokens = authTokens
+	}
+	sessionCtl.mailer = mailer
+	if lockout != nil {
+		sessionCtl.lockout = lockout
+	}
+	if attempts != nil {
+		sessionCtl.attempts = attempts
+	}
+	if sessionCtl.security, err = util.CreateLogger("security"); err != nil {
+		log.Println("failed to create security logger, falling back")
+		sessionCtl.security = sessionLogger
+	}
+	if jwtConfig != nil {
+		if sessionCtl.jwt, err = newJWTControl(*jwtConfig); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := sessionCtl.bootstrap(context.Background(), admin); err != nil {
+		log.Fatalln(err)
+	}
 	addApiRoutes(router.Group("/api"), sessionCtl)
+	return sessionCtl
 }
 
 // /api routes
@@ -41,7 +108,6 @@ func addApiRoutes(api *gin.RouterGroup, sessionCtl *SessionControl) {
 func addV1Routes(v1 *gin.RouterGroup, sessionCtl *SessionControl) {
 	v1.GET("/health", routeHealth)
 	v1.POST("/register", sessionCtl.register)
-	// v1.GET("/forward/:dest", ForwardRequest)
 	v1.GET("/status", sessionCtl.Status)
 	addAuthRoutes(v1.Group("/auth"), sessionCtl)
 }
@@ -52,11 +118,51 @@ func addAuthRoutes(auth *gin.RouterGroup, sessionCtl *SessionControl) {
 	auth.POST("/connect", sessionCtl.Connect)
 	auth.POST("/disconnect", sessionCtl.Disconnect)
 	auth.GET("/session", sessionCtl.GetSession)
+	if sessionCtl.jwt != nil {
+		auth.POST("/token", sessionCtl.issueToken)
+		auth.POST("/token/refresh", sessionCtl.refreshToken)
+	}
 
 	// /api/v1/auth/user routes
 	auth.GET("/user", sessionCtl.GetUser)
 	// user.POST("/", UpdateUser)
 	auth.DELETE("/user", sessionCtl.DeleteUser)
+
+	auth.POST("/email/verify", sessionCtl.verifyEmail)
+	auth.POST("/email/resend", sessionCtl.resendVerification)
+	auth.POST("/password/forgot", sessionCtl.forgotPassword)
+	auth.POST("/password/reset", sessionCtl.resetPassword)
+
+	auth.GET("/2fa", sessionCtl.getTwoFactor)
+	auth.POST("/2fa/enroll", sessionCtl.enrollTwoFactor)
+	auth.POST("/2fa/confirm", sessionCtl.confirmTwoFactor)
+	auth.POST("/2fa/verify", sessionCtl.verifyTwoFactor)
+	auth.DELETE("/2fa", sessionCtl.disableTwoFactor)
+
+	auth.GET("/tokens", sessionCtl.getTokens)
+	auth.POST("/tokens", sessionCtl.createToken)
+	auth.DELETE("/tokens/:id", sessionCtl.deleteToken)
+
+	addRoleRoutes(auth.Group("", sessionCtl.RequirePermission(system.PERMISSION_USER_ADMIN)), sessionCtl)
+}
+
+// /api/v1/auth role management routes, guarded by the user admin permission
+func addRoleRoutes(admin *gin.RouterGroup, sessionCtl *SessionControl) {
+	admin.GET("/roles", sessionCtl.getRoles)
+	admin.POST("/roles", sessionCtl.createRole)
+	admin.GET("/roles/:role", sessionCtl.getRole)
+	admin.PUT("/roles/:role", sessionCtl.setRolePermissions)
+	admin.DELETE("/roles/:role", sessionCtl.deleteRole)
+
+	admin.GET("/permissions", sessionCtl.getPermissions)
+	admin.POST("/permissions", sessionCtl.createPermission)
+	admin.DELETE("/permissions/:permission", sessionCtl.deletePermission)
+
+	admin.GET("/users/:name/lockout", sessionCtl.getLockout)
+	admin.DELETE("/users/:name/lockout", sessionCtl.unlockUser)
+	admin.GET("/users/:name/roles", sessionCtl.getUserRoles)
+	admin.PUT("/users/:name/roles/:role", sessionCtl.assignRole)
+	admin.DELETE("/users/:name/roles/:role", sessionCtl.revokeRole)
 }
 
 // func addUserRoutes(user *gin.RouterGroup, sessionCtl *SessionControl) {
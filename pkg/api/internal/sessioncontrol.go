@@ -1,21 +1,29 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/mail"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
 )
 
 const (
 	id_key           = "unique_user_identifier"
 	id_bytes         = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 	auth_key         = "authorization_status"
+	twofactor_key    = "two_factor_pending"
 	auth_pass_string = "user_is_authorized"
+	roles_key        = "roles"
+	permissions_key  = "permissions"
 )
 
 var (
@@ -25,18 +33,46 @@ var (
 )
 
 type SessionControl struct {
-	key_len  int
-	sessions map[string]sessions.Session
-	db       system.UserTable
+	key_len   int
+	sessions  map[string]sessions.Session
+	db        system.UserTable
+	roles     system.RoleTable
+	tokens    system.TokenTable
+	jwt       *jwtControl
+	twoFactor system.TwoFactorTable
+	// mailer is nil if mail is not configured
+	mailer     mail.Mailer
+	authTokens system.AuthTokenTable
+	// failed logins, replaced by AddRoutes with the redis counter if redis is used
+	attempts cache.AttemptCounter
+	lockout  *LockoutConfig
+	// lockouts and unlocks are written to the security log
+	security *log.Logger
 	logger   *log.Logger
 }
 
-func NewSessionControl(db system.UserTable, logger *log.Logger) *SessionControl {
+// NewSessionControl creates the session control, roles and tokens are kept in
+// memory if no table is given for them
+func NewSessionControl(db system.UserTable, roles system.RoleTable, tokens system.TokenTable, logger *log.Logger) *SessionControl {
+	if roles == nil {
+		roles = system.NewRoleIMDB()
+	}
+	if tokens == nil {
+		tokens = system.NewTokenIMDB()
+	}
 	return &SessionControl{
-		key_len:  16,
-		db:       db,
-		sessions: make(map[string]sessions.Session),
-		logger:   logger,
+		key_len: 16,
+		db:      db,
+		roles:   roles,
+		tokens:  tokens,
+		// replaced by AddRoutes if a two factor table is passed
+		twoFactor:  system.NewTwoFactorIMDB(),
+		authTokens: system.NewAuthTokenIMDB(),
+		attempts:   cache.NewMemoryAttempts(),
+		lockout:    DefaultLockoutConfig(),
+		security:   logger,
+		sessions:   make(map[string]sessions.Session),
+		logger:     logger,
 	}
 }
 
@@ -75,12 +111,23 @@ func (s *SessionControl) register(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": ErrRegister})
 		return
 	}
-	user, err := s.db.Create(c, raw.Username, "", raw.Password)
+	raw.Email = strings.TrimSpace(raw.Email)
+	if raw.Email != "" && !mail.ValidAddress(raw.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrRegister})
+		return
+	}
+	user, err := s.db.Create(c, raw.Username, raw.Email, raw.Password)
 	if err != nil {
 		s.logger.Println(err)
 		c.JSON(http.StatusConflict, gin.H{"error": ErrRegisterAlready})
 		return
 	}
+	// the user can ask for another mail if this one fails
+	if user.Email != "" && s.mailer != nil {
+		if err := s.sendAuthToken(c, user, system.AUTH_TOKEN_VERIFY_EMAIL); err != nil {
+			s.logger.Println(err)
+		}
+	}
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "registered",
 		"user":    user,
@@ -94,20 +141,35 @@ func (s *SessionControl) Connect(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": ErrConnect})
 		return
 	}
+	if s.rejectLocked(c, raw.Username) {
+		return
+	}
 	user, err := s.db.Authenticate(c, raw.Username, raw.Password)
 	if err != nil {
 		s.logger.Println(err)
+		s.loginFailed(c, raw.Username)
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": ErrConnect})
 		return
 	}
+	state, err := s.twoFactorState(c, user.Name)
+	if err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": ErrConnect})
+		return
+	}
 	session := sessions.Default(c)
 	session.Clear()
-	session.Set("username", user.Name)
-	session.Set(id_key, s.getNewId())
-	session.Set(auth_key, auth_pass_string)
-	if err := session.Save(); err != nil {
-		s.logger.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+	if state != "" {
+		s.startPartialSession(c, session, user.Name, state)
+		return
+	}
+	s.loginSucceeded(c, user.Name)
+	s.startSession(c, session, user.Name)
+}
+
+// startSession authenticates the session as the user and responds connected
+func (s *SessionControl) startSession(c *gin.Context, session sessions.Session, username string) {
+	if err := s.saveSession(c, session, username); err != nil {
 		return
 	}
 	c.JSON(http.StatusCreated, gin.H{
@@ -116,6 +178,28 @@ func (s *SessionControl) Connect(c *gin.Context) {
 	})
 }
 
+// saveSession authenticates the session as the user, it only responds on failure
+func (s *SessionControl) saveSession(c *gin.Context, session sessions.Session, username string) error {
+	// roles are loaded once per session, changes apply on the next connect
+	roles, err := s.roles.GetUserRoles(c, username)
+	if err != nil {
+		s.logger.Println(err)
+		roles = []*system.Role{}
+	}
+	session.Delete(twofactor_key)
+	session.Set("username", username)
+	session.Set(roles_key, system.RoleNames(roles))
+	session.Set(permissions_key, system.RolePermissions(roles))
+	session.Set(id_key, s.getNewId())
+	session.Set(auth_key, auth_pass_string)
+	if err := session.Save(); err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return err
+	}
+	return nil
+}
+
 func (s *SessionControl) Disconnect(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Clear()
@@ -147,21 +231,47 @@ func (s *SessionControl) GetSession(c *gin.Context) {
 	}
 	s.logger.Println("user session requested: ", session.Get(id_key))
 	c.JSON(http.StatusOK, gin.H{
-		"message": "connected",
-		"id":      session.Get(id_key),
-		"user":    session.Get("username"),
+		"message":     "connected",
+		"id":          session.Get(id_key),
+		"user":        session.Get("username"),
+		"roles":       session.Get(roles_key),
+		"permissions": session.Get(permissions_key),
 	})
 }
 
-// user routes
+// SessionUser returns the name of the user authenticated by the session of the request
+func SessionUser(c *gin.Context) (string, bool) {
+	if _, ok := c.Get(sessions.DefaultKey); !ok {
+		return "", false
+	}
+	session := sessions.Default(c)
+	if auth, ok := session.Get(auth_key).(string); !ok || auth != auth_pass_string {
+		return "", false
+	}
+	username, ok := session.Get("username").(string)
+	return username, ok
+}
+
+// user routes, requests with a bearer token are authenticated by it if access tokens are enabled
 func (s *SessionControl) UserRoutePass(c *gin.Context) {
+	if raw := bearerToken(c); raw != "" && s.jwt != nil {
+		s.jwtRoutePass(c, raw)
+		return
+	}
 	session := sessions.Default(c)
 	if auth, ok := session.Get(auth_key).(string); ok && auth == auth_pass_string {
-		c.Set("id", session.Get("id"))
+		c.Set("id", session.Get(id_key))
 		c.Set("username", session.Get("username"))
+		c.Set(roles_key, session.Get(roles_key))
+		c.Set(permissions_key, session.Get(permissions_key))
 		c.Next() // continue
-	} else if c.Request.URL.Path == LOGIN_URL_PATH {
+	} else if publicPath(c.Request.URL.Path) {
 		c.Next() // continue
+	} else if state, ok := session.Get(twofactor_key).(string); ok && twoFactorPath(state, c.Request.URL.Path) {
+		// partial sessions only reach the second login step
+		c.Set("username", session.Get("username"))
+		c.Set(twofactor_key, state)
+		c.Next()
 	} else {
 		s.logger.Println("Unauthorized access to " + c.Request.URL.Path + " from " + c.ClientIP() + " with user agent " + c.Request.UserAgent())
 		c.JSON(http.StatusUnauthorized, gin.H{
@@ -210,12 +320,45 @@ func (s *SessionControl) GetUser(c *gin.Context) {
 // 	})
 // }
 
+// revokeCredentials deletes the api and mailed tokens of the user and rejects the
+// access and refresh tokens issued so far. Cookie sessions cannot be revoked,
+// they expire with the session max age
+func (s *SessionControl) revokeCredentials(c *gin.Context, username string) {
+	if tokens, err := s.tokens.GetUserTokens(c, username); err == nil {
+		for _, token := range tokens {
+			if err := s.tokens.DeleteToken(c, username, token.ID); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+	for _, purpose := range []string{system.AUTH_TOKEN_VERIFY_EMAIL, system.AUTH_TOKEN_RESET_PASSWORD} {
+		if err := s.authTokens.DeleteAuthToken(c, username, purpose); err != nil {
+			s.logger.Println(err)
+		}
+	}
+	if s.jwt != nil {
+		s.jwt.revoke(username, time.Now())
+	}
+}
+
 func (s *SessionControl) DeleteUser(c *gin.Context) {
 	var username string
 	if val, ok := c.Get("username"); ok {
 		username = val.(string)
 	}
 	s.logger.Println("deleting user: ", username)
+	// assignments, tokens, 2FA and mailed tokens belong to the user and go first
+	if roles, err := s.roles.GetUserRoles(c, username); err == nil {
+		for _, role := range roles {
+			if err := s.roles.RevokeRole(c, username, role.Name); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+	s.revokeCredentials(c, username)
+	if err := s.twoFactor.DeleteTwoFactor(c, username); err != nil && !errors.Is(err, system.ErrNoTwoFactor) {
+		s.logger.Println(err)
+	}
 	if err := s.db.DeleteByName(c, username); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	token_key = "api_token"
+	// last used timestamps are written at most once per interval and token
+	token_touch_interval = time.Minute
+)
+
+type tokenPayload struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// TokenRoutePass authenticates requests by the api token in the bearer
+// authorization header, other requests fall back to UserRoutePass.
+// A token acts as its user with the permissions limited to its scopes
+func (s *SessionControl) TokenRoutePass(c *gin.Context) {
+	raw := bearerToken(c)
+	if !strings.HasPrefix(raw, system.TOKEN_PREFIX) {
+		s.UserRoutePass(c)
+		return
+	}
+	now := time.Now().UTC()
+	token, err := s.tokens.GetTokenByHash(c, system.HashToken(raw))
+	if err == nil && token.Expired(now) {
+		err = errors.New("token " + token.Hint + " expired")
+	}
+	if err == nil {
+		_, err = s.db.GetByName(c, token.User)
+	}
+	if err != nil {
+		s.logger.Println("Invalid token for " + c.Request.URL.Path + " from " + c.ClientIP() + ": " + err.Error())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "unauthorized"})
+		return
+	}
+	roles, err := s.roles.GetUserRoles(c, token.User)
+	if err != nil {
+		s.logger.Println(err)
+		roles = []*system.Role{}
+	}
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= token_touch_interval {
+		if err := s.tokens.TouchToken(c, token.ID, now); err != nil {
+			s.logger.Println(err)
+		}
+	}
+	c.Set("username", token.User)
+	c.Set(roles_key, system.RoleNames(roles))
+	c.Set(permissions_key, token.ScopedPermissions(system.RolePermissions(roles)))
+	c.Set(token_key, token)
+	c.Next()
+}
+
+// ScopeAllows reports if the api token of the request has the scope, requests
+// authenticated by a session are not limited
+func ScopeAllows(c *gin.Context, scope string) bool {
+	val, ok := c.Get(token_key)
+	if !ok {
+		return true
+	}
+	token, ok := val.(*system.APIToken)
+	return ok && token.HasScope(scope)
+}
+
+func (s *SessionControl) createToken(c *gin.Context) {
+	user := c.GetString("username")
+	var payload tokenPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || strings.TrimSpace(payload.Name) == "" || len(payload.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token"})
+		return
+	}
+	now := time.Now().UTC()
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token expiry must be in the future"})
+		return
+	}
+	permissions, err := s.roles.GetPermissions(c)
+	if err != nil {
+		s.respondRoleError(c, err)
+		return
+	}
+	for _, scope := range payload.Scopes {
+		known := false
+		for _, permission := range permissions {
+			known = known || permission.Name == scope
+		}
+		if !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+	raw, hash, err := system.GenerateToken()
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+	token := &system.APIToken{
+		Name:      strings.TrimSpace(payload.Name),
+		User:      user,
+		Hash:      hash,
+		Hint:      raw[:system.TOKEN_HINT_LENGTH],
+		Scopes:    append([]string{}, payload.Scopes...),
+		ExpiresAt: payload.ExpiresAt,
+		CreatedAt: now,
+	}
+	if err := s.tokens.CreateToken(c, token); err != nil {
+		if errors.Is(err, system.ErrTokenExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+	s.logger.Println("created token " + token.Name + " for " + user)
+	// the raw token is only shown once
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "token created",
+		"token":   raw,
+		"details": token,
+	})
+}
+
+func (s *SessionControl) getTokens(c *gin.Context) {
+	tokens, err := s.tokens.GetUserTokens(c, c.GetString("username"))
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (s *SessionControl) deleteToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+	if err := s.tokens.DeleteToken(c, c.GetString("username"), id); err != nil {
+		if errors.Is(err, system.ErrNoSuchToken) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "token revoked"})
+}
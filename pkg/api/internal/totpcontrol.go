@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	TOTP_ISSUER = "PaT-CH"
+	// states of a partial session, the password was checked but the second step is missing
+	twofactor_verify = "verify"
+	twofactor_enroll = "enroll"
+)
+
+type twoFactorPayload struct {
+	Code string `json:"code"`
+}
+
+// twoFactorPath reports if a partial session in state may reach the path
+func twoFactorPath(state string, path string) bool {
+	switch state {
+	case twofactor_verify:
+		return path == "/api/v1/auth/2fa/verify" || path == "/api/v1/auth/disconnect"
+	case twofactor_enroll:
+		return path == "/api/v1/auth/2fa/enroll" || path == "/api/v1/auth/2fa/confirm" || path == "/api/v1/auth/disconnect"
+	}
+	return false
+}
+
+// twoFactorState is the second login step the user still has to take, empty if none.
+// Users with 2FA enabled verify a code, users with a role requiring it enroll first
+func (s *SessionControl) twoFactorState(c *gin.Context, username string) (string, error) {
+	tf, err := s.twoFactor.GetTwoFactor(c, username)
+	if err != nil && !errors.Is(err, system.ErrNoTwoFactor) {
+		return "", err
+	}
+	if err == nil && tf.Enabled {
+		return twofactor_verify, nil
+	}
+	roles, err := s.roles.GetUserRoles(c, username)
+	if err != nil {
+		return "", err
+	}
+	if system.RequireTwoFactor(roles) {
+		return twofactor_enroll, nil
+	}
+	return "", nil
+}
+
+// startPartialSession remembers the user without authenticating the session
+func (s *SessionControl) startPartialSession(c *gin.Context, session sessions.Session, username string, state string) {
+	session.Set("username", username)
+	session.Set(twofactor_key, state)
+	if err := session.Save(); err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+	message := "two factor code required"
+	if state == twofactor_enroll {
+		message = "two factor enrolment required"
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    message,
+		"two_factor": state,
+	})
+}
+
+// checkCode accepts a totp code once or an unused recovery code, tf is updated
+// and has to be saved if the code was accepted
+func checkCode(tf *system.TwoFactor, code string, now time.Time) bool {
+	if step, ok := system.ValidateTOTP(tf.Secret, code, now, tf.LastStep); ok {
+		tf.LastStep = step
+		return true
+	}
+	return tf.UseRecoveryCode(code)
+}
+
+// checkTwoFactorLogin checks the code of a login without session, it responds
+// and returns false if the user may not log in
+func (s *SessionControl) checkTwoFactorLogin(c *gin.Context, username string, code string) bool {
+	state, err := s.twoFactorState(c, username)
+	if err != nil {
+		s.logger.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": ErrConnect})
+		return false
+	}
+	switch state {
+	case twofactor_enroll:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "two factor enrolment required"})
+		return false
+	case twofactor_verify:
+		tf, err := s.twoFactor.GetTwoFactor(c, username)
+		if err != nil || !checkCode(tf, code, time.Now()) {
+			s.logger.Println("Rejected two factor code for " + username + " from " + c.ClientIP())
+			s.loginFailed(c, username)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid two factor code"})
+			return false
+		}
+		if err := s.twoFactor.SaveTwoFactor(c, tf); err != nil {
+			s.logger.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": ErrConnect})
+			return false
+		}
+	}
+	return true
+}
+
+// partialState is the state of the partial session of the request, empty for authenticated requests
+func partialState(c *gin.Context) string {
+	state, _ := c.Get(twofactor_key)
+	str, _ := state.(string)
+	return str
+}
+
+func (s *SessionControl) getTwoFactor(c *gin.Context) {
+	username := c.GetString("username")
+	roles, err := s.roles.GetUserRoles(c, username)
+	if err != nil {
+		s.logger.Println(err)
+		roles = []*system.Role{}
+	}
+	status := gin.H{
+		"enabled":             false,
+		"required":            system.RequireTwoFactor(roles),
+		"recovery_codes_left": 0,
+	}
+	tf, err := s.twoFactor.GetTwoFactor(c, username)
+	if err == nil {
+		status["enabled"] = tf.Enabled
+		status["recovery_codes_left"] = len(tf.RecoveryCodes)
+	} else if !errors.Is(err, system.ErrNoTwoFactor) {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load two factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// enrollTwoFactor creates a new secret, it is only used once a code was confirmed
+func (s *SessionControl) enrollTwoFactor(c *gin.Context) {
+	username := c.GetString("username")
+	if tf, err := s.twoFactor.GetTwoFactor(c, username); err == nil && tf.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two factor authentication already enabled"})
+		return
+	}
+	secret, err := system.GenerateTOTPSecret()
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enroll"})
+		return
+	}
+	tf := &system.TwoFactor{User: username, Secret: secret, CreatedAt: time.Now().UTC()}
+	if err := s.twoFactor.SaveTwoFactor(c, tf); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enroll"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"secret": secret,
+		"uri":    system.TOTPURI(TOTP_ISSUER, username, secret),
+	})
+}
+
+// confirmTwoFactor enables the enrolment with its first code and hands out the
+// recovery codes, they are not shown again. A partial session is connected afterwards
+func (s *SessionControl) confirmTwoFactor(c *gin.Context) {
+	var payload twoFactorPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+		return
+	}
+	username := c.GetString("username")
+	tf, err := s.twoFactor.GetTwoFactor(c, username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no two factor enrolment"})
+		return
+	}
+	if tf.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two factor authentication already enabled"})
+		return
+	}
+	now := time.Now()
+	step, ok := system.ValidateTOTP(tf.Secret, payload.Code, now, tf.LastStep)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two factor code"})
+		return
+	}
+	codes, hashes, err := system.GenerateRecoveryCodes()
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to confirm"})
+		return
+	}
+	confirmed := now.UTC()
+	tf.Enabled = true
+	tf.LastStep = step
+	tf.RecoveryCodes = hashes
+	tf.ConfirmedAt = &confirmed
+	if err := s.twoFactor.SaveTwoFactor(c, tf); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to confirm"})
+		return
+	}
+	if partialState(c) == twofactor_enroll {
+		session := sessions.Default(c)
+		if err := s.saveSession(c, session, username); err != nil {
+			return
+		}
+		s.loginSucceeded(c, username)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "two factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// verifyTwoFactor is the second step of connecting with 2FA enabled
+func (s *SessionControl) verifyTwoFactor(c *gin.Context) {
+	if partialState(c) != twofactor_verify {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no two factor verification pending"})
+		return
+	}
+	var payload twoFactorPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+		return
+	}
+	username := c.GetString("username")
+	if s.rejectLocked(c, username) {
+		return
+	}
+	tf, err := s.twoFactor.GetTwoFactor(c, username)
+	if err != nil || !tf.Enabled || !checkCode(tf, payload.Code, time.Now()) {
+		s.logger.Println("Rejected two factor code for " + username + " from " + c.ClientIP())
+		s.loginFailed(c, username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two factor code"})
+		return
+	}
+	if err := s.twoFactor.SaveTwoFactor(c, tf); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": ErrConnect})
+		return
+	}
+	s.loginSucceeded(c, username)
+	s.startSession(c, sessions.Default(c), username)
+}
+
+// disableTwoFactor removes the enrolment, a current code is required and
+// users whose roles require 2FA cannot disable it
+func (s *SessionControl) disableTwoFactor(c *gin.Context) {
+	var payload twoFactorPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+		return
+	}
+	username := c.GetString("username")
+	if roles, err := s.roles.GetUserRoles(c, username); err != nil || system.RequireTwoFactor(roles) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "two factor authentication is required by a role"})
+		return
+	}
+	tf, err := s.twoFactor.GetTwoFactor(c, username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no two factor enrolment"})
+		return
+	}
+	if tf.Enabled && !checkCode(tf, payload.Code, time.Now()) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two factor code"})
+		return
+	}
+	if err := s.twoFactor.DeleteTwoFactor(c, username); err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "two factor authentication disabled"})
+}
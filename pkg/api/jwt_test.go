@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+func TestAccessTokens(t *testing.T) {
+	config := util.NewConfig(map[string]interface{}{
+		"jwt.keys":      "main:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))),
+		"jwt.accessttl": "1m",
+	}, nil)
+	jwtConfig, err := loadJWTConfig(config)
+	if err != nil || jwtConfig == nil || jwtConfig.AccessTTL.Minutes() != 1 || jwtConfig.Issuer != internal.DEFAULT_JWT_ISSUER {
+		t.Errorf("Expected the jwt config to be loaded, got %+v %v", jwtConfig, err)
+		t.FailNow()
+	}
+	if _, err := loadJWTConfig(util.NewConfig(map[string]interface{}{"jwt.keys": "main:HS256:c2hvcnQ="}, nil)); err == nil {
+		t.Error("Expected a short secret to be rejected")
+	}
+
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	users := system.NewUserIMDB()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		users, jwtConfig, &internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(bearer, method, target, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(raw)
+	}
+	type tokenPair struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	issue := func(target, body string) tokenPair {
+		t.Helper()
+		var pair tokenPair
+		code, raw := do("", http.MethodPost, target, body)
+		if err := json.Unmarshal([]byte(raw), &pair); code != http.StatusCreated || err != nil {
+			t.Errorf("Expected a token pair from %s, got %d %s", target, code, raw)
+			t.FailNow()
+		}
+		return pair
+	}
+
+	if code, _ := do("", http.MethodPost, "/api/v1/auth/token", `{"username": "root", "password": "wrong"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be rejected, got %d", code)
+	}
+	pair := issue("/api/v1/auth/token", `{"username": "root", "password": "rootpass"}`)
+	if pair.ExpiresIn != 60 {
+		t.Errorf("Expected the access token to expire in a minute, got %d", pair.ExpiresIn)
+	}
+	for _, target := range []string{"/patch", "/api/v1/auth/traffic", "/api/v1/auth/roles"} {
+		if code, body := do(pair.AccessToken, http.MethodGet, target, ""); code != http.StatusOK {
+			t.Errorf("%s: expected the access token to be accepted, got %d %s", target, code, body)
+		}
+	}
+	if code, _ := do(pair.RefreshToken, http.MethodGet, "/patch", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the refresh token not to grant access, got %d", code)
+	}
+	if code, _ := do(pair.AccessToken+"x", http.MethodGet, "/patch", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered token to be rejected, got %d", code)
+	}
+
+	refresh := `{"refresh_token": "` + pair.RefreshToken + `"}`
+	renewed := issue("/api/v1/auth/token/refresh", refresh)
+	if code, _ := do(renewed.AccessToken, http.MethodGet, "/patch", ""); code != http.StatusOK {
+		t.Errorf("Expected the renewed access token to be accepted, got %d", code)
+	}
+	if code, _ := do("", http.MethodPost, "/api/v1/auth/token/refresh", refresh); code != http.StatusUnauthorized {
+		t.Errorf("Expected the refresh token to be used once, got %d", code)
+	}
+
+	if code, _ := do("", http.MethodPost, "/api/v1/register", `{"username": "bob", "password": "bobpass"}`); code != http.StatusCreated {
+		t.Errorf("Expected bob to register, got %d", code)
+	}
+	bob := issue("/api/v1/auth/token", `{"username": "bob", "password": "bobpass"}`)
+	if err := users.DeleteByName(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do(bob.AccessToken, http.MethodGet, "/api/v1/auth/user", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the access token of a deleted user to be rejected, got %d", code)
+	}
+}
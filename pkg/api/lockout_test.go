@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+func TestLockout(t *testing.T) {
+	config := util.NewConfig(map[string]interface{}{"lockout.userattempts": "3", "lockout.ipattempts": "8", "lockout.delay": "1ms", "lockout.maxdelay": "4ms"}, nil)
+	lockout, err := loadLockoutConfig(config)
+	if err != nil || lockout.UserAttempts != 3 || lockout.IPAttempts != 8 || lockout.MaxDelay != 4*time.Millisecond || lockout.Window != internal.DefaultLockoutConfig().Window {
+		t.Fatalf("Expected the lockout config to be loaded, got %+v %v", lockout, err)
+	}
+	if _, err := loadLockoutConfig(util.NewConfig(map[string]interface{}{"lockout.window": "soon"}, nil)); err == nil {
+		t.Error("Expected an invalid window to be rejected")
+	}
+
+	users := system.NewUserIMDB()
+	if _, err := users.Create(context.Background(), "alice", "", "alicepass"); err != nil {
+		t.Fatal(err)
+	}
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		users, lockout, &internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	newClient := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar}
+	}
+	expect := func(client *http.Client, method, target, body string, want int) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("Expected %d for %s %s, got %d %s", want, method, target, resp.StatusCode, raw)
+		}
+		return resp
+	}
+	login := func(user, password string, want int) *http.Response {
+		t.Helper()
+		return expect(newClient(), http.MethodPost, "/api/v1/auth/connect", `{"username": "`+user+`", "password": "`+password+`"}`, want)
+	}
+	root := newClient()
+	expect(root, http.MethodPost, "/api/v1/auth/connect", `{"username": "root", "password": "rootpass"}`, http.StatusCreated)
+
+	// a successful login resets the failures of the user
+	login("alice", "wrong", http.StatusBadRequest)
+	login("alice", "wrong", http.StatusBadRequest)
+	login("alice", "alicepass", http.StatusCreated)
+	for i := 0; i < 3; i++ {
+		login("alice", "wrong", http.StatusBadRequest)
+	}
+	if resp := login("alice", "alicepass", http.StatusTooManyRequests); resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header while locked out")
+	}
+	expect(root, http.MethodGet, "/api/v1/auth/users/alice/lockout", "", http.StatusOK)
+	expect(root, http.MethodDelete, "/api/v1/auth/users/alice/lockout", "", http.StatusOK)
+	login("alice", "alicepass", http.StatusCreated)
+
+	// failures of any user count for the ip, unlocking a user does not lift it
+	for _, user := range []string{"bob", "carol", "dave"} {
+		login(user, "guess", http.StatusBadRequest)
+	}
+	login("alice", "alicepass", http.StatusTooManyRequests)
+	expect(root, http.MethodDelete, "/api/v1/auth/users/alice/lockout", "", http.StatusOK)
+	login("alice", "alicepass", http.StatusTooManyRequests)
+	expect(newClient(), http.MethodDelete, "/api/v1/auth/users/alice/lockout", "", http.StatusUnauthorized)
+}
+
+func TestLockoutAfterExpiry(t *testing.T) {
+	users := system.NewUserIMDB()
+	if _, err := users.Create(context.Background(), "alice", "", "alicepass"); err != nil {
+		t.Fatal(err)
+	}
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	// the window outlasts the lock so the failures are still counted once it expires
+	lockout := &internal.LockoutConfig{UserAttempts: 2, Window: time.Minute, Duration: 100 * time.Millisecond, Delay: time.Millisecond, MaxDelay: time.Millisecond}
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches, users, lockout)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	login := func(password string, want int) {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/api/v1/auth/connect", "application/json", strings.NewReader(`{"username": "alice", "password": "`+password+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("Expected %d, got %d", want, resp.StatusCode)
+		}
+	}
+	login("wrong", http.StatusBadRequest)
+	login("wrong", http.StatusBadRequest)
+	login("alicepass", http.StatusTooManyRequests)
+	time.Sleep(150 * time.Millisecond)
+	login("wrong", http.StatusBadRequest)
+	login("alicepass", http.StatusTooManyRequests)
+	time.Sleep(150 * time.Millisecond)
+	login("alicepass", http.StatusCreated)
+}
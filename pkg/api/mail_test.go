@@ -0,0 +1,124 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/mail"
+)
+
+func TestMailFlows(t *testing.T) {
+	outbox := &bytes.Buffer{}
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	users := system.NewUserIMDB()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		users, mail.NewWriterMailer(outbox, "patch@example.net"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	expect := func(method, target, body string, want int) string {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("Expected %d for %s %s, got %d %s", want, method, target, resp.StatusCode, raw)
+		}
+		return string(raw)
+	}
+	tokenPattern := regexp.MustCompile(`(?m)^([A-Za-z0-9_-]{43})\r$`)
+	mailed := func(subject string) string {
+		t.Helper()
+		sent := outbox.String()
+		outbox.Reset()
+		match := tokenPattern.FindStringSubmatch(sent)
+		if !strings.Contains(sent, "To: alice@example.net\r\n") || !strings.Contains(sent, "Subject: "+subject) || match == nil {
+			t.Fatalf("Expected a mail %q with a token, got %q", subject, sent)
+		}
+		return match[1]
+	}
+
+	expect(http.MethodPost, "/api/v1/register", `{"username": "alice", "email": "not an address", "password": "alicepass"}`, http.StatusBadRequest)
+	expect(http.MethodPost, "/api/v1/register", `{"username": "alice", "email": "alice@example.net", "password": "alicepass"}`, http.StatusCreated)
+	expect(http.MethodPost, "/api/v1/register", `{"username": "alice2", "email": "alice@example.net", "password": "alicepass"}`, http.StatusConflict)
+	verify := mailed("Verify your email address")
+
+	// resets are only mailed to verified addresses, the response does not tell
+	expect(http.MethodPost, "/api/v1/auth/password/forgot", `{"email": "alice@example.net"}`, http.StatusAccepted)
+	expect(http.MethodPost, "/api/v1/auth/password/forgot", `{"username": "nobody"}`, http.StatusAccepted)
+	if outbox.Len() != 0 {
+		t.Errorf("Expected no reset mail before verification, got %q", outbox.String())
+	}
+
+	expect(http.MethodPost, "/api/v1/auth/connect", `{"username": "alice", "password": "alicepass"}`, http.StatusCreated)
+	expect(http.MethodPost, "/api/v1/auth/email/resend", "", http.StatusAccepted)
+	resent := mailed("Verify your email address")
+	expect(http.MethodPost, "/api/v1/auth/email/verify", `{"token": "`+verify+`"}`, http.StatusBadRequest)
+	expect(http.MethodPost, "/api/v1/auth/email/verify", `{"token": "`+resent+`"}`, http.StatusOK)
+	expect(http.MethodPost, "/api/v1/auth/email/verify", `{"token": "`+resent+`"}`, http.StatusBadRequest)
+	if user := expect(http.MethodGet, "/api/v1/auth/user", "", http.StatusOK); !strings.Contains(user, `"email_verified":true`) {
+		t.Errorf("Expected the email to be verified, got %s", user)
+	}
+	expect(http.MethodPost, "/api/v1/auth/email/resend", "", http.StatusConflict)
+	expect(http.MethodPost, "/api/v1/auth/disconnect", "", http.StatusOK)
+
+	expect(http.MethodPost, "/api/v1/auth/connect", `{"username": "alice", "password": "alicepass"}`, http.StatusCreated)
+	var created struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal([]byte(expect(http.MethodPost, "/api/v1/auth/tokens", `{"name": "ci"}`, http.StatusCreated)), &created)
+	expect(http.MethodPost, "/api/v1/auth/disconnect", "", http.StatusOK)
+	bearer := func(want int) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/patch", nil)
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("Expected %d with the api token, got %d", want, resp.StatusCode)
+		}
+	}
+	bearer(http.StatusOK)
+
+	expect(http.MethodPost, "/api/v1/auth/password/forgot", `{"username": "alice"}`, http.StatusAccepted)
+	reset := mailed("Reset your password")
+	expect(http.MethodPost, "/api/v1/auth/password/reset", `{"token": "`+reset+`"}`, http.StatusBadRequest)
+	expect(http.MethodPost, "/api/v1/auth/password/reset", `{"token": "`+reset+`", "password": "newpass"}`, http.StatusOK)
+	expect(http.MethodPost, "/api/v1/auth/password/reset", `{"token": "`+reset+`", "password": "other"}`, http.StatusBadRequest)
+	// the reset revokes the tokens issued before it
+	bearer(http.StatusUnauthorized)
+	expect(http.MethodPost, "/api/v1/auth/connect", `{"username": "alice", "password": "alicepass"}`, http.StatusBadRequest)
+	expect(http.MethodPost, "/api/v1/auth/connect", `{"username": "alice", "password": "newpass"}`, http.StatusCreated)
+	expect(http.MethodPost, "/api/v1/auth/disconnect", "", http.StatusOK)
+
+	// a token mailed to a previous address is not accepted
+	expect(http.MethodPost, "/api/v1/auth/password/forgot", `{"username": "alice"}`, http.StatusAccepted)
+	stale := mailed("Reset your password")
+	alice, _ := users.GetByName(context.Background(), "alice")
+	alice.Email = "alice@example.org"
+	users.Update(context.Background(), alice)
+	expect(http.MethodPost, "/api/v1/auth/password/reset", `{"token": "`+stale+`", "password": "stolen"}`, http.StatusBadRequest)
+	expect(http.MethodPost, "/api/v1/auth/connect", `{"username": "alice", "password": "newpass"}`, http.StatusCreated)
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	DEFAULT_MIRROR_PERCENT  = 100
+	DEFAULT_MIRROR_TIMEOUT  = 5 * time.Second
+	DEFAULT_MIRROR_MAX_BODY = 64 * 1024
+	// mirrored requests in flight per patch before new ones are dropped
+	mirrorMaxInFlight = 64
+)
+
+var (
+	ErrInvalidMirror = errors.New("invalid mirror")
+)
+
+// MirrorConfig sends percent of the requests of a patch, all by default, to a
+// second destination as well. Mirrored requests don't wait for the primary and
+// their responses are discarded, or saved to the traffic store if record is
+// set. Requests with bodies larger than max body are not mirrored
+type MirrorConfig struct {
+	Dest    string   `json:"dest"`
+	Percent float64  `json:"percent,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+	MaxBody int      `json:"max_body,omitempty"`
+	Record  bool     `json:"record,omitempty"`
+}
+
+func (m *MirrorConfig) withDefaults() MirrorConfig {
+	config := *m
+	if config.Percent == 0 {
+		config.Percent = DEFAULT_MIRROR_PERCENT
+	}
+	if config.Timeout == 0 {
+		config.Timeout = Duration(DEFAULT_MIRROR_TIMEOUT)
+	}
+	if config.MaxBody == 0 {
+		config.MaxBody = DEFAULT_MIRROR_MAX_BODY
+	}
+	return config
+}
+
+func (m *MirrorConfig) validate() error {
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidMirror)
+	}
+	if m.Timeout < 0 || m.MaxBody < 0 {
+		return fmt.Errorf("%w: timeout and max body must not be negative", ErrInvalidMirror)
+	}
+	if _, err := parseDest(m.Dest); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMirror, err)
+	}
+	return nil
+}
+
+type MirrorStatus struct {
+	Dest    string `json:"dest"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// mirror sends copies of requests to the mirror destination of a route
+type mirror struct {
+	sync.Mutex
+	closed   bool
+	config   MirrorConfig
+	dest     *url.URL
+	client   *http.Client
+	inFlight chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *log.Logger
+
+	sent    atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newMirror(config MirrorConfig, logger *log.Logger) (*mirror, error) {
+	config = config.withDefaults()
+	dest, err := parseDest(config.Dest)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mirror{
+		config: config,
+		dest:   dest,
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   time.Duration(config.Timeout),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+	}, nil
+}
+
+// sample decides if a request is mirrored
+func (m *mirror) sample() bool {
+	return m.config.Percent >= 100 || rand.Float64()*100 < m.config.Percent
+}
+
+// prepare copies the request for the mirror, the body is buffered and put
+// back so the primary request is left untouched. Nil is returned if the
+// request is not mirrored
+func (m *mirror) prepare(c *gin.Context, subPath string) *http.Request {
+	req := c.Request
+	if !m.sample() || req.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	body, ok, err := bufferBody(req, int64(m.config.MaxBody))
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil || !ok {
+		m.dropped.Add(1)
+		return nil
+	}
+	mirrored, err := copyRequest(m.ctx, m.dest, req, subPath, body)
+	if err != nil {
+		m.dropped.Add(1)
+		return nil
+	}
+	return mirrored
+}
+
+// copyRequest builds a copy of req for dest with the buffered body, the sub
+// path and query are kept the same way rewrite does for the primary
+func copyRequest(ctx context.Context, dest *url.URL, req *http.Request, subPath string, body []byte) (*http.Request, error) {
+	target := *dest
+	target.Path = joinPath(dest.Path, subPath)
+	target.RawPath = ""
+	target.RawQuery = mergeQuery(dest.RawQuery, req.URL.RawQuery)
+	copied, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copied.Header = req.Header.Clone()
+	for _, name := range hopHeaders {
+		copied.Header.Del(name)
+	}
+	return copied, nil
+}
+
+// send fires the mirrored request in the background, the exchange is passed
+// to record if the mirror records its traffic
+func (m *mirror) send(req *http.Request, patch, path, clientIP string, record func(*system.TrafficRecord)) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		<-m.inFlight
+		return
+	}
+	m.wg.Add(1)
+	m.Unlock()
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.inFlight }()
+		var body []byte
+		if req.GetBody != nil {
+			if reader, err := req.GetBody(); err == nil {
+				body, _ = io.ReadAll(reader)
+			}
+		}
+		started := time.Now()
+		resp, err := m.client.Do(req)
+		if err != nil {
+			m.failed.Add(1)
+			if m.ctx.Err() == nil {
+				m.logger.Printf("mirror of %s to %s failed: %s\n", patch, req.URL, err)
+			}
+			return
+		}
+		defer resp.Body.Close()
+		m.sent.Add(1)
+		if !m.config.Record {
+			io.Copy(io.Discard, resp.Body)
+			return
+		}
+		response := captureBuffer{max: m.config.MaxBody}
+		io.Copy(&response, resp.Body)
+		record(&system.TrafficRecord{
+			Patch:           patch,
+			Method:          req.Method,
+			Path:            path,
+			URL:             req.URL.String(),
+			RequestHeaders:  redactHeaders(req.Header),
+			RequestBody:     body,
+			RequestSize:     int64(len(body)),
+			Status:          resp.StatusCode,
+			ResponseHeaders: redactHeaders(resp.Header),
+			ResponseBody:    response.Bytes(),
+			ResponseSize:    response.size,
+			ClientIP:        clientIP,
+			StartedAt:       started.UTC(),
+			Duration:        time.Since(started),
+			Mirror:          true,
+		})
+	}()
+}
+
+func (m *mirror) status() *MirrorStatus {
+	return &MirrorStatus{
+		Dest:    m.dest.String(),
+		Sent:    m.sent.Load(),
+		Failed:  m.failed.Load(),
+		Dropped: m.dropped.Load(),
+	}
+}
+
+// close cancels the mirrored requests in flight and waits for them
+func (m *mirror) close() {
+	m.Lock()
+	m.closed = true
+	m.Unlock()
+	m.cancel()
+	m.wg.Wait()
+	m.client.CloseIdleConnections()
+}
+
+// hopHeaders are not passed on to the mirror, same as httputil.ReverseProxy does for the primary
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
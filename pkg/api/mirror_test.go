@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+type mirroredRequest struct {
+	method string
+	uri    string
+	body   string
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	received := make(chan mirroredRequest, 4)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- mirroredRequest{r.Method, r.URL.RequestURI(), string(body)}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path:   "mirrored",
+		Dest:   upstream.URL,
+		Mirror: &MirrorConfig{Dest: shadow.URL + "/shadow", Record: true},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	resp, err := http.Post(server.URL+"/api/v1/forward/mirrored/items?x=1", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// the mirror is still blocked, the client got its response regardless
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" {
+		t.Errorf("Expected the primary response, got %d %q", resp.StatusCode, body)
+	}
+	select {
+	case mirrored := <-received:
+		if mirrored.method != http.MethodPost || mirrored.uri != "/shadow/items?x=1" || mirrored.body != "payload" {
+			t.Errorf("Unexpected mirrored request %+v", mirrored)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the request to be mirrored")
+		t.FailNow()
+	}
+	close(release)
+
+	mirror := true
+	var records []*system.TrafficRecord
+	if !waitFor(time.Second, func() bool {
+		records, _ = store.Query(ctx, &system.TrafficFilter{Patch: "mirrored", Mirror: &mirror})
+		return len(records) == 1
+	}) {
+		t.Error("Expected the mirrored exchange to be recorded")
+		t.FailNow()
+	}
+	if record := records[0]; record.Status != http.StatusCreated || string(record.ResponseBody) != "shadow" ||
+		string(record.RequestBody) != "payload" || record.Path != "/mirrored/items" {
+		t.Errorf("Unexpected mirror record %+v", record)
+	}
+	status := patches.routes["mirrored"].status().MirrorStatus
+	if status == nil || status.Sent != 1 || status.Failed != 0 {
+		t.Errorf("Unexpected mirror status %+v", status)
+	}
+}
+
+func TestMirrorTimeout(t *testing.T) {
+	ctx := context.Background()
+	upstream := newTestUpstream()
+	defer upstream.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer shadow.Close()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path:   "mirrored",
+		Dest:   upstream.URL,
+		Mirror: &MirrorConfig{Dest: shadow.URL, Timeout: Duration(50 * time.Millisecond), MaxBody: 4},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, body := range []string{"", "too large"} {
+		resp, err := http.Post(server.URL+"/api/v1/forward/mirrored", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		resp.Body.Close()
+	}
+	if !waitFor(time.Second, func() bool {
+		status := patches.routes["mirrored"].status().MirrorStatus
+		return status.Failed == 1 && status.Dropped == 1
+	}) {
+		t.Errorf("Expected one timed out and one dropped mirror, got %+v", patches.routes["mirrored"].status().MirrorStatus)
+	}
+}
+
+func TestMirrorSample(t *testing.T) {
+	m, err := newMirror(MirrorConfig{Dest: "http://localhost:1", Percent: 25}, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if m.sample() {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("Expected about a quarter of the requests to be mirrored, got %d of 4000", sampled)
+	}
+
+	for _, config := range []MirrorConfig{
+		{Dest: "http://localhost:1", Percent: 101},
+		{Dest: "http://localhost:1", Timeout: Duration(-time.Second)},
+		{Dest: "localhost"},
+	} {
+		config := config
+		patch := ForwardPatch{Path: "mirror", Dest: "http://localhost:1", Mirror: &config}
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestCopyRequestQuery(t *testing.T) {
+	cases := []struct {
+		dest   string
+		target string
+		want   string
+	}{
+		{"http://mirror/base", "/svc/items", "http://mirror/base/items"},
+		{"http://mirror/base", "/svc/items?page=2", "http://mirror/base/items?page=2"},
+		{"http://mirror/base?key=value", "/svc/items", "http://mirror/base/items?key=value"},
+		{"http://mirror/base?key=value", "/svc/items?page=2", "http://mirror/base/items?key=value&page=2"},
+	}
+	for _, tc := range cases {
+		dest, err := url.Parse(tc.dest)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		copied, err := copyRequest(context.Background(), dest, req, "/items", nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := copied.URL.String(); got != tc.want {
+			t.Errorf("%s %s: expected %s, got %s", tc.dest, tc.target, tc.want, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,84 +11,558 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
 )
 
-var pathTable = make(map[string]*url.URL)
-
 var (
-	ErrApplyPatch = errors.New("failed to apply patch")
+	ErrApplyPatch   = errors.New("failed to apply patch")
+	ErrInvalidPatch = errors.New("invalid patch")
+	ErrPathExists   = errors.New("path already exists")
+	ErrPathNotFound = errors.New("path not found")
+	ErrLoadPatches  = errors.New("failed to load patches")
+	ErrNoHealthy    = errors.New("no healthy upstream")
 )
 
-// /api/v1/auth/patch routes
-func addPatchRoutes(patch *gin.RouterGroup) {
-	patch.PATCH("", applyPatch)
-	patch.GET("", getPatch)
-	patch.GET("/:dest", getPatch)
-	patch.DELETE("/:dest", deletePatch)
+// PatchControl holds the registered patches, the map is a cache of the
+// persisted state in the patch store and is written through on every change
+type PatchControl struct {
+	sync.RWMutex
+	store   system.PatchTable
+	traffic *trafficRecorder
+	replays *replayControl
+	// mismatching exchanges of patches in compare mode
+	comparisons system.CompareTable
+	limiter     cache.RateLimiter
+	objects     cache.ObjectCache
+	listen      ListenConfig
+	admins      AdminList
+	routes      map[string]*patchRoute
+	logger      *log.Logger
+}
+
+type patchRoute struct {
+	patch     ForwardPatch
+	balancer  *balancer
+	health    *healthChecker
+	recording *recordBuffer
+	rules     *ruleSet
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+	mirror    *mirror
+	compare   *comparer
+	split     *splitter
+	tcp       *tcpListener
+	udp       *udpListener
+}
+
+// newPatchRoute builds the runtime state of a patch, destinations of patches
+// without a health check are probed once if probe is set
+func newPatchRoute(patch ForwardPatch, probe bool, logger *log.Logger) (*patchRoute, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if err := validateVisibility(&patch); err != nil {
+		return nil, err
+	}
+	switch patch.Type {
+	case "", PATCH_HTTP:
+	case PATCH_TCP, PATCH_UDP:
+		balancer, err := newBalancer(&patch, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateListenerPatch(&patch, balancer, probe); err != nil {
+			return nil, err
+		}
+		return &patchRoute{patch: patch, balancer: balancer}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrPatchType, patch.Type)
+	}
+	rules, err := compileRules(patch.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Stream != nil {
+		if err := patch.Stream.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.RateLimit != nil {
+		if err := patch.RateLimit.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Breaker != nil {
+		if err := patch.Breaker.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Retry != nil {
+		if err := patch.Retry.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Cache != nil {
+		if err := patch.Cache.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Mirror != nil {
+		if err := patch.Mirror.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Compare != nil {
+		if err := patch.Compare.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Split != nil {
+		if err := patch.Split.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Health != nil {
+		if err := patch.Health.validate(); err != nil {
+			return nil, err
+		}
+		probe = false
+	}
+	balancer, err := newBalancer(&patch, probe)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Breaker != nil {
+		config := patch.Breaker.withDefaults()
+		for _, up := range balancer.upstreams {
+			up.breaker = newBreaker(fmt.Sprintf("%s -> %s", patch.Path, up.dest), config, logger)
+		}
+	}
+	stream := patch.Stream.withDefaults()
+	transport := newTransport(stream)
+	var roundTripper http.RoundTripper = transport
+	if patch.Retry != nil {
+		roundTripper = newRetryTransport(transport, patch.Retry.compile(), logger)
+	}
+	route := &patchRoute{
+		patch:     patch,
+		balancer:  balancer,
+		rules:     rules,
+		transport: transport,
+		proxy:     newProxy(logger, rules, roundTripper, stream.flushInterval()),
+	}
+	if patch.Record != nil {
+		route.recording = newRecordBuffer(*patch.Record)
+	}
+	if patch.Mirror != nil {
+		if route.mirror, err = newMirror(*patch.Mirror, logger); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Compare != nil {
+		if route.compare, err = newComparer(*patch.Compare, rules, logger); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Split != nil {
+		if route.split, err = newSplitter(&patch, probe, logger); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Health != nil {
+		route.health = startHealthChecks(balancer, *patch.Health, logger)
+	}
+	return route, nil
+}
+
+// close stops the background work of the route
+func (r *patchRoute) close() {
+	if r.health != nil {
+		r.health.stop()
+	}
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
+	if r.mirror != nil {
+		r.mirror.close()
+	}
+	if r.compare != nil {
+		r.compare.close()
+	}
+	if r.split != nil {
+		r.split.close()
+	}
+	if r.tcp != nil {
+		r.tcp.closeIf(r.balancer)
+	}
+	if r.udp != nil {
+		r.udp.closeIf(r.balancer)
+	}
+}
+
+func (r *patchRoute) status() PatchStatus {
+	status := PatchStatus{
+		ForwardPatch: r.patch,
+		Status:       r.balancer.status(),
+	}
+	if r.mirror != nil {
+		status.MirrorStatus = r.mirror.status()
+	}
+	if r.compare != nil {
+		status.CompareStatus = r.compare.status()
+	}
+	if r.split != nil {
+		status.SplitStatus = r.split.balancer.status()
+	}
+	if r.tcp != nil {
+		status.TCP = r.tcp.status()
+	}
+	if r.udp != nil {
+		status.UDP = r.udp.status()
+	}
+	return status
+}
+
+// NewPatchControl picks the patch, traffic and compare stores, the rate limiter,
+// the response cache and the admins from args, missing ones are replaced by
+// in memory ones
+func NewPatchControl(logger *log.Logger, args ...any) *PatchControl {
+	if logger == nil {
+		logger = log.Default()
+	}
+	store, ok := findArg[system.PatchTable](args)
+	if !ok {
+		store = system.NewPatchIMDB()
+	}
+	trafficStore, ok := findArg[system.TrafficTable](args)
+	if !ok {
+		trafficStore = system.NewTrafficIMDB()
+	}
+	compareStore, ok := findArg[system.CompareTable](args)
+	if !ok {
+		compareStore = system.NewCompareIMDB()
+	}
+	listen, ok := findArg[ListenConfig](args)
+	if !ok {
+		listen = ListenConfig{Host: "127.0.0.1"}
+	}
+	admins, _ := findArg[AdminList](args)
+	limiter, ok := findArg[cache.RateLimiter](args)
+	if !ok {
+		limiter = cache.NewMemoryLimiter()
+	}
+	objects, ok := findArg[cache.ObjectCache](args)
+	if !ok {
+		objects = cache.NewMemoryCache()
+	}
+	return &PatchControl{
+		store:       store,
+		traffic:     newTrafficRecorder(trafficStore, logger),
+		replays:     newReplayControl(),
+		comparisons: compareStore,
+		limiter:     limiter,
+		objects:     objects,
+		listen:      listen,
+		admins:      admins,
+		routes:      make(map[string]*patchRoute),
+		logger:      logger,
+	}
+}
+
+// findArg returns the first arg of type T
+func findArg[T any](args []any) (T, bool) {
+	for _, arg := range args {
+		if val, ok := arg.(T); ok {
+			return val, true
+		}
+	}
+	var empty T
+	return empty, false
+}
+
+// /patch routes
+func (pc *PatchControl) addPatchRoutes(patch *gin.RouterGroup) {
+	patch.PATCH("", pc.applyPatch)
+	patch.GET("", pc.getPatch)
+	patch.GET("/:dest", pc.getPatch)
+	patch.DELETE("/:dest", pc.deletePatch)
+	patch.PUT("/:dest/split", pc.putSplit)
+	patch.DELETE("/:dest/split", pc.deleteSplit)
 }
 
 type ForwardPatch struct {
-	Path string `json:"path"`
-	Dest string `json:"dest"`
+	Path       string           `json:"path"`
+	Dest       string           `json:"dest,omitempty"`
+	Upstreams  []Upstream       `json:"upstreams,omitempty"`
+	Strategy   string           `json:"strategy,omitempty"`
+	HashHeader string           `json:"hash_header,omitempty"`
+	Health     *HealthCheck     `json:"health,omitempty"`
+	Capture    *CaptureConfig   `json:"capture,omitempty"`
+	Record     *RecordConfig    `json:"record,omitempty"`
+	Rules      []RewriteRule    `json:"rules,omitempty"`
+	Stream     *StreamConfig    `json:"stream,omitempty"`
+	RateLimit  *RateLimitConfig `json:"rate_limit,omitempty"`
+	Breaker    *BreakerConfig   `json:"breaker,omitempty"`
+	Retry      *RetryPolicy     `json:"retry,omitempty"`
+	Cache      *CacheConfig     `json:"cache,omitempty"`
+	Mirror     *MirrorConfig    `json:"mirror,omitempty"`
+	Compare    *CompareConfig   `json:"compare,omitempty"`
+	Split      *SplitConfig     `json:"split,omitempty"`
+	// user who created the patch, set from the session. Patches without owner
+	// are modified by admins only
+	Owner      string   `json:"owner,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+	SharedWith []string `json:"shared_with,omitempty"`
+	// tcp and udp patches relay the local port to the upstreams
+	Type string     `json:"type,omitempty"`
+	Port int        `json:"port,omitempty"`
+	UDP  *UDPConfig `json:"udp,omitempty"`
 }
 
-func getPatch(c *gin.Context) {
+// Duration is a time.Duration written as a string like "1m30s" in patch specs
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+type PatchStatus struct {
+	ForwardPatch
+	Status        []UpstreamStatus `json:"status"`
+	MirrorStatus  *MirrorStatus    `json:"mirror_status,omitempty"`
+	CompareStatus *CompareStatus   `json:"compare_status,omitempty"`
+	SplitStatus   []UpstreamStatus `json:"split_status,omitempty"`
+	TCP           *TCPStatus       `json:"tcp,omitempty"`
+	UDP           *UDPStatus       `json:"udp,omitempty"`
+}
+
+// getPatch lists the patches visible to the user of the request
+func (pc *PatchControl) getPatch(c *gin.Context) {
 	path := c.Param("dest")
+	pc.RLock()
+	defer pc.RUnlock()
 	if path == "" {
-		c.JSON(http.StatusOK, pathTable)
+		patches := make(map[string]PatchStatus, len(pc.routes))
+		for path, route := range pc.routes {
+			if pc.canView(c, &route.patch) {
+				patches[path] = route.status()
+			}
+		}
+		c.JSON(http.StatusOK, patches)
 		return
 	}
-	if dest, ok := pathTable[path]; ok {
-		c.JSON(http.StatusOK, dest)
+	if route, ok := pc.routes[sanitizePath(path)]; ok && pc.canView(c, &route.patch) {
+		c.JSON(http.StatusOK, route.status())
 		return
 	}
 	c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
 }
 
-func deletePatch(c *gin.Context) {
+func (pc *PatchControl) deletePatch(c *gin.Context) {
 	path := c.Param("dest")
 	if path == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "path cannot be empty"})
 		return
 	}
-	if _, ok := pathTable[path]; ok {
-		delete(pathTable, path)
-		c.JSON(http.StatusOK, gin.H{"message": "path deleted"})
+	if err := pc.authorizePatch(c, path, true); err != nil {
+		pc.respondPatchError(c, err)
 		return
 	}
-	c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+	if err := pc.unregisterPath(c, path); err != nil {
+		if errors.Is(err, ErrPathNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+			return
+		}
+		pc.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete path"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "path deleted"})
 }
 
-func applyPatch(c *gin.Context) {
+func (pc *PatchControl) applyPatch(c *gin.Context) {
 	var patch ForwardPatch
 	if err := c.ShouldBindJSON(&patch); err != nil {
-		log.Println(err)
+		pc.logger.Println(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": ErrApplyPatch})
 		return
 	}
-	log.Println("applying patch via api")
-	if err := registerPath(patch.Path, patch.Dest); err != nil {
-		log.Println(err)
+	pc.logger.Println("applying patch via api")
+	// existing patches are replaced if the user may modify them, they keep their owner
+	patch.Owner = requestUser(c)
+	replace := false
+	pc.RLock()
+	existing, exists := pc.routes[sanitizePath(patch.Path)]
+	pc.RUnlock()
+	if exists {
+		if err := pc.authorizePatch(c, patch.Path, true); err != nil {
+			pc.respondPatchError(c, err)
+			return
+		}
+		patch.Owner, replace = existing.patch.Owner, true
+	}
+	if err := pc.registerPath(c, patch, replace); err != nil {
+		pc.logger.Println(err)
+		if errors.Is(err, ErrInvalidPatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": ErrApplyPatch})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "patch applied"})
 }
 
-func registerPath(path, dest string) error {
+// registerPath validates the patch, persists it and adds it to the cache,
+// existing paths are only overwritten if replace is set. Errors of the spec wrap ErrInvalidPatch
+func (pc *PatchControl) registerPath(ctx context.Context, patch ForwardPatch, replace bool) error {
+	patch.Path = sanitizePath(patch.Path)
+	pc.RLock()
+	_, exists := pc.routes[patch.Path]
+	pc.RUnlock()
+	if exists && !replace {
+		return ErrPathExists
+	}
+	route, err := newPatchRoute(patch, true, pc.logger)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+	undo := route.close
+	if !patch.isHTTP() {
+		pc.RLock()
+		old := pc.routes[patch.Path]
+		pc.RUnlock()
+		if undo, err = pc.listenPatch(route, old); err != nil {
+			return err
+		}
+	}
+	spec, err := json.Marshal(patch)
+	if err != nil {
+		undo()
+		return err
+	}
+	if err := pc.store.Save(ctx, system.NewPatchRecord(patch.Path, string(spec))); err != nil {
+		undo()
+		return err
+	}
+	pc.logger.Printf("Adding path %s -> %d upstream(s)\n", patch.Path, len(route.balancer.upstreams))
+	pc.Lock()
+	old := pc.routes[patch.Path]
+	pc.routes[patch.Path] = route
+	pc.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// updatePatch changes a registered patch without rebuilding it, routes are
+// never changed in place so update works on a copy which then replaces the route
+func (pc *PatchControl) updatePatch(ctx context.Context, path string, update func(route *patchRoute) error) error {
 	path = sanitizePath(path)
-	if _, ok := pathTable[path]; ok {
-		return errors.New("path already exists")
+	pc.Lock()
+	defer pc.Unlock()
+	route, ok := pc.routes[path]
+	if !ok {
+		return ErrPathNotFound
+	}
+	updated := *route
+	if err := update(&updated); err != nil {
+		return err
 	}
-	var url *url.URL
-	var err error
-	if url, err = validatePath(dest); err != nil {
+	spec, err := json.Marshal(updated.patch)
+	if err != nil {
 		return err
 	}
-	log.Printf("Adding path %s -> %s\n", path, dest)
-	pathTable[path] = url
+	if err := pc.store.Save(ctx, system.NewPatchRecord(path, string(spec))); err != nil {
+		return err
+	}
+	pc.routes[path] = &updated
+	return nil
+}
+
+func (pc *PatchControl) unregisterPath(ctx context.Context, path string) error {
+	path = sanitizePath(path)
+	pc.RLock()
+	_, ok := pc.routes[path]
+	pc.RUnlock()
+	if !ok {
+		return ErrPathNotFound
+	}
+	if err := pc.store.DeleteByPath(ctx, path); err != nil {
+		return err
+	}
+	pc.logger.Printf("Removing path %s\n", path)
+	pc.Lock()
+	route := pc.routes[path]
+	delete(pc.routes, path)
+	pc.Unlock()
+	if route != nil {
+		route.close()
+	}
+	return nil
+}
+
+// Close stops the background work of all patches
+func (pc *PatchControl) Close() {
+	// running replays read the routes, they are stopped before the lock is taken
+	pc.replays.cancelAll()
+	pc.Lock()
+	defer pc.Unlock()
+	for _, route := range pc.routes {
+		route.close()
+	}
+	pc.traffic.close()
+}
+
+// Load fills the cache from the patch store, destinations are not probed
+// as they might not be reachable yet while the system is starting up
+func (pc *PatchControl) Load(ctx context.Context) error {
+	records, err := pc.store.GetAll(ctx)
+	if err != nil {
+		pc.logger.Println(err)
+		return ErrLoadPatches
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	for _, record := range records {
+		var patch ForwardPatch
+		if err := json.Unmarshal([]byte(record.Spec), &patch); err != nil {
+			pc.logger.Printf("skipping stored patch %s: %s\n", record.Path, err)
+			continue
+		}
+		route, err := newPatchRoute(patch, false, pc.logger)
+		if err != nil {
+			pc.logger.Printf("skipping stored patch %s: %s\n", record.Path, err)
+			continue
+		}
+		if !patch.isHTTP() {
+			if _, err := pc.listenPatch(route, nil); err != nil {
+				pc.logger.Printf("skipping stored patch %s: %s\n", record.Path, err)
+				continue
+			}
+		}
+		pc.routes[record.Path] = route
+	}
+	pc.logger.Printf("Loaded %d patches from store\n", len(pc.routes))
 	return nil
 }
 
@@ -97,6 +572,19 @@ func sanitizePath(path string) string {
 }
 
 func validatePath(rawurl string) (*url.URL, error) {
+	url, err := parseDest(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if resp, err := http.DefaultClient.Get(url.String()); err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("path is not reachable")
+	}
+	return url, nil
+}
+
+func parseDest(rawurl string) (*url.URL, error) {
 	if rawurl == "" {
 		return nil, errors.New("path cannot be empty")
 	}
@@ -119,65 +607,286 @@ func validatePath(rawurl string) (*url.URL, error) {
 			return nil, errors.New("path must contain a port")
 		}
 	}
-	if resp, err := http.DefaultClient.Get(url.String()); err != nil {
-		return nil, err
-	} else if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("path is not reachable")
-	}
 	return url, nil
 }
 
-func ForwardRequest(c *gin.Context) {
-	log.Println("Forwarding request...")
-	path := c.Param("dest")
-	dest, ok := pathTable[path]
+// /api/v1/forward routes
+func (pc *PatchControl) addForwardRoutes(forward *gin.RouterGroup) {
+	forward.Any("/*path", pc.ForwardRequest)
+}
+
+// ForwardRequest proxies the request to the patch with the longest matching prefix,
+// the remaining sub path and the query are kept
+func (pc *PatchControl) ForwardRequest(c *gin.Context) {
+	route, subPath, ok := pc.lookup(c.Param("path"))
 	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
 		return
 	}
-	c.Request = rewrite(dest, c.Request)
-	c.Request.Header.Set("X-Forwarded-For", c.ClientIP())
-	c.Request.Header.Set("X-Forwarded-Host", c.Request.Host)
-	c.Request.Header.Set("X-Forwarded-Proto", c.Request.Proto)
+	pc.logger.Printf("Forwarding request %s to %s\n", c.Request.URL.Path, route.patch.Path)
+	if !pc.allowRequest(c, route) {
+		return
+	}
+	// the session of the client is not passed on to the upstreams, mirrors and captures,
+	// the user limits above have to read it first
+	stripCookie(c.Request, SESSION_COOKIE)
+	// the split is decided on the request as sent by the client
+	pool, alternate := route.balancer, false
+	if route.split != nil {
+		cookiePath := strings.TrimSuffix(c.Request.URL.Path, subPath)
+		if cookiePath == "" {
+			cookiePath = "/"
+		}
+		if alternate = route.split.alternate(c, cookiePath); alternate {
+			pool = route.split.balancer
+		}
+	}
+	var ex *exchange
+	if route.patch.Capture != nil || route.recording != nil {
+		ex = startCapture(c, route.patch.Path, route.captureMaxBody())
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	rc := &ruleContext{
+		host:     c.Request.Host,
+		scheme:   scheme,
+		clientIP: c.ClientIP(),
+		method:   c.Request.Method,
+		path:     c.Request.URL.Path,
+	}
+	subPath = route.rules.applyRequest(c.Request, subPath, rc)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ruleContextKey{}, rc))
+	if route.mirror != nil {
+		if mirrored := route.mirror.prepare(c, subPath); mirrored != nil {
+			route.mirror.send(mirrored, route.patch.Path, c.Param("path"), c.ClientIP(), pc.traffic.record)
+		}
+	}
+	if route.patch.Cache != nil {
+		call, served := pc.lookupCache(c, route, subPath, alternate)
+		if served {
+			pc.recordExchange(route, ex, c.Request.URL.String(), nil)
+			return
+		}
+		if call != nil {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), cacheCallKey{}, call))
+		}
+	}
+	upstream := pool.next(c.Request, c.ClientIP())
+	if upstream == nil {
+		respondUnavailable(c, pool)
+		return
+	}
+	req, call, retry, ok := guardRequest(c.Request, route, upstream)
+	if !ok {
+		respondUnavailable(c, pool)
+		return
+	}
+	if call != nil {
+		defer call.abandon()
+	}
+	c.Request = req
+	upstream.acquire()
+	defer upstream.release()
+	var compared *comparison
+	if route.compare != nil {
+		compared = route.compare.start(c, subPath, route.patch.Path, pc.saveComparison)
+	}
+	c.Request = rewrite(upstream.dest, c.Request, subPath)
+	if compared != nil {
+		defer compared.finish(c.Request.URL.String())
+	}
+	route.proxy.ServeHTTP(c.Writer, c.Request)
+	if retry != nil {
+		c.Set(attemptsKey, retry.attempts)
+	}
+	if retry != nil && retry.attempts > 1 {
+		pc.logger.Printf("Forwarded request %s to %s in %d attempts\n", c.Request.URL.Path, upstream.dest.Host, retry.attempts)
+	}
+	pc.recordExchange(route, ex, c.Request.URL.String(), retry)
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(dest)
-	proxy.ServeHTTP(c.Writer, c.Request)
+// guardRequest stores the breaker call of up and the retry state of the route
+// in the context of req for the proxy hooks, ok is false while the circuit of
+// up is open. A returned call has to be abandoned once the request is done
+func guardRequest(req *http.Request, route *patchRoute, up *upstream) (*http.Request, *breakerCall, *retryState, bool) {
+	var call *breakerCall
+	if up.breaker != nil {
+		probe, ok := up.breaker.allow(time.Now())
+		if !ok {
+			return req, nil, nil, false
+		}
+		call = &breakerCall{breaker: up.breaker, probe: probe, start: time.Now()}
+		req = req.WithContext(context.WithValue(req.Context(), breakerCallKey{}, call))
+	}
+	var retry *retryState
+	if route.patch.Retry != nil {
+		retry = &retryState{}
+		req = req.WithContext(context.WithValue(req.Context(), retryStateKey{}, retry))
+	}
+	return req, call, retry, true
 }
 
-func rewrite(dest *url.URL, req *http.Request) *http.Request {
+// recordExchange passes a finished exchange to the recording and the traffic capture of the route
+func (pc *PatchControl) recordExchange(route *patchRoute, ex *exchange, upstreamURL string, retry *retryState) {
+	if ex == nil {
+		return
+	}
+	record := ex.finish(upstreamURL)
+	if retry != nil {
+		record.Attempts = retry.attempts
+	}
+	if route.recording != nil {
+		route.recording.add(record, ex.response.wait())
+	}
+	if route.patch.Capture != nil {
+		pc.traffic.record(truncateRecord(record, route.patch.Capture.maxBody()))
+	}
+}
+
+// lookup finds the patch with the longest prefix of path, matching only on
+// whole path segments, and returns it together with the remaining sub path
+func (pc *PatchControl) lookup(path string) (*patchRoute, string, bool) {
+	path = sanitizePath(path)
+	pc.RLock()
+	defer pc.RUnlock()
+	prefix := path
+	for {
+		if route, ok := pc.routes[prefix]; ok && route.patch.isHTTP() {
+			return route, path[len(prefix):], true
+		}
+		if prefix == "" {
+			return nil, "", false
+		}
+		if i := strings.LastIndex(prefix, "/"); i >= 0 {
+			prefix = prefix[:i]
+		} else {
+			prefix = ""
+		}
+	}
+}
+
+func rewrite(dest *url.URL, req *http.Request, subPath string) *http.Request {
 	req.Host = dest.Host
-	req.RequestURI = dest.RequestURI()
+	req.RequestURI = ""
 	req.URL.Host = dest.Host
 	req.URL.Scheme = dest.Scheme
-	req.URL.Path = dest.Path
-	req.URL.RawQuery = dest.RawQuery
-	req.URL.Fragment = dest.Fragment
+	req.URL.Path = joinPath(dest.Path, subPath)
+	req.URL.RawPath = ""
+	req.URL.RawQuery = mergeQuery(dest.RawQuery, req.URL.RawQuery)
+	req.URL.Fragment = ""
 	return req
 }
 
-type Patch struct {
-	Path string `json:"path"`
-	Dest string `json:"dest"`
+// mergeQuery appends the query of the request to the one of the destination
+func mergeQuery(destQuery, reqQuery string) string {
+	if destQuery == "" || reqQuery == "" {
+		return destQuery + reqQuery
+	}
+	return destQuery + "&" + reqQuery
+}
+
+// stripCookie removes the cookie name from the Cookie headers of req, headers
+// left without cookies are dropped
+func stripCookie(req *http.Request, name string) {
+	lines := req.Header.Values("Cookie")
+	if len(lines) == 0 {
+		return
+	}
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		parts := strings.Split(line, ";")
+		cookies := make([]string, 0, len(parts))
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if cookieName, _, _ := strings.Cut(part, "="); part != "" && cookieName != name {
+				cookies = append(cookies, part)
+			}
+		}
+		if len(cookies) > 0 {
+			kept = append(kept, strings.Join(cookies, "; "))
+		}
+	}
+	req.Header.Del("Cookie")
+	for _, line := range kept {
+		req.Header.Add("Cookie", line)
+	}
+}
+
+func joinPath(base, subPath string) string {
+	if subPath == "" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	if !strings.HasPrefix(subPath, "/") {
+		subPath = "/" + subPath
+	}
+	return strings.TrimSuffix(base, "/") + subPath
+}
+
+// ruleContextKey stores the ruleContext of a forwarded request for the response rules
+type ruleContextKey struct{}
+
+// newProxy creates the reverse proxy for a route, requests are already
+// rewritten by ForwardRequest so the director is left empty
+func newProxy(logger *log.Logger, rules *ruleSet, transport http.RoundTripper, flushInterval time.Duration) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:      func(req *http.Request) {},
+		Transport:     transport,
+		FlushInterval: flushInterval,
+		ErrorLog:      logger,
+		ModifyResponse: func(resp *http.Response) error {
+			if call, ok := resp.Request.Context().Value(breakerCallKey{}).(*breakerCall); ok {
+				call.respond(resp.StatusCode)
+			}
+			if len(rules.response) > 0 {
+				rc, _ := resp.Request.Context().Value(ruleContextKey{}).(*ruleContext)
+				if rc == nil {
+					rc = &ruleContext{}
+				}
+				rules.applyResponse(resp, rc)
+			}
+			// cached responses already have the response rules applied
+			if call, ok := resp.Request.Context().Value(cacheCallKey{}).(*cacheCall); ok {
+				call.respond(resp)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if call, ok := req.Context().Value(breakerCallKey{}).(*breakerCall); ok {
+				call.fail(req.Context().Err() != nil)
+			}
+			logger.Printf("http: proxy error: %v", err)
+			if replayed, ok := w.(*replayWriter); ok {
+				replayed.err = err
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
 }
 
 type PatchList struct {
-	Patches []Patch `json:"patches"`
+	Patches []ForwardPatch `json:"patches"`
 }
 
 func ParsePatches(raw string) (PatchList, error) {
-	var patches []Patch
+	var patches []ForwardPatch
 	if err := json.Unmarshal([]byte(raw), &patches); err != nil {
 		return PatchList{Patches: patches}, err
 	}
 	return PatchList{Patches: patches}, nil
 }
 
-func (p PatchList) Apply() error {
+// Apply registers the patches, replacing any persisted patch with the same path
+func (p PatchList) Apply(ctx context.Context, pc *PatchControl) error {
 	if os.Getenv("ENVIRONMENT") == "DEVELOPMENT" {
 		fmt.Printf("Patches: %v\n", p.Patches)
 	}
 	for _, patch := range p.Patches {
-		if err := registerPath(patch.Path, patch.Dest); err != nil {
+		if err := pc.registerPath(ctx, patch, true); err != nil {
 			return err
 		}
 	}
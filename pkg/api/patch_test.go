@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func newTestUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestPatchPersistence(t *testing.T) {
+	ctx := context.Background()
+	upstream := newTestUpstream()
+	defer upstream.Close()
+
+	store := system.NewPatchIMDB()
+	patches := NewPatchControl(nil, store)
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "/persist", Dest: upstream.URL}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, err := store.GetByPath(ctx, "persist"); err != nil {
+		t.Error("patch was not written to the store")
+	}
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "persist", Dest: upstream.URL}, false); err != ErrPathExists {
+		t.Errorf("Expected %v, got %v", ErrPathExists, err)
+	}
+
+	// a fresh control simulates a restart
+	reloaded := NewPatchControl(nil, store)
+	if err := reloaded.Load(ctx); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	route, ok := reloaded.routes["persist"]
+	if !ok {
+		t.Error("patch was not loaded from the store")
+		t.FailNow()
+	}
+	if route.patch.Dest != upstream.URL {
+		t.Errorf("Expected dest %s, got %s", upstream.URL, route.patch.Dest)
+	}
+
+	if err := reloaded.unregisterPath(ctx, "persist"); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.GetByPath(ctx, "persist"); err == nil {
+		t.Error("patch was not removed from the store")
+	}
+	if err := reloaded.unregisterPath(ctx, "persist"); err != ErrPathNotFound {
+		t.Errorf("Expected %v, got %v", ErrPathNotFound, err)
+	}
+}
+
+func TestForwardRequest(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Method", r.Method)
+		w.Header().Set("X-Upstream-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	patches := TEST_SERVER.patches
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "svc", Dest: upstream.URL + "/base?key=value"}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer patches.unregisterPath(ctx, "svc")
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "svc/v2", Dest: upstream.URL + "/next"}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer patches.unregisterPath(ctx, "svc/v2")
+
+	cases := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/svc", "/base?key=value"},
+		{http.MethodGet, "/svc/users/1?page=2", "/base/users/1?key=value&page=2"},
+		{http.MethodPost, "/svc/v2/items", "/next/items"},
+		{http.MethodDelete, "/svc/v2", "/next"},
+		{http.MethodGet, "/svc/v22", "/base/v22?key=value"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, TEST_SERVER.Addr("/api/v1/forward"+tc.path), nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(body) != tc.want {
+			t.Errorf("%s %s: expected %s, got %s", tc.method, tc.path, tc.want, string(body))
+		}
+		if method := resp.Header.Get("X-Upstream-Method"); method != tc.method {
+			t.Errorf("Expected method %s, got %s", tc.method, method)
+		}
+		if host := resp.Header.Get("X-Upstream-Host"); host != "localhost:12345" {
+			t.Errorf("Expected forwarded host localhost:12345, got %s", host)
+		}
+	}
+
+	resp, err := http.DefaultClient.Get(TEST_SERVER.Addr("/api/v1/forward/unknown"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestApplyPatchInvalid(t *testing.T) {
+	patches := NewPatchControl(nil, AdminList{"admin"})
+	defer patches.Close()
+	router := gin.New()
+	patches.addPatchRoutes(router.Group("/patch", withUser("admin")))
+
+	dest := "http://localhost:1"
+	cases := []struct {
+		want  error
+		patch ForwardPatch
+	}{
+		{ErrInvalidVisibility, ForwardPatch{Dest: dest, Visibility: "secret"}},
+		{ErrPatchType, ForwardPatch{Dest: dest, Type: "udpx"}},
+		{ErrInvalidRule, ForwardPatch{Dest: dest, Rules: []RewriteRule{{Action: "unknown"}}}},
+		{ErrInvalidStream, ForwardPatch{Dest: dest, Stream: &StreamConfig{IdleTimeout: Duration(-time.Second)}}},
+		{ErrInvalidRateLimit, ForwardPatch{Dest: dest, RateLimit: &RateLimitConfig{IP: &RateLimit{Window: Duration(time.Second)}}}},
+		{ErrInvalidBreaker, ForwardPatch{Dest: dest, Breaker: &BreakerConfig{ErrorRate: 1.5}}},
+		{ErrInvalidRetry, ForwardPatch{Dest: dest, Retry: &RetryPolicy{Attempts: MAX_RETRY_ATTEMPTS + 1}}},
+		{ErrInvalidCache, ForwardPatch{Dest: dest, Cache: &CacheConfig{TTL: Duration(-time.Second)}}},
+		{ErrInvalidMirror, ForwardPatch{Dest: dest, Mirror: &MirrorConfig{Dest: dest, Percent: 101}}},
+		{ErrInvalidCompare, ForwardPatch{Dest: dest, Compare: &CompareConfig{Dest: dest, Percent: -1}}},
+		{ErrInvalidSplit, ForwardPatch{Dest: dest, Split: &SplitConfig{Upstreams: []Upstream{{Dest: dest}}, Percent: 101}}},
+		{ErrHealthCheck, ForwardPatch{Dest: dest, Health: &HealthCheck{StatusMin: 500}}},
+		{ErrUnknownStrategy, ForwardPatch{Dest: dest, Strategy: "random"}},
+		{ErrInvalidWeight, ForwardPatch{Upstreams: []Upstream{{Dest: dest, Weight: -1}}}},
+		{ErrInvalidPort, ForwardPatch{Type: PATCH_TCP, Dest: "tcp://localhost:1", Port: 70000}},
+		{ErrHTTPOption, ForwardPatch{Type: PATCH_TCP, Dest: "tcp://localhost:1", Capture: &CaptureConfig{}}},
+		{ErrUDPOption, ForwardPatch{Type: PATCH_TCP, Dest: "tcp://localhost:1", UDP: &UDPConfig{}}},
+		{ErrInvalidUDP, ForwardPatch{Type: PATCH_UDP, Dest: "udp://localhost:53", UDP: &UDPConfig{MaxSessions: -1}}},
+	}
+	for i, tc := range cases {
+		tc.patch.Path = "invalid" + strconv.Itoa(i)
+		err := patches.registerPath(context.Background(), tc.patch, false)
+		if !errors.Is(err, ErrInvalidPatch) || !errors.Is(err, tc.want) {
+			t.Errorf("%v: expected an invalid patch, got %v", tc.want, err)
+			continue
+		}
+		body, _ := json.Marshal(tc.patch)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPatch, "/patch", bytes.NewReader(body)))
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), tc.want.Error()) {
+			t.Errorf("%v: expected the reason in a bad request, got %d %s", tc.want, resp.Code, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
+)
+
+const (
+	rateLimitPrefix = "ratelimit"
+)
+
+var (
+	ErrInvalidRateLimit = errors.New("invalid rate limit")
+)
+
+// RateLimit allows limit requests per window with bursts of up to burst requests
+type RateLimit struct {
+	Limit  int      `json:"limit"`
+	Window Duration `json:"window"`
+	Burst  int      `json:"burst,omitempty"`
+}
+
+func (r *RateLimit) rate() cache.Rate {
+	return cache.Rate{Limit: r.Limit, Window: time.Duration(r.Window), Burst: r.Burst}
+}
+
+// RateLimitConfig throttles a patch as a whole, per authenticated user and per client ip,
+// a request has to pass every configured limit
+type RateLimitConfig struct {
+	Patch *RateLimit `json:"patch,omitempty"`
+	User  *RateLimit `json:"user,omitempty"`
+	IP    *RateLimit `json:"ip,omitempty"`
+}
+
+func (r *RateLimitConfig) validate() error {
+	for scope, limit := range map[string]*RateLimit{"patch": r.Patch, "user": r.User, "ip": r.IP} {
+		if limit == nil {
+			continue
+		}
+		if err := limit.rate().Validate(); err != nil {
+			return fmt.Errorf("%w for %s: %s", ErrInvalidRateLimit, scope, err)
+		}
+	}
+	return nil
+}
+
+type rateLimitCheck struct {
+	key   string
+	limit *RateLimit
+}
+
+// checks returns the limits that apply to the request
+func (r *RateLimitConfig) checks(c *gin.Context, patch string) []rateLimitCheck {
+	checks := make([]rateLimitCheck, 0, 3)
+	if r.Patch != nil {
+		checks = append(checks, rateLimitCheck{fmt.Sprintf("%s:%s:patch", rateLimitPrefix, patch), r.Patch})
+	}
+	if r.User != nil {
+		if user, ok := internal.SessionUser(c); ok {
+			checks = append(checks, rateLimitCheck{fmt.Sprintf("%s:%s:user:%s", rateLimitPrefix, patch, user), r.User})
+		}
+	}
+	if r.IP != nil {
+		checks = append(checks, rateLimitCheck{fmt.Sprintf("%s:%s:ip:%s", rateLimitPrefix, patch, c.ClientIP()), r.IP})
+	}
+	return checks
+}
+
+// allowRequest checks the rate limits of the route and writes the RateLimit
+// headers of the most restrictive one, a throttled request is answered with
+// 429 and false is returned. Limits fail open if the limiter is not reachable
+func (pc *PatchControl) allowRequest(c *gin.Context, route *patchRoute) bool {
+	if route.patch.RateLimit == nil {
+		return true
+	}
+	var tightest *cache.RateResult
+	for _, check := range route.patch.RateLimit.checks(c, route.patch.Path) {
+		result, err := pc.limiter.Allow(c, check.key, check.limit.rate())
+		if err != nil {
+			pc.logger.Println("error checking rate limit:", err)
+			continue
+		}
+		if tightest == nil || moreRestrictive(result, tightest) {
+			tightest = result
+		}
+	}
+	if tightest == nil {
+		return true
+	}
+	c.Header("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+	if tightest.Allowed {
+		return true
+	}
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+	return false
+}
+
+func moreRestrictive(a, b *cache.RateResult) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
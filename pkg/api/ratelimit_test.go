@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	upstream := newTestUpstream()
+	defer upstream.Close()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	users := system.NewUserIMDB()
+	if _, err := users.Create(ctx, "alice", "", "alicepass"); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches, users)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path: "limited",
+		Dest: upstream.URL,
+		RateLimit: &RateLimitConfig{
+			Patch: &RateLimit{Limit: 10, Window: Duration(time.Minute)},
+			IP:    &RateLimit{Limit: 2, Window: Duration(time.Minute)},
+			User:  &RateLimit{Limit: 1, Window: Duration(time.Minute)},
+		},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Get(server.URL + "/api/v1/forward/limited")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Request %d: expected %d, got %d", i, want, resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "2" {
+			t.Errorf("Expected the ip limit to be the tightest, got %s", resp.Header.Get("RateLimit-Limit"))
+		}
+		if remaining := resp.Header.Get("RateLimit-Remaining"); want == http.StatusOK && remaining != strconv.Itoa(1-i) {
+			t.Errorf("Request %d: unexpected remaining %s", i, remaining)
+		}
+		if want == http.StatusTooManyRequests {
+			if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retry <= 0 || retry > 30 {
+				t.Errorf("Expected Retry-After in seconds, got %s", resp.Header.Get("Retry-After"))
+			}
+		}
+	}
+
+	// the user limit only applies to requests of an authenticated session
+	jar, _ := cookiejar.New(nil)
+	alice := &http.Client{Jar: jar}
+	resp, err := alice.Post(server.URL+"/api/v1/auth/connect", "application/json", strings.NewReader(`{"username": "alice", "password": "alicepass"}`))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected alice to connect, got %d", resp.StatusCode)
+		t.FailNow()
+	}
+	patch.Path = "userlimited"
+	patch.RateLimit = &RateLimitConfig{
+		User: &RateLimit{Limit: 1, Window: Duration(time.Minute)},
+		IP:   &RateLimit{Limit: 5, Window: Duration(time.Minute)},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := alice.Get(server.URL + "/api/v1/forward/userlimited")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("User request %d: expected %d, got %d", i, want, resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "1" {
+			t.Errorf("Expected the user limit to be the tightest, got %s", resp.Header.Get("RateLimit-Limit"))
+		}
+	}
+	resp, err = http.Get(server.URL + "/api/v1/forward/userlimited")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "5" {
+		t.Errorf("Expected anonymous requests to only be limited by ip, got %d with limit %s", resp.StatusCode, resp.Header.Get("RateLimit-Limit"))
+	}
+}
+
+func TestRateLimitInvalid(t *testing.T) {
+	patch := ForwardPatch{
+		Path:      "limited",
+		Dest:      "http://localhost:1",
+		RateLimit: &RateLimitConfig{IP: &RateLimit{Limit: 0, Window: Duration(time.Second)}},
+	}
+	if _, err := newPatchRoute(patch, false, nil); err == nil {
+		t.Error("Expected invalid rate limit to be rejected")
+	}
+}
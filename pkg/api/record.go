@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	DEFAULT_RECORD_SIZE     = 100
+	DEFAULT_RECORD_MAX_BODY = 16 * 1024
+)
+
+var (
+	ErrNotRecording = errors.New("patch is not recording")
+)
+
+// RecordConfig keeps the most recent exchanges of a patch in memory
+type RecordConfig struct {
+	Size    int `json:"size,omitempty"`
+	MaxBody int `json:"max_body,omitempty"`
+}
+
+type recordedExchange struct {
+	record *system.TrafficRecord
+	wait   time.Duration
+}
+
+// recordBuffer is a ring buffer of the latest exchanges of a patch
+type recordBuffer struct {
+	sync.Mutex
+	entries []recordedExchange
+	next    int
+	full    bool
+	maxBody int
+}
+
+func newRecordBuffer(config RecordConfig) *recordBuffer {
+	size := config.Size
+	if size <= 0 {
+		size = DEFAULT_RECORD_SIZE
+	}
+	maxBody := config.MaxBody
+	if maxBody <= 0 {
+		maxBody = DEFAULT_RECORD_MAX_BODY
+	}
+	return &recordBuffer{
+		entries: make([]recordedExchange, size),
+		maxBody: maxBody,
+	}
+}
+
+func (b *recordBuffer) add(record *system.TrafficRecord, wait time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.entries[b.next] = recordedExchange{record: truncateRecord(record, b.maxBody), wait: wait}
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns the matching exchanges, oldest first
+func (b *recordBuffer) list(filter *system.TrafficFilter) []recordedExchange {
+	b.Lock()
+	defer b.Unlock()
+	start, count := 0, b.next
+	if b.full {
+		start, count = b.next, len(b.entries)
+	}
+	exchanges := make([]recordedExchange, 0, count)
+	for i := 0; i < count; i++ {
+		entry := b.entries[(start+i)%len(b.entries)]
+		if filter == nil || filter.Match(entry.record) {
+			exchanges = append(exchanges, entry)
+		}
+	}
+	if filter != nil && filter.Limit > 0 && len(exchanges) > filter.Limit {
+		exchanges = exchanges[len(exchanges)-filter.Limit:]
+	}
+	return exchanges
+}
+
+// /api/v1/auth/recording routes
+func (pc *PatchControl) addRecordingRoutes(recording *gin.RouterGroup) {
+	recording.PUT("", pc.startRecording)
+	recording.DELETE("", pc.stopRecording)
+	recording.GET("/har", pc.exportHAR)
+	recording.GET("/curl", pc.exportCurl)
+}
+
+// setRecording switches the recording of a patch, a nil config stops it
+func (pc *PatchControl) setRecording(c *gin.Context, path string, config *RecordConfig) error {
+	return pc.updatePatch(c, path, func(route *patchRoute) error {
+		if !route.patch.isHTTP() {
+			return ErrHTTPOption
+		}
+		route.patch.Record = config
+		if config == nil {
+			route.recording = nil
+		} else {
+			route.recording = newRecordBuffer(*config)
+		}
+		return nil
+	})
+}
+
+func (pc *PatchControl) startRecording(c *gin.Context) {
+	config := &RecordConfig{}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(config); err != nil {
+			pc.logger.Println(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid recording config"})
+			return
+		}
+	}
+	if err := pc.authorizePatch(c, c.Query("patch"), true); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	if err := pc.setRecording(c, c.Query("patch"), config); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "recording started"})
+}
+
+func (pc *PatchControl) stopRecording(c *gin.Context) {
+	if err := pc.authorizePatch(c, c.Query("patch"), true); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	if err := pc.setRecording(c, c.Query("patch"), nil); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "recording stopped"})
+}
+
+func (pc *PatchControl) exportHAR(c *gin.Context) {
+	exchanges, ok := pc.recordedExchanges(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\"recording.har\"")
+	c.JSON(http.StatusOK, buildHAR(exchanges))
+}
+
+func (pc *PatchControl) exportCurl(c *gin.Context) {
+	exchanges, ok := pc.recordedExchanges(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\"recording.sh\"")
+	c.Data(http.StatusOK, "text/x-shellscript; charset=utf-8", []byte(buildCurlScript(exchanges)))
+}
+
+// recordedExchanges reads the filtered recording of the patch in the query,
+// the error response is already written if false is returned
+func (pc *PatchControl) recordedExchanges(c *gin.Context) ([]recordedExchange, bool) {
+	var filter system.TrafficFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filter"})
+		return nil, false
+	}
+	if err := pc.authorizePatch(c, filter.Patch, false); err != nil {
+		pc.respondPatchError(c, err)
+		return nil, false
+	}
+	pc.RLock()
+	route, ok := pc.routes[sanitizePath(filter.Patch)]
+	pc.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+		return nil, false
+	}
+	if route.recording == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrNotRecording.Error()})
+		return nil, false
+	}
+	// the patch is already selected by the route
+	filter.Patch = ""
+	filter.Path = "/" + sanitizePath(filter.Path)
+	if filter.Path == "/" {
+		filter.Path = ""
+	}
+	return route.recording.list(&filter), true
+}
+
+func (pc *PatchControl) respondPatchError(c *gin.Context, err error) {
+	if errors.Is(err, ErrPathNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+		return
+	}
+	if errors.Is(err, ErrHTTPOption) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	pc.logger.Println(err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update patch"})
+}
@@ -0,0 +1,617 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	DEFAULT_REPLAY_RATE = 10 // requests per second
+	MAX_REPLAY_RATE     = 100
+	MAX_REPLAY_JOBS     = 4 // running at the same time
+	// finished jobs kept for progress queries
+	replayHistory = 50
+	replayTimeout = 30 * time.Second
+
+	REPLAY_RUNNING   = "running"
+	REPLAY_DONE      = "done"
+	REPLAY_CANCELLED = "cancelled"
+)
+
+var (
+	ErrReplayTarget   = errors.New("replay needs either a patch or an url, not both")
+	ErrReplayEmpty    = errors.New("replay needs a request or a har file")
+	ErrReplayRate     = errors.New("replay rate must be between 0 and 100 requests per second")
+	ErrTooManyReplays = errors.New("too many replays running")
+	ErrReplaysClosed  = errors.New("replays are shut down")
+)
+
+// ReplaySpec describes what to replay and where to, requests are sent to the
+// patch or url keeping their path and query, without a target they are sent
+// to their original url
+type ReplaySpec struct {
+	Patch      string            `json:"patch,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Rate       float64           `json:"rate,omitempty"`
+	Background bool              `json:"background,omitempty"`
+	Request    *ReplayRequest    `json:"request,omitempty"`
+	HAR        *HAR              `json:"har,omitempty"`
+}
+
+type ReplayRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    string              `json:"body,omitempty"`
+}
+
+// requests returns everything to replay in order
+func (s *ReplaySpec) requests() []ReplayRequest {
+	requests := make([]ReplayRequest, 0)
+	if s.Request != nil {
+		requests = append(requests, *s.Request)
+	}
+	if s.HAR != nil {
+		for _, entry := range s.HAR.Log.Entries {
+			requests = append(requests, replayRequestFromHAR(entry.Request))
+		}
+	}
+	return requests
+}
+
+func (s *ReplaySpec) validate() error {
+	if s.Patch != "" && s.URL != "" {
+		return ErrReplayTarget
+	}
+	if s.URL != "" {
+		if _, err := parseDest(s.URL); err != nil {
+			return err
+		}
+	}
+	if s.Rate < 0 || s.Rate > MAX_REPLAY_RATE {
+		return ErrReplayRate
+	}
+	if len(s.requests()) == 0 {
+		return ErrReplayEmpty
+	}
+	return nil
+}
+
+func replayRequestFromHAR(request HARRequest) ReplayRequest {
+	replay := ReplayRequest{
+		Method:  request.Method,
+		URL:     request.URL,
+		Headers: make(map[string][]string),
+	}
+	for _, header := range request.Headers {
+		replay.Headers[header.Name] = append(replay.Headers[header.Name], header.Value)
+	}
+	if request.PostData != nil {
+		replay.Body = request.PostData.Text
+	}
+	return replay
+}
+
+// ReplayJob reports the progress of a replay, the exchanges are stored in
+// the traffic store with the job id
+type ReplayJob struct {
+	sync.Mutex `json:"-"`
+	ID         int64          `json:"id"`
+	Status     string         `json:"status"`
+	Target     string         `json:"target,omitempty"`
+	Total      int            `json:"total"`
+	Done       int            `json:"done"`
+	Failed     int            `json:"failed"`
+	Results    []ReplayResult `json:"results"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	cancel     context.CancelFunc
+}
+
+type ReplayResult struct {
+	Method   string   `json:"method"`
+	URL      string   `json:"url"`
+	Status   int      `json:"status,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Duration Duration `json:"duration"`
+}
+
+func (j *ReplayJob) add(result ReplayResult) {
+	j.Lock()
+	defer j.Unlock()
+	j.Done++
+	if result.Error != "" {
+		j.Failed++
+	}
+	j.Results = append(j.Results, result)
+}
+
+func (j *ReplayJob) finish(status string) {
+	j.Lock()
+	defer j.Unlock()
+	now := time.Now().UTC()
+	j.Status = status
+	j.FinishedAt = &now
+}
+
+func (j *ReplayJob) MarshalJSON() ([]byte, error) {
+	j.Lock()
+	defer j.Unlock()
+	type job ReplayJob
+	return json.Marshal((*job)(j))
+}
+
+// replayControl keeps track of the replay jobs
+type replayControl struct {
+	sync.Mutex
+	jobs      map[int64]*ReplayJob
+	order     []int64
+	running   int
+	idCounter int64
+	closed    bool
+	// running jobs, waited for on close
+	wg     sync.WaitGroup
+	client *http.Client
+}
+
+func newReplayControl() *replayControl {
+	return &replayControl{
+		jobs:  make(map[int64]*ReplayJob),
+		order: make([]int64, 0),
+		client: &http.Client{
+			Timeout: replayTimeout,
+			// redirects are part of the replayed response
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// start registers a job, its context is derived from parent and cancelled once
+// the job is done
+func (rc *replayControl) start(parent context.Context, target string, total int) (*ReplayJob, context.Context, error) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.closed {
+		return nil, nil, ErrReplaysClosed
+	}
+	if rc.running >= MAX_REPLAY_JOBS {
+		return nil, nil, ErrTooManyReplays
+	}
+	rc.running++
+	rc.wg.Add(1)
+	rc.idCounter++
+	ctx, cancel := context.WithCancel(parent)
+	job := &ReplayJob{
+		ID:        rc.idCounter,
+		Status:    REPLAY_RUNNING,
+		Target:    target,
+		Total:     total,
+		Results:   make([]ReplayResult, 0, total),
+		StartedAt: time.Now().UTC(),
+		cancel:    cancel,
+	}
+	rc.jobs[job.ID] = job
+	rc.order = append(rc.order, job.ID)
+	rc.evict()
+	return job, ctx, nil
+}
+
+// evict drops the oldest finished jobs above the history size
+func (rc *replayControl) evict() {
+	for i := 0; len(rc.order) > replayHistory && i < len(rc.order); {
+		job := rc.jobs[rc.order[i]]
+		job.Lock()
+		running := job.Status == REPLAY_RUNNING
+		job.Unlock()
+		if running {
+			i++
+			continue
+		}
+		delete(rc.jobs, job.ID)
+		rc.order = append(rc.order[:i], rc.order[i+1:]...)
+	}
+}
+
+func (rc *replayControl) done(job *ReplayJob) {
+	defer rc.wg.Done()
+	job.cancel()
+	rc.Lock()
+	defer rc.Unlock()
+	rc.running--
+}
+
+func (rc *replayControl) get(id int64) (*ReplayJob, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	job, ok := rc.jobs[id]
+	return job, ok
+}
+
+func (rc *replayControl) list() []*ReplayJob {
+	rc.Lock()
+	defer rc.Unlock()
+	jobs := make([]*ReplayJob, 0, len(rc.order))
+	for _, id := range rc.order {
+		jobs = append(jobs, rc.jobs[id])
+	}
+	return jobs
+}
+
+// cancelAll stops the running jobs and waits for them to finish, no new jobs
+// are started afterwards
+func (rc *replayControl) cancelAll() {
+	rc.Lock()
+	rc.closed = true
+	for _, job := range rc.jobs {
+		job.cancel()
+	}
+	rc.Unlock()
+	rc.wg.Wait()
+}
+
+// /api/v1/auth/replay routes
+func (pc *PatchControl) addReplayRoutes(replay *gin.RouterGroup) {
+	replay.POST("", pc.startReplay)
+	replay.GET("", pc.getReplay)
+	replay.GET("/:id", pc.getReplay)
+	replay.DELETE("/:id", pc.cancelReplay)
+}
+
+func (pc *PatchControl) startReplay(c *gin.Context) {
+	spec, err := bindReplaySpec(c)
+	if err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid replay"})
+		return
+	}
+	spec.Patch = sanitizePath(spec.Patch)
+	if err := spec.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	target := spec.URL
+	if spec.Patch != "" {
+		pc.RLock()
+		route, ok := pc.routes[spec.Patch]
+		pc.RUnlock()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "path not found"})
+			return
+		}
+		if !route.patch.isHTTP() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ErrHTTPOption.Error()})
+			return
+		}
+		target = spec.Patch
+	}
+	requests := spec.requests()
+	// background jobs outlive the request, the others end with it
+	parent := c.Request.Context()
+	if spec.Background {
+		parent = context.Background()
+	}
+	job, ctx, err := pc.replays.start(parent, target, len(requests))
+	if errors.Is(err, ErrReplaysClosed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if spec.Background {
+		go pc.runReplay(ctx, job, spec, requests)
+		c.JSON(http.StatusAccepted, job)
+		return
+	}
+	pc.runReplay(ctx, job, spec, requests)
+	c.JSON(http.StatusOK, job)
+}
+
+// bindReplaySpec reads the spec from json or from a multipart form with the
+// har file in the har field and header overrides as "Name: value" header fields
+func bindReplaySpec(c *gin.Context) (*ReplaySpec, error) {
+	spec := &ReplaySpec{}
+	if !strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if err := c.ShouldBindJSON(spec); err != nil {
+			return nil, err
+		}
+		return spec, nil
+	}
+	spec.Patch = c.PostForm("patch")
+	spec.URL = c.PostForm("url")
+	spec.Background = c.PostForm("background") == "true"
+	if rate := c.PostForm("rate"); rate != "" {
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, err
+		}
+		spec.Rate = parsed
+	}
+	for _, header := range c.PostFormArray("header") {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, errors.New("header override must be formatted as Name: value")
+		}
+		if spec.Headers == nil {
+			spec.Headers = make(map[string]string)
+		}
+		spec.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	file, err := c.FormFile("har")
+	if err != nil {
+		return nil, err
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	spec.HAR = &HAR{}
+	if err := json.NewDecoder(reader).Decode(spec.HAR); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// runReplay sends the requests one after another at the rate of the spec
+func (pc *PatchControl) runReplay(ctx context.Context, job *ReplayJob, spec *ReplaySpec, requests []ReplayRequest) {
+	defer pc.replays.done(job)
+	rate := spec.Rate
+	if rate == 0 {
+		rate = DEFAULT_REPLAY_RATE
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for i, request := range requests {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				job.finish(REPLAY_CANCELLED)
+				return
+			case <-ticker.C:
+			}
+		}
+		job.add(pc.replay(ctx, job.ID, spec, request))
+	}
+	if ctx.Err() != nil {
+		job.finish(REPLAY_CANCELLED)
+		return
+	}
+	job.finish(REPLAY_DONE)
+}
+
+// replay sends a single request and stores the exchange in the traffic store
+func (pc *PatchControl) replay(ctx context.Context, jobID int64, spec *ReplaySpec, request ReplayRequest) ReplayResult {
+	result := ReplayResult{Method: request.Method, URL: request.URL}
+	req, route, subPath, err := pc.buildReplayRequest(ctx, spec, request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	record := &system.TrafficRecord{
+		Patch:          spec.Patch,
+		Method:         req.Method,
+		RequestHeaders: redactHeaders(req.Header),
+		RequestBody:    []byte(request.Body),
+		RequestSize:    int64(len(request.Body)),
+		StartedAt:      time.Now().UTC(),
+		Replay:         jobID,
+	}
+	var resp *replayWriter
+	if route != nil {
+		resp, err = pc.proxyReplay(route, req, subPath)
+	} else {
+		resp, err = pc.sendReplay(req)
+	}
+	result.URL = req.URL.String()
+	record.Path = req.URL.Path
+	record.URL = result.URL
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		if resp.err != nil {
+			result.Error = resp.err.Error()
+		}
+		result.Status = resp.status
+		record.Status = resp.status
+		record.ResponseHeaders = redactHeaders(resp.header)
+		record.ResponseBody = resp.body.Bytes()
+		record.ResponseSize = resp.body.size
+		record.Attempts = resp.attempts
+	}
+	record.Duration = time.Since(record.StartedAt)
+	result.Duration = Duration(record.Duration)
+	if err := pc.traffic.store.Save(ctx, record); err != nil {
+		pc.logger.Println("error saving replayed traffic:", err)
+	}
+	pc.logger.Printf("Replayed %s %s: %d %s\n", record.Method, record.URL, result.Status, result.Error)
+	return result
+}
+
+// replayWriter collects a replayed response, errors of the proxy are kept in err
+type replayWriter struct {
+	header   http.Header
+	status   int
+	body     captureBuffer
+	attempts int
+	err      error
+}
+
+func newReplayWriter() *replayWriter {
+	return &replayWriter{
+		header: make(http.Header),
+		body:   captureBuffer{max: DEFAULT_CAPTURE_MAX_BODY},
+	}
+}
+
+func (w *replayWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replayWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// sendReplay sends a request to a fixed url target
+func (pc *PatchControl) sendReplay(req *http.Request) (*replayWriter, error) {
+	resp, err := pc.replays.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	w := newReplayWriter()
+	w.header = resp.Header
+	w.status = resp.StatusCode
+	if _, err := io.Copy(&w.body, resp.Body); err != nil {
+		w.err = err
+	}
+	return w, nil
+}
+
+// proxyReplay sends a request through the proxy of the route, with the same
+// upstream selection, circuit breaker, retries and response rules as ForwardRequest
+func (pc *PatchControl) proxyReplay(route *patchRoute, req *http.Request, subPath string) (*replayWriter, error) {
+	upstream := route.balancer.next(req, "")
+	if upstream == nil {
+		if _, open := route.balancer.circuitRetry(time.Now()); open {
+			return nil, ErrCircuitOpen
+		}
+		return nil, ErrNoHealthy
+	}
+	req, call, retry, ok := guardRequest(req, route, upstream)
+	if !ok {
+		return nil, ErrCircuitOpen
+	}
+	if call != nil {
+		defer call.abandon()
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), replayTimeout)
+	defer cancel()
+	upstream.acquire()
+	defer upstream.release()
+	w := newReplayWriter()
+	route.proxy.ServeHTTP(w, rewrite(upstream.dest, req.WithContext(ctx), subPath))
+	if retry != nil {
+		w.attempts = retry.attempts
+	}
+	return w, nil
+}
+
+// buildReplayRequest resolves the target of the request. Requests to a patch
+// are returned with the request rules applied together with the route and the
+// sub path, the upstream is picked once the request is sent
+func (pc *PatchControl) buildReplayRequest(ctx context.Context, spec *ReplaySpec, request ReplayRequest) (*http.Request, *patchRoute, string, error) {
+	original, err := url.Parse(request.URL)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, original.String(), strings.NewReader(request.Body))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for name, values := range request.Headers {
+		if curlSkipHeaders[http.CanonicalHeaderKey(name)] || strings.EqualFold(name, "Host") {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	for name, value := range spec.Headers {
+		if value == "" {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+
+	subPath := original.EscapedPath()
+	switch {
+	case spec.URL != "":
+		dest, err := parseDest(spec.URL)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		req = rewrite(dest, req, subPath)
+	case spec.Patch != "":
+		pc.RLock()
+		route, ok := pc.routes[spec.Patch]
+		pc.RUnlock()
+		if !ok {
+			return nil, nil, "", ErrPathNotFound
+		}
+		rc := &ruleContext{
+			host:   original.Host,
+			scheme: original.Scheme,
+			method: method,
+			path:   original.Path,
+		}
+		subPath = route.rules.applyRequest(req, subPath, rc)
+		req = req.WithContext(context.WithValue(req.Context(), ruleContextKey{}, rc))
+		return req, route, subPath, nil
+	}
+	if req.URL.Scheme == "" || req.URL.Host == "" {
+		return nil, nil, "", errors.New("replayed request needs an absolute url without a target")
+	}
+	return req, nil, "", nil
+}
+
+func (pc *PatchControl) getReplay(c *gin.Context) {
+	rawID := c.Param("id")
+	if rawID == "" {
+		c.JSON(http.StatusOK, gin.H{"replays": pc.replays.list()})
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	job, ok := pc.replays.get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replay not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func (pc *PatchControl) cancelReplay(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	job, ok := pc.replays.get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replay not found"})
+		return
+	}
+	job.cancel()
+	c.JSON(http.StatusOK, gin.H{"message": "replay cancelled"})
+}
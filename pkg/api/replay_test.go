@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Override", r.Header.Get("X-Override"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer upstream.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addReplayRoutes(router.Group("/replay"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "replayed", Dest: upstream.URL}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	spec := ReplaySpec{
+		Patch:   "replayed",
+		Headers: map[string]string{"X-Override": "yes"},
+		Request: &ReplayRequest{Method: http.MethodPost, URL: "http://old.host/items?id=1", Body: "fixed"},
+	}
+	raw, _ := json.Marshal(spec)
+	resp, err := http.Post(server.URL+"/replay", "application/json", bytes.NewReader(raw))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var job ReplayJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || job.Status != REPLAY_DONE || job.Done != 1 || job.Failed != 0 {
+		t.Errorf("Expected finished replay, got %d %+v", resp.StatusCode, &job)
+		t.FailNow()
+	}
+	if job.Results[0].Status != http.StatusCreated || !strings.HasSuffix(job.Results[0].URL, "/items?id=1") {
+		t.Errorf("Unexpected result %+v", job.Results[0])
+	}
+	records, _ := store.Query(ctx, &system.TrafficFilter{Replay: job.ID})
+	if len(records) != 1 || string(records[0].ResponseBody) != "/items?id=1 fixed" || records[0].ResponseHeaders["X-Override"][0] != "yes" {
+		t.Errorf("Expected replayed exchange to be stored, got %+v", records)
+	}
+
+	// har upload as background job
+	har := buildHAR([]recordedExchange{
+		{record: &system.TrafficRecord{Method: http.MethodGet, URL: "http://old.host/a"}},
+		{record: &system.TrafficRecord{Method: http.MethodPut, URL: "http://old.host/b", RequestBody: []byte("x"), RequestSize: 1}},
+	})
+	harRaw, _ := json.Marshal(har)
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	writer.WriteField("url", upstream.URL+"/v2")
+	writer.WriteField("background", "true")
+	writer.WriteField("rate", "50")
+	file, _ := writer.CreateFormFile("har", "recording.har")
+	file.Write(harRaw)
+	writer.Close()
+	resp, err = http.Post(server.URL+"/replay", writer.FormDataContentType(), form)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || job.Total != 2 {
+		t.Errorf("Expected accepted background job, got %d %+v", resp.StatusCode, &job)
+		t.FailNow()
+	}
+	if !waitFor(time.Second, func() bool {
+		resp, err := http.Get(server.URL + "/replay/" + strconv.FormatInt(job.ID, 10))
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&job)
+		return job.Status == REPLAY_DONE
+	}) {
+		t.Error("Expected background replay to finish")
+		t.FailNow()
+	}
+	if job.Done != 2 || !strings.HasSuffix(job.Results[1].URL, "/v2/b") {
+		t.Errorf("Unexpected job progress %+v", &job)
+	}
+}
+
+func TestReplayThroughPatch(t *testing.T) {
+	ctx := context.Background()
+	var failures atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addReplayRoutes(router.Group("/replay"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	patch := ForwardPatch{
+		Path:  "guarded",
+		Dest:  upstream.URL,
+		Retry: &RetryPolicy{Attempts: 2, Backoff: Duration(time.Millisecond)},
+		Rules: []RewriteRule{{Action: RULE_SET_HEADER, Name: "X-Patched", Value: "{method}", Target: RULE_RESPONSE}},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer failing.Close()
+	broken := ForwardPatch{Path: "broken", Dest: failing.URL, Breaker: &BreakerConfig{MinRequests: 1}}
+	if err := patches.registerPath(ctx, broken, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	replay := func(patch string) *ReplayJob {
+		raw, _ := json.Marshal(ReplaySpec{Patch: patch, Request: &ReplayRequest{URL: "/items"}})
+		resp, err := http.Post(server.URL+"/replay", "application/json", bytes.NewReader(raw))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		job := &ReplayJob{}
+		json.NewDecoder(resp.Body).Decode(job)
+		return job
+	}
+
+	// the failed attempt is retried and the response rules apply
+	failures.Store(1)
+	job := replay("guarded")
+	if job.Failed != 0 || len(job.Results) != 1 || job.Results[0].Status != http.StatusOK {
+		t.Errorf("Expected the retried replay to succeed, got %+v", job)
+		t.FailNow()
+	}
+	records, _ := store.Query(ctx, &system.TrafficFilter{Replay: job.ID})
+	if len(records) != 1 || records[0].Attempts != 2 || records[0].ResponseHeaders["X-Patched"][0] != http.MethodGet {
+		t.Errorf("Expected the retried exchange with the response rules, got %+v", records)
+	}
+
+	// failed replays open the circuit of the upstream
+	if job := replay("broken"); job.Failed != 0 || job.Results[0].Status != http.StatusInternalServerError {
+		t.Errorf("Expected the upstream error, got %+v", job)
+	}
+	if job := replay("broken"); job.Failed != 1 || job.Results[0].Error != ErrCircuitOpen.Error() {
+		t.Errorf("Expected the open circuit, got %+v", job)
+	}
+}
+
+func TestReplayCancel(t *testing.T) {
+	received := make(chan struct{}, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	router := gin.New()
+	patches.addReplayRoutes(router.Group("/replay"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	post := func(ctx context.Context, spec ReplaySpec) (*http.Response, error) {
+		raw, _ := json.Marshal(spec)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/replay", bytes.NewReader(raw))
+		req.Header.Set("Content-Type", "application/json")
+		return http.DefaultClient.Do(req)
+	}
+	status := func(job *ReplayJob) string {
+		job.Lock()
+		defer job.Unlock()
+		return job.Status
+	}
+
+	// a synchronous replay ends with the request
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	if _, err := post(ctx, ReplaySpec{URL: upstream.URL, Request: &ReplayRequest{URL: "/slow"}}); err == nil {
+		t.Error("Expected the cancelled request to fail")
+	}
+	if !waitFor(time.Second, func() bool {
+		jobs := patches.replays.list()
+		return len(jobs) == 1 && status(jobs[0]) == REPLAY_CANCELLED
+	}) {
+		t.Error("Expected the replay to be cancelled with its request")
+	}
+
+	// close waits for background jobs
+	resp, err := post(context.Background(), ReplaySpec{URL: upstream.URL, Background: true, Request: &ReplayRequest{URL: "/slow"}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var job ReplayJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	<-received
+	patches.Close()
+	if background, _ := patches.replays.get(job.ID); status(background) != REPLAY_CANCELLED {
+		t.Errorf("Expected close to wait for the cancelled job, got %+v", background)
+	}
+	if records, _ := store.Query(context.Background(), &system.TrafficFilter{Replay: job.ID}); len(records) != 1 {
+		t.Errorf("Expected the cancelled exchange to be stored before close, got %+v", records)
+	}
+	resp, err = post(context.Background(), ReplaySpec{URL: upstream.URL, Request: &ReplayRequest{URL: "/slow"}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected replays to be refused after close, got %d", resp.StatusCode)
+	}
+}
+
+func TestReplayInvalid(t *testing.T) {
+	for _, spec := range []ReplaySpec{
+		{},
+		{Patch: "a", URL: "http://localhost:1", Request: &ReplayRequest{URL: "/"}},
+		{Rate: 1000, Request: &ReplayRequest{URL: "/"}},
+	} {
+		if err := spec.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", spec)
+		}
+	}
+}
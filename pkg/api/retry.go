@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_ATTEMPTS    = 3
+	DEFAULT_RETRY_BACKOFF     = 100 * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF = 2 * time.Second
+	DEFAULT_RETRY_MAX_BODY    = 64 * 1024
+	MAX_RETRY_ATTEMPTS        = 10
+
+	// the request never reached the upstream
+	RETRY_CONNECT = "connect"
+	// the upstream closed the connection before answering
+	RETRY_RESET = "reset"
+	// the upstream did not answer in time
+	RETRY_TIMEOUT = "timeout"
+
+	// responses of failed attempts are drained up to this size to reuse the connection
+	retryDrainLimit = 4 * 1024
+)
+
+var (
+	ErrInvalidRetry = errors.New("invalid retry policy")
+
+	defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	defaultRetryErrors   = []string{RETRY_CONNECT, RETRY_RESET}
+	idempotentMethods    = []string{
+		http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+	}
+)
+
+// RetryPolicy retries failed attempts of a request against the same upstream,
+// waiting an exponentially growing backoff with jitter in between. Only
+// idempotent methods are retried unless methods are set and request bodies
+// larger than max body are sent once
+type RetryPolicy struct {
+	Attempts   int      `json:"attempts,omitempty"`
+	Backoff    Duration `json:"backoff,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+	Statuses   []int    `json:"statuses,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	MaxBody    int      `json:"max_body,omitempty"`
+}
+
+func (r *RetryPolicy) validate() error {
+	if r.Attempts < 0 || r.Attempts > MAX_RETRY_ATTEMPTS {
+		return fmt.Errorf("%w: attempts must be between 1 and %d", ErrInvalidRetry, MAX_RETRY_ATTEMPTS)
+	}
+	if r.Backoff < 0 || r.MaxBackoff < 0 || r.MaxBody < 0 {
+		return fmt.Errorf("%w: backoff and max body must not be negative", ErrInvalidRetry)
+	}
+	if r.Backoff > 0 && r.MaxBackoff > 0 && r.MaxBackoff < r.Backoff {
+		return fmt.Errorf("%w: max backoff is shorter than the backoff", ErrInvalidRetry)
+	}
+	for _, status := range r.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("%w: unknown status %d", ErrInvalidRetry, status)
+		}
+	}
+	for _, kind := range r.Errors {
+		switch kind {
+		case RETRY_CONNECT, RETRY_RESET, RETRY_TIMEOUT:
+		default:
+			return fmt.Errorf("%w: unknown error %s", ErrInvalidRetry, kind)
+		}
+	}
+	return nil
+}
+
+// retryPolicy is the compiled form of a RetryPolicy
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	statuses   map[int]bool
+	errors     map[string]bool
+	methods    map[string]bool
+	maxBody    int64
+}
+
+func (r *RetryPolicy) compile() *retryPolicy {
+	policy := &retryPolicy{
+		attempts:   r.Attempts,
+		backoff:    time.Duration(r.Backoff),
+		maxBackoff: time.Duration(r.MaxBackoff),
+		statuses:   make(map[int]bool),
+		errors:     make(map[string]bool),
+		methods:    make(map[string]bool),
+		maxBody:    int64(r.MaxBody),
+	}
+	if policy.attempts == 0 {
+		policy.attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if policy.backoff == 0 {
+		policy.backoff = DEFAULT_RETRY_BACKOFF
+	}
+	if policy.maxBackoff == 0 {
+		policy.maxBackoff = DEFAULT_RETRY_MAX_BACKOFF
+	}
+	if policy.maxBackoff < policy.backoff {
+		policy.maxBackoff = policy.backoff
+	}
+	if policy.maxBody == 0 {
+		policy.maxBody = DEFAULT_RETRY_MAX_BODY
+	}
+	statuses, kinds, methods := r.Statuses, r.Errors, r.Methods
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	if len(kinds) == 0 {
+		kinds = defaultRetryErrors
+	}
+	if len(methods) == 0 {
+		methods = idempotentMethods
+	}
+	for _, status := range statuses {
+		policy.statuses[status] = true
+	}
+	for _, kind := range kinds {
+		policy.errors[kind] = true
+	}
+	for _, method := range methods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+	return policy
+}
+
+// retryable reports if the attempt failed in a way the policy retries
+func (p *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err == nil {
+		return p.statuses[resp.StatusCode]
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.errors[RETRY_CONNECT]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return p.errors[RETRY_TIMEOUT]
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return p.errors[RETRY_RESET]
+	}
+	return false
+}
+
+// delay is the backoff before the next attempt, half of it is random
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	delay := p.maxBackoff
+	if shift := attempt - 1; shift < 32 && p.backoff<<shift < p.maxBackoff {
+		delay = p.backoff << shift
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// attemptsKey is the gin context key of the attempts a forwarded request took
+const attemptsKey = "attempts"
+
+// retryStateKey stores the retryState of a forwarded request
+type retryStateKey struct{}
+
+// retryState holds the number of attempts a forwarded request took
+type retryState struct {
+	attempts int
+}
+
+// retryTransport sends requests again after retryable failures
+type retryTransport struct {
+	next   http.RoundTripper
+	policy *retryPolicy
+	logger *log.Logger
+}
+
+func newRetryTransport(next http.RoundTripper, policy *retryPolicy, logger *log.Logger) *retryTransport {
+	return &retryTransport{
+		next:   next,
+		policy: policy,
+		logger: logger,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state, _ := req.Context().Value(retryStateKey{}).(*retryState)
+	if state == nil {
+		state = &retryState{}
+	}
+	state.attempts = 1
+	// upgraded connections can't be sent again
+	if !t.policy.methods[req.Method] || req.Header.Get("Upgrade") != "" {
+		return t.next.RoundTrip(req)
+	}
+	body, ok, err := bufferBody(req, t.policy.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		t.logger.Printf("not retrying %s %s, body is larger than %d bytes\n", req.Method, req.URL, t.policy.maxBody)
+		return t.next.RoundTrip(req)
+	}
+	for {
+		attempt := req
+		if body != nil {
+			attempt = req.Clone(req.Context())
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(attempt)
+		if state.attempts >= t.policy.attempts || req.Context().Err() != nil || !t.policy.retryable(resp, err) {
+			return resp, err
+		}
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.CopyN(io.Discard, resp.Body, retryDrainLimit)
+			resp.Body.Close()
+		}
+		delay := t.policy.delay(state.attempts)
+		t.logger.Printf("retrying %s %s in %s after attempt %d of %d failed: %s\n",
+			req.Method, req.URL, delay, state.attempts, t.policy.attempts, reason)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		state.attempts++
+	}
+}
+
+// bufferBody reads the request body so it can be sent again, false is
+// returned and the body is left readable if it is larger than max
+func bufferBody(req *http.Request, max int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(buf)) > max {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return buf, true, nil
+}
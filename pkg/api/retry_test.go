@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	var failures atomic.Int64
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if failures.Add(-1) >= 0 {
+			if r.URL.Path == "/reset" {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	store := system.NewTrafficIMDB()
+	patches := NewPatchControl(nil, store)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	retry := &RetryPolicy{Attempts: 3, Backoff: Duration(time.Millisecond), MaxBackoff: Duration(5 * time.Millisecond), MaxBody: 8}
+	patch := ForwardPatch{Path: "flaky", Dest: upstream.URL, Retry: retry, Capture: &CaptureConfig{}}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	for i, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		failures int64
+		status   int
+		hits     int64
+	}{
+		{"status", http.MethodPut, "/flaky", "again", 2, http.StatusOK, 3},
+		{"reset", http.MethodGet, "/reset", "", 1, http.StatusOK, 2},
+		{"exhausted", http.MethodGet, "/flaky", "", 5, http.StatusServiceUnavailable, 3},
+		{"not idempotent", http.MethodPost, "/flaky", "once", 1, http.StatusServiceUnavailable, 1},
+		{"large body", http.MethodPut, "/flaky", "too large to buffer", 1, http.StatusServiceUnavailable, 1},
+	} {
+		failures.Store(tc.failures)
+		hits.Store(0)
+		// the transport retries resets on reused connections by itself
+		patches.routes["flaky"].transport.CloseIdleConnections()
+		req, _ := http.NewRequest(tc.method, server.URL+"/api/v1/forward/flaky"+tc.path, strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || hits.Load() != tc.hits {
+			t.Errorf("%s: expected %d after %d attempts, got %d after %d", tc.name, tc.status, tc.hits, resp.StatusCode, hits.Load())
+		}
+		if tc.status == http.StatusOK && string(body) != tc.body {
+			t.Errorf("%s: expected the body to be sent again, got %q", tc.name, body)
+		}
+		var records []*system.TrafficRecord
+		if !waitFor(time.Second, func() bool {
+			records, _ = store.Query(ctx, &system.TrafficFilter{Patch: "flaky"})
+			return len(records) == i+1
+		}) || int64(records[0].Attempts) != tc.hits {
+			t.Errorf("%s: expected %d attempts to be recorded", tc.name, tc.hits)
+		}
+	}
+
+	// methods override the idempotent default
+	retry.Methods = []string{"post"}
+	patch.Capture = nil
+	if err := patches.registerPath(ctx, patch, true); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	failures.Store(1)
+	hits.Store(0)
+	resp, err := http.Post(server.URL+"/api/v1/forward/flaky/flaky", "text/plain", strings.NewReader("twice"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || hits.Load() != 2 {
+		t.Errorf("Expected the post to be retried, got %d after %d attempts", resp.StatusCode, hits.Load())
+	}
+
+	params := gin.LogFormatterParams{
+		Request: httptest.NewRequest(http.MethodGet, "/api/v1/forward/flaky", nil),
+		Keys:    map[string]any{attemptsKey: 2},
+	}
+	if attempts := createLog(params).Attempts; attempts != 2 {
+		t.Errorf("Expected the attempts in the request log, got %d", attempts)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := (&RetryPolicy{Backoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(300 * time.Millisecond)}).compile()
+	for attempt, max := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 40: 300} {
+		max *= time.Millisecond
+		if delay := policy.delay(attempt); delay < max/2 || delay > max {
+			t.Errorf("Attempt %d: expected delay between %s and %s, got %s", attempt, max/2, max, delay)
+		}
+	}
+	dial := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	if !policy.retryable(nil, dial) || !policy.retryable(nil, io.ErrUnexpectedEOF) {
+		t.Error("Expected connect and reset errors to be retried by default")
+	}
+	if policy.retryable(nil, context.DeadlineExceeded) || policy.retryable(&http.Response{StatusCode: 500}, nil) {
+		t.Error("Expected timeouts and 500 not to be retried by default")
+	}
+
+	for _, retry := range []RetryPolicy{
+		{Attempts: MAX_RETRY_ATTEMPTS + 1},
+		{Backoff: Duration(time.Second), MaxBackoff: Duration(time.Millisecond)},
+		{Statuses: []int{99}},
+		{Errors: []string{"refused"}},
+		{MaxBody: -1},
+	} {
+		retry := retry
+		patch := ForwardPatch{Path: "retry", Dest: "http://localhost:1", Retry: &retry}
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", retry)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+)
+
+func TestRoles(t *testing.T) {
+	users := system.NewUserIMDB()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		users, system.NewRoleIMDB(), &internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	client := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar}
+	}
+	do := func(client *http.Client, method, target, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(raw)
+	}
+	connect := func(client *http.Client, name, password string) {
+		t.Helper()
+		if code, body := do(client, http.MethodPost, "/api/v1/auth/connect", `{"username": "`+name+`", "password": "`+password+`"}`); code != http.StatusCreated {
+			t.Errorf("Expected %s to connect, got %d %s", name, code, body)
+			t.FailNow()
+		}
+	}
+
+	admin := client()
+	connect(admin, "root", "rootpass")
+	_, body := do(admin, http.MethodGet, "/api/v1/auth/session", "")
+	var session struct {
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.Unmarshal([]byte(body), &session); err != nil || len(session.Roles) != 1 || len(session.Permissions) != len(system.BuiltinPermissions) {
+		t.Errorf("Expected the admin role in the session, got %s", body)
+	}
+
+	if code, _ := do(client(), http.MethodPost, "/api/v1/register", `{"username": "bob", "password": "bobpass"}`); code != http.StatusCreated {
+		t.Errorf("Expected bob to register, got %d", code)
+	}
+	bob := client()
+	connect(bob, "bob", "bobpass")
+	for _, target := range []string{"/api/v1/auth/traffic", "/api/v1/auth/compare", "/api/v1/auth/roles", "/api/v1/auth/replay"} {
+		if code, _ := do(bob, http.MethodGet, target, ""); code != http.StatusForbidden {
+			t.Errorf("%s: expected bob to be forbidden, got %d", target, code)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPost, "/api/v1/auth/roles", `{"name": "reader", "permissions": ["traffic:read"]}`, http.StatusCreated},
+		{http.MethodPost, "/api/v1/auth/roles", `{"name": "reader"}`, http.StatusConflict},
+		{http.MethodPost, "/api/v1/auth/roles", `{"name": "broken", "permissions": ["unknown"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/auth/roles", `{"name": "with space"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/auth/permissions", `{"name": "reports:read"}`, http.StatusCreated},
+		{http.MethodPut, "/api/v1/auth/roles/reader", `{"permissions": ["traffic:read", "reports:read"]}`, http.StatusOK},
+		{http.MethodDelete, "/api/v1/auth/permissions/traffic:read", "", http.StatusBadRequest},
+		{http.MethodPut, "/api/v1/auth/users/bob/roles/reader", "", http.StatusOK},
+		{http.MethodPut, "/api/v1/auth/users/nobody/roles/reader", "", http.StatusNotFound},
+		{http.MethodPut, "/api/v1/auth/users/bob/roles/missing", "", http.StatusNotFound},
+	} {
+		if code, body := do(admin, tc.method, tc.target, tc.body); code != tc.want {
+			t.Errorf("%s %s: expected %d, got %d %s", tc.method, tc.target, tc.want, code, body)
+		}
+	}
+	_, body = do(admin, http.MethodGet, "/api/v1/auth/users/bob/roles", "")
+	var roles []*system.Role
+	if err := json.Unmarshal([]byte(body), &roles); err != nil || len(roles) != 1 || len(roles[0].Permissions) != 2 {
+		t.Errorf("Expected bob to have the reader role, got %s", body)
+	}
+
+	if code, _ := do(bob, http.MethodGet, "/api/v1/auth/traffic", ""); code != http.StatusForbidden {
+		t.Errorf("Expected roles to apply on the next connect, got %d", code)
+	}
+	connect(bob, "bob", "bobpass")
+	if code, _ := do(bob, http.MethodGet, "/api/v1/auth/traffic", ""); code != http.StatusOK {
+		t.Errorf("Expected bob to read traffic, got %d", code)
+	}
+	if code, _ := do(bob, http.MethodGet, "/api/v1/auth/replay", ""); code != http.StatusForbidden {
+		t.Errorf("Expected bob not to replay, got %d", code)
+	}
+
+	// the patch admin permission grants access to the patches of other users
+	upstream := newTestUpstream()
+	defer upstream.Close()
+	if code, body := do(bob, http.MethodPatch, "/patch", `{"path": "private", "dest": "`+upstream.URL+`"}`); code != http.StatusOK {
+		t.Errorf("Expected bob to apply a patch, got %d %s", code, body)
+	}
+	if code, _ := do(admin, http.MethodGet, "/patch/private", ""); code != http.StatusOK {
+		t.Errorf("Expected the admin to see the private patch, got %d", code)
+	}
+	if code, _ := do(admin, http.MethodDelete, "/patch/private", ""); code != http.StatusOK {
+		t.Errorf("Expected the admin to delete the private patch, got %d", code)
+	}
+
+	if code, _ := do(admin, http.MethodDelete, "/api/v1/auth/users/bob/roles/reader", ""); code != http.StatusOK {
+		t.Errorf("Expected the role to be revoked, got %d", code)
+	}
+	if code, _ := do(admin, http.MethodDelete, "/api/v1/auth/roles/reader", ""); code != http.StatusOK {
+		t.Errorf("Expected the role to be deleted, got %d", code)
+	}
+}
+
+func TestForwardStripsSessionCookie(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header.Values("Cookie"), "; ")))
+	}))
+	defer upstream.Close()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		system.NewUserIMDB(), system.NewRoleIMDB(), &internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	// the user limit has to read the session before it is stripped
+	patch := ForwardPatch{
+		Path:      "svc",
+		Dest:      upstream.URL,
+		RateLimit: &RateLimitConfig{User: &RateLimit{Limit: 1, Window: Duration(time.Minute)}},
+	}
+	if err := patches.registerPath(context.Background(), patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Post(server.URL+"/api/v1/auth/connect", "application/json", strings.NewReader(`{"username": "root", "password": "rootpass"}`))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected to connect, got %d", resp.StatusCode)
+		t.FailNow()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/forward/svc", nil)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	sent := string(raw)
+	if strings.Contains(sent, SESSION_COOKIE) {
+		t.Errorf("Expected the session cookie to be stripped, upstream got %q", sent)
+	}
+	if sent != "theme=dark" {
+		t.Errorf("Expected other cookies to be kept, upstream got %q", sent)
+	}
+
+	resp, err = client.Get(server.URL + "/api/v1/forward/svc")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected the user limit to apply, got %d", resp.StatusCode)
+	}
+}
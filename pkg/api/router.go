@@ -10,9 +10,13 @@ import (
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/internal/system"
 	"github.com/myLogic207/PaT-CH/pkg/api/internal"
 )
 
+// SESSION_COOKIE is the cookie of the user sessions, it is never forwarded to a patch
+const SESSION_COOKIE = "patch_session"
+
 var apiSkipPaths = []string{"/api/v1/health"}
 
 type ApiLog struct {
@@ -25,9 +29,11 @@ type ApiLog struct {
 	Latency      time.Duration `json:"latency"`
 	UserAgent    string        `json:"user_agent"`
 	ErrorMessage string        `json:"error_message"`
+	// attempts of forwarded requests of patches with a retry policy
+	Attempts int `json:"attempts,omitempty"`
 }
 
-func NewRouter(logger *log.Logger, cache sessions.Store, args ...any) *gin.Engine {
+func NewRouter(logger *log.Logger, cache sessions.Store, patches *PatchControl, args ...any) *gin.Engine {
 	router := gin.New()
 	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		Formatter: generateLogFormatter,
@@ -35,6 +41,8 @@ func NewRouter(logger *log.Logger, cache sessions.Store, args ...any) *gin.Engin
 		SkipPaths: apiSkipPaths,
 	}))
 	cache.Options(sessions.Options{
+		// the session is shared by the auth and patch routes
+		Path:     "/",
 		MaxAge:   60 * 60 * 1, // 1 hour
 		SameSite: http.SameSiteLaxMode,
 		Secure:   false,
@@ -45,10 +53,22 @@ func NewRouter(logger *log.Logger, cache sessions.Store, args ...any) *gin.Engin
 	}
 
 	router.Use(gin.Recovery())
-	router.Use(sessions.Sessions("patch_session", cache))
+	router.Use(sessions.Sessions(SESSION_COOKIE, cache))
+
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	sessionCtl := internal.AddRoutes(router.Group("/"), args...)
+	// routes of the patch control also accept api tokens for machine clients
+	patches.addPatchRoutes(router.Group("/patch", sessionCtl.TokenRoutePass))
 
-	addPatchRoutes(router.Group("/patch"))
-	internal.AddRoutes(router.Group("/"), args...)
+	// /api/v1/auth routes served by the patch control, guarded by the permissions of the session
+	auth := router.Group("/api/v1/auth", sessionCtl.TokenRoutePass)
+	trafficRead := sessionCtl.RequirePermission(system.PERMISSION_TRAFFIC_READ)
+	patchAdmin := sessionCtl.RequirePermission(system.PERMISSION_PATCH_ADMIN)
+	patches.addTrafficRoutes(auth.Group("/traffic", trafficRead))
+	patches.addRecordingRoutes(auth.Group("/recording", trafficRead))
+	patches.addReplayRoutes(auth.Group("/replay", patchAdmin))
+	patches.addCacheRoutes(auth.Group("/cache", patchAdmin))
+	patches.addCompareRoutes(auth.Group("/compare", trafficRead))
 
 	return router
 }
@@ -82,5 +102,8 @@ func createLog(params gin.LogFormatterParams) *ApiLog {
 	if params.ErrorMessage != "" {
 		outLog.ErrorMessage = params.ErrorMessage
 	}
+	if attempts, ok := params.Keys[attemptsKey].(int); ok {
+		outLog.Attempts = attempts
+	}
 	return outLog
 }
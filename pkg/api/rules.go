@@ -0,0 +1,174 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	RULE_ADD_HEADER    = "add_header"
+	RULE_SET_HEADER    = "set_header"
+	RULE_REMOVE_HEADER = "remove_header"
+	RULE_REWRITE_PATH  = "rewrite_path"
+	RULE_STRIP_PREFIX  = "strip_prefix"
+	RULE_ADD_PREFIX    = "add_prefix"
+
+	RULE_REQUEST  = "request"
+	RULE_RESPONSE = "response"
+)
+
+var (
+	ErrInvalidRule = errors.New("invalid rewrite rule")
+)
+
+// defaultRules run before the rules of every patch, so a patch can override or remove them
+var defaultRules = []RewriteRule{
+	{Action: RULE_SET_HEADER, Name: "X-Forwarded-Host", Value: "{host}"},
+	{Action: RULE_SET_HEADER, Name: "X-Forwarded-Proto", Value: "{scheme}"},
+}
+
+// RewriteRule transforms a forwarded request or its response. Header values
+// may contain the variables {host}, {scheme}, {client_ip}, {method} and {path}.
+// Path rules work on the sub path below the patch, before it is joined to the
+// destination, pattern replacements can use capture groups as $1 or ${name}
+type RewriteRule struct {
+	Action  string `json:"action"`
+	Target  string `json:"target,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Replace string `json:"replace,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+}
+
+type compiledRule struct {
+	RewriteRule
+	pattern *regexp.Regexp
+}
+
+// ruleSet is the validated, ordered list of rules of a patch
+type ruleSet struct {
+	request  []compiledRule
+	response []compiledRule
+}
+
+// ruleContext holds the values of the original request for header variables
+type ruleContext struct {
+	host     string
+	scheme   string
+	clientIP string
+	method   string
+	path     string
+}
+
+func (rc *ruleContext) expand(value string) string {
+	return strings.NewReplacer(
+		"{host}", rc.host,
+		"{scheme}", rc.scheme,
+		"{client_ip}", rc.clientIP,
+		"{method}", rc.method,
+		"{path}", rc.path,
+	).Replace(value)
+}
+
+func invalidRule(i int, format string, args ...any) error {
+	return fmt.Errorf("%w %d: %s", ErrInvalidRule, i, fmt.Sprintf(format, args...))
+}
+
+// compileRules validates the rules of a patch and prepends the default rules
+func compileRules(rules []RewriteRule) (*ruleSet, error) {
+	set := &ruleSet{}
+	for i, rule := range append(append([]RewriteRule{}, defaultRules...), rules...) {
+		// report the position in the list of the patch
+		pos := i - len(defaultRules)
+		compiled := compiledRule{RewriteRule: rule}
+		switch rule.Action {
+		case RULE_ADD_HEADER, RULE_SET_HEADER, RULE_REMOVE_HEADER:
+			if rule.Name == "" {
+				return nil, invalidRule(pos, "%s needs a header name", rule.Action)
+			}
+			switch rule.Target {
+			case "", RULE_REQUEST:
+				set.request = append(set.request, compiled)
+			case RULE_RESPONSE:
+				set.response = append(set.response, compiled)
+			default:
+				return nil, invalidRule(pos, "unknown target %q", rule.Target)
+			}
+			continue
+		case RULE_REWRITE_PATH:
+			if rule.Pattern == "" {
+				return nil, invalidRule(pos, "%s needs a pattern", rule.Action)
+			}
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, invalidRule(pos, "%s", err)
+			}
+			compiled.pattern = pattern
+		case RULE_STRIP_PREFIX, RULE_ADD_PREFIX:
+			if rule.Prefix == "" {
+				return nil, invalidRule(pos, "%s needs a prefix", rule.Action)
+			}
+		default:
+			return nil, invalidRule(pos, "unknown action %q", rule.Action)
+		}
+		if rule.Target != "" && rule.Target != RULE_REQUEST {
+			return nil, invalidRule(pos, "%s only applies to the request", rule.Action)
+		}
+		set.request = append(set.request, compiled)
+	}
+	return set, nil
+}
+
+// applyRequest runs the request rules in order and returns the rewritten sub path
+func (s *ruleSet) applyRequest(req *http.Request, subPath string, rc *ruleContext) string {
+	for _, rule := range s.request {
+		switch rule.Action {
+		case RULE_REWRITE_PATH:
+			subPath = rule.pattern.ReplaceAllString(subPath, rule.Replace)
+		case RULE_STRIP_PREFIX:
+			subPath = stripPathPrefix(subPath, rule.Prefix)
+		case RULE_ADD_PREFIX:
+			subPath = joinPath(strings.TrimSuffix(rule.Prefix, "/"), subPath)
+		default:
+			applyHeaderRule(req.Header, rule.RewriteRule, rc)
+		}
+	}
+	return subPath
+}
+
+func (s *ruleSet) applyResponse(resp *http.Response, rc *ruleContext) {
+	for _, rule := range s.response {
+		applyHeaderRule(resp.Header, rule.RewriteRule, rc)
+	}
+}
+
+func applyHeaderRule(header http.Header, rule RewriteRule, rc *ruleContext) {
+	switch rule.Action {
+	case RULE_ADD_HEADER:
+		header.Add(rule.Name, rc.expand(rule.Value))
+	case RULE_SET_HEADER:
+		header.Set(rule.Name, rc.expand(rule.Value))
+	case RULE_REMOVE_HEADER:
+		header.Del(rule.Name)
+	}
+}
+
+// stripPathPrefix removes prefix if it matches whole path segments
+func stripPathPrefix(path, prefix string) string {
+	prefix = "/" + strings.Trim(prefix, "/")
+	check := path
+	if !strings.HasPrefix(check, "/") {
+		check = "/" + check
+	}
+	if check == prefix {
+		return ""
+	}
+	if strings.HasPrefix(check, prefix+"/") {
+		return check[len(prefix):]
+	}
+	return path
+}
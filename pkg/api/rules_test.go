@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRewriteRules(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Path", r.URL.Path)
+		w.Header().Set("X-Seen-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.Header().Set("X-Seen-Client", r.Header.Get("X-Client"))
+		w.Header().Set("Server", "upstream")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path: "rules",
+		Dest: upstream.URL + "/base",
+		Rules: []RewriteRule{
+			{Action: RULE_REMOVE_HEADER, Name: "X-Forwarded-Proto"},
+			{Action: RULE_SET_HEADER, Name: "X-Client", Value: "{method} {host}"},
+			{Action: RULE_STRIP_PREFIX, Prefix: "/v1"},
+			{Action: RULE_REWRITE_PATH, Pattern: `^/users/(\d+)$`, Replace: "/accounts/$1"},
+			{Action: RULE_ADD_PREFIX, Prefix: "/api/"},
+			{Action: RULE_REMOVE_HEADER, Name: "Server", Target: RULE_RESPONSE},
+			{Action: RULE_ADD_HEADER, Name: "X-Patched", Value: "{path}", Target: RULE_RESPONSE},
+		},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/forward/rules/v1/users/42")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if path := resp.Header.Get("X-Seen-Path"); path != "/base/api/accounts/42" {
+		t.Errorf("Expected rewritten path, got %s", path)
+	}
+	if proto := resp.Header.Get("X-Seen-Proto"); proto != "" {
+		t.Errorf("Expected default header to be removed, got %s", proto)
+	}
+	if client := resp.Header.Get("X-Seen-Client"); client != "GET "+server.Listener.Addr().String() {
+		t.Errorf("Expected expanded header, got %s", client)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("X-Patched") != "/api/v1/forward/rules/v1/users/42" {
+		t.Errorf("Expected response rules to apply, got %v", resp.Header)
+	}
+}
+
+func TestRewriteRulesInvalid(t *testing.T) {
+	for _, rule := range []RewriteRule{
+		{Action: "replace_body"},
+		{Action: RULE_SET_HEADER},
+		{Action: RULE_SET_HEADER, Name: "X", Target: "upstream"},
+		{Action: RULE_REWRITE_PATH, Pattern: "(unclosed"},
+		{Action: RULE_STRIP_PREFIX, Prefix: "/a", Target: RULE_RESPONSE},
+		{Action: RULE_ADD_PREFIX},
+	} {
+		if _, err := compileRules([]RewriteRule{rule}); err == nil {
+			t.Errorf("Expected %+v to be rejected", rule)
+		}
+	}
+	patch := ForwardPatch{Path: "invalid", Dest: "http://localhost:1", Rules: []RewriteRule{{Action: "unknown"}}}
+	if _, err := newPatchRoute(patch, false, nil); err == nil {
+		t.Error("Expected patch with invalid rules to be rejected")
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	for _, tc := range []struct{ path, prefix, want string }{
+		{"/v1/users", "v1", "/users"},
+		{"/v1", "/v1/", ""},
+		{"/v10/users", "/v1", "/v10/users"},
+		{"", "/v1", ""},
+	} {
+		if got := stripPathPrefix(tc.path, tc.prefix); got != tc.want {
+			t.Errorf("stripPathPrefix(%q, %q) = %q, expected %q", tc.path, tc.prefix, got, tc.want)
+		}
+	}
+}
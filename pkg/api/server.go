@@ -13,10 +13,14 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-contrib/sessions/redis"
 	"github.com/gin-gonic/gin"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+	"github.com/myLogic207/PaT-CH/pkg/mail"
+	"github.com/myLogic207/PaT-CH/pkg/storage/cache"
 	"github.com/myLogic207/PaT-CH/pkg/util"
 )
 
@@ -42,6 +46,7 @@ type Server struct {
 	config  *util.Config
 	cert    *Certificate
 	router  *gin.Engine
+	patches *PatchControl
 	server  *http.Server
 	ctx     context.Context
 	logger  *log.Logger
@@ -69,6 +74,9 @@ func NewServer(ctx context.Context, logger *log.Logger, config *util.Config, arg
 		}
 	}
 
+	// patch control args, the ones passed in take precedence over the server config
+	patchArgs := append([]any{}, args...)
+	routerArgs := append([]any{}, args...)
 	cache := cookie.NewStore([]byte("secret"))
 	if redisConfig, ok := config.Get("redis").(*util.Config); ok {
 		if redisConfig.GetBool("use") {
@@ -77,6 +85,13 @@ func NewServer(ctx context.Context, logger *log.Logger, config *util.Config, arg
 			if cache, err = connectRedisCache(redisConfig); err != nil {
 				return nil, ErrInitServer
 			}
+			connector, err := connectRedisConnector(redisConfig, logger)
+			if err != nil {
+				return nil, ErrInitServer
+			}
+			patchArgs = append(patchArgs, connector)
+			// mailed tokens expire by themselves in redis, it replaces the table passed in
+			routerArgs = append(routerArgs, connector)
 		}
 	} else {
 		return nil, ErrInitServer
@@ -86,7 +101,38 @@ func NewServer(ctx context.Context, logger *log.Logger, config *util.Config, arg
 	if serverAddress == "" {
 		return nil, ErrInitServer
 	}
-	router := NewRouter(logger, cache, args...)
+	patchArgs = append(patchArgs, loadListenConfig(config), loadAdmins(config))
+	patches := NewPatchControl(logger, patchArgs...)
+	admin, err := loadBootstrapAdmin(config)
+	if err != nil {
+		logger.Println(err)
+		return nil, ErrInitServer
+	} else if admin != nil {
+		routerArgs = append(routerArgs, admin)
+	}
+	jwtConfig, err := loadJWTConfig(config)
+	if err != nil {
+		logger.Println(err)
+		return nil, ErrInitServer
+	} else if jwtConfig != nil {
+		routerArgs = append(routerArgs, jwtConfig)
+	}
+	if mailConfig, ok := config.Get("mail").(*util.Config); ok {
+		mailer, err := mail.NewMailer(mailConfig, logger)
+		if err != nil {
+			logger.Println(err)
+			return nil, ErrInitServer
+		} else if mailer != nil {
+			routerArgs = append(routerArgs, mailer)
+		}
+	}
+	lockout, err := loadLockoutConfig(config)
+	if err != nil {
+		logger.Println(err)
+		return nil, ErrInitServer
+	}
+	routerArgs = append(routerArgs, lockout)
+	router := NewRouter(logger, cache, patches, routerArgs...)
 	httpServer := &http.Server{
 		Addr:    serverAddress,
 		Handler: router,
@@ -98,6 +144,7 @@ func NewServer(ctx context.Context, logger *log.Logger, config *util.Config, arg
 	return &Server{
 		config:  config,
 		router:  router,
+		patches: patches,
 		server:  httpServer,
 		ctx:     ctx,
 		running: false,
@@ -124,6 +171,74 @@ func loadAddress(config *util.Config) string {
 	return fmt.Sprintf("%s:%d", serverAddress, port)
 }
 
+// loadJWTConfig reads the keys and claims of signed access tokens from the jwt
+// keys of the api config, keys are comma separated kid:alg:base64 entries.
+// Access tokens are disabled if no keys are set
+func loadJWTConfig(config *util.Config) (*internal.JWTConfig, error) {
+	rawKeys, ok := config.GetString("jwt.keys")
+	if !ok || strings.TrimSpace(rawKeys) == "" {
+		return nil, nil
+	}
+	jwtConfig := &internal.JWTConfig{
+		Issuer:   internal.DEFAULT_JWT_ISSUER,
+		Audience: internal.DEFAULT_JWT_AUDIENCE,
+	}
+	for _, rawKey := range strings.Split(rawKeys, ",") {
+		key, err := internal.ParseJWTKey(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		jwtConfig.Keys = append(jwtConfig.Keys, key)
+	}
+	if issuer, ok := config.GetString("jwt.issuer"); ok {
+		jwtConfig.Issuer = issuer
+	}
+	if audience, ok := config.GetString("jwt.audience"); ok {
+		jwtConfig.Audience = audience
+	}
+	jwtConfig.SigningKey, _ = config.GetString("jwt.signingkey")
+	for key, ttl := range map[string]*time.Duration{"jwt.accessttl": &jwtConfig.AccessTTL, "jwt.refreshttl": &jwtConfig.RefreshTTL} {
+		if raw, ok := config.GetString(key); ok {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("%w: %s must be a positive duration", internal.ErrJWTConfig, key)
+			}
+			*ttl = parsed
+		}
+	}
+	return jwtConfig, nil
+}
+
+// loadLockoutConfig overrides the default lockout with the lockout keys of config
+func loadLockoutConfig(config *util.Config) (*internal.LockoutConfig, error) {
+	lockout := internal.DefaultLockoutConfig()
+	for key, count := range map[string]*int{"lockout.userattempts": &lockout.UserAttempts, "lockout.ipattempts": &lockout.IPAttempts} {
+		if raw, ok := config.GetString(key); ok && raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 0 {
+				return nil, fmt.Errorf("%s must be a count, 0 disables it", key)
+			}
+			*count = parsed
+		}
+	}
+	durations := map[string]*time.Duration{
+		"lockout.window":   &lockout.Window,
+		"lockout.duration": &lockout.Duration,
+		"lockout.delay":    &lockout.Delay,
+		"lockout.maxdelay": &lockout.MaxDelay,
+	}
+	for key, duration := range durations {
+		if raw, ok := config.GetString(key); ok && raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 {
+				return nil, fmt.Errorf("%s must be a duration", key)
+			}
+			*duration = parsed
+		}
+	}
+	return lockout, nil
+}
+
 func loadCert(config *util.Config) *Certificate {
 	cert := &Certificate{}
 	if certPath, ok := config.GetString("cert"); ok {
@@ -163,7 +278,17 @@ func connectRedisCache(redisConfig *util.Config) (redis.Store, error) {
 	return conn, nil
 }
 
+// connectRedisConnector keeps the rate limit counters and cached responses
+// in redis so they are shared across instances
+func connectRedisConnector(redisConfig *util.Config, logger *log.Logger) (*cache.RedisConnector, error) {
+	return cache.NewConnector(redisConfig, logger)
+}
+
 func (s *Server) Init() error {
+	if err := s.patches.Load(s.ctx); err != nil {
+		return err
+	}
+
 	initFile, ok := s.config.GetString("InitFile")
 	if !ok {
 		s.logger.Println("No init file provided")
@@ -219,24 +344,32 @@ func (s *Server) loadInitFile(path string) error {
 		s.logger.Println(err)
 		return errors.New("could not parse file: " + path)
 	}
-	return patches.Apply()
+	return patches.Apply(s.ctx, s.patches)
 }
 
 func (s *Server) Start() error {
 	s.logger.Println("Starting server")
+	// listen before returning so the server accepts requests right away
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.logger.Println(err)
+		return ErrStartServer
+	}
 	s.running = true
 	if s.cert == nil {
 		go func() {
-			if err := s.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			if err := s.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 				s.logger.Fatalln(err)
 			}
 		}()
 	} else {
 		if !s.cert.Validate() {
+			listener.Close()
+			s.running = false
 			return ErrStartServer
 		}
 		go func() {
-			if err := s.server.ListenAndServeTLS(s.cert.Cert, s.cert.Key); !errors.Is(err, http.ErrServerClosed) {
+			if err := s.server.ServeTLS(listener, s.cert.Cert, s.cert.Key); !errors.Is(err, http.ErrServerClosed) {
 				s.logger.Fatalln(err)
 			}
 		}()
@@ -254,6 +387,7 @@ func (s *Server) Stop() error {
 		s.logger.Println(err)
 		return ErrStopServer
 	}
+	s.patches.Close()
 	s.running = false
 	s.logger.Println("Server stopped")
 	return nil
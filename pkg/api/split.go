@@ -0,0 +1,267 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DEFAULT_SPLIT_COOKIE     = "patch_split"
+	DEFAULT_SPLIT_COOKIE_TTL = 24 * time.Hour
+	// clients are assigned to one of splitBuckets buckets, percent is split in hundredths
+	splitBuckets = 10000
+	// cache entries of the alternate set are kept apart from the primary ones
+	splitCacheSuffix = "#split"
+)
+
+var (
+	ErrInvalidSplit = errors.New("invalid split")
+)
+
+// SplitConfig routes part of the traffic of a patch to an alternate set of
+// upstreams. Requests matching any of the conditions always go to the
+// alternate set, of the others percent are sent there. Clients are assigned
+// to a bucket kept in the sticky cookie, so they stay on the same set and
+// raising percent only moves clients from the primary set to the alternate one
+type SplitConfig struct {
+	Upstreams []Upstream   `json:"upstreams"`
+	Percent   float64      `json:"percent,omitempty"`
+	Match     []SplitMatch `json:"match,omitempty"`
+	Cookie    string       `json:"cookie,omitempty"`
+	CookieTTL Duration     `json:"cookie_ttl,omitempty"`
+}
+
+// SplitMatch is a condition on a header, cookie or query parameter of the
+// request, it matches if the value equals value or, without value, if it is set
+type SplitMatch struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+	Query  string `json:"query,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (s *SplitConfig) withDefaults() SplitConfig {
+	config := *s
+	if config.Cookie == "" {
+		config.Cookie = DEFAULT_SPLIT_COOKIE
+	}
+	if config.CookieTTL == 0 {
+		config.CookieTTL = Duration(DEFAULT_SPLIT_COOKIE_TTL)
+	}
+	return config
+}
+
+func (s *SplitConfig) validate() error {
+	if len(s.Upstreams) == 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidSplit, ErrNoUpstream)
+	}
+	if s.Percent < 0 || s.Percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidSplit)
+	}
+	if s.CookieTTL < 0 {
+		return fmt.Errorf("%w: cookie ttl must not be negative", ErrInvalidSplit)
+	}
+	if strings.ContainsAny(s.Cookie, " \t\r\n;,=\"") {
+		return fmt.Errorf("%w: invalid cookie name %q", ErrInvalidSplit, s.Cookie)
+	}
+	for i, match := range s.Match {
+		set := 0
+		for _, name := range []string{match.Header, match.Cookie, match.Query} {
+			if name != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("%w: match %d needs exactly one of header, cookie or query", ErrInvalidSplit, i)
+		}
+	}
+	return nil
+}
+
+// matches reports if the request meets the condition
+func (m *SplitMatch) matches(req *http.Request) bool {
+	var value string
+	var ok bool
+	switch {
+	case m.Header != "":
+		values := req.Header.Values(m.Header)
+		value, ok = strings.Join(values, ", "), len(values) > 0
+	case m.Cookie != "":
+		if cookie, err := req.Cookie(m.Cookie); err == nil {
+			value, ok = cookie.Value, true
+		}
+	case m.Query != "":
+		value, ok = req.URL.Query().Get(m.Query), req.URL.Query().Has(m.Query)
+	}
+	return ok && (m.Value == "" || value == m.Value)
+}
+
+// splitter holds the alternate upstreams of a route, it is replaced as a
+// whole when the split changes and shares the balancer with its predecessor
+// if the upstreams stay the same
+type splitter struct {
+	config   SplitConfig
+	balancer *balancer
+	health   *healthChecker
+}
+
+// newSplitter parses the alternate upstreams with the strategy of the patch,
+// they are probed if probe is set and health checked with the patch checks
+func newSplitter(patch *ForwardPatch, probe bool, logger *log.Logger) (*splitter, error) {
+	config := patch.Split.withDefaults()
+	alternate := &ForwardPatch{Upstreams: config.Upstreams, Strategy: patch.Strategy, HashHeader: patch.HashHeader}
+	balancer, err := newBalancer(alternate, probe && patch.Health == nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSplit, err)
+	}
+	if patch.Breaker != nil {
+		breakerConfig := patch.Breaker.withDefaults()
+		for _, up := range balancer.upstreams {
+			up.breaker = newBreaker(fmt.Sprintf("%s -> %s (split)", patch.Path, up.dest), breakerConfig, logger)
+		}
+	}
+	s := &splitter{config: config, balancer: balancer}
+	if patch.Health != nil {
+		s.health = startHealthChecks(balancer, *patch.Health, logger)
+	}
+	return s, nil
+}
+
+// sameUpstreams reports if config keeps the alternate upstreams of s
+func (s *splitter) sameUpstreams(config *SplitConfig) bool {
+	return s != nil && reflect.DeepEqual(s.config.Upstreams, config.Upstreams)
+}
+
+// alternate decides if the request goes to the alternate upstreams, clients
+// without a bucket get one assigned in the sticky cookie scoped to cookiePath
+func (s *splitter) alternate(c *gin.Context, cookiePath string) bool {
+	for i := range s.config.Match {
+		if s.config.Match[i].matches(c.Request) {
+			return true
+		}
+	}
+	if s.config.Percent <= 0 {
+		return false
+	}
+	bucket := -1
+	if cookie, err := c.Request.Cookie(s.config.Cookie); err == nil {
+		if val, err := strconv.Atoi(cookie.Value); err == nil && val >= 0 && val < splitBuckets {
+			bucket = val
+		}
+	}
+	if bucket < 0 {
+		bucket = rand.Intn(splitBuckets)
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     s.config.Cookie,
+			Value:    strconv.Itoa(bucket),
+			Path:     cookiePath,
+			MaxAge:   int(time.Duration(s.config.CookieTTL).Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return float64(bucket) < s.config.Percent*splitBuckets/100
+}
+
+func (s *splitter) close() {
+	if s.health != nil {
+		s.health.stop()
+	}
+}
+
+// setSplit changes the split of a registered patch in place, a nil config
+// removes it. The alternate upstreams are kept if they did not change, new
+// ones are probed before the patch is locked unless the patch is health checked
+func (pc *PatchControl) setSplit(c *gin.Context, path string, config *SplitConfig) error {
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return err
+		}
+		pc.RLock()
+		route, ok := pc.routes[sanitizePath(path)]
+		pc.RUnlock()
+		if ok && route.patch.Health == nil && !route.split.sameUpstreams(config) {
+			for _, up := range config.Upstreams {
+				if _, err := validatePath(up.Dest); err != nil {
+					return fmt.Errorf("%w: %s", ErrInvalidSplit, err)
+				}
+			}
+		}
+	}
+	var old, created *splitter
+	err := pc.updatePatch(c, path, func(route *patchRoute) error {
+		if !route.patch.isHTTP() {
+			return ErrHTTPOption
+		}
+		old = route.split
+		route.patch.Split = config
+		if config == nil {
+			route.split = nil
+			return nil
+		}
+		if old.sameUpstreams(config) {
+			route.split = &splitter{config: config.withDefaults(), balancer: old.balancer, health: old.health}
+			old = nil
+			return nil
+		}
+		var err error
+		if created, err = newSplitter(&route.patch, false, pc.logger); err != nil {
+			return err
+		}
+		route.split = created
+		return nil
+	})
+	if err != nil {
+		if created != nil {
+			created.close()
+		}
+		return err
+	}
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+func (pc *PatchControl) putSplit(c *gin.Context) {
+	var config SplitConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		pc.logger.Println(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid split config"})
+		return
+	}
+	if err := pc.authorizePatch(c, c.Param("dest"), true); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	if err := pc.setSplit(c, c.Param("dest"), &config); err != nil {
+		if errors.Is(err, ErrInvalidSplit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pc.respondPatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "split updated"})
+}
+
+func (pc *PatchControl) deleteSplit(c *gin.Context) {
+	if err := pc.authorizePatch(c, c.Param("dest"), true); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	if err := pc.setSplit(c, c.Param("dest"), nil); err != nil {
+		pc.respondPatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "split removed"})
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	stable := named("stable")
+	defer stable.Close()
+	canary := named("canary")
+	defer canary.Close()
+
+	patches := NewPatchControl(nil, AdminList{"admin"})
+	defer patches.Close()
+	router := gin.New()
+	patches.addPatchRoutes(router.Group("/patch", withUser("admin")))
+	patches.addForwardRoutes(router.Group("/api/v1/forward"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	patch := ForwardPatch{
+		Path: "split",
+		Dest: stable.URL,
+		Split: &SplitConfig{
+			Upstreams: []Upstream{{Dest: canary.URL}},
+			Match:     []SplitMatch{{Header: "X-Canary", Value: "1"}, {Query: "canary"}},
+		},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	forward := func(target string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/forward/split"+target, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	expect := func(name, target string, header map[string]string, want string) *http.Response {
+		t.Helper()
+		resp, body := forward(target, header)
+		if body != want {
+			t.Errorf("%s: expected %s, got %d %s", name, want, resp.StatusCode, body)
+		}
+		return resp
+	}
+	expect("header", "/items", map[string]string{"X-Canary": "1"}, "canary")
+	expect("header value", "/items", map[string]string{"X-Canary": "0"}, "stable")
+	expect("query", "/items?canary", nil, "canary")
+	if resp := expect("no split", "/items", nil, "stable"); resp.Header.Get("Set-Cookie") != "" {
+		t.Error("Expected no sticky cookie without a percentage")
+	}
+
+	setSplit := func(config string) int {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/patch/split/split", strings.NewReader(config)))
+		return resp.Code
+	}
+	balancer := patches.routes["split"].split.balancer
+	if code := setSplit(`{"upstreams": [{"dest": "` + canary.URL + `"}], "percent": 100}`); code != http.StatusOK {
+		t.Errorf("Expected the split to be updated, got %d", code)
+	}
+	if patches.routes["split"].split.balancer != balancer {
+		t.Error("Expected the alternate upstreams to be kept")
+	}
+	resp := expect("all", "/items", nil, "canary")
+	cookie := resp.Cookies()
+	if len(cookie) != 1 || cookie[0].Name != DEFAULT_SPLIT_COOKIE || cookie[0].Path != "/api/v1/forward/split" {
+		t.Errorf("Expected a sticky cookie for the patch, got %v", resp.Header.Values("Set-Cookie"))
+	}
+
+	setSplit(`{"upstreams": [{"dest": "` + canary.URL + `"}], "percent": 50}`)
+	for bucket, want := range map[string]string{"1234": "canary", "4999": "canary", "5000": "stable", "9999": "stable"} {
+		resp := expect("bucket "+bucket, "/items", map[string]string{"Cookie": DEFAULT_SPLIT_COOKIE + "=" + bucket}, want)
+		if resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("bucket %s: expected the assigned bucket to be kept", bucket)
+		}
+	}
+	sampled := 0
+	for i := 0; i < 400; i++ {
+		if _, body := forward("/items", nil); body == "canary" {
+			sampled++
+		}
+	}
+	if sampled < 140 || sampled > 260 {
+		t.Errorf("Expected about half of the new clients on the canary, got %d of 400", sampled)
+	}
+
+	if code := setSplit(`{"upstreams": [], "percent": 50}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a split without upstreams to be rejected, got %d", code)
+	}
+	if code := setSplit(`{"upstreams": [{"dest": "http://localhost:1"}]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unreachable upstream to be rejected, got %d", code)
+	}
+	deleted := httptest.NewRecorder()
+	router.ServeHTTP(deleted, httptest.NewRequest(http.MethodDelete, "/patch/split/split", nil))
+	if deleted.Code != http.StatusOK || patches.routes["split"].split != nil {
+		t.Errorf("Expected the split to be removed, got %d", deleted.Code)
+	}
+	expect("removed", "/items", map[string]string{"X-Canary": "1"}, "stable")
+
+	stored, err := patches.store.GetAll(ctx)
+	if err != nil || len(stored) != 1 || strings.Contains(stored[0].Spec, "split\":{") {
+		t.Errorf("Expected the removed split to be persisted, got %+v", stored)
+	}
+	missing := httptest.NewRecorder()
+	router.ServeHTTP(missing, httptest.NewRequest(http.MethodPut, "/patch/unknown/split", strings.NewReader(`{"upstreams": [{"dest": "`+canary.URL+`"}]}`)))
+	if missing.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown patch to be reported, got %d", missing.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_STREAM_IDLE_TIMEOUT = 5 * time.Minute
+	DEFAULT_STREAM_IDLE_CONNS   = 16
+	dialTimeout                 = 30 * time.Second
+)
+
+var (
+	ErrInvalidStream = errors.New("stream limits must not be negative")
+)
+
+// StreamConfig controls long lived exchanges of a patch. Responses are
+// flushed to the client right away unless a flush interval is set, upstream
+// connections, upgraded ones included, are closed after being idle for the
+// idle timeout and at most max idle conns are kept open per upstream
+type StreamConfig struct {
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	IdleTimeout   Duration `json:"idle_timeout,omitempty"`
+	MaxIdleConns  int      `json:"max_idle_conns,omitempty"`
+}
+
+func (s *StreamConfig) withDefaults() StreamConfig {
+	config := StreamConfig{}
+	if s != nil {
+		config = *s
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = Duration(DEFAULT_STREAM_IDLE_TIMEOUT)
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = DEFAULT_STREAM_IDLE_CONNS
+	}
+	return config
+}
+
+func (s *StreamConfig) validate() error {
+	if s.FlushInterval < 0 || s.IdleTimeout < 0 || s.MaxIdleConns < 0 {
+		return ErrInvalidStream
+	}
+	return nil
+}
+
+// flushInterval maps the config onto httputil.ReverseProxy, where -1 flushes after every write
+func (s StreamConfig) flushInterval() time.Duration {
+	if s.FlushInterval == 0 {
+		return -1
+	}
+	return time.Duration(s.FlushInterval)
+}
+
+// newTransport creates the upstream transport of a route
+func newTransport(config StreamConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.MaxIdleConns
+	transport.IdleConnTimeout = time.Duration(config.IdleTimeout)
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	timeout := time.Duration(config.IdleTimeout)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &idleConn{Conn: conn, timeout: timeout}, nil
+	}
+	return transport
+}
+
+// idleConn pushes its deadline forward on every read and write, a connection
+// without traffic in either direction for the timeout is closed
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeFrame writes a single short websocket text frame
+func writeFrame(w io.Writer, payload []byte, masked bool) error {
+	header := []byte{0x81, byte(len(payload))}
+	if !masked {
+		_, err := w.Write(append(header, payload...))
+		return err
+	}
+	mask := []byte{1, 2, 3, 4}
+	header[1] |= 0x80
+	frame := append(header, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a single short websocket frame
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1] & 0x7f)
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+// newEchoUpstream answers websocket upgrades on /ws with an echo of every frame
+// and streams server sent events on /events, the second event is only sent
+// once release is closed
+func newEchoUpstream(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws":
+			if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+			rw.Flush()
+			for {
+				payload, err := readFrame(rw)
+				if err != nil {
+					return
+				}
+				writeFrame(rw, payload, false)
+				rw.Flush()
+			}
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "data: first\n\n")
+			http.NewResponseController(w).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprint(w, "data: second\n\n")
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+}
+
+// dialWebSocket opens a websocket through the test server
+func dialWebSocket(t *testing.T, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", TEST_SERVER.server.Addr)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	key := base64.StdEncoding.EncodeToString([]byte("pat-ch-test-key!"))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, TEST_SERVER.server.Addr, key)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		t.Errorf("Expected websocket upgrade, got %d %v", resp.StatusCode, resp.Header)
+		t.FailNow()
+	}
+	return conn, reader
+}
+
+func TestWebSocketPassThrough(t *testing.T) {
+	ctx := context.Background()
+	upstream := newEchoUpstream(nil)
+	defer upstream.Close()
+	patches := TEST_SERVER.patches
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "ws", Dest: upstream.URL}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer patches.unregisterPath(ctx, "ws")
+
+	conn, reader := dialWebSocket(t, "/api/v1/forward/ws/ws")
+	defer conn.Close()
+	for _, message := range []string{"hello", "world"} {
+		if err := writeFrame(conn, []byte(message), true); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		payload, err := readFrame(reader)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if string(payload) != message {
+			t.Errorf("Expected echo %s, got %s", message, payload)
+		}
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	ctx := context.Background()
+	upstream := newEchoUpstream(nil)
+	defer upstream.Close()
+	patches := TEST_SERVER.patches
+	patch := ForwardPatch{
+		Path:   "ws-idle",
+		Dest:   upstream.URL,
+		Stream: &StreamConfig{IdleTimeout: Duration(100 * time.Millisecond)},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer patches.unregisterPath(ctx, "ws-idle")
+
+	conn, reader := dialWebSocket(t, "/api/v1/forward/ws-idle/ws")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	started := time.Now()
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Expected idle connection to be closed")
+	} else if time.Since(started) > time.Second {
+		t.Errorf("Expected idle connection to be closed by the proxy, got %s", err)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	upstream := newEchoUpstream(release)
+	defer upstream.Close()
+	patches := TEST_SERVER.patches
+	if err := patches.registerPath(ctx, ForwardPatch{Path: "sse", Dest: upstream.URL}, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer patches.unregisterPath(ctx, "sse")
+
+	resp, err := http.Get(TEST_SERVER.Addr("/api/v1/forward/sse/events"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	// the first event has to arrive while the upstream is still holding the stream
+	received := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		received <- line
+	}()
+	select {
+	case line := <-received:
+		if line != "data: first\n" {
+			t.Errorf("Unexpected event %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected first event to be flushed")
+	}
+	close(release)
+	rest, _ := io.ReadAll(reader)
+	if !strings.Contains(string(rest), "data: second") {
+		t.Errorf("Expected second event, got %q", rest)
+	}
+}
+
+func TestStreamConfigInvalid(t *testing.T) {
+	patch := ForwardPatch{
+		Path:   "stream",
+		Dest:   "http://localhost:1",
+		Stream: &StreamConfig{IdleTimeout: Duration(-time.Second)},
+	}
+	if _, err := newPatchRoute(patch, false, nil); err == nil {
+		t.Error("Expected negative idle timeout to be rejected")
+	}
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+const (
+	PATCH_HTTP = "http"
+	PATCH_TCP  = "tcp"
+	PATCH_UDP  = "udp"
+
+	tcpDialTimeout = 10 * time.Second
+)
+
+var (
+	ErrPatchType   = errors.New("unknown patch type")
+	ErrHTTPOption  = errors.New("option is only supported for http patches")
+	ErrInvalidPort = errors.New("port must be between 0 and 65535")
+)
+
+// ListenConfig is where tcp and udp patches bind, the port of a patch is added to the offset
+type ListenConfig struct {
+	Host       string
+	PortOffset int
+}
+
+func loadListenConfig(config *util.Config) ListenConfig {
+	listen := ListenConfig{Host: "127.0.0.1"}
+	if host, ok := config.GetString("host"); ok {
+		listen.Host = host
+	}
+	if offset, ok := config.GetString("portoffset"); ok {
+		if offset, err := strconv.Atoi(offset); err == nil {
+			listen.PortOffset = offset
+		}
+	}
+	return listen
+}
+
+func (l ListenConfig) address(port int) (string, error) {
+	port += l.PortOffset
+	if port < 0 || port > 65535 {
+		return "", ErrInvalidPort
+	}
+	return net.JoinHostPort(l.Host, strconv.Itoa(port)), nil
+}
+
+func (p *ForwardPatch) isHTTP() bool {
+	return p.Type == "" || p.Type == PATCH_HTTP
+}
+
+// validateListenerPatch rejects the http only options of a tcp or udp patch,
+// tcp upstreams are probed if probe is set
+func validateListenerPatch(patch *ForwardPatch, b *balancer, probe bool) error {
+	if patch.HashHeader != "" || patch.Health != nil || patch.Capture != nil ||
+		patch.Record != nil || len(patch.Rules) > 0 || patch.Stream != nil || patch.RateLimit != nil ||
+		patch.Breaker != nil || patch.Retry != nil || patch.Cache != nil ||
+		patch.Mirror != nil || patch.Compare != nil || patch.Split != nil {
+		return ErrHTTPOption
+	}
+	if patch.Port < 0 || patch.Port > 65535 {
+		return ErrInvalidPort
+	}
+	if patch.Type == PATCH_UDP {
+		return patch.UDP.validate()
+	}
+	if patch.UDP != nil {
+		return ErrUDPOption
+	}
+	if !probe {
+		return nil
+	}
+	for _, up := range b.upstreams {
+		conn, err := net.DialTimeout("tcp", up.dest.Host, tcpDialTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+type TCPStatus struct {
+	Listen      string `json:"listen"`
+	Connections uint64 `json:"connections"`
+	Active      int64  `json:"active"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// tcpListener accepts the connections of a tcp patch and splices them to an
+// upstream of the owning balancer, a replacing patch on the same port takes
+// the listener over by swapping the owner
+type tcpListener struct {
+	name     string
+	listener net.Listener
+	owner    atomic.Pointer[balancer]
+	conns    sync.Map // net.Conn -> struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	closed   atomic.Bool
+	logger   *log.Logger
+
+	connections atomic.Uint64
+	active      atomic.Int64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+}
+
+func newTCPListener(name, address string, owner *balancer, logger *log.Logger) (*tcpListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &tcpListener{
+		name:     name,
+		listener: listener,
+		logger:   logger,
+	}
+	l.owner.Store(owner)
+	l.wg.Add(1)
+	go l.serve()
+	logger.Printf("Listening for tcp patch %s on %s\n", name, listener.Addr())
+	return l, nil
+}
+
+func (l *tcpListener) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				l.logger.Printf("tcp patch %s stopped accepting: %s\n", l.name, err)
+			}
+			return
+		}
+		l.wg.Add(1)
+		go l.handle(conn)
+	}
+}
+
+func (l *tcpListener) handle(client net.Conn) {
+	defer l.wg.Done()
+	defer client.Close()
+	started := time.Now()
+	clientIP, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+	up := l.owner.Load().next(nil, clientIP)
+	if up == nil {
+		l.logger.Printf("tcp %s: %s rejected, %s\n", l.name, client.RemoteAddr(), ErrNoHealthy)
+		return
+	}
+	up.acquire()
+	defer up.release()
+	upstream, err := net.DialTimeout("tcp", up.dest.Host, tcpDialTimeout)
+	if err != nil {
+		l.logger.Printf("tcp %s: %s could not reach %s: %s\n", l.name, client.RemoteAddr(), up.dest.Host, err)
+		return
+	}
+	defer upstream.Close()
+	l.connections.Add(1)
+	l.active.Add(1)
+	defer l.active.Add(-1)
+	l.conns.Store(client, struct{}{})
+	l.conns.Store(upstream, struct{}{})
+	defer l.conns.Delete(client)
+	defer l.conns.Delete(upstream)
+	if l.closed.Load() {
+		return
+	}
+
+	var in, out int64
+	done := make(chan struct{})
+	go func() {
+		in = splice(upstream, client)
+		close(done)
+	}()
+	out = splice(client, upstream)
+	<-done
+	l.bytesIn.Add(uint64(in))
+	l.bytesOut.Add(uint64(out))
+	l.logger.Printf("tcp %s: %s -> %s closed, %d bytes in, %d bytes out, %s\n",
+		l.name, client.RemoteAddr(), up.dest.Host, in, out, time.Since(started))
+}
+
+// splice copies src to dst until src is done and half closes dst
+func splice(dst, src net.Conn) int64 {
+	n, _ := io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+func (l *tcpListener) status() *TCPStatus {
+	return &TCPStatus{
+		Listen:      l.listener.Addr().String(),
+		Connections: l.connections.Load(),
+		Active:      l.active.Load(),
+		BytesIn:     l.bytesIn.Load(),
+		BytesOut:    l.bytesOut.Load(),
+	}
+}
+
+// closeIf stops the listener and its connections if owner still owns it
+func (l *tcpListener) closeIf(owner *balancer) {
+	if l.owner.Load() != owner {
+		return
+	}
+	l.once.Do(func() {
+		l.closed.Store(true)
+		l.listener.Close()
+		l.conns.Range(func(conn, _ any) bool {
+			conn.(net.Conn).Close()
+			return true
+		})
+		l.wg.Wait()
+		l.logger.Printf("Stopped tcp patch %s\n", l.name)
+	})
+}
+
+// listenPatch binds the listener of a tcp or udp route, if the replaced route
+// listens on the same port its listener is taken over. undo reverts a take
+// over or closes the new listener
+func (pc *PatchControl) listenPatch(route, old *patchRoute) (undo func(), err error) {
+	sameListener := old != nil && old.patch.Type == route.patch.Type &&
+		old.patch.Port == route.patch.Port && route.patch.Port+pc.listen.PortOffset != 0
+	switch {
+	case sameListener && old.tcp != nil:
+		route.tcp = old.tcp
+		route.tcp.owner.Store(route.balancer)
+		return func() { route.tcp.owner.Store(old.balancer) }, nil
+	case sameListener && old.udp != nil:
+		route.udp = old.udp
+		route.udp.takeOver(route.balancer, route.patch.UDP)
+		return func() { route.udp.takeOver(old.balancer, old.patch.UDP) }, nil
+	}
+	address, err := pc.listen.address(route.patch.Port)
+	if err != nil {
+		return nil, err
+	}
+	if route.patch.Type == PATCH_UDP {
+		route.udp, err = newUDPListener(route.patch.Path, address, route.balancer, route.patch.UDP, pc.logger)
+	} else {
+		route.tcp, err = newTCPListener(route.patch.Path, address, route.balancer, pc.logger)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", address, err)
+	}
+	return route.close, nil
+}
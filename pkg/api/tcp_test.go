@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTCPEchoUpstream(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTCPPatch(t *testing.T) {
+	upstream := newTCPEchoUpstream(t)
+	defer upstream.Close()
+
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addPatchRoutes(router.Group("/patch", withUser("tester")))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	raw, _ := json.Marshal(ForwardPatch{Path: "echo", Type: PATCH_TCP, Dest: "tcp://" + upstream.Addr().String()})
+	req, _ := http.NewRequest(http.MethodPatch, server.URL+"/patch", bytes.NewReader(raw))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected tcp patch to be applied, got %d", resp.StatusCode)
+		t.FailNow()
+	}
+	listen := patches.routes["echo"].tcp.listener.Addr().String()
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	echoed, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(echoed) != "ping" {
+		t.Errorf("Expected echo, got %q", echoed)
+	}
+
+	var status PatchStatus
+	if !waitFor(time.Second, func() bool {
+		resp, err := http.Get(server.URL + "/patch/echo")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status.TCP != nil && status.TCP.Active == 0 && status.TCP.Connections == 1
+	}) {
+		t.Errorf("Expected finished connection in status, got %+v", status.TCP)
+		t.FailNow()
+	}
+	if status.TCP.BytesIn != 4 || status.TCP.BytesOut != 4 || status.TCP.Listen != listen {
+		t.Errorf("Unexpected tcp status %+v", status.TCP)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/patch/echo", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected tcp patch to be deleted, got %v %v", resp, err)
+	}
+	if conn, err := net.DialTimeout("tcp", listen, 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Error("Expected listener to be closed")
+	}
+}
+
+func TestTCPPatchInvalid(t *testing.T) {
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := gin.New()
+	patches.addPatchRoutes(router.Group("/patch", withUser("tester")))
+	for _, patch := range []ForwardPatch{
+		{Path: "a", Type: PATCH_TCP, Dest: "tcp://localhost:1", Capture: &CaptureConfig{}},
+		{Path: "b", Type: PATCH_TCP, Dest: "tcp://localhost:1", Port: 70000},
+		{Path: "c", Type: "udpx", Dest: "tcp://localhost:1"},
+	} {
+		raw, _ := json.Marshal(patch)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPatch, "/patch", bytes.NewReader(raw)))
+		if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "error") {
+			t.Errorf("Expected %s to be rejected, got %d %s", patch.Path, resp.Code, resp.Body)
+		}
+	}
+}
+
+func TestTCPPatchTakeOver(t *testing.T) {
+	first := newTCPEchoUpstream(t)
+	defer first.Close()
+	second := newTCPEchoUpstream(t)
+	defer second.Close()
+	patches := NewPatchControl(nil, ListenConfig{Host: "127.0.0.1", PortOffset: 0})
+	defer patches.Close()
+
+	port := freePort(t)
+	patch := ForwardPatch{Path: "takeover", Type: PATCH_TCP, Dest: "tcp://" + first.Addr().String(), Port: port}
+	if err := patches.registerPath(context.Background(), patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	listener := patches.routes["takeover"].tcp
+	patch.Dest = "tcp://" + second.Addr().String()
+	if err := patches.registerPath(context.Background(), patch, true); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	route := patches.routes["takeover"]
+	if route.tcp != listener || listener.closed.Load() || listener.owner.Load() != route.balancer {
+		t.Error("Expected listener to be taken over by the replacing patch")
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
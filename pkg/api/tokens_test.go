@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+)
+
+func TestTokens(t *testing.T) {
+	tokens := system.NewTokenIMDB()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		system.NewUserIMDB(), tokens, &internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	upstream := newTestUpstream()
+	defer upstream.Close()
+
+	jar, _ := cookiejar.New(nil)
+	session := &http.Client{Jar: jar}
+	do := func(client *http.Client, bearer, method, target, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(raw)
+	}
+	create := func(payload string, want int) string {
+		t.Helper()
+		code, body := do(session, "", http.MethodPost, "/api/v1/auth/tokens", payload)
+		if code != want {
+			t.Errorf("Expected %d creating %s, got %d %s", want, payload, code, body)
+			return ""
+		}
+		var created struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal([]byte(body), &created)
+		return created.Token
+	}
+	if code, _ := do(session, "", http.MethodPost, "/api/v1/auth/connect", `{"username": "root", "password": "rootpass"}`); code != http.StatusCreated {
+		t.Errorf("Expected the admin to connect, got %d", code)
+		t.FailNow()
+	}
+
+	plain := create(`{"name": "ci"}`, http.StatusCreated)
+	reader := create(`{"name": "reader", "scopes": ["traffic:read"], "expires_at": "`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`, http.StatusCreated)
+	create(`{"name": "ci"}`, http.StatusConflict)
+	create(`{"name": "bad", "scopes": ["unknown"]}`, http.StatusBadRequest)
+	create(`{"name": "old", "expires_at": "2000-01-01T00:00:00Z"}`, http.StatusBadRequest)
+	if !strings.HasPrefix(plain, system.TOKEN_PREFIX) || reader == "" {
+		t.Errorf("Expected raw tokens, got %q and %q", plain, reader)
+		t.FailNow()
+	}
+
+	client := &http.Client{}
+	if code, body := do(client, plain, http.MethodPatch, "/patch", `{"path": "ci", "dest": "`+upstream.URL+`"}`); code != http.StatusOK {
+		t.Errorf("Expected the token to apply a patch, got %d %s", code, body)
+	}
+	if owner := patches.routes["ci"].patch.Owner; owner != "root" {
+		t.Errorf("Expected the patch to be owned by the token user, got %q", owner)
+	}
+	for _, tc := range []struct {
+		token, target string
+		want          int
+	}{
+		{plain, "/api/v1/auth/traffic", http.StatusForbidden},
+		{reader, "/api/v1/auth/traffic", http.StatusOK},
+		{reader, "/api/v1/auth/replay", http.StatusForbidden},
+		{reader, "/api/v1/auth/tokens", http.StatusUnauthorized},
+		{"pat_unknown", "/patch", http.StatusUnauthorized},
+	} {
+		if code, _ := do(client, tc.token, http.MethodGet, tc.target, ""); code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.target, tc.want, code)
+		}
+	}
+
+	_, body := do(session, "", http.MethodGet, "/api/v1/auth/tokens", "")
+	var listed []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &listed); err != nil || len(listed) != 2 {
+		t.Errorf("Expected two tokens, got %s", body)
+		t.FailNow()
+	}
+	if listed[0]["last_used_at"] == nil || listed[0]["hash"] != nil || strings.Contains(body, plain) {
+		t.Errorf("Expected the last use without the token, got %s", body)
+	}
+
+	ctx := context.Background()
+	expired := time.Now().Add(-time.Minute)
+	stored, _ := tokens.GetTokenByHash(ctx, system.HashToken(reader))
+	tokens.Lock()
+	tokens.Tokens[stored.ID].ExpiresAt = &expired
+	tokens.Unlock()
+	if code, _ := do(client, reader, http.MethodGet, "/patch", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the expired token to be rejected, got %d", code)
+	}
+
+	stored, _ = tokens.GetTokenByHash(ctx, system.HashToken(plain))
+	if code, _ := do(session, "", http.MethodDelete, "/api/v1/auth/tokens/"+strconv.FormatInt(stored.ID, 10), ""); code != http.StatusOK {
+		t.Errorf("Expected the token to be revoked, got %d", code)
+	}
+	if code, _ := do(client, plain, http.MethodGet, "/patch", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked token to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/myLogic207/PaT-CH/pkg/api/internal"
+)
+
+func TestTwoFactor(t *testing.T) {
+	ctx := context.Background()
+	users := system.NewUserIMDB()
+	twoFactor := system.NewTwoFactorIMDB()
+	jwtKey, _ := internal.ParseJWTKey("main:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+	router := NewRouter(log.Default(), cookie.NewStore([]byte("secret")), patches,
+		users, twoFactor, &internal.JWTConfig{Keys: []*internal.JWTKey{jwtKey}},
+		&internal.AdminBootstrap{Name: "root", Password: "rootpass"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	newClient := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar}
+	}
+	do := func(client *http.Client, method, target, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(raw)
+	}
+	expect := func(client *http.Client, method, target, body string, want int) string {
+		t.Helper()
+		code, resp := do(client, method, target, body)
+		if code != want {
+			t.Errorf("Expected %d for %s %s, got %d %s", want, method, target, code, resp)
+			t.FailNow()
+		}
+		return resp
+	}
+	code := func(secret string, offset int64) string {
+		raw, _ := system.TOTPCode(secret, system.TOTPStep(time.Now())+offset)
+		return `{"code": "` + raw + `"}`
+	}
+	if _, err := users.Create(ctx, "alice", "", "alicepass"); err != nil {
+		t.Fatal(err)
+	}
+	login := `{"username": "alice", "password": "alicepass"}`
+
+	// enrol, the secret is only used once the first code is confirmed
+	alice := newClient()
+	expect(alice, http.MethodPost, "/api/v1/auth/connect", login, http.StatusCreated)
+	var enrolment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	json.Unmarshal([]byte(expect(alice, http.MethodPost, "/api/v1/auth/2fa/enroll", "", http.StatusCreated)), &enrolment)
+	if enrolment.Secret == "" || !strings.HasPrefix(enrolment.URI, "otpauth://totp/") {
+		t.Fatalf("Expected a secret and otpauth uri, got %+v", enrolment)
+	}
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/confirm", `{"code": "000000x"}`, http.StatusUnauthorized)
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal([]byte(expect(alice, http.MethodPost, "/api/v1/auth/2fa/confirm", code(enrolment.Secret, 0), http.StatusOK)), &confirmed)
+	if len(confirmed.RecoveryCodes) != system.RECOVERY_CODE_COUNT {
+		t.Fatalf("Expected recovery codes, got %v", confirmed.RecoveryCodes)
+	}
+	if stored, _ := twoFactor.GetTwoFactor(ctx, "alice"); stored == nil || stored.RecoveryCodes[0] == confirmed.RecoveryCodes[0] {
+		t.Errorf("Expected the recovery codes to be stored hashed")
+	}
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/enroll", "", http.StatusConflict)
+
+	// connecting now only gets a partial session until a code is verified
+	alice = newClient()
+	expect(alice, http.MethodPost, "/api/v1/auth/connect", login, http.StatusAccepted)
+	expect(alice, http.MethodGet, "/api/v1/auth/user", "", http.StatusUnauthorized)
+	expect(alice, http.MethodGet, "/api/v1/auth/2fa", "", http.StatusUnauthorized)
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/verify", code(enrolment.Secret, 0), http.StatusUnauthorized)
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/verify", code(enrolment.Secret, 1), http.StatusCreated)
+	expect(alice, http.MethodGet, "/api/v1/auth/user", "", http.StatusOK)
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/verify", code(enrolment.Secret, 1), http.StatusBadRequest)
+
+	// recovery codes work once, also for access tokens
+	alice = newClient()
+	expect(alice, http.MethodPost, "/api/v1/auth/connect", login, http.StatusAccepted)
+	expect(alice, http.MethodPost, "/api/v1/auth/2fa/verify", `{"code": "`+confirmed.RecoveryCodes[0]+`"}`, http.StatusCreated)
+	expect(http.DefaultClient, http.MethodPost, "/api/v1/auth/token", login, http.StatusUnauthorized)
+	expect(http.DefaultClient, http.MethodPost, "/api/v1/auth/token", `{"username": "alice", "password": "alicepass", "code": "`+confirmed.RecoveryCodes[0]+`"}`, http.StatusUnauthorized)
+	expect(http.DefaultClient, http.MethodPost, "/api/v1/auth/token", `{"username": "alice", "password": "alicepass", "code": "`+confirmed.RecoveryCodes[1]+`"}`, http.StatusCreated)
+	if status := expect(alice, http.MethodGet, "/api/v1/auth/2fa", "", http.StatusOK); !strings.Contains(status, `"recovery_codes_left":8`) {
+		t.Errorf("Expected two recovery codes to be used, got %s", status)
+	}
+
+	// roles can require 2FA, members without it have to enrol before connecting
+	root := newClient()
+	expect(root, http.MethodPost, "/api/v1/auth/connect", `{"username": "root", "password": "rootpass"}`, http.StatusCreated)
+	expect(root, http.MethodPost, "/api/v1/auth/roles", `{"name": "ops", "permissions": ["traffic:read"], "require_two_factor": true}`, http.StatusCreated)
+	expect(root, http.MethodPut, "/api/v1/auth/roles/ops", `{}`, http.StatusBadRequest)
+	if role := expect(root, http.MethodPut, "/api/v1/auth/roles/ops", `{"require_two_factor": true}`, http.StatusOK); !strings.Contains(role, `"traffic:read"`) {
+		t.Errorf("Expected the permissions to be kept, got %s", role)
+	}
+	if _, err := users.Create(ctx, "bob", "", "bobpass"); err != nil {
+		t.Fatal(err)
+	}
+	expect(root, http.MethodPut, "/api/v1/auth/users/bob/roles/ops", "", http.StatusOK)
+	expect(root, http.MethodPut, "/api/v1/auth/users/alice/roles/ops", "", http.StatusOK)
+	expect(alice, http.MethodDelete, "/api/v1/auth/2fa", code(enrolment.Secret, -1), http.StatusForbidden)
+
+	bob := newClient()
+	expect(http.DefaultClient, http.MethodPost, "/api/v1/auth/token", `{"username": "bob", "password": "bobpass"}`, http.StatusForbidden)
+	expect(bob, http.MethodPost, "/api/v1/auth/connect", `{"username": "bob", "password": "bobpass"}`, http.StatusAccepted)
+	expect(bob, http.MethodGet, "/api/v1/auth/user", "", http.StatusUnauthorized)
+	json.Unmarshal([]byte(expect(bob, http.MethodPost, "/api/v1/auth/2fa/enroll", "", http.StatusCreated)), &enrolment)
+	expect(bob, http.MethodPost, "/api/v1/auth/2fa/confirm", code(enrolment.Secret, 0), http.StatusOK)
+	expect(bob, http.MethodGet, "/api/v1/auth/user", "", http.StatusOK)
+
+	// without a role requiring it, 2FA can be disabled with a current code
+	expect(root, http.MethodDelete, "/api/v1/auth/users/alice/roles/ops", "", http.StatusOK)
+	expect(alice, http.MethodDelete, "/api/v1/auth/2fa", `{"code": "123"}`, http.StatusUnauthorized)
+	expect(alice, http.MethodDelete, "/api/v1/auth/2fa", code(enrolment.Secret, 0), http.StatusUnauthorized)
+	expect(alice, http.MethodDelete, "/api/v1/auth/2fa", `{"code": "`+confirmed.RecoveryCodes[2]+`"}`, http.StatusOK)
+	expect(newClient(), http.MethodPost, "/api/v1/auth/connect", login, http.StatusCreated)
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_UDP_IDLE_TIMEOUT = 30 * time.Second
+	DEFAULT_UDP_MAX_SESSIONS = 1024
+	// largest possible udp payload
+	udpBufferSize = 64 * 1024
+)
+
+var (
+	ErrUDPOption  = errors.New("udp options are only supported for udp patches")
+	ErrInvalidUDP = errors.New("udp limits must not be negative")
+)
+
+// UDPConfig limits the client sessions of a udp patch, a session ends after
+// the idle timeout without datagrams in either direction
+type UDPConfig struct {
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+}
+
+func (u *UDPConfig) withDefaults() UDPConfig {
+	config := UDPConfig{}
+	if u != nil {
+		config = *u
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = Duration(DEFAULT_UDP_IDLE_TIMEOUT)
+	}
+	if config.MaxSessions == 0 {
+		config.MaxSessions = DEFAULT_UDP_MAX_SESSIONS
+	}
+	return config
+}
+
+func (u *UDPConfig) validate() error {
+	if u != nil && (u.IdleTimeout < 0 || u.MaxSessions < 0) {
+		return ErrInvalidUDP
+	}
+	return nil
+}
+
+type UDPStatus struct {
+	Listen   string             `json:"listen"`
+	Total    uint64             `json:"total"`
+	Dropped  uint64             `json:"dropped"`
+	Sessions []UDPSessionStatus `json:"sessions"`
+}
+
+type UDPSessionStatus struct {
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	StartedAt  time.Time `json:"started_at"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// udpSession relays the datagrams of one client through its own upstream socket
+type udpSession struct {
+	client     *net.UDPAddr
+	upstream   *upstream
+	conn       *net.UDPConn
+	started    time.Time
+	lastActive atomic.Int64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) status() UDPSessionStatus {
+	return UDPSessionStatus{
+		Client:     s.client.String(),
+		Upstream:   s.upstream.dest.Host,
+		PacketsIn:  s.packetsIn.Load(),
+		PacketsOut: s.packetsOut.Load(),
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		StartedAt:  s.started,
+		LastActive: time.Unix(0, s.lastActive.Load()).UTC(),
+	}
+}
+
+// udpListener tracks a session per client address of a udp patch, like the
+// tcp listener it can be taken over by a replacing patch on the same port
+type udpListener struct {
+	sync.Mutex
+	name     string
+	conn     *net.UDPConn
+	owner    atomic.Pointer[balancer]
+	config   atomic.Pointer[UDPConfig]
+	sessions map[string]*udpSession
+	wg       sync.WaitGroup
+	once     sync.Once
+	closed   bool
+	logger   *log.Logger
+
+	total   atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newUDPListener(name, address string, owner *balancer, config *UDPConfig, logger *log.Logger) (*udpListener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		name:     name,
+		conn:     conn,
+		sessions: make(map[string]*udpSession),
+		logger:   logger,
+	}
+	l.takeOver(owner, config)
+	l.wg.Add(1)
+	go l.serve()
+	logger.Printf("Listening for udp patch %s on %s\n", name, conn.LocalAddr())
+	return l, nil
+}
+
+func (l *udpListener) takeOver(owner *balancer, config *UDPConfig) {
+	withDefaults := config.withDefaults()
+	l.config.Store(&withDefaults)
+	l.owner.Store(owner)
+}
+
+func (l *udpListener) serve() {
+	defer l.wg.Done()
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.logger.Printf("udp %s: %s\n", l.name, err)
+			continue
+		}
+		session := l.session(client)
+		if session == nil {
+			l.dropped.Add(1)
+			continue
+		}
+		session.touch()
+		if _, err := session.conn.Write(buf[:n]); err != nil {
+			l.dropped.Add(1)
+			continue
+		}
+		session.packetsIn.Add(1)
+		session.bytesIn.Add(uint64(n))
+	}
+}
+
+// session returns the session of the client, a new one is opened to the
+// next upstream if the client has none, nil is returned if it can't be opened
+func (l *udpListener) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+	l.Lock()
+	defer l.Unlock()
+	if session, ok := l.sessions[key]; ok {
+		return session
+	}
+	if l.closed {
+		return nil
+	}
+	if len(l.sessions) >= l.config.Load().MaxSessions {
+		l.logger.Printf("udp %s: session limit reached, dropping datagram of %s\n", l.name, key)
+		return nil
+	}
+	up := l.owner.Load().next(nil, client.IP.String())
+	if up == nil {
+		l.logger.Printf("udp %s: %s rejected, %s\n", l.name, key, ErrNoHealthy)
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", up.dest.Host)
+	if err != nil {
+		l.logger.Printf("udp %s: %s could not resolve %s: %s\n", l.name, key, up.dest.Host, err)
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		l.logger.Printf("udp %s: %s could not reach %s: %s\n", l.name, key, up.dest.Host, err)
+		return nil
+	}
+	up.acquire()
+	session := &udpSession{
+		client:   client,
+		upstream: up,
+		conn:     conn,
+		started:  time.Now().UTC(),
+	}
+	session.touch()
+	l.sessions[key] = session
+	l.total.Add(1)
+	l.wg.Add(1)
+	go l.relay(session)
+	return session
+}
+
+// relay sends the replies of the upstream back to the client until the session is idle
+func (l *udpListener) relay(session *udpSession) {
+	defer l.wg.Done()
+	defer l.closeSession(session)
+	buf := make([]byte, udpBufferSize)
+	for {
+		idle := time.Duration(l.config.Load().IdleTimeout)
+		session.conn.SetReadDeadline(time.Unix(0, session.lastActive.Load()).Add(idle))
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			// the client may have sent datagrams since the deadline was set
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, session.lastActive.Load())) < idle {
+				continue
+			}
+			return
+		}
+		session.touch()
+		if _, err := l.conn.WriteToUDP(buf[:n], session.client); err != nil {
+			return
+		}
+		session.packetsOut.Add(1)
+		session.bytesOut.Add(uint64(n))
+	}
+}
+
+func (l *udpListener) closeSession(session *udpSession) {
+	key := session.client.String()
+	l.Lock()
+	if l.sessions[key] == session {
+		delete(l.sessions, key)
+	}
+	l.Unlock()
+	session.conn.Close()
+	session.upstream.release()
+	l.logger.Printf("udp %s: %s -> %s closed, %d datagrams (%d bytes) in, %d datagrams (%d bytes) out, %s\n",
+		l.name, key, session.upstream.dest.Host,
+		session.packetsIn.Load(), session.bytesIn.Load(),
+		session.packetsOut.Load(), session.bytesOut.Load(),
+		time.Since(session.started))
+}
+
+func (l *udpListener) status() *UDPStatus {
+	l.Lock()
+	defer l.Unlock()
+	status := &UDPStatus{
+		Listen:   l.conn.LocalAddr().String(),
+		Total:    l.total.Load(),
+		Dropped:  l.dropped.Load(),
+		Sessions: make([]UDPSessionStatus, 0, len(l.sessions)),
+	}
+	for _, session := range l.sessions {
+		status.Sessions = append(status.Sessions, session.status())
+	}
+	sort.Slice(status.Sessions, func(i, j int) bool {
+		return status.Sessions[i].StartedAt.Before(status.Sessions[j].StartedAt)
+	})
+	return status
+}
+
+// closeIf stops the listener and its sessions if owner still owns it
+func (l *udpListener) closeIf(owner *balancer) {
+	if l.owner.Load() != owner {
+		return
+	}
+	l.once.Do(func() {
+		l.Lock()
+		l.closed = true
+		for _, session := range l.sessions {
+			session.conn.Close()
+		}
+		l.Unlock()
+		l.conn.Close()
+		l.wg.Wait()
+		l.logger.Printf("Stopped udp patch %s\n", l.name)
+	})
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newUDPEchoUpstream(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPPatch(t *testing.T) {
+	ctx := context.Background()
+	upstream := newUDPEchoUpstream(t)
+	defer upstream.Close()
+	patches := NewPatchControl(nil)
+	defer patches.Close()
+
+	patch := ForwardPatch{
+		Path: "dns",
+		Type: PATCH_UDP,
+		Dest: "udp://" + upstream.LocalAddr().String(),
+		UDP:  &UDPConfig{IdleTimeout: Duration(100 * time.Millisecond)},
+	}
+	if err := patches.registerPath(ctx, patch, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	listen := patches.routes["dns"].udp.conn.LocalAddr().String()
+
+	for _, message := range []string{"first", "second"} {
+		client, err := net.Dial("udp", listen)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer client.Close()
+		for i := 0; i < 2; i++ {
+			client.Write([]byte(message))
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := client.Read(buf)
+			if err != nil || string(buf[:n]) != message {
+				t.Errorf("Expected echo %s, got %q %v", message, buf[:n], err)
+			}
+		}
+	}
+
+	status := patches.routes["dns"].status().UDP
+	if status == nil || len(status.Sessions) != 2 || status.Total != 2 {
+		t.Errorf("Expected 2 sessions, got %+v", status)
+		t.FailNow()
+	}
+	session := status.Sessions[0]
+	if session.PacketsIn != 2 || session.PacketsOut != 2 || session.BytesIn != 10 || session.BytesOut != 10 {
+		t.Errorf("Unexpected session counters %+v", session)
+	}
+	if !waitFor(time.Second, func() bool {
+		return len(patches.routes["dns"].status().UDP.Sessions) == 0
+	}) {
+		t.Error("Expected idle sessions to be closed")
+	}
+
+	if err := patches.unregisterPath(ctx, "dns"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUDPPatchInvalid(t *testing.T) {
+	for _, patch := range []ForwardPatch{
+		{Path: "a", Type: PATCH_UDP, Dest: "udp://localhost:53", UDP: &UDPConfig{MaxSessions: -1}},
+		{Path: "b", Type: PATCH_UDP, Dest: "udp://localhost:53", Rules: []RewriteRule{{Action: RULE_ADD_PREFIX, Prefix: "/"}}},
+		{Path: "c", Type: PATCH_TCP, Dest: "tcp://localhost:53", UDP: &UDPConfig{}},
+	} {
+		if _, err := newPatchRoute(patch, false, nil); err == nil {
+			t.Errorf("Expected %s to be rejected", patch.Path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+var (
+	ErrMailConfig = errors.New("invalid mail config")
+	ErrSendMail   = errors.New("could not send mail")
+)
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mails, implementations have to be safe for concurrent use
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// ValidAddress reports if address is a single plain mail address
+func ValidAddress(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address
+}
+
+// NewMailer creates the mailer selected by the driver key of config, smtp, file
+// or stdout. No driver disables mails and returns nil
+func NewMailer(config *util.Config, logger *log.Logger) (Mailer, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	driver, _ := config.GetString("driver")
+	from, _ := config.GetString("from")
+	if driver != "" && !ValidAddress(from) {
+		return nil, fmt.Errorf("%w: from must be a mail address", ErrMailConfig)
+	}
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "":
+		return nil, nil
+	case "smtp":
+		host, ok := config.GetString("host")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("%w: smtp needs a host", ErrMailConfig)
+		}
+		port, ok := config.GetString("port")
+		if !ok || port == "" {
+			port = "587"
+		}
+		username, _ := config.GetString("username")
+		password, _ := config.GetString("password")
+		return NewSMTPMailer(host, port, username, password, from, logger), nil
+	case "file":
+		path, ok := config.GetString("file")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("%w: file needs a path", ErrMailConfig)
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.Println(err)
+			return nil, fmt.Errorf("%w: cannot open %s", ErrMailConfig, path)
+		}
+		return NewWriterMailer(file, from), nil
+	case "stdout":
+		return NewWriterMailer(os.Stdout, from), nil
+	}
+	return nil, fmt.Errorf("%w: unknown driver %s", ErrMailConfig, driver)
+}
+
+// format renders the message with the headers every mail needs
+func format(from string, msg *Message, now time.Time) []byte {
+	sb := strings.Builder{}
+	sb.WriteString("From: " + from + "\r\n")
+	sb.WriteString("To: " + msg.To + "\r\n")
+	sb.WriteString("Subject: " + msg.Subject + "\r\n")
+	sb.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
+
+// checkMessage rejects recipients and subjects that would inject headers
+func checkMessage(msg *Message) error {
+	if !ValidAddress(msg.To) || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("%w: invalid recipient or subject", ErrSendMail)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/myLogic207/PaT-CH/pkg/util"
+)
+
+// smtpStandIn accepts one mail without tls or auth and hands out its data
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ready")
+		data := strings.Builder{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := smtpStandIn(t)
+	host, port, _ := net.SplitHostPort(addr)
+	config := util.NewConfig(map[string]interface{}{"driver": "smtp", "from": "patch@example.net", "host": host, "port": port}, nil)
+	mailer, err := NewMailer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(context.Background(), &Message{To: "user@example.net", Subject: "Hello", Body: "line one\nline two"}); err != nil {
+		t.Fatal(err)
+	}
+	data := <-received
+	for _, want := range []string{"From: patch@example.net\r\n", "To: user@example.net\r\n", "Subject: Hello\r\n", "\r\n\r\nline one\r\nline two\r\n"} {
+		if !strings.Contains(data, want) {
+			t.Errorf("Expected the mail to contain %q, got %q", want, data)
+		}
+	}
+}
+
+func TestWriterMailer(t *testing.T) {
+	out := &bytes.Buffer{}
+	mailer := NewWriterMailer(out, "patch@example.net")
+	if err := mailer.Send(context.Background(), &Message{To: "user@example.net", Subject: "Hello", Body: "body"}); err != nil || !strings.Contains(out.String(), "Subject: Hello\r\n") {
+		t.Errorf("Expected the mail to be written, got %q %v", out.String(), err)
+	}
+	for _, msg := range []*Message{
+		{To: "user@example.net\r\nBcc: other@example.net", Subject: "Hello"},
+		{To: "user@example.net", Subject: "Hello\r\nBcc: other@example.net"},
+		{To: "Name <user@example.net>", Subject: "Hello"},
+	} {
+		if err := mailer.Send(context.Background(), msg); !errors.Is(err, ErrSendMail) {
+			t.Errorf("Expected %+v to be rejected, got %v", msg, err)
+		}
+	}
+
+	for driver, valid := range map[string]bool{"": true, "stdout": true, "smtp": false, "file": false, "pigeon": false} {
+		mailer, err := NewMailer(util.NewConfig(map[string]interface{}{"driver": driver, "from": "patch@example.net"}, nil), nil)
+		if valid != (err == nil) || (valid && (driver == "") != (mailer == nil)) {
+			t.Errorf("Unexpected result for driver %q: %v %v", driver, mailer, err)
+		}
+	}
+}
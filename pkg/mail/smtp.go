@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends mails over smtp, it uses STARTTLS when the server offers it
+// and only authenticates if a username is set
+type SMTPMailer struct {
+	addr   string
+	host   string
+	auth   smtp.Auth
+	from   string
+	logger *log.Logger
+}
+
+func NewSMTPMailer(host string, port string, username string, password string, from string, logger *log.Logger) *SMTPMailer {
+	if logger == nil {
+		logger = log.Default()
+	}
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{
+		addr:   net.JoinHostPort(host, port),
+		host:   host,
+		auth:   auth,
+		from:   from,
+		logger: logger,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	// smtp.SendMail does not take a context, the send runs on and is abandoned on cancel
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg, time.Now()))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			m.logger.Println(err)
+			return ErrSendMail
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+package mail
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// WriterMailer writes mails to a file or stdout instead of sending them, for
+// development and tests
+type WriterMailer struct {
+	sync.Mutex
+	out  io.Writer
+	from string
+}
+
+func NewWriterMailer(out io.Writer, from string) *WriterMailer {
+	return &WriterMailer{
+		out:  out,
+		from: from,
+	}
+}
+
+func (m *WriterMailer) Send(ctx context.Context, msg *Message) error {
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.out.Write(append(format(m.from, msg, time.Now()), '\r', '\n')); err != nil {
+		return ErrSendMail
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	attemptsPrefix = "login_attempts:"
+	lockoutPrefix  = "login_lockout:"
+)
+
+var (
+	ErrAttempts = errors.New("could not count attempts")
+)
+
+// AttemptCounter counts failed attempts per key and locks keys out for a while
+type AttemptCounter interface {
+	// Fail counts a failed attempt and returns the count, it expires window after the first failure
+	Fail(ctx context.Context, key string, window time.Duration) (int, error)
+	Attempts(ctx context.Context, key string) (int, error)
+	Lock(ctx context.Context, key string, duration time.Duration) error
+	// LockedFor is the time left until key is unlocked, 0 if it is not locked
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	// Clear resets the count and lockout of key
+	Clear(ctx context.Context, key string) error
+}
+
+// the expiry is only set by the first failure so the window does not slide
+var failScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (c *RedisConnector) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	if !c.active {
+		return 0, ErrRedisOffline
+	}
+	count, err := failScript.Run(ctx, c.store, []string{attemptsPrefix + key}, window.Milliseconds()).Int()
+	if err != nil {
+		c.logger.Println(err)
+		return 0, ErrAttempts
+	}
+	return count, nil
+}
+
+func (c *RedisConnector) Attempts(ctx context.Context, key string) (int, error) {
+	if !c.active {
+		return 0, ErrRedisOffline
+	}
+	count, err := c.store.Get(ctx, attemptsPrefix+key).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		c.logger.Println(err)
+		return 0, ErrAttempts
+	}
+	return count, nil
+}
+
+func (c *RedisConnector) Lock(ctx context.Context, key string, duration time.Duration) error {
+	if !c.active {
+		return ErrRedisOffline
+	}
+	if err := c.store.Set(ctx, lockoutPrefix+key, 1, duration).Err(); err != nil {
+		c.logger.Println(err)
+		return ErrAttempts
+	}
+	return nil
+}
+
+func (c *RedisConnector) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	if !c.active {
+		return 0, ErrRedisOffline
+	}
+	ttl, err := c.store.PTTL(ctx, lockoutPrefix+key).Result()
+	if err != nil {
+		c.logger.Println(err)
+		return 0, ErrAttempts
+	}
+	// missing keys have a negative ttl
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (c *RedisConnector) Clear(ctx context.Context, key string) error {
+	if !c.active {
+		return ErrRedisOffline
+	}
+	if err := c.store.Del(ctx, attemptsPrefix+key, lockoutPrefix+key).Err(); err != nil {
+		c.logger.Println(err)
+		return ErrAttempts
+	}
+	return nil
+}
+
+type attempts struct {
+	count   int
+	expires time.Time
+}
+
+// MemoryAttempts keeps the counts in memory, they only hold for a single instance
+type MemoryAttempts struct {
+	// not embedded, Lock is the lockout of the counter
+	mu       sync.Mutex
+	attempts map[string]*attempts
+	locks    map[string]time.Time
+	calls    int
+}
+
+func NewMemoryAttempts() *MemoryAttempts {
+	return &MemoryAttempts{
+		attempts: make(map[string]*attempts),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryAttempts) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.calls++
+	if m.calls%1024 == 0 {
+		m.evict(now)
+	}
+	a, ok := m.attempts[key]
+	if !ok || !now.Before(a.expires) {
+		a = &attempts{expires: now.Add(window)}
+		m.attempts[key] = a
+	}
+	a.count++
+	return a.count, nil
+}
+
+func (m *MemoryAttempts) Attempts(ctx context.Context, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.attempts[key]; ok && time.Now().Before(a.expires) {
+		return a.count, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryAttempts) Lock(ctx context.Context, key string, duration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[key] = time.Now().Add(duration)
+	return nil
+}
+
+func (m *MemoryAttempts) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if until, ok := m.locks[key]; ok {
+		if left := time.Until(until); left > 0 {
+			return left, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *MemoryAttempts) Clear(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	delete(m.locks, key)
+	return nil
+}
+
+// evict drops expired counts and lockouts
+func (m *MemoryAttempts) evict(now time.Time) {
+	for key, a := range m.attempts {
+		if !now.Before(a.expires) {
+			delete(m.attempts, key)
+		}
+	}
+	for key, until := range m.locks {
+		if !now.Before(until) {
+			delete(m.locks, key)
+		}
+	}
+}
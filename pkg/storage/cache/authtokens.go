@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+	"github.com/redis/go-redis/v9"
+)
+
+// mailed tokens are stored by hash, a second key points from the user to the
+// current token so a new token replaces the old one. Both expire with the token
+const (
+	authTokenPrefix     = "auth_token:"
+	authTokenUserPrefix = "auth_token_user:"
+)
+
+func (c *RedisConnector) SaveAuthToken(ctx context.Context, token *system.AuthToken) error {
+	if !c.active {
+		return ErrRedisOffline
+	}
+	value, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(token.ExpiresAt)
+	if ttl <= 0 {
+		return system.ErrNoSuchAuthToken
+	}
+	if err := c.DeleteAuthToken(ctx, token.User, token.Purpose); err != nil {
+		return err
+	}
+	_, err = c.store.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, authTokenPrefix+token.Purpose+":"+token.Hash, value, ttl)
+		pipe.Set(ctx, authTokenUserPrefix+token.Purpose+":"+token.User, token.Hash, ttl)
+		return nil
+	})
+	if err != nil {
+		c.logger.Println(err)
+		return ErrObjectCache
+	}
+	return nil
+}
+
+// ConsumeAuthToken loads and deletes the token in one step, so it is used at most once
+func (c *RedisConnector) ConsumeAuthToken(ctx context.Context, purpose string, hash string) (*system.AuthToken, error) {
+	if !c.active {
+		return nil, ErrRedisOffline
+	}
+	value, err := c.store.GetDel(ctx, authTokenPrefix+purpose+":"+hash).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, system.ErrNoSuchAuthToken
+	}
+	if err != nil {
+		c.logger.Println(err)
+		return nil, ErrObjectCache
+	}
+	token := &system.AuthToken{}
+	if err := json.Unmarshal(value, token); err != nil {
+		c.logger.Println(err)
+		return nil, ErrObjectCache
+	}
+	c.store.Del(ctx, authTokenUserPrefix+purpose+":"+token.User)
+	if token.Expired(time.Now()) {
+		return nil, system.ErrNoSuchAuthToken
+	}
+	return token, nil
+}
+
+func (c *RedisConnector) DeleteAuthToken(ctx context.Context, user string, purpose string) error {
+	if !c.active {
+		return ErrRedisOffline
+	}
+	hash, err := c.store.GetDel(ctx, authTokenUserPrefix+purpose+":"+user).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		c.logger.Println(err)
+		return ErrObjectCache
+	}
+	if err := c.store.Del(ctx, authTokenPrefix+purpose+":"+hash).Err(); err != nil {
+		c.logger.Println(err)
+		return ErrObjectCache
+	}
+	return nil
+}
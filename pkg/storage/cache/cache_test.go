@@ -1,3 +1,82 @@
 package cache
 
-// TODO
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewMemoryLimiter()
+	rate := Rate{Limit: 2, Window: time.Minute}
+	for i := 0; i < 2; i++ {
+		result, err := limiter.Allow(ctx, "key", rate)
+		if err != nil || !result.Allowed || result.Remaining != 1-i {
+			t.Errorf("Expected request %d to be allowed, got %+v %v", i, result, err)
+		}
+	}
+	result, err := limiter.Allow(ctx, "key", rate)
+	if err != nil || result.Allowed {
+		t.Errorf("Expected request to be throttled, got %+v %v", result, err)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 30*time.Second {
+		t.Errorf("Expected retry after half the window at most, got %s", result.RetryAfter)
+	}
+	if result, _ := limiter.Allow(ctx, "other", rate); !result.Allowed {
+		t.Error("Expected separate bucket per key")
+	}
+	if _, err := limiter.Allow(ctx, "key", Rate{Limit: 1}); err == nil {
+		t.Error("Expected rate without window to be rejected")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	objects := NewMemoryCache()
+	objects.Store(ctx, "patch:a:/items", []byte("items"), time.Minute)
+	objects.Store(ctx, "patch:a:/items/1", []byte("item"), time.Minute)
+	objects.Store(ctx, "patch:ab:/items", []byte("other"), time.Minute)
+	objects.Store(ctx, "patch:a:/expired", []byte("old"), -time.Second)
+	if value, err := objects.Load(ctx, "patch:a:/items"); err != nil || string(value) != "items" {
+		t.Errorf("Expected stored object, got %q %v", value, err)
+	}
+	if _, err := objects.Load(ctx, "patch:a:/expired"); err != ErrCacheMiss {
+		t.Errorf("Expected expired object to miss, got %v", err)
+	}
+	if purged, err := objects.Purge(ctx, "patch:a:/items"); err != nil || purged != 2 {
+		t.Errorf("Expected 2 objects to be purged, got %d %v", purged, err)
+	}
+	if _, err := objects.Load(ctx, "patch:ab:/items"); err != nil {
+		t.Error("Expected objects outside the prefix to be kept")
+	}
+	if escaped := escapePattern("a*b?[c]"); escaped != `a\*b\?\[c\]` {
+		t.Errorf("Unexpected pattern %s", escaped)
+	}
+}
+
+func TestMemoryAttempts(t *testing.T) {
+	ctx := context.Background()
+	counter := NewMemoryAttempts()
+	for i := 1; i <= 3; i++ {
+		if count, err := counter.Fail(ctx, "user:a", time.Minute); err != nil || count != i {
+			t.Errorf("Expected failure %d to be counted, got %d %v", i, count, err)
+		}
+	}
+	if count, _ := counter.Fail(ctx, "user:b", -time.Second); count != 1 {
+		t.Errorf("Expected separate counts per key, got %d", count)
+	}
+	if count, _ := counter.Attempts(ctx, "user:b"); count != 0 {
+		t.Errorf("Expected the count to expire with its window, got %d", count)
+	}
+	counter.Lock(ctx, "user:a", time.Minute)
+	if left, _ := counter.LockedFor(ctx, "user:a"); left <= 0 || left > time.Minute {
+		t.Errorf("Expected a lockout of up to a minute, got %s", left)
+	}
+	counter.Clear(ctx, "user:a")
+	left, _ := counter.LockedFor(ctx, "user:a")
+	count, _ := counter.Attempts(ctx, "user:a")
+	if left != 0 || count != 0 {
+		t.Errorf("Expected clear to reset the key, got %s and %d", left, count)
+	}
+}
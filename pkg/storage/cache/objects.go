@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// keys deleted per round trip while purging
+	purgeBatch = 256
+)
+
+var (
+	ErrCacheMiss    = errors.New("cache miss")
+	ErrObjectCache  = errors.New("could not access object cache")
+	ErrRedisOffline = errors.New("redis not active")
+)
+
+// ObjectCache stores opaque objects that expire after their ttl
+type ObjectCache interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+	Store(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Purge deletes all objects whose key starts with prefix and returns how many were deleted
+	Purge(ctx context.Context, prefix string) (int, error)
+}
+
+func (c *RedisConnector) Load(ctx context.Context, key string) ([]byte, error) {
+	if !c.active {
+		return nil, ErrRedisOffline
+	}
+	value, err := c.store.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		c.logger.Println(err)
+		return nil, ErrObjectCache
+	}
+	return value, nil
+}
+
+func (c *RedisConnector) Store(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if !c.active {
+		return ErrRedisOffline
+	}
+	if err := c.store.Set(ctx, key, value, ttl).Err(); err != nil {
+		c.logger.Println(err)
+		return ErrObjectCache
+	}
+	return nil
+}
+
+func (c *RedisConnector) Purge(ctx context.Context, prefix string) (int, error) {
+	if !c.active {
+		return 0, ErrRedisOffline
+	}
+	deleted := 0
+	iter := c.store.Scan(ctx, 0, escapePattern(prefix)+"*", purgeBatch).Iterator()
+	keys := make([]string, 0, purgeBatch)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		n, err := c.store.Del(ctx, keys...).Result()
+		deleted += int(n)
+		keys = keys[:0]
+		return err
+	}
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == purgeBatch {
+			if err := flush(); err != nil {
+				c.logger.Println(err)
+				return deleted, ErrObjectCache
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		c.logger.Println(err)
+		return deleted, ErrObjectCache
+	}
+	if err := flush(); err != nil {
+		c.logger.Println(err)
+		return deleted, ErrObjectCache
+	}
+	return deleted, nil
+}
+
+// escapePattern escapes the glob characters of a redis match pattern
+func escapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+type object struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCache keeps the objects in memory, they are only shared within a single instance
+type MemoryCache struct {
+	sync.Mutex
+	objects map[string]object
+	calls   int
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		objects: make(map[string]object),
+	}
+}
+
+func (m *MemoryCache) Load(ctx context.Context, key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	obj, ok := m.objects[key]
+	if !ok || time.Now().After(obj.expires) {
+		return nil, ErrCacheMiss
+	}
+	return obj.value, nil
+}
+
+func (m *MemoryCache) Store(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.calls++
+	if m.calls%1024 == 0 {
+		m.evict(now)
+	}
+	m.objects[key] = object{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *MemoryCache) Purge(ctx context.Context, prefix string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	deleted := 0
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.objects, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// evict drops the expired objects
+func (m *MemoryCache) evict(now time.Time) {
+	for key, obj := range m.objects {
+		if now.After(obj.expires) {
+			delete(m.objects, key)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidRate = errors.New("rate limit needs a positive limit and window")
+	ErrRateLimit   = errors.New("could not check rate limit")
+)
+
+// Rate allows Limit requests per Window, bursts of up to Burst requests are
+// allowed if the bucket is full, Burst defaults to Limit
+type Rate struct {
+	Limit  int
+	Window time.Duration
+	Burst  int
+}
+
+func (r Rate) Validate() error {
+	if r.Limit <= 0 || r.Window < time.Millisecond || r.Burst < 0 {
+		return ErrInvalidRate
+	}
+	return nil
+}
+
+func (r Rate) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Limit)
+}
+
+// perMilli is the refill rate of the bucket
+func (r Rate) perMilli() float64 {
+	return float64(r.Limit) / float64(r.Window.Milliseconds())
+}
+
+type RateResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, 0 if allowed
+	RetryAfter time.Duration
+}
+
+func newRateResult(rate Rate, allowed bool, tokens float64) *RateResult {
+	perMilli := rate.perMilli()
+	result := &RateResult{
+		Allowed:   allowed,
+		Limit:     rate.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((rate.capacity()-tokens)/perMilli) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((1-tokens)/perMilli)) * time.Millisecond
+	}
+	return result
+}
+
+// RateLimiter takes a token from the bucket of key
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, rate Rate) (*RateResult, error)
+}
+
+// the bucket is refilled with the time of the redis server so all instances share the same clock
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local per_milli = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * per_milli)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / per_milli))
+return {allowed, tostring(tokens)}
+`)
+
+func (c *RedisConnector) Allow(ctx context.Context, key string, rate Rate) (*RateResult, error) {
+	if !c.active {
+		return nil, ErrRedisOffline
+	}
+	if err := rate.Validate(); err != nil {
+		return nil, err
+	}
+	reply, err := tokenBucketScript.Run(ctx, c.store, []string{key}, rate.capacity(), rate.perMilli()).Slice()
+	if err != nil {
+		c.logger.Println(err)
+		return nil, ErrRateLimit
+	}
+	if len(reply) != 2 {
+		return nil, ErrRateLimit
+	}
+	allowed, _ := reply[0].(int64)
+	raw, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		c.logger.Println(err)
+		return nil, ErrRateLimit
+	}
+	return newRateResult(rate, allowed == 1, tokens), nil
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	expires time.Time
+}
+
+// MemoryLimiter keeps the buckets in memory, limits only hold for a single instance
+type MemoryLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (m *MemoryLimiter) Allow(ctx context.Context, key string, rate Rate) (*RateResult, error) {
+	if err := rate.Validate(); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.calls++
+	if m.calls%1024 == 0 {
+		m.evict(now)
+	}
+	capacity := rate.capacity()
+	b, ok := m.buckets[key]
+	if !ok || now.After(b.expires) {
+		b = &bucket{tokens: capacity, updated: now}
+		m.buckets[key] = b
+	}
+	elapsed := float64(now.Sub(b.updated)) / float64(time.Millisecond)
+	b.tokens = math.Min(capacity, b.tokens+elapsed*rate.perMilli())
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.expires = now.Add(time.Duration(capacity/rate.perMilli()) * time.Millisecond)
+	return newRateResult(rate, allowed, b.tokens), nil
+}
+
+// evict drops the buckets that are full again
+func (m *MemoryLimiter) evict(now time.Time) {
+	for key, b := range m.buckets {
+		if now.After(b.expires) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -94,6 +94,7 @@ func NewConnector(config *util.Config, logger *log.Logger) (*RedisConnector, err
 		config: config,
 		store:  connection,
 		active: true,
+		logger: logger,
 	}, nil
 }
 
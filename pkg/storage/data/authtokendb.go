@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+var (
+	AUTH_TOKEN_FIELDS  = []string{"hash", "username", "purpose", "email", "expires_at", "created_at"}
+	ErrSaveAuthToken   = errors.New("error saving auth token")
+	ErrDeleteAuthToken = errors.New("error deleting auth token")
+)
+
+type AuthTokenDB struct {
+	p              *DataBase
+	authTokenTable string
+	logger         *log.Logger
+}
+
+func NewAuthTokenDB(p *DataBase, authTokenTable string, logger *log.Logger) *AuthTokenDB {
+	authTokenTable = strings.ToLower(authTokenTable)
+	authTokenTable = strings.TrimSpace(authTokenTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &AuthTokenDB{
+		p:              p,
+		authTokenTable: authTokenTable,
+		logger:         logger,
+	}
+}
+
+func (adb *AuthTokenDB) SetTableName(authTokenTable string) {
+	adb.authTokenTable = authTokenTable
+}
+
+// SaveAuthToken replaces the token the user has for the purpose
+func (adb *AuthTokenDB) SaveAuthToken(ctx context.Context, token *system.AuthToken) error {
+	if err := adb.DeleteAuthToken(ctx, token.User, token.Purpose); err != nil {
+		return ErrSaveAuthToken
+	}
+	values := [][]interface{}{{token.Hash, token.User, token.Purpose, token.Email, token.ExpiresAt, token.CreatedAt}}
+	if err := adb.p.Insert(ctx, adb.authTokenTable, []FieldName{"hash", "username", "purpose", "email", "expires_at", "created_at"}, values); err != nil {
+		adb.logger.Println(err)
+		return ErrSaveAuthToken
+	}
+	return nil
+}
+
+// ConsumeAuthToken loads and deletes the token, expired tokens are deleted as well
+func (adb *AuthTokenDB) ConsumeAuthToken(ctx context.Context, purpose string, hash string) (*system.AuthToken, error) {
+	where := NewWhereMap(map[FieldName]interface{}{"hash": hash, "purpose": purpose})
+	// loading and deleting in one statement keeps the token single use
+	rows, err := adb.p.DeleteReturning(ctx, adb.authTokenTable, AUTH_TOKEN_FIELDS, where)
+	if err != nil {
+		adb.logger.Println(err)
+		return nil, ErrDeleteAuthToken
+	}
+	if len(rows) == 0 {
+		return nil, system.ErrNoSuchAuthToken
+	}
+	row := rows[0]
+	token := &system.AuthToken{Hash: hash, Purpose: purpose}
+	token.User, _ = row["username"].(string)
+	token.Email, _ = row["email"].(string)
+	token.ExpiresAt, _ = row["expires_at"].(time.Time)
+	token.CreatedAt, _ = row["created_at"].(time.Time)
+	if token.Expired(time.Now()) {
+		return nil, system.ErrNoSuchAuthToken
+	}
+	return token, nil
+}
+
+func (adb *AuthTokenDB) DeleteAuthToken(ctx context.Context, user string, purpose string) error {
+	if err := adb.p.Delete(ctx, adb.authTokenTable, NewWhereMap(map[FieldName]interface{}{"username": user, "purpose": purpose})); err != nil {
+		adb.logger.Println(err)
+		return ErrDeleteAuthToken
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	COMPARE_DEFAULT_LIMIT = 100
+)
+
+var (
+	COMPARE_FIELDS = []string{
+		"compare_id", "patch", "method", "path", "primary_url", "candidate_url",
+		"primary_status", "candidate_status", "primary_body", "candidate_body",
+		"primary_duration", "candidate_duration", "differences", "error", "started_at",
+	}
+	ErrNoComparison    = errors.New("no comparison found")
+	ErrSaveComparison  = errors.New("error saving comparison")
+	ErrQueryComparison = errors.New("error querying comparisons")
+)
+
+type CompareDB struct {
+	p            *DataBase
+	compareTable string
+	logger       *log.Logger
+}
+
+func NewCompareDB(p *DataBase, compareTable string, logger *log.Logger) *CompareDB {
+	compareTable = strings.ToLower(compareTable)
+	compareTable = strings.TrimSpace(compareTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &CompareDB{
+		p:            p,
+		compareTable: compareTable,
+		logger:       logger,
+	}
+}
+
+func (cdb *CompareDB) SetTableName(compareTable string) {
+	cdb.compareTable = compareTable
+}
+
+func (cdb *CompareDB) Save(ctx context.Context, record *system.CompareRecord) error {
+	differences, err := json.Marshal(record.Differences)
+	if err != nil {
+		cdb.logger.Println(err)
+		return ErrSaveComparison
+	}
+	// the id is generated by the database
+	fields := []FieldName{
+		"patch", "method", "path", "primary_url", "candidate_url",
+		"primary_status", "candidate_status", "primary_body", "candidate_body",
+		"primary_duration", "candidate_duration", "differences", "error", "started_at",
+	}
+	values := [][]interface{}{{
+		record.Patch, record.Method, record.Path, record.PrimaryURL, record.CandidateURL,
+		record.PrimaryStatus, record.CandidateStatus, record.PrimaryBody, record.CandidateBody,
+		int64(record.PrimaryDuration), int64(record.CandidateDuration), string(differences), record.Error, record.StartedAt,
+	}}
+	if err := cdb.p.Insert(ctx, cdb.compareTable, fields, values); err != nil {
+		cdb.logger.Println(err)
+		return ErrSaveComparison
+	}
+	return nil
+}
+
+// Query builds the where clause itself as WhereMap only supports equality
+func (cdb *CompareDB) Query(ctx context.Context, filter *system.CompareFilter) ([]*system.CompareRecord, error) {
+	if filter == nil {
+		filter = &system.CompareFilter{}
+	}
+	clauses := make([]string, 0)
+	if filter.Patch != "" {
+		clauses = append(clauses, fmt.Sprintf("patch = %s", quote(filter.Patch)))
+	}
+	if filter.Path != "" {
+		escaped := strings.NewReplacer("%", "\\%", "_", "\\_").Replace(filter.Path)
+		clauses = append(clauses, fmt.Sprintf("path LIKE %s", quote(escaped+"%")))
+	}
+	if !filter.From.IsZero() {
+		clauses = append(clauses, fmt.Sprintf("started_at >= %s", quote(filter.From.UTC().Format(time.RFC3339Nano))))
+	}
+	if !filter.To.IsZero() {
+		clauses = append(clauses, fmt.Sprintf("started_at <= %s", quote(filter.To.UTC().Format(time.RFC3339Nano))))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = COMPARE_DEFAULT_LIMIT
+	}
+	args := fmt.Sprintf("ORDER BY started_at DESC LIMIT %d", limit)
+	if len(clauses) > 0 {
+		args = fmt.Sprintf("WHERE %s %s", strings.Join(clauses, " AND "), args)
+	}
+	rows := cdb.p.Select(ctx, cdb.compareTable, COMPARE_FIELDS, nil, args)
+	if rows == nil {
+		return nil, ErrQueryComparison
+	}
+	records := make([]*system.CompareRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, cdb.loadCompareRecord(row))
+	}
+	return records, nil
+}
+
+func (cdb *CompareDB) GetById(ctx context.Context, id int64) (*system.CompareRecord, error) {
+	whereClause := NewWhereMap(map[FieldName]interface{}{"compare_id": id})
+	rows := cdb.p.Select(ctx, cdb.compareTable, COMPARE_FIELDS, whereClause, "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, ErrNoComparison
+	}
+	return cdb.loadCompareRecord(rows[0]), nil
+}
+
+func (cdb *CompareDB) loadCompareRecord(row map[string]interface{}) *system.CompareRecord {
+	record := &system.CompareRecord{}
+	if val, ok := row["compare_id"].(int32); ok {
+		record.ID = int64(val)
+	} else if val, ok := row["compare_id"].(int64); ok {
+		record.ID = val
+	}
+	record.Patch, _ = row["patch"].(string)
+	record.Method, _ = row["method"].(string)
+	record.Path, _ = row["path"].(string)
+	record.PrimaryURL, _ = row["primary_url"].(string)
+	record.CandidateURL, _ = row["candidate_url"].(string)
+	record.PrimaryBody, _ = row["primary_body"].([]byte)
+	record.CandidateBody, _ = row["candidate_body"].([]byte)
+	record.Error, _ = row["error"].(string)
+	if val, ok := row["primary_status"].(int32); ok {
+		record.PrimaryStatus = int(val)
+	}
+	if val, ok := row["candidate_status"].(int32); ok {
+		record.CandidateStatus = int(val)
+	}
+	if val, ok := row["primary_duration"].(int64); ok {
+		record.PrimaryDuration = time.Duration(val)
+	}
+	if val, ok := row["candidate_duration"].(int64); ok {
+		record.CandidateDuration = time.Duration(val)
+	}
+	if val, ok := row["started_at"].(time.Time); ok {
+		record.StartedAt = val
+	}
+	if val, ok := row["differences"].(string); ok {
+		if err := json.Unmarshal([]byte(val), &record.Differences); err != nil {
+			cdb.logger.Println(err)
+		}
+	}
+	return record
+}
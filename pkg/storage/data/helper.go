@@ -2,6 +2,7 @@ package data
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -16,6 +17,11 @@ func join[K any](a []K, sep string) string {
 	return sb.String()
 }
 
+// quote wraps a value in single quotes, escaping any quotes inside of it
+func quote(v any) string {
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+}
+
 // WhereMap represents a map of fields and values to be used in a WHERE clause
 
 type WhereMap struct {
@@ -28,16 +34,16 @@ func (m *WhereMap) String() string {
 	}
 	if len(m.clauses) == 1 {
 		for k, v := range m.clauses {
-			return fmt.Sprintf("%s = '%s'", strings.ToLower(fmt.Sprint(k)), fmt.Sprint(v))
+			return fmt.Sprintf("%s = %s", strings.ToLower(fmt.Sprint(k)), quote(v))
 		}
 	}
-	sb := strings.Builder{}
-	counter := 0
+	clauses := make([]string, 0, len(m.clauses))
 	for k, v := range m.clauses {
-		sb.WriteString(fmt.Sprintf("%s = '%s' AND", strings.ToLower(fmt.Sprint(k)), fmt.Sprint(v)))
-		counter++
+		clauses = append(clauses, fmt.Sprintf("%s = %s", strings.ToLower(fmt.Sprint(k)), quote(v)))
 	}
-	return sb.String()
+	// sorted so the same map always builds the same query
+	sort.Strings(clauses)
+	return strings.Join(clauses, " AND ")
 }
 
 func NewWhereMap(rawMap map[FieldName]interface{}) *WhereMap {
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+var (
+	PATCH_FIELDS     = []string{"path", "spec", "created_at", "updated_at"}
+	ErrNoPatch       = errors.New("no patch found")
+	ErrSavePatch     = errors.New("error saving patch")
+	ErrDeletePatch   = errors.New("error deleting patch")
+	ErrGetAllPatches = errors.New("error getting all patches")
+)
+
+type PatchDB struct {
+	p          *DataBase
+	patchTable string
+	logger     *log.Logger
+}
+
+func NewPatchDB(p *DataBase, patchTable string, logger *log.Logger) *PatchDB {
+	patchTable = strings.ToLower(patchTable)
+	patchTable = strings.TrimSpace(patchTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &PatchDB{
+		p:          p,
+		patchTable: patchTable,
+		logger:     logger,
+	}
+}
+
+func (pdb *PatchDB) SetTableName(patchTable string) {
+	pdb.patchTable = patchTable
+}
+
+func (pdb *PatchDB) GetAll(ctx context.Context) ([]*system.PatchRecord, error) {
+	pdb.logger.Println("Getting all patches")
+	val := pdb.p.Select(ctx, pdb.patchTable, PATCH_FIELDS, nil, "")
+	if val == nil {
+		return nil, ErrGetAllPatches
+	}
+	patches := make([]*system.PatchRecord, 0, len(val))
+	for _, v := range val {
+		if patch, ok := loadPatchRecord(v); ok {
+			patches = append(patches, patch)
+		}
+	}
+	return patches, nil
+}
+
+func (pdb *PatchDB) GetByPath(ctx context.Context, path string) (*system.PatchRecord, error) {
+	whereClause := NewWhereMap(map[FieldName]interface{}{"path": path})
+	val := pdb.p.Select(ctx, pdb.patchTable, PATCH_FIELDS, whereClause, "LIMIT 1")
+	if len(val) == 0 {
+		return nil, ErrNoPatch
+	}
+	patch, ok := loadPatchRecord(val[0])
+	if !ok {
+		return nil, ErrNoPatch
+	}
+	return patch, nil
+}
+
+// Save inserts the patch or updates the spec if the path is already stored
+func (pdb *PatchDB) Save(ctx context.Context, record *system.PatchRecord) error {
+	if _, err := pdb.GetByPath(ctx, record.Path); err == nil {
+		timestamp := fmt.Sprint(time.Now().UTC())
+		timestamp = timestamp[:len(timestamp)-9]
+		patchMap := map[FieldName]DBValue{
+			"spec":       record.Spec,
+			"updated_at": timestamp,
+		}
+		if err := pdb.p.Update(ctx, pdb.patchTable, patchMap, NewWhereMap(map[FieldName]interface{}{"path": record.Path})); err != nil {
+			pdb.logger.Println(err)
+			return ErrSavePatch
+		}
+		pdb.logger.Printf("Updated patch %s\n", record.Path)
+		return nil
+	}
+
+	if err := pdb.p.Insert(ctx, pdb.patchTable, []FieldName{"path", "spec", "created_at", "updated_at"}, [][]interface{}{{record.Path, record.Spec, record.CreatedAt, record.UpdatedAt}}); err != nil {
+		pdb.logger.Println(err)
+		return ErrSavePatch
+	}
+	pdb.logger.Printf("Saved patch %s\n", record.Path)
+	return nil
+}
+
+func (pdb *PatchDB) DeleteByPath(ctx context.Context, path string) error {
+	if _, err := pdb.GetByPath(ctx, path); err != nil {
+		return ErrNoPatch
+	}
+	if err := pdb.p.Delete(ctx, pdb.patchTable, NewWhereMap(map[FieldName]interface{}{"path": path})); err != nil {
+		pdb.logger.Println(err)
+		return ErrDeletePatch
+	}
+	return nil
+}
+
+func loadPatchRecord(row map[string]interface{}) (*system.PatchRecord, bool) {
+	path, ok := row["path"].(string)
+	if !ok {
+		return nil, false
+	}
+	spec, ok := row["spec"].(string)
+	if !ok {
+		return nil, false
+	}
+	patch := &system.PatchRecord{
+		Path: path,
+		Spec: spec,
+	}
+	if val, ok := row["created_at"].(time.Time); ok {
+		patch.CreatedAt = val
+	}
+	if val, ok := row["updated_at"].(time.Time); ok {
+		patch.UpdatedAt = val
+	}
+	return patch, true
+}
@@ -0,0 +1,349 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+var (
+	ROLE_FIELDS       = []string{"role_id", "name", "require_two_factor", "created_at", "updated_at"}
+	PERMISSION_FIELDS = []string{"permission_id", "name", "created_at"}
+	ErrSaveRole       = errors.New("error saving role")
+	ErrDeleteRole     = errors.New("error deleting role")
+	ErrGetRoles       = errors.New("error getting roles")
+)
+
+// RoleDB keeps roles in the roles table, the permissions they grant in
+// role_permissions and the roles of users in user_roles
+type RoleDB struct {
+	p                   *DataBase
+	roleTable           string
+	permissionTable     string
+	rolePermissionTable string
+	userRoleTable       string
+	logger              *log.Logger
+}
+
+func NewRoleDB(p *DataBase, roleTable string, permissionTable string, rolePermissionTable string, userRoleTable string, logger *log.Logger) *RoleDB {
+	clean := func(table string) string {
+		return strings.TrimSpace(strings.ToLower(table))
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &RoleDB{
+		p:                   p,
+		roleTable:           clean(roleTable),
+		permissionTable:     clean(permissionTable),
+		rolePermissionTable: clean(rolePermissionTable),
+		userRoleTable:       clean(userRoleTable),
+		logger:              logger,
+	}
+}
+
+func (rdb *RoleDB) CreatePermission(ctx context.Context, name string) (*system.Permission, error) {
+	if _, err := rdb.permissionID(ctx, name); err == nil {
+		return nil, system.ErrPermissionExists
+	}
+	now := time.Now().UTC()
+	if err := rdb.p.Insert(ctx, rdb.permissionTable, []FieldName{"name", "created_at", "updated_at"}, [][]interface{}{{name, now, now}}); err != nil {
+		rdb.logger.Println(err)
+		return nil, ErrSaveRole
+	}
+	rows := rdb.p.Select(ctx, rdb.permissionTable, PERMISSION_FIELDS, NewWhereMap(map[FieldName]interface{}{"name": name}), "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, ErrSaveRole
+	}
+	rdb.logger.Printf("Created permission %s\n", name)
+	return loadPermission(rows[0]), nil
+}
+
+func (rdb *RoleDB) GetPermissions(ctx context.Context) ([]*system.Permission, error) {
+	rows := rdb.p.Select(ctx, rdb.permissionTable, PERMISSION_FIELDS, nil, "ORDER BY name")
+	if rows == nil {
+		return nil, ErrGetRoles
+	}
+	permissions := make([]*system.Permission, 0, len(rows))
+	for _, row := range rows {
+		permissions = append(permissions, loadPermission(row))
+	}
+	return permissions, nil
+}
+
+func (rdb *RoleDB) DeletePermission(ctx context.Context, name string) error {
+	id, err := rdb.permissionID(ctx, name)
+	if err != nil {
+		return err
+	}
+	where := NewWhereMap(map[FieldName]interface{}{"permission_id": id})
+	if err := rdb.p.Delete(ctx, rdb.rolePermissionTable, where); err != nil {
+		rdb.logger.Println(err)
+		return ErrDeleteRole
+	}
+	if err := rdb.p.Delete(ctx, rdb.permissionTable, where); err != nil {
+		rdb.logger.Println(err)
+		return ErrDeleteRole
+	}
+	return nil
+}
+
+func (rdb *RoleDB) CreateRole(ctx context.Context, name string, permissions []string) (*system.Role, error) {
+	if _, err := rdb.roleID(ctx, name); err == nil {
+		return nil, system.ErrRoleExists
+	}
+	permissionIDs, err := rdb.permissionIDs(ctx, permissions)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if err := rdb.p.Insert(ctx, rdb.roleTable, []FieldName{"name", "require_two_factor", "created_at", "updated_at"}, [][]interface{}{{name, false, now, now}}); err != nil {
+		rdb.logger.Println(err)
+		return nil, ErrSaveRole
+	}
+	id, err := rdb.roleID(ctx, name)
+	if err != nil {
+		return nil, ErrSaveRole
+	}
+	if err := rdb.grant(ctx, id, permissionIDs); err != nil {
+		return nil, err
+	}
+	rdb.logger.Printf("Created role %s\n", name)
+	return rdb.GetRole(ctx, name)
+}
+
+func (rdb *RoleDB) GetRole(ctx context.Context, name string) (*system.Role, error) {
+	rows := rdb.p.Select(ctx, rdb.roleTable, ROLE_FIELDS, NewWhereMap(map[FieldName]interface{}{"name": name}), "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, system.ErrNoSuchRole
+	}
+	return rdb.loadRole(ctx, rows[0]), nil
+}
+
+func (rdb *RoleDB) GetRoles(ctx context.Context) ([]*system.Role, error) {
+	rows := rdb.p.Select(ctx, rdb.roleTable, ROLE_FIELDS, nil, "ORDER BY name")
+	if rows == nil {
+		return nil, ErrGetRoles
+	}
+	roles := make([]*system.Role, 0, len(rows))
+	for _, row := range rows {
+		roles = append(roles, rdb.loadRole(ctx, row))
+	}
+	return roles, nil
+}
+
+// SetPermissions replaces the permissions granted by the role
+func (rdb *RoleDB) SetPermissions(ctx context.Context, name string, permissions []string) (*system.Role, error) {
+	id, err := rdb.roleID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	permissionIDs, err := rdb.permissionIDs(ctx, permissions)
+	if err != nil {
+		return nil, err
+	}
+	where := NewWhereMap(map[FieldName]interface{}{"role_id": id})
+	if err := rdb.p.Delete(ctx, rdb.rolePermissionTable, where); err != nil {
+		rdb.logger.Println(err)
+		return nil, ErrSaveRole
+	}
+	if err := rdb.grant(ctx, id, permissionIDs); err != nil {
+		return nil, err
+	}
+	timestamp := fmt.Sprint(time.Now().UTC())
+	timestamp = timestamp[:len(timestamp)-9]
+	if err := rdb.p.Update(ctx, rdb.roleTable, map[FieldName]DBValue{"updated_at": timestamp}, where); err != nil {
+		rdb.logger.Println(err)
+	}
+	return rdb.GetRole(ctx, name)
+}
+
+func (rdb *RoleDB) SetTwoFactor(ctx context.Context, name string, required bool) (*system.Role, error) {
+	id, err := rdb.roleID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := fmt.Sprint(time.Now().UTC())
+	timestamp = timestamp[:len(timestamp)-9]
+	updates := map[FieldName]DBValue{"require_two_factor": fmt.Sprint(required), "updated_at": timestamp}
+	if err := rdb.p.Update(ctx, rdb.roleTable, updates, NewWhereMap(map[FieldName]interface{}{"role_id": id})); err != nil {
+		rdb.logger.Println(err)
+		return nil, ErrSaveRole
+	}
+	return rdb.GetRole(ctx, name)
+}
+
+func (rdb *RoleDB) DeleteRole(ctx context.Context, name string) error {
+	id, err := rdb.roleID(ctx, name)
+	if err != nil {
+		return err
+	}
+	where := NewWhereMap(map[FieldName]interface{}{"role_id": id})
+	for _, table := range []string{rdb.userRoleTable, rdb.rolePermissionTable, rdb.roleTable} {
+		if err := rdb.p.Delete(ctx, table, where); err != nil {
+			rdb.logger.Println(err)
+			return ErrDeleteRole
+		}
+	}
+	rdb.logger.Printf("Deleted role %s\n", name)
+	return nil
+}
+
+func (rdb *RoleDB) AssignRole(ctx context.Context, username string, role string) error {
+	where, err := rdb.userRoleWhere(ctx, username, role)
+	if err != nil {
+		return err
+	}
+	if rows := rdb.p.Select(ctx, rdb.userRoleTable, []string{"role_id"}, where, "LIMIT 1"); len(rows) > 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	values := [][]interface{}{{where.clauses["user_id"], where.clauses["role_id"], now, now}}
+	if err := rdb.p.Insert(ctx, rdb.userRoleTable, []FieldName{"user_id", "role_id", "created_at", "updated_at"}, values); err != nil {
+		rdb.logger.Println(err)
+		return ErrSaveRole
+	}
+	return nil
+}
+
+func (rdb *RoleDB) RevokeRole(ctx context.Context, username string, role string) error {
+	where, err := rdb.userRoleWhere(ctx, username, role)
+	if err != nil {
+		return err
+	}
+	if rows := rdb.p.Select(ctx, rdb.userRoleTable, []string{"role_id"}, where, "LIMIT 1"); len(rows) == 0 {
+		return system.ErrNoSuchRole
+	}
+	if err := rdb.p.Delete(ctx, rdb.userRoleTable, where); err != nil {
+		rdb.logger.Println(err)
+		return ErrDeleteRole
+	}
+	return nil
+}
+
+func (rdb *RoleDB) GetUserRoles(ctx context.Context, username string) ([]*system.Role, error) {
+	user, err := rdb.p.users.GetByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	// user roles carry timestamps of their own, the role fields are qualified
+	fields := make([]string, 0, len(ROLE_FIELDS))
+	for _, field := range ROLE_FIELDS {
+		fields = append(fields, rdb.roleTable+"."+field)
+	}
+	table := fmt.Sprintf("%s JOIN %s USING (role_id)", rdb.userRoleTable, rdb.roleTable)
+	rows := rdb.p.Select(ctx, table, fields, NewWhereMap(map[FieldName]interface{}{"user_id": user.ID()}), "ORDER BY "+rdb.roleTable+".name")
+	if rows == nil {
+		return nil, ErrGetRoles
+	}
+	roles := make([]*system.Role, 0, len(rows))
+	for _, row := range rows {
+		roles = append(roles, rdb.loadRole(ctx, row))
+	}
+	return roles, nil
+}
+
+func (rdb *RoleDB) userRoleWhere(ctx context.Context, username string, role string) (*WhereMap, error) {
+	user, err := rdb.p.users.GetByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	roleID, err := rdb.roleID(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	return NewWhereMap(map[FieldName]interface{}{"user_id": user.ID(), "role_id": roleID}), nil
+}
+
+func (rdb *RoleDB) grant(ctx context.Context, roleID int64, permissionIDs []int64) error {
+	if len(permissionIDs) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	values := make([][]interface{}, len(permissionIDs))
+	for i, id := range permissionIDs {
+		values[i] = []interface{}{roleID, id, now}
+	}
+	if err := rdb.p.Insert(ctx, rdb.rolePermissionTable, []FieldName{"role_id", "permission_id", "created_at"}, values); err != nil {
+		rdb.logger.Println(err)
+		return ErrSaveRole
+	}
+	return nil
+}
+
+func (rdb *RoleDB) roleID(ctx context.Context, name string) (int64, error) {
+	rows := rdb.p.Select(ctx, rdb.roleTable, []string{"role_id"}, NewWhereMap(map[FieldName]interface{}{"name": name}), "LIMIT 1")
+	if len(rows) == 0 {
+		return 0, system.ErrNoSuchRole
+	}
+	return rowID(rows[0], "role_id"), nil
+}
+
+func (rdb *RoleDB) permissionID(ctx context.Context, name string) (int64, error) {
+	rows := rdb.p.Select(ctx, rdb.permissionTable, []string{"permission_id"}, NewWhereMap(map[FieldName]interface{}{"name": name}), "LIMIT 1")
+	if len(rows) == 0 {
+		return 0, system.ErrNoSuchPermission
+	}
+	return rowID(rows[0], "permission_id"), nil
+}
+
+func (rdb *RoleDB) permissionIDs(ctx context.Context, names []string) ([]int64, error) {
+	ids := make([]int64, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		id, err := rdb.permissionID(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (rdb *RoleDB) loadRole(ctx context.Context, row map[string]interface{}) *system.Role {
+	role := &system.Role{ID: rowID(row, "role_id"), Permissions: make([]string, 0)}
+	role.Name, _ = row["name"].(string)
+	role.RequireTwoFactor, _ = row["require_two_factor"].(bool)
+	if val, ok := row["created_at"].(time.Time); ok {
+		role.CreatedAt = val
+	}
+	if val, ok := row["updated_at"].(time.Time); ok {
+		role.UpdatedAt = val
+	}
+	table := fmt.Sprintf("%s JOIN %s USING (permission_id)", rdb.rolePermissionTable, rdb.permissionTable)
+	for _, permission := range rdb.p.Select(ctx, table, []string{"name"}, NewWhereMap(map[FieldName]interface{}{"role_id": role.ID}), "ORDER BY name") {
+		if name, ok := permission["name"].(string); ok {
+			role.Permissions = append(role.Permissions, name)
+		}
+	}
+	return role
+}
+
+func loadPermission(row map[string]interface{}) *system.Permission {
+	permission := &system.Permission{ID: rowID(row, "permission_id")}
+	permission.Name, _ = row["name"].(string)
+	if val, ok := row["created_at"].(time.Time); ok {
+		permission.CreatedAt = val
+	}
+	return permission
+}
+
+// rowID reads a serial id, which the driver returns as int32
+func rowID(row map[string]interface{}, field string) int64 {
+	switch val := row[field].(type) {
+	case int32:
+		return int64(val)
+	case int64:
+		return val
+	}
+	return 0
+}
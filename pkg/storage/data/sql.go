@@ -67,6 +67,13 @@ type DataBase struct {
 	config  *util.Config
 	cache   *cache.RedisConnector
 	users   *UserDB
+	patches *PatchDB
+	traffic *TrafficDB
+	compare *CompareDB
+	roles   *RoleDB
+	tokens  *TokenDB
+	totp    *TwoFactorDB
+	mailed  *AuthTokenDB
 	logger  *log.Logger
 }
 
@@ -124,6 +131,13 @@ func NewConnector(ctx context.Context, logger *log.Logger, config *util.Config)
 		logger:  logger,
 	}
 	dbConn.users = NewUserDB(dbConn, "users", "shadow", logger)
+	dbConn.patches = NewPatchDB(dbConn, "patches", logger)
+	dbConn.traffic = NewTrafficDB(dbConn, "traffic", logger)
+	dbConn.compare = NewCompareDB(dbConn, "comparisons", logger)
+	dbConn.roles = NewRoleDB(dbConn, "roles", "permissions", "role_permissions", "user_roles", logger)
+	dbConn.tokens = NewTokenDB(dbConn, "api_tokens", logger)
+	dbConn.totp = NewTwoFactorDB(dbConn, "two_factor", logger)
+	dbConn.mailed = NewAuthTokenDB(dbConn, "auth_tokens", logger)
 	if redisConfig, ok := config.Get("redis").(*util.Config); ok && redisConfig != nil {
 		dbConn.cache, err = setupRedisConnector(redisConfig, logger)
 		if err != nil {
@@ -406,7 +420,7 @@ func (db *DataBase) Update(ctx context.Context, table string, updates map[FieldN
 	buffer := make([]string, len(updates))
 	counter := 0
 	for k, v := range updates {
-		buffer[counter] = fmt.Sprintf("%s = '%s'", strings.ToLower(fmt.Sprint(k)), fmt.Sprint(v))
+		buffer[counter] = fmt.Sprintf("%s = %s", strings.ToLower(fmt.Sprint(k)), quote(v))
 		counter++
 	}
 	sb.WriteString(join(buffer, ", "))
@@ -444,6 +458,31 @@ func (db *DataBase) Delete(ctx context.Context, table string, wm *WhereMap) erro
 	return nil
 }
 
+// DeleteReturning deletes the matching rows and returns their fields in the
+// same statement, a row is only returned to one of concurrent callers
+func (db *DataBase) DeleteReturning(ctx context.Context, table string, fields []string, wm *WhereMap) (DBResult, error) {
+	db.logger.Println("deleting from table:", table)
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprint("DELETE FROM ", table))
+	if wm != nil {
+		sb.WriteString(fmt.Sprint(" WHERE ", wm.String()))
+	}
+	sb.WriteString(" RETURNING ")
+	if len(fields) == 0 {
+		sb.WriteString("*")
+	} else {
+		sb.WriteString(strings.Join(fields, ", "))
+	}
+	query := sb.String() + ";"
+	rows, err := db.transactionWrapper(ctx, query)
+	if err != nil {
+		db.logger.Println(err)
+		return nil, ErrDBDelete
+	}
+	db.logger.Println("deleted successfully")
+	return rows, nil
+}
+
 // transactionWrapper
 func (db *DataBase) transactionWrapper(ctx context.Context, query string) (DBResult, error) {
 	db.logger.Printf("wrapping transaction")
@@ -462,7 +501,7 @@ func (db *DataBase) transactionWrapper(ctx context.Context, query string) (DBRes
 	}
 	var rows DBResult
 
-	if strings.HasPrefix(query, "SELECT") {
+	if strings.HasPrefix(query, "SELECT") || strings.Contains(query, " RETURNING ") {
 		db.logger.Println("getting data")
 		rows, err = db.getData(ctx, tx, query)
 	} else {
@@ -540,3 +579,31 @@ func (db *DataBase) insert(ctx context.Context, tx pgx.Tx, table string, fields
 func (db *DataBase) GetUserDB() *UserDB {
 	return db.users
 }
+
+func (db *DataBase) GetPatchDB() *PatchDB {
+	return db.patches
+}
+
+func (db *DataBase) GetTrafficDB() *TrafficDB {
+	return db.traffic
+}
+
+func (db *DataBase) GetRoleDB() *RoleDB {
+	return db.roles
+}
+
+func (db *DataBase) GetTokenDB() *TokenDB {
+	return db.tokens
+}
+
+func (db *DataBase) GetTwoFactorDB() *TwoFactorDB {
+	return db.totp
+}
+
+func (db *DataBase) GetAuthTokenDB() *AuthTokenDB {
+	return db.mailed
+}
+
+func (db *DataBase) GetCompareDB() *CompareDB {
+	return db.compare
+}
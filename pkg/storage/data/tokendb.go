@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+var (
+	TOKEN_FIELDS    = []string{"token_id", "name", "username", "hash", "hint", "scopes", "expires_at", "last_used_at", "created_at"}
+	ErrSaveToken    = errors.New("error saving token")
+	ErrDeleteToken  = errors.New("error deleting token")
+	ErrGetAllTokens = errors.New("error getting tokens")
+)
+
+type TokenDB struct {
+	p          *DataBase
+	tokenTable string
+	logger     *log.Logger
+}
+
+func NewTokenDB(p *DataBase, tokenTable string, logger *log.Logger) *TokenDB {
+	tokenTable = strings.ToLower(tokenTable)
+	tokenTable = strings.TrimSpace(tokenTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &TokenDB{
+		p:          p,
+		tokenTable: tokenTable,
+		logger:     logger,
+	}
+}
+
+func (tdb *TokenDB) SetTableName(tokenTable string) {
+	tdb.tokenTable = tokenTable
+}
+
+func (tdb *TokenDB) CreateToken(ctx context.Context, token *system.APIToken) error {
+	existing := tdb.p.Select(ctx, tdb.tokenTable, []string{"token_id"}, NewWhereMap(map[FieldName]interface{}{"username": token.User, "name": token.Name}), "LIMIT 1")
+	if len(existing) > 0 {
+		return system.ErrTokenExists
+	}
+	fields := []FieldName{"name", "username", "hash", "hint", "scopes", "expires_at", "created_at"}
+	values := [][]interface{}{{token.Name, token.User, token.Hash, token.Hint, strings.Join(token.Scopes, ","), token.ExpiresAt, token.CreatedAt}}
+	if err := tdb.p.Insert(ctx, tdb.tokenTable, fields, values); err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveToken
+	}
+	stored, err := tdb.GetTokenByHash(ctx, token.Hash)
+	if err != nil {
+		return ErrSaveToken
+	}
+	token.ID = stored.ID
+	tdb.logger.Printf("Created token %s of %s\n", token.Name, token.User)
+	return nil
+}
+
+func (tdb *TokenDB) GetTokenByHash(ctx context.Context, hash string) (*system.APIToken, error) {
+	rows := tdb.p.Select(ctx, tdb.tokenTable, TOKEN_FIELDS, NewWhereMap(map[FieldName]interface{}{"hash": hash}), "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, system.ErrNoSuchToken
+	}
+	return loadToken(rows[0]), nil
+}
+
+func (tdb *TokenDB) GetUserTokens(ctx context.Context, user string) ([]*system.APIToken, error) {
+	rows := tdb.p.Select(ctx, tdb.tokenTable, TOKEN_FIELDS, NewWhereMap(map[FieldName]interface{}{"username": user}), "ORDER BY token_id")
+	if rows == nil {
+		return nil, ErrGetAllTokens
+	}
+	tokens := make([]*system.APIToken, 0, len(rows))
+	for _, row := range rows {
+		tokens = append(tokens, loadToken(row))
+	}
+	return tokens, nil
+}
+
+func (tdb *TokenDB) DeleteToken(ctx context.Context, user string, id int64) error {
+	where := NewWhereMap(map[FieldName]interface{}{"token_id": id, "username": user})
+	if rows := tdb.p.Select(ctx, tdb.tokenTable, []string{"token_id"}, where, "LIMIT 1"); len(rows) == 0 {
+		return system.ErrNoSuchToken
+	}
+	if err := tdb.p.Delete(ctx, tdb.tokenTable, where); err != nil {
+		tdb.logger.Println(err)
+		return ErrDeleteToken
+	}
+	return nil
+}
+
+func (tdb *TokenDB) TouchToken(ctx context.Context, id int64, usedAt time.Time) error {
+	updates := map[FieldName]DBValue{"last_used_at": usedAt.UTC().Format(time.RFC3339Nano)}
+	if err := tdb.p.Update(ctx, tdb.tokenTable, updates, NewWhereMap(map[FieldName]interface{}{"token_id": id})); err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveToken
+	}
+	return nil
+}
+
+func loadToken(row map[string]interface{}) *system.APIToken {
+	token := &system.APIToken{ID: rowID(row, "token_id"), Scopes: make([]string, 0)}
+	token.Name, _ = row["name"].(string)
+	token.User, _ = row["username"].(string)
+	token.Hash, _ = row["hash"].(string)
+	token.Hint, _ = row["hint"].(string)
+	if val, ok := row["scopes"].(string); ok && val != "" {
+		token.Scopes = strings.Split(val, ",")
+	}
+	if val, ok := row["expires_at"].(time.Time); ok {
+		token.ExpiresAt = &val
+	}
+	if val, ok := row["last_used_at"].(time.Time); ok {
+		token.LastUsedAt = &val
+	}
+	if val, ok := row["created_at"].(time.Time); ok {
+		token.CreatedAt = val
+	}
+	return token
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+var (
+	TWO_FACTOR_FIELDS  = []string{"username", "secret", "enabled", "recovery_codes", "last_step", "created_at", "confirmed_at"}
+	ErrSaveTwoFactor   = errors.New("error saving two factor")
+	ErrDeleteTwoFactor = errors.New("error deleting two factor")
+)
+
+type TwoFactorDB struct {
+	p              *DataBase
+	twoFactorTable string
+	logger         *log.Logger
+}
+
+func NewTwoFactorDB(p *DataBase, twoFactorTable string, logger *log.Logger) *TwoFactorDB {
+	twoFactorTable = strings.ToLower(twoFactorTable)
+	twoFactorTable = strings.TrimSpace(twoFactorTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &TwoFactorDB{
+		p:              p,
+		twoFactorTable: twoFactorTable,
+		logger:         logger,
+	}
+}
+
+func (tdb *TwoFactorDB) SetTableName(twoFactorTable string) {
+	tdb.twoFactorTable = twoFactorTable
+}
+
+func (tdb *TwoFactorDB) GetTwoFactor(ctx context.Context, user string) (*system.TwoFactor, error) {
+	rows := tdb.p.Select(ctx, tdb.twoFactorTable, TWO_FACTOR_FIELDS, NewWhereMap(map[FieldName]interface{}{"username": user}), "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, system.ErrNoTwoFactor
+	}
+	row := rows[0]
+	twoFactor := &system.TwoFactor{User: user, RecoveryCodes: make([]string, 0)}
+	twoFactor.Secret, _ = row["secret"].(string)
+	twoFactor.Enabled, _ = row["enabled"].(bool)
+	twoFactor.LastStep, _ = row["last_step"].(int64)
+	if val, ok := row["recovery_codes"].(string); ok && val != "" {
+		twoFactor.RecoveryCodes = strings.Split(val, ",")
+	}
+	if val, ok := row["created_at"].(time.Time); ok {
+		twoFactor.CreatedAt = val
+	}
+	if val, ok := row["confirmed_at"].(time.Time); ok {
+		twoFactor.ConfirmedAt = &val
+	}
+	return twoFactor, nil
+}
+
+// SaveTwoFactor inserts the enrolment or updates it if the user has one
+func (tdb *TwoFactorDB) SaveTwoFactor(ctx context.Context, twoFactor *system.TwoFactor) error {
+	codes := strings.Join(twoFactor.RecoveryCodes, ",")
+	if _, err := tdb.GetTwoFactor(ctx, twoFactor.User); err == nil {
+		updates := map[FieldName]DBValue{
+			"secret":         twoFactor.Secret,
+			"enabled":        fmt.Sprint(twoFactor.Enabled),
+			"recovery_codes": codes,
+			"last_step":      twoFactor.LastStep,
+		}
+		if twoFactor.ConfirmedAt != nil {
+			updates["confirmed_at"] = twoFactor.ConfirmedAt.UTC().Format(time.RFC3339Nano)
+		}
+		if err := tdb.p.Update(ctx, tdb.twoFactorTable, updates, NewWhereMap(map[FieldName]interface{}{"username": twoFactor.User})); err != nil {
+			tdb.logger.Println(err)
+			return ErrSaveTwoFactor
+		}
+		return nil
+	}
+	values := [][]interface{}{{twoFactor.User, twoFactor.Secret, twoFactor.Enabled, codes, twoFactor.LastStep, twoFactor.CreatedAt, twoFactor.ConfirmedAt}}
+	if err := tdb.p.Insert(ctx, tdb.twoFactorTable, []FieldName{"username", "secret", "enabled", "recovery_codes", "last_step", "created_at", "confirmed_at"}, values); err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveTwoFactor
+	}
+	return nil
+}
+
+func (tdb *TwoFactorDB) DeleteTwoFactor(ctx context.Context, user string) error {
+	if _, err := tdb.GetTwoFactor(ctx, user); err != nil {
+		return err
+	}
+	if err := tdb.p.Delete(ctx, tdb.twoFactorTable, NewWhereMap(map[FieldName]interface{}{"username": user})); err != nil {
+		tdb.logger.Println(err)
+		return ErrDeleteTwoFactor
+	}
+	return nil
+}
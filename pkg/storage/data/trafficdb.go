@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/PaT-CH/internal/system"
+)
+
+const (
+	TRAFFIC_DEFAULT_LIMIT = 100
+)
+
+var (
+	TRAFFIC_FIELDS = []string{
+		"traffic_id", "patch", "method", "path", "url",
+		"request_headers", "request_body", "request_size",
+		"status", "response_headers", "response_body", "response_size",
+		"client_ip", "started_at", "duration", "replay", "attempts", "mirror",
+	}
+	ErrNoTraffic    = errors.New("no traffic record found")
+	ErrSaveTraffic  = errors.New("error saving traffic record")
+	ErrQueryTraffic = errors.New("error querying traffic")
+)
+
+type TrafficDB struct {
+	p            *DataBase
+	trafficTable string
+	logger       *log.Logger
+}
+
+func NewTrafficDB(p *DataBase, trafficTable string, logger *log.Logger) *TrafficDB {
+	trafficTable = strings.ToLower(trafficTable)
+	trafficTable = strings.TrimSpace(trafficTable)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &TrafficDB{
+		p:            p,
+		trafficTable: trafficTable,
+		logger:       logger,
+	}
+}
+
+func (tdb *TrafficDB) SetTableName(trafficTable string) {
+	tdb.trafficTable = trafficTable
+}
+
+func (tdb *TrafficDB) Save(ctx context.Context, record *system.TrafficRecord) error {
+	requestHeaders, err := json.Marshal(record.RequestHeaders)
+	if err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveTraffic
+	}
+	responseHeaders, err := json.Marshal(record.ResponseHeaders)
+	if err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveTraffic
+	}
+	// the id is generated by the database
+	fields := []FieldName{
+		"patch", "method", "path", "url",
+		"request_headers", "request_body", "request_size",
+		"status", "response_headers", "response_body", "response_size",
+		"client_ip", "started_at", "duration", "replay", "attempts", "mirror",
+	}
+	values := [][]interface{}{{
+		record.Patch, record.Method, record.Path, record.URL,
+		string(requestHeaders), record.RequestBody, record.RequestSize,
+		record.Status, string(responseHeaders), record.ResponseBody, record.ResponseSize,
+		record.ClientIP, record.StartedAt, int64(record.Duration), record.Replay, record.Attempts, record.Mirror,
+	}}
+	if err := tdb.p.Insert(ctx, tdb.trafficTable, fields, values); err != nil {
+		tdb.logger.Println(err)
+		return ErrSaveTraffic
+	}
+	return nil
+}
+
+// Query builds the where clause itself as WhereMap only supports equality
+func (tdb *TrafficDB) Query(ctx context.Context, filter *system.TrafficFilter) ([]*system.TrafficRecord, error) {
+	if filter == nil {
+		filter = &system.TrafficFilter{}
+	}
+	clauses := make([]string, 0)
+	if filter.Patch != "" {
+		clauses = append(clauses, fmt.Sprintf("patch = %s", quote(filter.Patch)))
+	}
+	if filter.Status != 0 {
+		clauses = append(clauses, fmt.Sprintf("status = %d", filter.Status))
+	}
+	if filter.Path != "" {
+		escaped := strings.NewReplacer("%", "\\%", "_", "\\_").Replace(filter.Path)
+		clauses = append(clauses, fmt.Sprintf("path LIKE %s", quote(escaped+"%")))
+	}
+	if filter.Replay != 0 {
+		clauses = append(clauses, fmt.Sprintf("replay = %d", filter.Replay))
+	}
+	if filter.Mirror != nil {
+		clauses = append(clauses, fmt.Sprintf("mirror = %t", *filter.Mirror))
+	}
+	if !filter.From.IsZero() {
+		clauses = append(clauses, fmt.Sprintf("started_at >= %s", quote(filter.From.UTC().Format(time.RFC3339Nano))))
+	}
+	if !filter.To.IsZero() {
+		clauses = append(clauses, fmt.Sprintf("started_at <= %s", quote(filter.To.UTC().Format(time.RFC3339Nano))))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = TRAFFIC_DEFAULT_LIMIT
+	}
+	args := fmt.Sprintf("ORDER BY started_at DESC LIMIT %d", limit)
+	if len(clauses) > 0 {
+		args = fmt.Sprintf("WHERE %s %s", strings.Join(clauses, " AND "), args)
+	}
+	rows := tdb.p.Select(ctx, tdb.trafficTable, TRAFFIC_FIELDS, nil, args)
+	if rows == nil {
+		return nil, ErrQueryTraffic
+	}
+	records := make([]*system.TrafficRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, tdb.loadTrafficRecord(row))
+	}
+	return records, nil
+}
+
+func (tdb *TrafficDB) GetById(ctx context.Context, id int64) (*system.TrafficRecord, error) {
+	whereClause := NewWhereMap(map[FieldName]interface{}{"traffic_id": id})
+	rows := tdb.p.Select(ctx, tdb.trafficTable, TRAFFIC_FIELDS, whereClause, "LIMIT 1")
+	if len(rows) == 0 {
+		return nil, ErrNoTraffic
+	}
+	return tdb.loadTrafficRecord(rows[0]), nil
+}
+
+func (tdb *TrafficDB) loadTrafficRecord(row map[string]interface{}) *system.TrafficRecord {
+	record := &system.TrafficRecord{}
+	if val, ok := row["traffic_id"].(int32); ok {
+		record.ID = int64(val)
+	} else if val, ok := row["traffic_id"].(int64); ok {
+		record.ID = val
+	}
+	record.Patch, _ = row["patch"].(string)
+	record.Method, _ = row["method"].(string)
+	record.Path, _ = row["path"].(string)
+	record.URL, _ = row["url"].(string)
+	record.ClientIP, _ = row["client_ip"].(string)
+	record.RequestBody, _ = row["request_body"].([]byte)
+	record.ResponseBody, _ = row["response_body"].([]byte)
+	record.RequestSize, _ = row["request_size"].(int64)
+	record.ResponseSize, _ = row["response_size"].(int64)
+	if val, ok := row["status"].(int32); ok {
+		record.Status = int(val)
+	}
+	if val, ok := row["started_at"].(time.Time); ok {
+		record.StartedAt = val
+	}
+	if val, ok := row["duration"].(int64); ok {
+		record.Duration = time.Duration(val)
+	}
+	if val, ok := row["replay"].(int64); ok {
+		record.Replay = val
+	}
+	if val, ok := row["attempts"].(int32); ok {
+		record.Attempts = int(val)
+	}
+	if val, ok := row["mirror"].(bool); ok {
+		record.Mirror = val
+	}
+	if val, ok := row["request_headers"].(string); ok {
+		if err := json.Unmarshal([]byte(val), &record.RequestHeaders); err != nil {
+			tdb.logger.Println(err)
+		}
+	}
+	if val, ok := row["response_headers"].(string); ok {
+		if err := json.Unmarshal([]byte(val), &record.ResponseHeaders); err != nil {
+			tdb.logger.Println(err)
+		}
+	}
+	return record
+}
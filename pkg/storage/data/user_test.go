@@ -22,6 +22,7 @@ func TestUserDB(t *testing.T) {
 		{"id", "serial", 0},
 		{"name", "text", 0},
 		{"email", "text", 0},
+		{"email_verified", "boolean", 0},
 		{"password", "text", 0},
 		{"created_at", "timestamp", 0},
 		{"updated_at", "timestamp", 0},
@@ -14,7 +14,7 @@ import (
 
 var (
 	USER_PASSWORD_FIELDS = []string{"password"}
-	USER_FIELDS          = []string{"id", "name", "email", "created_at", "updated_at"}
+	USER_FIELDS          = []string{"id", "name", "email", "email_verified", "created_at", "updated_at"}
 	ErrNoUser            = errors.New("no user found")
 	ErrPassMismatch      = errors.New("username or password incorrect")
 	ErrUserExists        = errors.New("username or email already exists")
@@ -54,7 +54,7 @@ func (udb *UserDB) Create(ctx context.Context, name string, email string, passwo
 	if _, err := udb.GetByName(ctx, name); err == nil {
 		return nil, ErrUserExists
 	}
-	if _, err := udb.GetByEmail(ctx, email); err == nil {
+	if _, err := udb.GetByEmail(ctx, email); email != "" && err == nil {
 		return nil, ErrUserExists
 	}
 	if strings.ContainsAny(name, " \t\r ") {
@@ -67,7 +67,7 @@ func (udb *UserDB) Create(ctx context.Context, name string, email string, passwo
 		return nil, ErrCreateUser
 	}
 
-	if err := udb.p.Insert(ctx, udb.userTable, []FieldName{"name", "email", "password", "created_at", "updated_at"}, [][]interface{}{{name, email, passwordHash, now, now}}); err != nil {
+	if err := udb.p.Insert(ctx, udb.userTable, []FieldName{"name", "email", "email_verified", "password", "created_at", "updated_at"}, [][]interface{}{{name, email, false, passwordHash, now, now}}); err != nil {
 		udb.logger.Println(err)
 		return nil, ErrCreateUser
 	}
@@ -138,6 +138,7 @@ func (udb *UserDB) getUserWithWhere(ctx context.Context, whereMap *WhereMap) (*s
 		updated = val
 	}
 	user := system.LoadUser(raw_db_user[0]["id"].(int64), raw_db_user[0]["name"].(string), raw_db_user[0]["email"].(string), &created, &updated)
+	user.EmailVerified, _ = raw_db_user[0]["email_verified"].(bool)
 	udb.logger.Println("Got user", user.Name)
 	go udb.updateCache(ctx, user)
 	return user, nil
@@ -160,9 +161,10 @@ func (udb *UserDB) Update(ctx context.Context, user *system.User) (*system.User,
 	timestamp := fmt.Sprint(time.Now().UTC())
 	timestamp = timestamp[:len(timestamp)-9]
 	userMap := map[FieldName]DBValue{
-		"name":       user.Name,
-		"email":      user.Email,
-		"updated_at": timestamp,
+		"name":           user.Name,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"updated_at":     timestamp,
 	}
 	if err := udb.p.Update(ctx, udb.userTable, userMap, NewWhereMap(map[FieldName]interface{}{"id": user.ID()})); err != nil {
 		return nil, err